@@ -0,0 +1,433 @@
+package goose
+
+import (
+	. "github.com/getwe/goose/database"
+	log "github.com/getwe/goose/log"
+	. "github.com/getwe/goose/utils"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+// 一个版本的数据库,以及在其上的检索流程和动态索引流程
+type dbVersion struct {
+	path    string
+	version DBVersionStatus
+
+	db         *DBSearcher
+	searcher   *Searcher
+	varIndexer *VarIndexer
+
+	// 已经应用到这个版本的最后一条请求日志记录,由dbSwitcher.lock保护
+	applied docLogPos
+
+	// 版本目录的引用,使用中的版本不会被建库程序清理
+	ref *DBVersionRef
+
+	// 正在使用这个版本的请求数量
+	refs int
+	// 已经被新版本替代,引用归0后关闭
+	retired bool
+}
+
+// 版本目录中记录已经应用的请求日志位置的文件
+const docLogAppliedFile = "doclog.stat"
+
+// 数据库版本切换.
+// 检索请求通过Acquire/Release引用当前版本,切换后旧版本上正在进行的检索不受影响,
+// 最后一个引用释放后关闭旧版本.
+// 动态插入和删除请求记录到请求日志,打开版本时重放建库时间之后还没有应用到这个版本的请求,
+// 已经应用的位置定时保存在版本目录中.重放是幂等的,保存的位置落后只会多重放一些请求.
+// 只会切换到比当前更新的版本,不支持回滚:旧版本的文件已经被动态索引修改,
+// 请求日志也已经删除了旧版本需要的记录.
+type dbSwitcher struct {
+	// 保护curr以及引用计数
+	lock sync.Mutex
+	curr *dbVersion
+
+	// 动态索引请求和版本切换互斥,切换过程中的请求等待切换完成后写入新版本
+	writeLock sync.Mutex
+
+	// 动态索引请求日志,没有建索引策略或者没有开启版本切换时为nil
+	docLog *docLog
+
+	// 数据库根目录
+	dbPath string
+
+	// 校验失败的版本,不再尝试切换
+	badVersion string
+
+	opts dbSwitcherOptions
+
+	indexSty  IndexStrategy
+	searchSty SearchStrategy
+}
+
+// 打开数据库版本的选项
+type dbSwitcherOptions struct {
+	// 记录动态索引请求日志,支持切换版本
+	enableSwitch bool
+
+	// 每个版本的拉链缓存大小,0表示不缓存
+	indexCacheSize int
+
+	// 每个版本的检索结果缓存数量,0表示不缓存
+	resultCacheSize int
+	// 检索结果缓存的有效时间
+	resultCacheTTL time.Duration
+
+	// 单个检索并行归并的分片数量,以及并行需要的最小拉链总长度
+	shardNum         int
+	shardMinPostings int
+}
+
+// 打开dbPath下最新的数据库版本
+func newDBSwitcher(dbPath string, indexSty IndexStrategy, searchSty SearchStrategy,
+	opts dbSwitcherOptions) (*dbSwitcher, error) {
+
+	s := dbSwitcher{}
+	s.dbPath = dbPath
+	s.opts = opts
+	s.indexSty = indexSty
+	s.searchSty = searchSty
+
+	path, version, err := LatestDBVersion(dbPath)
+	if err != nil {
+		return nil, log.Error("find db version in [%s] fail : %s", dbPath, err)
+	}
+	s.curr, err = s.openVersion(path, version)
+	if err != nil {
+		return nil, err
+	}
+
+	if opts.enableSwitch && indexSty != nil {
+		s.docLog, err = openDocLog(filepath.Join(dbPath, "doc.log"))
+		if err != nil {
+			s.closeVersion(s.curr)
+			return nil, err
+		}
+		// 上次退出前没有保存到版本中的请求
+		err = s.replayDocLog(s.curr)
+		if err != nil {
+			s.docLog.Close()
+			s.closeVersion(s.curr)
+			return nil, err
+		}
+	}
+	return &s, nil
+}
+
+func (this *dbSwitcher) openVersion(path string, version DBVersionStatus) (*dbVersion, error) {
+	log.Debug("open db [%s] version [%s]", path, version.Version)
+
+	v := dbVersion{}
+	v.path = path
+	v.version = version
+
+	// 建库时间之前的请求已经包含在版本中
+	v.applied = docLogPos{Time: version.BuildTime}
+	applied := docLogPos{}
+	err := JsonDecodeFromFile(&applied, filepath.Join(path, docLogAppliedFile))
+	if err == nil && v.applied.Less(applied) {
+		v.applied = applied
+	}
+
+	// 旧的目录结构没有版本目录,不需要引用
+	if len(version.Version) > 0 {
+		v.ref, err = RefDBVersion(path)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	v.db = NewDBSearcher()
+	v.db.SetIndexCacheSize(this.opts.indexCacheSize)
+	err = v.db.Init(path)
+	if err != nil {
+		v.ref.Release()
+		return nil, err
+	}
+
+	if this.indexSty != nil {
+		v.varIndexer, err = NewVarIndexer(v.db, this.indexSty)
+		if err != nil {
+			v.db.Close()
+			v.ref.Release()
+			return nil, err
+		}
+	}
+	if this.searchSty != nil {
+		// 每个版本有自己的结果缓存,切换版本后旧的结果自然失效
+		var cache *ResultCache
+		if this.opts.resultCacheSize > 0 {
+			cache = NewResultCache(this.opts.resultCacheSize, this.opts.resultCacheTTL)
+		}
+		v.searcher, err = NewSearcher(v.db, this.searchSty, cache)
+		if err != nil {
+			v.db.Close()
+			v.ref.Release()
+			return nil, err
+		}
+		v.searcher.SetParallel(this.opts.shardNum, this.opts.shardMinPostings)
+	}
+	return &v, nil
+}
+
+func (this *dbSwitcher) closeVersion(v *dbVersion) {
+	err := v.db.Close()
+	if err != nil {
+		log.Warn("close db [%s] fail : %s", v.path, err)
+	}
+	v.ref.Release()
+	log.Info("db [%s] closed", v.path)
+}
+
+func (this *dbSwitcher) CanSearch() bool {
+	return this.searchSty != nil
+}
+
+func (this *dbSwitcher) CanIndex() bool {
+	return this.indexSty != nil
+}
+
+// 引用当前版本,使用完需要调用Release
+func (this *dbSwitcher) Acquire() *dbVersion {
+	this.lock.Lock()
+	defer this.lock.Unlock()
+	this.curr.refs++
+	return this.curr
+}
+
+// 释放版本的引用,被替代的版本没有引用后关闭
+func (this *dbSwitcher) Release(v *dbVersion) {
+	this.lock.Lock()
+	v.refs--
+	closeIt := v.retired && v.refs == 0
+	this.lock.Unlock()
+
+	if closeIt {
+		this.closeVersion(v)
+	}
+}
+
+// 动态插入一个doc
+func (this *dbSwitcher) Index(doc []byte) error {
+	this.writeLock.Lock()
+	defer this.writeLock.Unlock()
+
+	var pos docLogPos
+	if this.docLog != nil {
+		var err error
+		pos, err = this.docLog.Append(docLogIndex, doc)
+		if err != nil {
+			return log.Error("append doc log fail : %s", err)
+		}
+	}
+
+	v := this.Acquire()
+	defer this.Release(v)
+	// 写入失败的请求同样算作已经应用,跟重放时的行为一致
+	defer this.setApplied(v, pos)
+	return v.varIndexer.BuildIndex(NewBufferIterOnce(doc))
+}
+
+// 根据外部id删除doc
+func (this *dbSwitcher) Delete(outIdList []OutIdType) error {
+	this.writeLock.Lock()
+	defer this.writeLock.Unlock()
+
+	var pos docLogPos
+	if this.docLog != nil {
+		var err error
+		pos, err = this.docLog.Append(docLogDelete, encodeOutIdList(outIdList))
+		if err != nil {
+			return log.Error("append doc log fail : %s", err)
+		}
+	}
+
+	v := this.Acquire()
+	defer this.Release(v)
+	defer this.setApplied(v, pos)
+	return v.varIndexer.DeleteDoc(outIdList)
+}
+
+// 记录应用到版本的请求日志位置.动态索引的写入返回前已经持久化,
+// 记录的位置之前的请求都不会因为程序退出丢失
+func (this *dbSwitcher) setApplied(v *dbVersion, pos docLogPos) {
+	this.lock.Lock()
+	defer this.lock.Unlock()
+	if v.applied.Less(pos) {
+		v.applied = pos
+	}
+}
+
+// 保存版本已经应用的请求日志位置,失败只会导致下次打开时多重放一些请求
+func (this *dbSwitcher) saveApplied(v *dbVersion) {
+	if this.docLog == nil {
+		return
+	}
+	this.lock.Lock()
+	applied := v.applied
+	this.lock.Unlock()
+
+	err := JsonEncodeToFile(applied, filepath.Join(v.path, docLogAppliedFile))
+	if err != nil {
+		log.Warn("save doc log position of [%s] fail : %s", v.path, err)
+	}
+}
+
+// 在版本上重放还没有应用的请求.调用者需要保证没有并发的动态索引请求
+func (this *dbSwitcher) replayDocLog(v *dbVersion) error {
+	if this.docLog == nil || v.varIndexer == nil {
+		return nil
+	}
+
+	this.lock.Lock()
+	from := v.applied
+	this.lock.Unlock()
+
+	cnt := 0
+	err := this.docLog.Replay(from, func(pos docLogPos, typ uint8, payload []byte) error {
+		cnt++
+		var err error
+		switch typ {
+		case docLogIndex:
+			err = v.varIndexer.BuildIndex(NewBufferIterOnce(payload))
+		case docLogDelete:
+			err = v.varIndexer.DeleteDoc(decodeOutIdList(payload))
+		default:
+			err = log.Warn("unknown doc log type [%d]", typ)
+		}
+		// 单个请求失败不影响切换,跟原来处理请求时的行为一致
+		if err != nil {
+			log.Warn("replay doc log fail : %s", err)
+		}
+		this.setApplied(v, pos)
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	log.Info("replay [%d] doc log records after %+v on [%s]", cnt, from, v.path)
+	this.saveApplied(v)
+	return nil
+}
+
+// 当前版本定时同步
+func (this *dbSwitcher) Sync() error {
+	v := this.Acquire()
+	defer this.Release(v)
+	err := v.db.Sync()
+	this.saveApplied(v)
+	return err
+}
+
+// 检查是否有更新的数据库版本,有的话打开新版本,重放动态索引请求后切换.
+// 返回是否进行了切换
+func (this *dbSwitcher) CheckNewVersion() (bool, error) {
+	path, version, err := LatestDBVersion(this.dbPath)
+	if err != nil {
+		return false, log.Warn("find db version in [%s] fail : %s", this.dbPath, err)
+	}
+
+	this.lock.Lock()
+	currVersion := this.curr.version.Version
+	this.lock.Unlock()
+	if len(version.Version) == 0 || version.Version == currVersion ||
+		version.Version == this.badVersion {
+		return false, nil
+	}
+
+	// 版本名中的时间格式保证字典序就是时间顺序.current指回旧版本不切换
+	if version.Version < currVersion {
+		this.badVersion = version.Version
+		return false, log.Warn("db version [%s] older than current [%s], rollback not supported",
+			version.Version, currVersion)
+	}
+
+	// 打开之前校验建库生成的文件,打开后动态索引会修改文件内容
+	err = VerifyDBManifest(path)
+	if err != nil {
+		this.badVersion = version.Version
+		return false, log.Error("db version [%s] broken, skip it : %s", path, err)
+	}
+	return true, this.switchTo(path, version)
+}
+
+// 切换到指定版本.打开新版本的过程不影响检索和动态索引,
+// 重放请求日志的过程暂停动态索引,检索继续使用旧版本.
+func (this *dbSwitcher) switchTo(path string, version DBVersionStatus) error {
+	log.Info("switch db to [%s] BuildTime[%d]", path, version.BuildTime)
+
+	newV, err := this.openVersion(path, version)
+	if err != nil {
+		return err
+	}
+
+	this.writeLock.Lock()
+	defer this.writeLock.Unlock()
+
+	err = this.replayDocLog(newV)
+	if err != nil {
+		this.closeVersion(newV)
+		return err
+	}
+
+	this.saveApplied(this.curr)
+	this.lock.Lock()
+	oldV := this.curr
+	this.curr = newV
+	oldV.retired = true
+	closeIt := oldV.refs == 0
+	this.lock.Unlock()
+
+	if closeIt {
+		this.closeVersion(oldV)
+	}
+
+	// 新版本建库之前的请求不再需要
+	if this.docLog != nil {
+		err = this.docLog.Trim(version.BuildTime)
+		if err != nil {
+			log.Warn("trim doc log fail : %s", err)
+		}
+	}
+	log.Info("switch db to [%s] finish", path)
+	return nil
+}
+
+// 当前版本的动态索引合并进静态索引
+func (this *dbSwitcher) FoldVarIndex() error {
+	v := this.Acquire()
+	defer this.Release(v)
+	return v.db.FoldVarIndex()
+}
+
+// 当前版本不受同步间隔限制的完整同步,退出前调用
+func (this *dbSwitcher) ForceSync() error {
+	v := this.Acquire()
+	defer this.Release(v)
+	err := v.db.ForceSync()
+	this.saveApplied(v)
+	return err
+}
+
+// 关闭当前版本和请求日志,调用者需要保证没有正在进行的请求
+func (this *dbSwitcher) Close() error {
+	this.writeLock.Lock()
+	defer this.writeLock.Unlock()
+
+	this.lock.Lock()
+	v := this.curr
+	this.lock.Unlock()
+
+	this.saveApplied(v)
+	err := v.db.Close()
+	v.ref.Release()
+	if this.docLog != nil {
+		this.docLog.Close()
+	}
+	return err
+}
+
+/* vim: set expandtab ts=4 sw=4 sts=4 tw=100: */
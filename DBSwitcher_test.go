@@ -0,0 +1,209 @@
+package goose
+
+import (
+	"fmt"
+	"github.com/getwe/goose/config"
+	. "github.com/getwe/goose/database"
+	. "github.com/getwe/goose/utils"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// doc格式"outId term",每个doc只有一个term
+type switchTestSty struct{}
+
+func (switchTestSty) Init(conf config.Conf) error {
+	return nil
+}
+
+func (switchTestSty) ParseDoc(doc interface{}, context *StyContext) (OutIdType, []TermInDoc,
+	Value, Data, error) {
+
+	var outId, term int
+	_, err := fmt.Sscanf(string(doc.([]byte)), "%d %d", &outId, &term)
+	if err != nil {
+		return 0, nil, nil, nil, err
+	}
+	termList := []TermInDoc{TermInDoc{Sign: TermSign(term), Weight: 1}}
+	return OutIdType(outId), termList, Value("v"), Data("d"), nil
+}
+
+// 建立一个版本的db,docs是outId到term的映射
+func buildTestVersion(t *testing.T, dbPath string, st DBVersionStatus, docs map[int]int) {
+	path := filepath.Join(dbPath, st.Version)
+	db := NewDBBuilder()
+	err := db.Init(path, 1000, 100, 8, 1024*1024, 1024*1024, DefaultPostingCodec)
+	if err != nil {
+		t.Fatalf("DBBuilder.Init --- %s", err)
+	}
+	for outId, term := range docs {
+		inId, _ := db.AllocID(OutIdType(outId))
+		db.WriteIndex(inId, []TermInDoc{TermInDoc{Sign: TermSign(term), Weight: 1}})
+		db.WriteValue(inId, Value("v"))
+		db.WriteData(inId, Data("d"))
+		db.CommitID(inId)
+	}
+	if err = db.Sync(); err != nil {
+		t.Fatalf("DBBuilder.Sync --- %s", err)
+	}
+	if err = SaveDBVersion(path, st); err != nil {
+		t.Fatalf("SaveDBVersion --- %s", err)
+	}
+}
+
+func countHit(t *testing.T, v *dbVersion, term TermSign) int {
+	l, err := v.db.ReadIndex(term)
+	if err != nil {
+		t.Fatalf("ReadIndex --- %s", err)
+	}
+	cnt := 0
+	for _, index := range *l {
+		if !v.db.IsDeleted(index.InID) {
+			cnt++
+		}
+	}
+	return cnt
+}
+
+func TestDBSwitcher(t *testing.T) {
+	dbPath := filepath.Join(os.Getenv("HOME"), "tmp", "goosedb", "test_dbswitcher")
+	os.RemoveAll(dbPath)
+	os.MkdirAll(dbPath, 0755)
+
+	now := time.Now().Unix()
+	buildTestVersion(t, dbPath,
+		DBVersionStatus{Version: "db.20140101000000", BuildTime: now - 3600},
+		map[int]int{1: 10})
+
+	dbs, err := newDBSwitcher(dbPath, switchTestSty{}, nil,
+		dbSwitcherOptions{enableSwitch: true, indexCacheSize: DefaultIndexCacheSize})
+	if err != nil {
+		t.Fatalf("newDBSwitcher --- %s", err)
+	}
+
+	// 动态插入doc 2,删除doc 1
+	if err = dbs.Index([]byte("2 20")); err != nil {
+		t.Fatalf("Index --- %s", err)
+	}
+	if err = dbs.Delete([]OutIdType{1}); err != nil {
+		t.Fatalf("Delete --- %s", err)
+	}
+
+	// 新版本包含doc 1和doc 3,建库时间在上面的动态请求之前
+	buildTestVersion(t, dbPath,
+		DBVersionStatus{Version: "db.20140102000000", BuildTime: now - 60},
+		map[int]int{1: 10, 3: 30})
+	// 没有完成的版本不会被使用
+	os.MkdirAll(filepath.Join(dbPath, "db.20140103000000"), 0755)
+
+	oldV := dbs.Acquire()
+	switched, err := dbs.CheckNewVersion()
+	if err != nil || !switched {
+		t.Fatalf("CheckNewVersion switched[%v] err[%v]", switched, err)
+	}
+
+	// 切换之前引用的旧版本依然可用
+	if countHit(t, oldV, 20) != 1 || countHit(t, oldV, 30) != 0 {
+		t.Errorf("old version hit term20[%d] term30[%d]",
+			countHit(t, oldV, 20), countHit(t, oldV, 30))
+	}
+	dbs.Release(oldV)
+
+	v := dbs.Acquire()
+	if v.version.Version != "db.20140102000000" {
+		t.Errorf("curr version [%s]", v.version.Version)
+	}
+	// 动态请求在新版本上重放
+	if countHit(t, v, 10) != 0 || countHit(t, v, 20) != 1 || countHit(t, v, 30) != 1 {
+		t.Errorf("new version hit term10[%d] term20[%d] term30[%d]",
+			countHit(t, v, 10), countHit(t, v, 20), countHit(t, v, 30))
+	}
+	dbs.Release(v)
+
+	switched, err = dbs.CheckNewVersion()
+	if err != nil || switched {
+		t.Errorf("CheckNewVersion again switched[%v] err[%v]", switched, err)
+	}
+
+	// current指回旧版本不切换
+	if err = os.Symlink("db.20140101000000", filepath.Join(dbPath, DBVersionCurrent)); err != nil {
+		t.Fatalf("Symlink --- %s", err)
+	}
+	switched, err = dbs.CheckNewVersion()
+	if err == nil || switched {
+		t.Errorf("CheckNewVersion rollback switched[%v] err[%v]", switched, err)
+	}
+	switched, err = dbs.CheckNewVersion()
+	if err != nil || switched {
+		t.Errorf("CheckNewVersion rollback again switched[%v] err[%v]", switched, err)
+	}
+	v = dbs.Acquire()
+	if v.version.Version != "db.20140102000000" {
+		t.Errorf("curr version [%s] after rollback", v.version.Version)
+	}
+	dbs.Release(v)
+
+	if err = dbs.Close(); err != nil {
+		t.Errorf("Close --- %s", err)
+	}
+}
+
+func TestDBSwitcherReplayOnOpen(t *testing.T) {
+	dbPath := filepath.Join(os.Getenv("HOME"), "tmp", "goosedb", "test_dbswitcher_replay")
+	os.RemoveAll(dbPath)
+	os.MkdirAll(dbPath, 0755)
+
+	buildTestVersion(t, dbPath,
+		DBVersionStatus{Version: "db.20140101000000", BuildTime: time.Now().Unix() - 3600},
+		map[int]int{1: 10})
+	open := func() *dbSwitcher {
+		dbs, err := newDBSwitcher(dbPath, switchTestSty{}, nil,
+			dbSwitcherOptions{enableSwitch: true})
+		if err != nil {
+			t.Fatalf("newDBSwitcher --- %s", err)
+		}
+		return dbs
+	}
+
+	dbs := open()
+	if err := dbs.Index([]byte("2 20")); err != nil {
+		t.Fatalf("Index --- %s", err)
+	}
+	if err := dbs.Close(); err != nil {
+		t.Fatalf("Close --- %s", err)
+	}
+
+	// 请求写入日志之后,应用到版本之前退出
+	dl, err := openDocLog(filepath.Join(dbPath, "doc.log"))
+	if err != nil {
+		t.Fatalf("openDocLog --- %s", err)
+	}
+	dl.Append(docLogIndex, []byte("3 30"))
+	dl.Append(docLogDelete, encodeOutIdList([]OutIdType{1}))
+	dl.Close()
+
+	dbs = open()
+	v := dbs.Acquire()
+	if countHit(t, v, 10) != 0 || countHit(t, v, 20) != 1 || countHit(t, v, 30) != 1 {
+		t.Errorf("hit term10[%d] term20[%d] term30[%d] after reopen",
+			countHit(t, v, 10), countHit(t, v, 20), countHit(t, v, 30))
+	}
+	idSt, _ := v.db.GetIdStatus()
+	dbs.Release(v)
+	if err := dbs.Close(); err != nil {
+		t.Fatalf("Close --- %s", err)
+	}
+
+	// 已经应用的请求不再重放
+	dbs = open()
+	v = dbs.Acquire()
+	if again, _ := v.db.GetIdStatus(); again.CurId != idSt.CurId {
+		t.Errorf("reopen replay again, CurId [%d] expect [%d]", again.CurId, idSt.CurId)
+	}
+	dbs.Release(v)
+	dbs.Close()
+}
+
+/* vim: set expandtab ts=4 sw=4 sts=4 tw=100: */
@@ -0,0 +1,104 @@
+package goose
+
+import (
+	"encoding/json"
+	log "github.com/getwe/goose/log"
+	"os"
+	"sync"
+)
+
+// 一个建库失败的doc
+type deadLetter struct {
+	// 失败的阶段,见StaticIndexer
+	Stage string
+	Error string
+	// 原始doc.[]byte类型的doc按字符串保存,JsonDoc保存原始的json
+	Doc interface{}
+}
+
+// 建库失败的doc写入的文件,一行一个json.第一次写入时才创建文件,追加写入.可并发写入
+type DeadLetterFile struct {
+	lock sync.Mutex
+
+	path string
+	file *os.File
+	enc  *json.Encoder
+}
+
+// 写入一个失败的doc
+func (this *DeadLetterFile) Write(stage string, doc interface{}, docErr error) error {
+	this.lock.Lock()
+	defer this.lock.Unlock()
+
+	if this.file == nil {
+		f, err := os.OpenFile(this.path, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0644)
+		if err != nil {
+			return log.Error("open dead letter file [%s] fail : %s", this.path, err)
+		}
+		this.file = f
+		this.enc = json.NewEncoder(f)
+	}
+
+	switch d := doc.(type) {
+	case []byte:
+		doc = string(d)
+	case *BadDoc:
+		doc = string(d.Raw)
+	case *JsonDoc:
+		doc = json.RawMessage(d.Raw)
+	}
+	return this.enc.Encode(deadLetter{Stage: stage, Error: docErr.Error(), Doc: doc})
+}
+
+// 文件当前大小,文件不存在为0.继续建库时用于丢弃中断前最后一个数据文件写入的doc
+func (this *DeadLetterFile) Size() (int64, error) {
+	this.lock.Lock()
+	defer this.lock.Unlock()
+
+	info, err := os.Stat(this.path)
+	if os.IsNotExist(err) {
+		return 0, nil
+	}
+	if err != nil {
+		return 0, log.Error("stat dead letter file [%s] fail : %s", this.path, err)
+	}
+	return info.Size(), nil
+}
+
+// 丢弃size之后的内容,文件不存在或者不超过size的时候不处理
+func (this *DeadLetterFile) Truncate(size int64) error {
+	this.lock.Lock()
+	defer this.lock.Unlock()
+
+	info, err := os.Stat(this.path)
+	if os.IsNotExist(err) || (err == nil && info.Size() <= size) {
+		return nil
+	}
+	if err == nil {
+		err = os.Truncate(this.path, size)
+	}
+	if err != nil {
+		return log.Error("truncate dead letter file [%s] fail : %s", this.path, err)
+	}
+	return nil
+}
+
+func (this *DeadLetterFile) Close() error {
+	this.lock.Lock()
+	defer this.lock.Unlock()
+
+	if this.file == nil {
+		return nil
+	}
+	err := this.file.Close()
+	this.file = nil
+	return err
+}
+
+func NewDeadLetterFile(path string) *DeadLetterFile {
+	f := DeadLetterFile{}
+	f.path = path
+	return &f
+}
+
+/* vim: set expandtab ts=4 sw=4 sts=4 tw=100: */
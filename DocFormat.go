@@ -0,0 +1,385 @@
+package goose
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"github.com/getwe/goose/config"
+	log "github.com/getwe/goose/log"
+	. "github.com/getwe/goose/utils"
+	"io"
+	"strconv"
+	"strings"
+)
+
+// 建库数据文件的格式,配置GooseBuild.DocFormat.Type选择,默认是line.
+// 格式负责把数据文件切分成doc,doc原样交给IndexStrategy.ParseDoc.
+// line:一行一个doc,类型[]byte,不包含换行符.
+// jsonl:一行一个json对象,类型*JsonDoc.
+// csv,tsv:第一行是表头,之后一行一条记录(csv带引号的字段可以跨行),类型*CsvDoc.
+// binary:4字节大端长度加内容,内容可以包含换行符,类型[]byte.
+// 格式错误的记录以*BadDoc交给建库流程,记录错误后跳过,不会调用ParseDoc.
+type DocFormat interface {
+	// 全局初始化,读取格式自己的配置
+	Init(conf config.Conf) error
+
+	// 一个数据文件的doc迭代器
+	NewDocIterator(r io.Reader) DocFileIterator
+}
+
+// 数据文件的doc迭代器
+type DocFileIterator interface {
+	DocIterator
+
+	// 读取过程中遇到的错误,正常读到文件结束返回nil
+	Err() error
+}
+
+// 格式错误的记录
+type BadDoc struct {
+	// 原始记录,无法取得时为nil
+	Raw []byte
+	Err error
+}
+
+// jsonl格式的doc
+type JsonDoc struct {
+	// IdField字段的值,没有这个字段时为0
+	Id OutIdType
+	// 全部字段,数字解析为json.Number
+	Fields map[string]interface{}
+	// 原始的一行
+	Raw []byte
+}
+
+// csv,tsv格式的doc
+type CsvDoc struct {
+	// IdField列的值,表头没有这一列时为0
+	Id OutIdType
+	// 表头列名到值
+	Fields map[string]string
+	// 按表头顺序的记录
+	Record []string
+}
+
+var docFormats = make(map[string]func() DocFormat)
+
+// 注册数据文件格式,同名格式重复注册会panic.应该在init函数中调用
+func RegisterDocFormat(name string, newFormat func() DocFormat) {
+	_, ok := docFormats[name]
+	if ok {
+		panic("duplicate doc format " + name)
+	}
+	docFormats[name] = newFormat
+}
+
+// 根据格式名生成并初始化数据文件格式
+func NewDocFormat(name string, conf config.Conf) (DocFormat, error) {
+	newFormat, ok := docFormats[name]
+	if !ok {
+		return nil, log.Error("unknown doc format [%s]", name)
+	}
+	f := newFormat()
+	err := f.Init(conf)
+	if err != nil {
+		return nil, err
+	}
+	return f, nil
+}
+
+func init() {
+	RegisterDocFormat("line", func() DocFormat { return &lineDocFormat{} })
+	RegisterDocFormat("jsonl", func() DocFormat { return &jsonDocFormat{} })
+	RegisterDocFormat("csv", func() DocFormat { return &csvDocFormat{comma: ','} })
+	RegisterDocFormat("tsv", func() DocFormat { return &csvDocFormat{comma: '\t'} })
+	RegisterDocFormat("binary", func() DocFormat { return &binaryDocFormat{} })
+}
+
+// id字段的值转换为外部id,空值为0
+func parseDocId(v string) (OutIdType, error) {
+	if len(v) == 0 {
+		return 0, nil
+	}
+	id, err := strconv.ParseUint(v, 10, 32)
+	if err != nil {
+		return 0, fmt.Errorf("illegal id [%s]", v)
+	}
+	return OutIdType(id), nil
+}
+
+// 一行一个doc
+type lineDocFormat struct{}
+
+func (this *lineDocFormat) Init(conf config.Conf) error {
+	return nil
+}
+
+func (this *lineDocFormat) NewDocIterator(r io.Reader) DocFileIterator {
+	return NewFileIter(r)
+}
+
+// 一行一个json对象,空行跳过
+type jsonDocFormat struct {
+	idField string
+}
+
+func (this *jsonDocFormat) Init(conf config.Conf) error {
+	this.idField = config.StringDefault(conf, "GooseBuild.DocFormat.IdField", "id")
+	return nil
+}
+
+func (this *jsonDocFormat) NewDocIterator(r io.Reader) DocFileIterator {
+	return &jsonDocIter{lines: NewFileIter(r), idField: this.idField}
+}
+
+type jsonDocIter struct {
+	lines   *FileIter
+	idField string
+}
+
+func (this *jsonDocIter) NextDoc() interface{} {
+	for {
+		next := this.lines.NextDoc()
+		if next == nil {
+			return nil
+		}
+		line := next.([]byte)
+		if len(bytes.TrimSpace(line)) == 0 {
+			continue
+		}
+		return this.parse(line)
+	}
+}
+
+func (this *jsonDocIter) parse(line []byte) interface{} {
+	doc := JsonDoc{Raw: line}
+	dec := json.NewDecoder(bytes.NewReader(line))
+	dec.UseNumber()
+	err := dec.Decode(&doc.Fields)
+	if err != nil {
+		return &BadDoc{Raw: line, Err: fmt.Errorf("parse json fail : %s", err)}
+	}
+
+	switch v := doc.Fields[this.idField].(type) {
+	case nil:
+	case json.Number:
+		doc.Id, err = parseDocId(v.String())
+	case string:
+		doc.Id, err = parseDocId(v)
+	default:
+		err = fmt.Errorf("illegal id [%v]", v)
+	}
+	if err != nil {
+		return &BadDoc{Raw: line, Err: err}
+	}
+	return &doc
+}
+
+func (this *jsonDocIter) Err() error {
+	return this.lines.Err()
+}
+
+// 带表头的csv,tsv.tsv没有引号转义,字段中不能出现tab和换行符
+type csvDocFormat struct {
+	comma   rune
+	idField string
+}
+
+func (this *csvDocFormat) Init(conf config.Conf) error {
+	this.idField = config.StringDefault(conf, "GooseBuild.DocFormat.IdField", "id")
+	return nil
+}
+
+func (this *csvDocFormat) NewDocIterator(r io.Reader) DocFileIterator {
+	iter := csvDocIter{idField: this.idField, idCol: -1}
+	if this.comma == '\t' {
+		iter.read = newTsvReader(r)
+	} else {
+		iter.read = newCsvReader(r, this.comma)
+	}
+	return &iter
+}
+
+// 读取一条记录,返回记录和原始内容.*csv.ParseError表示这一条记录格式错误,可以继续读取
+type recordReader func() ([]string, []byte, error)
+
+func newCsvReader(r io.Reader, comma rune) recordReader {
+	cr := csv.NewReader(r)
+	cr.Comma = comma
+	// 列数跟表头不同的记录由csvDocIter检查
+	cr.FieldsPerRecord = -1
+	return func() ([]string, []byte, error) {
+		record, err := cr.Read()
+		if record == nil {
+			return nil, nil, err
+		}
+		// 重新编码成一行作为原始内容
+		buf := bytes.Buffer{}
+		w := csv.NewWriter(&buf)
+		w.Comma = comma
+		w.Write(record)
+		w.Flush()
+		return record, bytes.TrimRight(buf.Bytes(), "\r\n"), err
+	}
+}
+
+func newTsvReader(r io.Reader) recordReader {
+	lines := NewFileIter(r)
+	return func() ([]string, []byte, error) {
+		for {
+			next := lines.NextDoc()
+			if next == nil {
+				if lines.Err() != nil {
+					return nil, nil, lines.Err()
+				}
+				return nil, nil, io.EOF
+			}
+			line := next.([]byte)
+			if len(line) > 0 {
+				return strings.Split(string(line), "\t"), line, nil
+			}
+		}
+	}
+}
+
+type csvDocIter struct {
+	read    recordReader
+	idField string
+
+	header []string
+	idCol  int
+	line   int
+
+	done bool
+	err  error
+}
+
+func (this *csvDocIter) NextDoc() interface{} {
+	if this.done {
+		return nil
+	}
+	if this.header == nil {
+		header, _, err := this.read()
+		if err != nil {
+			this.stop(err)
+			return nil
+		}
+		this.header = header
+		this.line++
+		for i, name := range header {
+			if name == this.idField {
+				this.idCol = i
+			}
+		}
+	}
+
+	record, raw, err := this.read()
+	this.line++
+	if err != nil {
+		if _, ok := err.(*csv.ParseError); ok {
+			// 引号不匹配,跳过这一条记录继续读取
+			return &BadDoc{Raw: raw, Err: err}
+		}
+		this.stop(err)
+		return nil
+	}
+	if len(record) != len(this.header) {
+		return &BadDoc{Raw: raw, Err: fmt.Errorf("record %d has %d fields, header has %d",
+			this.line, len(record), len(this.header))}
+	}
+
+	doc := CsvDoc{Record: record, Fields: make(map[string]string, len(record))}
+	for i, v := range record {
+		doc.Fields[this.header[i]] = v
+	}
+	if this.idCol >= 0 {
+		doc.Id, err = parseDocId(strings.TrimSpace(record[this.idCol]))
+		if err != nil {
+			return &BadDoc{Raw: raw, Err: err}
+		}
+	}
+	return &doc
+}
+
+func (this *csvDocIter) stop(err error) {
+	this.done = true
+	if err != io.EOF {
+		this.err = err
+	}
+}
+
+func (this *csvDocIter) Err() error {
+	return this.err
+}
+
+// 4字节大端长度加内容
+type binaryDocFormat struct {
+	maxRecordSize uint32
+}
+
+func (this *binaryDocFormat) Init(conf config.Conf) error {
+	this.maxRecordSize = uint32(config.Int64Default(conf,
+		"GooseBuild.DocFormat.MaxRecordSize", 64*1024*1024))
+	return nil
+}
+
+func (this *binaryDocFormat) NewDocIterator(r io.Reader) DocFileIterator {
+	return &binaryDocIter{r: bufio.NewReader(r), maxRecordSize: this.maxRecordSize}
+}
+
+type binaryDocIter struct {
+	r             *bufio.Reader
+	maxRecordSize uint32
+
+	done bool
+	err  error
+}
+
+func (this *binaryDocIter) NextDoc() interface{} {
+	if this.done {
+		return nil
+	}
+
+	head := make([]byte, 4)
+	_, err := io.ReadFull(this.r, head)
+	if err != nil {
+		// 在记录边界结束是正常的文件结束
+		this.stop(err)
+		return nil
+	}
+
+	// 长度错误之后的数据都无法定位,只能结束
+	length := binary.BigEndian.Uint32(head)
+	if length > this.maxRecordSize {
+		this.stop(fmt.Errorf("record length [%d] exceed MaxRecordSize [%d]",
+			length, this.maxRecordSize))
+		return nil
+	}
+
+	buf := make([]byte, length)
+	_, err = io.ReadFull(this.r, buf)
+	if err != nil {
+		if err == io.EOF {
+			err = io.ErrUnexpectedEOF
+		}
+		this.stop(err)
+		return nil
+	}
+	return buf
+}
+
+func (this *binaryDocIter) stop(err error) {
+	this.done = true
+	if err != io.EOF {
+		this.err = err
+	}
+}
+
+func (this *binaryDocIter) Err() error {
+	return this.err
+}
+
+/* vim: set expandtab ts=4 sw=4 sts=4 tw=100: */
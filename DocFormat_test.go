@@ -0,0 +1,137 @@
+package goose
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/json"
+	"github.com/getwe/goose/config"
+	"strings"
+	"testing"
+)
+
+// 只有字符串和整数配置项的测试配置
+type formatTestConf map[string]interface{}
+
+func (this formatTestConf) String(key string) string {
+	s, _ := this[key].(string)
+	return s
+}
+
+func (this formatTestConf) Int64(key string) int64 {
+	n, _ := this[key].(int64)
+	return n
+}
+
+func (this formatTestConf) Float64(key string) float64        { return 0 }
+func (this formatTestConf) Bool(key string) bool              { return false }
+func (this formatTestConf) Float64Array(key string) []float64 { return nil }
+
+func readFormatDocs(t *testing.T, name string, conf config.Conf, input []byte) ([]interface{},
+	error) {
+
+	format, err := NewDocFormat(name, conf)
+	if err != nil {
+		t.Fatalf("NewDocFormat [%s] --- %s", name, err)
+	}
+	iter := format.NewDocIterator(bytes.NewReader(input))
+	docs := make([]interface{}, 0)
+	for doc := iter.NextDoc(); doc != nil; doc = iter.NextDoc() {
+		docs = append(docs, doc)
+	}
+	return docs, iter.Err()
+}
+
+func TestDocFormatJson(t *testing.T) {
+	input := "{\"id\":1,\"title\":\"a\"}\n\n{\"id\":\"2\",\"n\":3.5}\nnot json\n" +
+		"{\"title\":\"no id\"}\n{\"id\":-1}\n"
+	docs, err := readFormatDocs(t, "jsonl", formatTestConf{}, []byte(input))
+	if err != nil || len(docs) != 5 {
+		t.Fatalf("doc count [%d] err [%v]", len(docs), err)
+	}
+
+	doc, ok := docs[0].(*JsonDoc)
+	if !ok || doc.Id != 1 || doc.Fields["title"] != "a" {
+		t.Errorf("doc0 %v", docs[0])
+	}
+	doc, ok = docs[1].(*JsonDoc)
+	if !ok || doc.Id != 2 || doc.Fields["n"] != json.Number("3.5") {
+		t.Errorf("doc1 %v", docs[1])
+	}
+	if bad, ok := docs[2].(*BadDoc); !ok || string(bad.Raw) != "not json" {
+		t.Errorf("doc2 %v", docs[2])
+	}
+	if doc, ok := docs[3].(*JsonDoc); !ok || doc.Id != 0 {
+		t.Errorf("doc3 %v", docs[3])
+	}
+	if _, ok := docs[4].(*BadDoc); !ok {
+		t.Errorf("doc4 %v", docs[4])
+	}
+
+	// 配置id字段
+	conf := formatTestConf{"GooseBuild.DocFormat.IdField": "docid"}
+	docs, _ = readFormatDocs(t, "jsonl", conf, []byte("{\"docid\":7}\n"))
+	if doc, ok := docs[0].(*JsonDoc); !ok || doc.Id != 7 {
+		t.Errorf("docid %v", docs[0])
+	}
+}
+
+func TestDocFormatCsv(t *testing.T) {
+	input := "id,title,body\n1,a,\"x,\ny\"\n2,b\n3,c,z\n"
+	docs, err := readFormatDocs(t, "csv", formatTestConf{}, []byte(input))
+	if err != nil || len(docs) != 3 {
+		t.Fatalf("doc count [%d] err [%v]", len(docs), err)
+	}
+	doc, ok := docs[0].(*CsvDoc)
+	if !ok || doc.Id != 1 || doc.Fields["title"] != "a" || doc.Fields["body"] != "x,\ny" {
+		t.Errorf("doc0 %v", docs[0])
+	}
+	if bad, ok := docs[1].(*BadDoc); !ok || string(bad.Raw) != "2,b" {
+		t.Errorf("doc1 %v", docs[1])
+	}
+	if doc, ok := docs[2].(*CsvDoc); !ok || doc.Id != 3 || len(doc.Record) != 3 {
+		t.Errorf("doc2 %v", docs[2])
+	}
+
+	docs, err = readFormatDocs(t, "tsv", formatTestConf{}, []byte("title\tid\n\"q\t9\n"))
+	if err != nil || len(docs) != 1 {
+		t.Fatalf("tsv doc count [%d] err [%v]", len(docs), err)
+	}
+	if doc, ok := docs[0].(*CsvDoc); !ok || doc.Id != 9 || doc.Fields["title"] != "\"q" {
+		t.Errorf("tsv doc %v", docs[0])
+	}
+}
+
+func TestDocFormatBinary(t *testing.T) {
+	buf := bytes.Buffer{}
+	for _, r := range []string{"a\nb", "", strings.Repeat("c", 100)} {
+		head := make([]byte, 4)
+		binary.BigEndian.PutUint32(head, uint32(len(r)))
+		buf.Write(head)
+		buf.WriteString(r)
+	}
+	docs, err := readFormatDocs(t, "binary", formatTestConf{}, buf.Bytes())
+	if err != nil || len(docs) != 3 {
+		t.Fatalf("doc count [%d] err [%v]", len(docs), err)
+	}
+	if string(docs[0].([]byte)) != "a\nb" || len(docs[1].([]byte)) != 0 ||
+		len(docs[2].([]byte)) != 100 {
+		t.Errorf("docs %v", docs)
+	}
+
+	// 截断的记录和超长的记录
+	docs, err = readFormatDocs(t, "binary", formatTestConf{}, buf.Bytes()[:buf.Len()-1])
+	if err == nil || len(docs) != 2 {
+		t.Errorf("truncated doc count [%d] err [%v]", len(docs), err)
+	}
+	conf := formatTestConf{"GooseBuild.DocFormat.MaxRecordSize": int64(10)}
+	docs, err = readFormatDocs(t, "binary", conf, buf.Bytes())
+	if err == nil || len(docs) != 2 {
+		t.Errorf("oversize doc count [%d] err [%v]", len(docs), err)
+	}
+
+	if _, err := NewDocFormat("nothing", formatTestConf{}); err == nil {
+		t.Errorf("unknown format succ")
+	}
+}
+
+/* vim: set expandtab ts=4 sw=4 sts=4 tw=100: */
@@ -0,0 +1,256 @@
+package goose
+
+import (
+	"bufio"
+	"encoding/binary"
+	log "github.com/getwe/goose/log"
+	. "github.com/getwe/goose/utils"
+	"hash/crc32"
+	"io"
+	"os"
+	"sync"
+	"time"
+)
+
+// 动态索引请求的类型
+const (
+	docLogIndex  = 1 // 插入doc,内容是原始doc
+	docLogDelete = 2 // 删除doc,内容是4字节大端序外部id列表
+)
+
+const (
+	// 记录头:[4字节:长度][4字节:crc32]
+	docLogRecordHeaderSize = 8
+	// 记录内容的固定部分:[8字节:时间][1字节:类型]
+	docLogRecordFixedSize = 9
+	// 一条记录最大长度,超过认为日志已经损坏
+	docLogMaxRecordSize = 256 * 1024 * 1024
+)
+
+// 动态索引请求日志.记录每个插入和删除请求的原始内容和时间,
+// 切换到新建的数据库版本时,重放版本建库时间之后的请求,保证动态插入的doc不会丢失.
+// 跟VarIndex的预写日志不同,这里保存的是策略处理之前的原始doc,跟数据库版本无关.
+// 记录格式(大端序):
+//
+//	[4字节:长度][4字节:crc32][8字节:时间][1字节:类型][内容]
+type docLog struct {
+	lock sync.Mutex
+
+	file     *os.File
+	fullpath string
+
+	// 最后一条记录的位置
+	last docLogPos
+}
+
+// 一条记录在日志中的位置:记录的时间(unix秒)以及这一秒内的序号(从1开始).
+// 写入的时间不会倒退,Trim删除的是整秒的记录,位置在Trim之后依然有效
+type docLogPos struct {
+	Time  int64
+	Count int64
+}
+
+// 位置是否在other之前
+func (this docLogPos) Less(other docLogPos) bool {
+	return this.Time < other.Time || (this.Time == other.Time && this.Count < other.Count)
+}
+
+// 记录时间t在last之后的位置.时间倒退的记录(早期的日志)算作跟last同一秒
+func (this docLogPos) next(t int64) docLogPos {
+	if t <= this.Time {
+		return docLogPos{Time: this.Time, Count: this.Count + 1}
+	}
+	return docLogPos{Time: t, Count: 1}
+}
+
+// 打开日志文件,末尾不完整的记录被截断
+func openDocLog(fullpath string) (*docLog, error) {
+	l := docLog{}
+	l.fullpath = fullpath
+
+	var err error
+	l.file, err = os.OpenFile(fullpath, os.O_RDWR|os.O_CREATE, 0644)
+	if err != nil {
+		return nil, log.Error("open doc log [%s] fail : %s", fullpath, err)
+	}
+
+	offset, err := l.scanRaw(func(pos docLogPos, record []byte) error {
+		l.last = pos
+		return nil
+	})
+	if err != nil {
+		l.file.Close()
+		return nil, err
+	}
+	err = l.file.Truncate(offset)
+	if err != nil {
+		l.file.Close()
+		return nil, log.Error("truncate doc log [%s] fail : %s", fullpath, err)
+	}
+	_, err = l.file.Seek(offset, os.SEEK_SET)
+	if err != nil {
+		l.file.Close()
+		return nil, log.Error("seek doc log [%s] fail : %s", fullpath, err)
+	}
+	return &l, nil
+}
+
+// 追加一条记录并写入磁盘,返回记录的位置
+func (this *docLog) Append(typ uint8, payload []byte) (docLogPos, error) {
+	this.lock.Lock()
+	defer this.lock.Unlock()
+
+	pos := this.last.next(time.Now().Unix())
+	body := make([]byte, docLogRecordFixedSize+len(payload))
+	binary.BigEndian.PutUint64(body[0:8], uint64(pos.Time))
+	body[8] = typ
+	copy(body[docLogRecordFixedSize:], payload)
+
+	buf := make([]byte, docLogRecordHeaderSize, docLogRecordHeaderSize+len(body))
+	binary.BigEndian.PutUint32(buf[0:4], uint32(len(body)))
+	binary.BigEndian.PutUint32(buf[4:8], crc32.ChecksumIEEE(body))
+	buf = append(buf, body...)
+
+	_, err := this.file.Write(buf)
+	if err == nil {
+		err = this.file.Sync()
+	}
+	if err != nil {
+		return pos, err
+	}
+	this.last = pos
+	return pos, nil
+}
+
+// 按顺序重放位置在from之后的记录
+func (this *docLog) Replay(from docLogPos,
+	fn func(pos docLogPos, typ uint8, payload []byte) error) error {
+
+	this.lock.Lock()
+	defer this.lock.Unlock()
+
+	_, err := this.scanRaw(func(pos docLogPos, record []byte) error {
+		if !from.Less(pos) {
+			return nil
+		}
+		body := record[docLogRecordHeaderSize:]
+		return fn(pos, body[8], body[docLogRecordFixedSize:])
+	})
+	if err != nil {
+		return err
+	}
+	_, err = this.file.Seek(0, os.SEEK_END)
+	return err
+}
+
+// 删除since(unix秒)之前的记录,已经包含在数据库版本中,不再需要重放
+func (this *docLog) Trim(since int64) error {
+	this.lock.Lock()
+	defer this.lock.Unlock()
+
+	tmpPath := this.fullpath + ".tmp"
+	tmp, err := os.OpenFile(tmpPath, os.O_RDWR|os.O_CREATE|os.O_TRUNC, 0644)
+	if err != nil {
+		return log.Error("open [%s] fail : %s", tmpPath, err)
+	}
+	writer := bufio.NewWriter(tmp)
+
+	_, err = this.scanRaw(func(pos docLogPos, record []byte) error {
+		if pos.Time < since {
+			return nil
+		}
+		_, err := writer.Write(record)
+		return err
+	})
+	if err == nil {
+		err = writer.Flush()
+	}
+	if err == nil {
+		err = tmp.Sync()
+	}
+	if err != nil {
+		tmp.Close()
+		os.Remove(tmpPath)
+		return log.Error("trim doc log fail : %s", err)
+	}
+
+	// 替换旧日志
+	err = os.Rename(tmpPath, this.fullpath)
+	if err != nil {
+		tmp.Close()
+		return log.Error("rename [%s] fail : %s", tmpPath, err)
+	}
+	this.file.Close()
+	this.file = tmp
+	_, err = this.file.Seek(0, os.SEEK_END)
+	return err
+}
+
+func (this *docLog) Close() error {
+	this.lock.Lock()
+	defer this.lock.Unlock()
+	return this.file.Close()
+}
+
+// 从头读取全部完整的记录,返回最后一条完整记录的结束位置.
+// record是包括记录头的整条记录
+func (this *docLog) scanRaw(fn func(pos docLogPos, record []byte) error) (int64, error) {
+	_, err := this.file.Seek(0, os.SEEK_SET)
+	if err != nil {
+		return 0, err
+	}
+	reader := bufio.NewReader(this.file)
+	offset := int64(0)
+	pos := docLogPos{}
+
+	for {
+		head := make([]byte, docLogRecordHeaderSize)
+		_, err := io.ReadFull(reader, head)
+		if err != nil {
+			if err != io.EOF {
+				log.Warn("doc log [%s] broken record head at [%d]", this.fullpath, offset)
+			}
+			return offset, nil
+		}
+		length := binary.BigEndian.Uint32(head[0:4])
+		if length < docLogRecordFixedSize || length > docLogMaxRecordSize {
+			log.Warn("doc log [%s] illegal record length [%d] at [%d]",
+				this.fullpath, length, offset)
+			return offset, nil
+		}
+		record := make([]byte, docLogRecordHeaderSize+int(length))
+		copy(record, head)
+		body := record[docLogRecordHeaderSize:]
+		_, err = io.ReadFull(reader, body)
+		if err != nil || crc32.ChecksumIEEE(body) != binary.BigEndian.Uint32(head[4:8]) {
+			log.Warn("doc log [%s] broken record at [%d]", this.fullpath, offset)
+			return offset, nil
+		}
+
+		pos = pos.next(int64(binary.BigEndian.Uint64(body[0:8])))
+		err = fn(pos, record)
+		if err != nil {
+			return offset, err
+		}
+		offset += int64(len(record))
+	}
+}
+
+// 删除请求的外部id列表序列化
+func encodeOutIdList(outIdList []OutIdType) []byte {
+	buf := make([]byte, 4*len(outIdList))
+	for i, id := range outIdList {
+		binary.BigEndian.PutUint32(buf[4*i:], uint32(id))
+	}
+	return buf
+}
+
+func decodeOutIdList(buf []byte) []OutIdType {
+	outIdList := make([]OutIdType, len(buf)/4)
+	for i, _ := range outIdList {
+		outIdList[i] = OutIdType(binary.BigEndian.Uint32(buf[4*i:]))
+	}
+	return outIdList
+}
+
+/* vim: set expandtab ts=4 sw=4 sts=4 tw=100: */
@@ -7,7 +7,6 @@ import (
 	log "github.com/getwe/goose/log"
 	flags "github.com/jessevdk/go-flags"
 	"os"
-	"time"
 )
 
 // goose的入口程序.
@@ -25,6 +24,9 @@ type Goose struct {
 
 	// 建库模式数据文件
 	dataPath string
+
+	// 增量建库,数据文件中的doc合并到当前版本
+	incremental bool
 }
 
 func (this *Goose) SetIndexStrategy(sty IndexStrategy) {
@@ -55,7 +57,10 @@ func (this *Goose) Run() {
 		LogConf string `short:"l" long:"logconf" description:"log congfigure file" default:"conf/log.toml"`
 
 		// build mode data file
-		DataFile string `short:"d" long:"datafile" description:"build mode data file"`
+		DataFile string `short:"d" long:"datafile" description:"build mode data files, comma separated files/dirs/globs, .gz and .zst are decompressed"`
+
+		// incremental build
+		Incremental bool `short:"i" long:"incremental" description:"build mode: merge datafile into current database"`
 	}
 	parser := flags.NewParser(&opts, flags.HelpFlag)
 	_, err := parser.ParseArgs(os.Args)
@@ -72,6 +77,7 @@ func (this *Goose) Run() {
 
 	this.confPath = opts.Configure
 	this.dataPath = opts.DataFile
+	this.incremental = opts.Incremental
 	this.logConfPath = opts.LogConf
 
 	// init log
@@ -89,9 +95,9 @@ func (this *Goose) Run() {
 		this.searchModeRun()
 	}
 
-	// BUG(log4go) log4go need time to sync ...(wtf)
+	// 等待log4go把缓存的日志写入文件
 	// see http://stackoverflow.com/questions/14252766/abnormal-behavior-of-log4go
-	time.Sleep(100 * time.Millisecond)
+	log.Close()
 }
 
 func (this *Goose) showLogo() string {
@@ -119,7 +125,12 @@ func (this *Goose) buildModeRun() {
 	}
 
 	gooseBuild := NewGooseBuild()
-	err := gooseBuild.Init(this.confPath, this.indexSty, this.dataPath)
+	var err error
+	if this.incremental {
+		err = gooseBuild.InitIncremental(this.confPath, this.indexSty, this.dataPath)
+	} else {
+		err = gooseBuild.Init(this.confPath, this.indexSty, this.dataPath)
+	}
 	if err != nil {
 		fmt.Println(err)
 		log.Error(err)
@@ -6,47 +6,277 @@ import (
 	log "github.com/getwe/goose/log"
 	. "github.com/getwe/goose/utils"
 	"os"
+	"path/filepath"
+	"reflect"
 	"runtime"
+	"time"
 )
 
+// 建库进度文件,在建库临时目录中,每完成一个数据文件更新一次
+const buildCheckpointFile = "checkpoint.stat"
+
+// 建库统计文件,建库完成后在版本目录中
+const buildStatFile = "build.stat"
+
+// 建库统计
+type BuildStatus struct {
+	Version DBVersionStatus
+	// 数据文件数量和总大小,压缩文件是压缩后的大小
+	FileCount int
+	InputSize int64
+	// doc计数
+	Indexer StaticIndexerStatus
+	// 最终索引的统计,包括暂存磁盘和合并索引的耗时
+	Index DBBuilderStatus
+	// 读取数据文件建索引的耗时(秒),继续建库时包括中断前的耗时
+	IndexSeconds float64
+	// 生成最终索引的耗时(秒)
+	SyncSeconds float64
+	// 写入文件清单等发布之前的全部耗时(秒)
+	TotalSeconds float64
+}
+
+// 建库进度.建库中断后再次用同样的数据文件建库,从最近一次完成的数据文件之后继续
+type buildCheckpoint struct {
+	// 新版本信息
+	Version DBVersionStatus
+	// 增量建库的基础版本目录,全量建库为空
+	BasePath string
+	// 全部数据文件
+	Files []string
+	// 已经完成的数据文件数量
+	Done int
+	// 已经完成的数据文件的doc计数
+	Indexer StaticIndexerStatus
+	// 已经完成的数据文件的建索引耗时(秒)
+	IndexSeconds float64
+	// 已经完成的数据文件写入失败doc后,失败doc文件的大小
+	DeadLetterSize int64
+}
+
 // Goose的静态库生成程序.
 type GooseBuild struct {
 	conf config.Conf
 
 	staticDB *DBBuilder
 
+	// 数据库根目录
+	dbPath string
+	// 本次建库的临时目录和进度,版本信息在进度中
+	stagingPath string
+	checkpoint  buildCheckpoint
+	// 临时目录的引用,建库过程中不会被清理
+	stagingRef *DBVersionRef
+
+	// 保留的版本数量,0不清理旧版本
+	keepVersions int
+
 	staticIndexer *StaticIndexer
 
-	fileHd   *os.File
-	fileIter *FileIter
+	// 数据文件格式
+	docFormat DocFormat
+
+	// 失败的doc超过这个比例建库失败,0不限制
+	maxErrorRatio float64
+	deadLetter    *DeadLetterFile
+
+	// 每个数据文件的大小,用于估计剩余时间
+	fileSizes []int64
+	// 本次运行开始时间和开始时已经完成的数据大小
+	startTime time.Time
+	startSize int64
+	// 之前的数据文件的大小和正在读取的数据文件
+	doneSize int64
+	currFile *DocFile
 }
 
 func (this *GooseBuild) Run() (err error) {
-	defer this.fileHd.Close()
+	ckptPath := filepath.Join(this.stagingPath, buildCheckpointFile)
+	defer this.deadLetter.Close()
+	defer this.stagingRef.Release()
+
+	// 建库失败删除临时目录,正在使用的版本不受影响.已经有进度的保留下来等待继续
+	defer func() {
+		if err == nil {
+			return
+		}
+		if _, e := os.Stat(ckptPath); e == nil {
+			log.Error("build db fail, keep [%s] to resume after file [%d/%d]",
+				this.stagingPath, this.checkpoint.Done, len(this.checkpoint.Files))
+			return
+		}
+		log.Error("build db fail, remove [%s]", this.stagingPath)
+		os.RemoveAll(this.stagingPath)
+	}()
 
 	// build index
-	err = this.staticIndexer.BuildIndex(this.fileIter)
-	if err != nil {
-		return err
+	this.startTime = time.Now()
+	this.doneSize = 0
+	for _, size := range this.fileSizes[:this.checkpoint.Done] {
+		this.doneSize += size
+	}
+	this.startSize = this.doneSize
+
+	for this.checkpoint.Done < len(this.checkpoint.Files) {
+		begin := time.Now()
+		err = this.buildFile(this.checkpoint.Files[this.checkpoint.Done])
+		if err != nil {
+			return err
+		}
+
+		// 失败的doc太多不发布新版本
+		st := this.staticIndexer.GetStatus()
+		if this.maxErrorRatio > 0 && st.ErrorRatio() > this.maxErrorRatio {
+			return log.Error("error ratio [%f] exceed MaxErrorRatio [%f] : %+v",
+				st.ErrorRatio(), this.maxErrorRatio, st)
+		}
+
+		// 一个数据文件全部写入后持久化并记录进度
+		err = this.staticDB.Flush()
+		if err != nil {
+			return err
+		}
+		this.doneSize += this.fileSizes[this.checkpoint.Done]
+		this.checkpoint.Done++
+		this.checkpoint.Indexer = st
+		this.checkpoint.IndexSeconds += time.Since(begin).Seconds()
+		this.checkpoint.DeadLetterSize, err = this.deadLetter.Size()
+		if err != nil {
+			return err
+		}
+		err = JsonEncodeToFile(this.checkpoint, ckptPath)
+		if err != nil {
+			return err
+		}
 	}
 
+	st := this.staticIndexer.GetStatus()
+	log.Info("build index finish, doc [%d] write [%d] error [%d] : %+v", st.DocCount,
+		st.WriteCount, st.ErrorCount(), st)
+
 	// db sync
+	syncBegin := time.Now()
 	err = this.staticDB.Sync()
 	if err != nil {
 		return err
 	}
+	os.Remove(ckptPath)
+	this.checkpoint.Version.CurId = this.staticDB.GetStatus().CurId
+
+	// 统计写入版本目录,跟索引一起写入文件清单
+	bs := BuildStatus{}
+	bs.Version = this.checkpoint.Version
+	bs.FileCount = len(this.fileSizes)
+	bs.InputSize = this.doneSize
+	bs.Indexer = st
+	bs.Index = this.staticDB.GetStatus()
+	bs.IndexSeconds = this.checkpoint.IndexSeconds
+	bs.SyncSeconds = time.Since(syncBegin).Seconds()
+	bs.TotalSeconds = bs.IndexSeconds + bs.SyncSeconds
+	err = JsonEncodeToFile(bs, filepath.Join(this.stagingPath, buildStatFile))
+	if err != nil {
+		return err
+	}
+
+	// 全部数据写入后才发布新版本,检索程序只会打开发布的版本
+	version := this.checkpoint.Version
+	err = PublishDBVersion(this.dbPath, this.stagingPath, version)
+	if err != nil {
+		return err
+	}
+	log.Info("build db version [%s] finish", version.Version)
+
+	// 新版本已经发布,清理失败不影响建库结果
+	this.stagingRef.Release()
+	CleanDBVersions(this.dbPath, this.keepVersions)
 
 	return nil
 }
 
+// 建立一个数据文件的索引
+func (this *GooseBuild) buildFile(path string) error {
+	r, err := OpenDocFile(path)
+	if err != nil {
+		return err
+	}
+	defer r.Close()
+
+	log.Info("build index from [%s] [%d/%d]", path, this.checkpoint.Done+1,
+		len(this.checkpoint.Files))
+
+	last := this.staticIndexer.GetStatus()
+	this.currFile = r
+	defer func() { this.currFile = nil }()
+
+	iter := this.docFormat.NewDocIterator(r)
+	err = this.staticIndexer.BuildIndex(iter)
+	if err != nil {
+		return err
+	}
+	if iter.Err() != nil {
+		return log.Error("read [%s] fail : %s", path, iter.Err())
+	}
+
+	st := this.staticIndexer.GetStatus()
+	log.Info("build index from [%s] finish, doc [%d] error [%d]", path,
+		st.DocCount-last.DocCount, st.ErrorCount()-last.ErrorCount())
+	return nil
+}
+
+// 打印建库进度,根据已经读取的数据大小估计剩余时间
+func (this *GooseBuild) reportProgress(p StaticIndexerProgress) {
+	var total int64
+	for _, size := range this.fileSizes {
+		total += size
+	}
+	read := this.doneSize + this.currFile.Offset()
+
+	eta := "-"
+	if read > this.startSize {
+		elapsed := time.Since(this.startTime)
+		remain := float64(elapsed) * float64(total-read) / float64(read-this.startSize)
+		eta = time.Duration(remain).Truncate(time.Second).String()
+	}
+	percent := 100.0
+	if total > 0 {
+		percent = float64(read) * 100 / float64(total)
+	}
+	log.Info("build progress file [%d/%d] doc [%d] parse [%.0f/s] write [%.0f/s] "+
+		"error [%d] input [%.1f%%] eta [%s]", this.checkpoint.Done+1,
+		len(this.checkpoint.Files), p.Status.DocCount, p.ParseRate, p.WriteRate,
+		p.Status.ErrorCount(), percent, eta)
+}
+
 // 根据配置文件进行初始化.
 // 需要外部指定索引策略,策略可以重新设计.
-// 需要外部知道被索引文件(这个易变信息不适合放配置)
-func (this *GooseBuild) Init(confPath string, indexSty IndexStrategy, toIndexFile string) (err error) {
+// 需要外部知道被索引文件(这个易变信息不适合放配置),多个文件用逗号分隔,
+// 可以是目录或者glob模式,.gz和.zst文件自动解压.文件格式见DocFormat.
+// 同样的数据文件上一次建库中断的,从中断前最后完成的数据文件之后继续.
+func (this *GooseBuild) Init(confPath string, indexSty IndexStrategy, toIndexFile string) error {
+	return this.init(confPath, indexSty, toIndexFile, false)
+}
+
+// 增量建库的初始化.以当前版本为基础,toIndexFile中的doc追加到基础版本的doc之后,
+// 生成包含全部doc的新版本.外部id已经存在的doc替换旧的doc.
+func (this *GooseBuild) InitIncremental(confPath string, indexSty IndexStrategy,
+	toIndexFile string) error {
+	return this.init(confPath, indexSty, toIndexFile, true)
+}
+
+func (this *GooseBuild) init(confPath string, indexSty IndexStrategy, toIndexFile string,
+	incremental bool) (err error) {
 	defer func() {
 		if r := recover(); r != nil {
 			err = log.Error(r)
 		}
+		if err == nil || len(this.stagingPath) == 0 {
+			return
+		}
+		this.stagingRef.Release()
+		// 继续建库的临时目录保留进度
+		if _, e := os.Stat(filepath.Join(this.stagingPath, buildCheckpointFile)); e != nil {
+			os.RemoveAll(this.stagingPath)
+		}
 	}()
 
 	// load conf
@@ -69,13 +299,101 @@ func (this *GooseBuild) Init(confPath string, indexSty IndexStrategy, toIndexFil
 	maxIndexFileSize := this.conf.Int64("GooseBuild.DataBase.MaxIndexFileSize")
 	maxDataFileSize := this.conf.Int64("GooseBuild.DataBase.MaxDataFileSize")
 	valueSize := this.conf.Int64("GooseBuild.DataBase.ValueSize")
+	codec, err := ParsePostingCodec(
+		config.StringDefault(this.conf, "GooseBuild.DataBase.PostingCodec", ""))
+	if err != nil {
+		return
+	}
+
+	// data files
+	this.docFormat, err = NewDocFormat(
+		config.StringDefault(this.conf, "GooseBuild.DocFormat.Type", "line"), this.conf)
+	if err != nil {
+		return
+	}
+	files, err := ExpandDocFiles(toIndexFile)
+	if err != nil {
+		return
+	}
+	this.fileSizes = make([]int64, len(files))
+	for i, f := range files {
+		files[i], err = filepath.Abs(f)
+		if err != nil {
+			return
+		}
+		var fileInfo os.FileInfo
+		fileInfo, err = os.Stat(f)
+		if err != nil {
+			return
+		}
+		this.fileSizes[i] = fileInfo.Size()
+	}
+
+	this.dbPath = dbPath
+	var basePath string
+	var baseVersion DBVersionStatus
+	if incremental {
+		basePath, baseVersion, err = LatestDBVersion(dbPath)
+		if err != nil {
+			return
+		}
+		log.Info("incremental build base on [%s]", basePath)
+	}
 
 	this.staticDB = NewDBBuilder()
-	err = this.staticDB.Init(dbPath, int(transformMaxTermCnt), InIdType(maxId),
-		uint32(valueSize), uint32(maxIndexFileSize), uint32(maxDataFileSize))
+	if path, ckpt := findBuildCheckpoint(dbPath, files, basePath); ckpt != nil {
+		// 继续上一次中断的建库
+		this.stagingPath = path
+		this.checkpoint = *ckpt
+		log.Info("resume build [%s] after file [%d/%d]", path, ckpt.Done, len(ckpt.Files))
+		err = this.staticDB.Open(this.stagingPath, basePath,
+			int(transformMaxTermCnt), uint32(maxIndexFileSize), codec)
+		if err != nil {
+			return
+		}
+	} else {
+		// 每次建库在临时目录中进行,不影响正在使用的版本
+		var version DBVersionStatus
+		this.stagingPath, version, err = NewDBVersion(dbPath)
+		if err != nil {
+			return
+		}
+
+		// 数据文件可能在建库之前很久就生成了,以最早的数据文件修改时间作为版本的数据时间
+		for _, f := range files {
+			var fileInfo os.FileInfo
+			fileInfo, err = os.Stat(f)
+			if err != nil {
+				return
+			}
+			if fileInfo.ModTime().Unix() < version.BuildTime {
+				version.BuildTime = fileInfo.ModTime().Unix()
+			}
+		}
+
+		if incremental {
+			// 基础版本的动态索引不会复制到新版本,需要检索程序重放基础版本建库时间之后的请求
+			if baseVersion.BuildTime < version.BuildTime {
+				version.BuildTime = baseVersion.BuildTime
+			}
+			err = this.staticDB.InitIncremental(this.stagingPath, basePath,
+				int(transformMaxTermCnt), uint32(maxIndexFileSize), codec)
+		} else {
+			err = this.staticDB.Init(this.stagingPath, int(transformMaxTermCnt),
+				InIdType(maxId), uint32(valueSize), uint32(maxIndexFileSize),
+				uint32(maxDataFileSize), codec)
+		}
+		if err != nil {
+			return
+		}
+		this.checkpoint = buildCheckpoint{Version: version, BasePath: basePath, Files: files}
+	}
+	this.stagingRef, err = RefDBVersion(this.stagingPath)
 	if err != nil {
 		return
 	}
+	// 每次建库之后保留的版本数量
+	this.keepVersions = int(config.Int64Default(this.conf, "GooseBuild.DataBase.KeepVersions", 3))
 
 	// index strategy global init
 	err = indexSty.Init(this.conf)
@@ -88,19 +406,68 @@ func (this *GooseBuild) Init(confPath string, indexSty IndexStrategy, toIndexFil
 	if err != nil {
 		return
 	}
+	// 继续建库时从已经完成的数据文件的计数开始累计
+	this.staticIndexer.status = this.checkpoint.Indexer
 
-	// open data file
-	this.fileHd, err = os.OpenFile(toIndexFile, os.O_RDONLY, 0644)
-	if err != nil {
-		return
+	// 按输入顺序写入,同样的输入生成同样的库
+	this.staticIndexer.SetOrdered(config.BoolDefault(this.conf, "GooseBuild.OrderedWrite", false))
+
+	// 进度报告周期(秒),小于0不报告
+	progressInterval := time.Duration(config.Int64Default(this.conf,
+		"GooseBuild.Progress.Interval", 10)) * time.Second
+	if progressInterval < 0 {
+		progressInterval = 0
 	}
+	this.staticIndexer.SetProgress(progressInterval, this.reportProgress)
+	this.staticDB.SetProgressInterval(progressInterval)
 
-	// file iter
-	this.fileIter = NewFileIter(this.fileHd)
+	// 失败的doc默认写入DbPath下跟版本同名的文件.继续建库时先丢弃中断的数据文件写入的doc,
+	// 这个数据文件会从头重新建索引
+	this.maxErrorRatio = config.Float64Default(this.conf, "GooseBuild.MaxErrorRatio", 0)
+	deadLetterPath := config.StringDefault(this.conf, "GooseBuild.DeadLetter.Path",
+		filepath.Join(dbPath, this.checkpoint.Version.Version+".deadletter"))
+	this.deadLetter = NewDeadLetterFile(deadLetterPath)
+	if this.checkpoint.Done > 0 {
+		err = this.deadLetter.Truncate(this.checkpoint.DeadLetterSize)
+		if err != nil {
+			return
+		}
+	} else {
+		this.checkpoint.DeadLetterSize, err = this.deadLetter.Size()
+		if err != nil {
+			return
+		}
+	}
+	this.staticIndexer.SetDeadLetter(this.deadLetter)
 
 	return nil
 }
 
+// 查找可以继续的建库临时目录,要求数据文件和增量建库的基础版本都跟这次相同
+func findBuildCheckpoint(dbPath string, files []string, basePath string) (string,
+	*buildCheckpoint) {
+
+	stagings, err := ListDBStaging(dbPath)
+	if err != nil {
+		return "", nil
+	}
+	for _, path := range stagings {
+		// 正在被另一个建库程序使用
+		if DBVersionInUse(path) {
+			continue
+		}
+		ckpt := buildCheckpoint{}
+		err = JsonDecodeFromFile(&ckpt, filepath.Join(path, buildCheckpointFile))
+		if err != nil {
+			continue
+		}
+		if ckpt.BasePath == basePath && reflect.DeepEqual(ckpt.Files, files) {
+			return path, &ckpt
+		}
+	}
+	return "", nil
+}
+
 func NewGooseBuild() *GooseBuild {
 	bui := GooseBuild{}
 	return &bui
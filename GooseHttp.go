@@ -0,0 +1,308 @@
+package goose
+
+import (
+	"encoding/json"
+	"fmt"
+	. "github.com/getwe/goose/database"
+	log "github.com/getwe/goose/log"
+	. "github.com/getwe/goose/utils"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"sync/atomic"
+	"time"
+)
+
+// HTTP服务.跟TCP服务共用检索流程和动态索引流程:
+//
+//	POST /search : 请求body交给SearchStrategy,返回Response写入的内容
+//	POST /index  : 请求body作为一个doc交给IndexStrategy建动态索引
+//	POST /delete : 请求body是外部id的JSON数组,例如[1,2,3].有外部id不存在时返回404,
+//	               其它存在的id依然删除
+//	GET  /status : 返回服务状态以及数据库状态的JSON
+//
+// 策略返回StyError的时候使用其中的状态码,其它错误返回500.
+type httpServer struct {
+	dbs *dbSwitcher
+
+	// 检索资源池,同时也限制了并发检索的数量
+	searchSlots chan *searchSlot
+
+	// 请求body大小限制
+	searchReqBufSize int
+	indexReqBufSize  int
+
+	startTime time.Time
+
+	// 请求计数
+	searchCount     int64
+	searchFailCount int64
+	indexCount      int64
+	indexFailCount  int64
+	deleteCount     int64
+	deleteFailCount int64
+
+	server *http.Server
+}
+
+// 服务状态
+type httpStatus struct {
+	// 服务运行时间(秒)
+	Uptime int64
+
+	SearchCount     int64
+	SearchFailCount int64
+	IndexCount      int64
+	IndexFailCount  int64
+	DeleteCount     int64
+	DeleteFailCount int64
+
+	// 当前使用的db版本,旧的目录结构为空
+	DbVersion string
+
+	// 数据库id状态
+	IdStatus IdManagerStatus
+
+	// 拉链缓存命中情况
+	IndexCache InvListCacheStatus
+
+	// 检索结果缓存命中情况,没有开启时为空
+	ResultCache *ResultCacheStatus `json:",omitempty"`
+}
+
+func (this *GooseSearch) runHttpServer(host string, listenPort int, routineNum int,
+	searchReqBufSize int, searchResBufSize int, indexReqBufSize int) error {
+
+	if 0 == listenPort || 0 == routineNum || 0 == searchReqBufSize ||
+		0 == searchResBufSize || 0 == indexReqBufSize {
+		return log.Error("arg error listenPort[%d] routineNum[%d] searchReqBufSize[%d] "+
+			"searchResBufSize[%d] indexReqBufSize[%d]", listenPort, routineNum,
+			searchReqBufSize, searchResBufSize, indexReqBufSize)
+	}
+
+	s := newHttpServer(this.dbs, routineNum, searchReqBufSize, searchResBufSize,
+		indexReqBufSize)
+
+	// 先监听端口,监听失败直接返回错误
+	listener, err := net.Listen("tcp", fmt.Sprintf("%s:%d", host, listenPort))
+	if err != nil {
+		log.Error("runHttpServer listen fail : %s", err.Error())
+		return err
+	}
+
+	go func() {
+		err := s.server.Serve(listener)
+		if err != nil {
+			log.Warn("HttpServer exit : %s", err.Error())
+		}
+	}()
+
+	this.httpSvr = s
+	return nil
+}
+
+// 创建HTTP服务,server.Handler处理全部请求,由调用者负责监听
+func newHttpServer(dbs *dbSwitcher, routineNum int, searchReqBufSize int,
+	searchResBufSize int, indexReqBufSize int) *httpServer {
+
+	s := &httpServer{}
+	s.dbs = dbs
+	s.searchReqBufSize = searchReqBufSize
+	s.indexReqBufSize = indexReqBufSize
+	s.startTime = time.Now()
+
+	s.searchSlots = make(chan *searchSlot, routineNum)
+	for i := 0; i < routineNum; i++ {
+		s.searchSlots <- &searchSlot{
+			resbuf:  make([]byte, searchResBufSize),
+			context: NewStyContext()}
+	}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/search", s.handleSearch)
+	mux.HandleFunc("/index", s.handleIndex)
+	mux.HandleFunc("/delete", s.handleDelete)
+	mux.HandleFunc("/status", s.handleStatus)
+	s.server = &http.Server{Handler: mux}
+	return s
+}
+
+func (this *httpServer) handleSearch(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		this.writeError(w, http.StatusMethodNotAllowed, "use POST")
+		return
+	}
+	if !this.dbs.CanSearch() {
+		this.writeError(w, http.StatusNotImplemented, "no search strategy")
+		return
+	}
+
+	body, status, err := this.readBody(r, this.searchReqBufSize)
+	if err != nil {
+		this.writeError(w, status, err.Error())
+		return
+	}
+
+	atomic.AddInt64(&this.searchCount, 1)
+
+	// 等待空闲的检索资源
+	slot := <-this.searchSlots
+	defer func() {
+		this.searchSlots <- slot
+	}()
+
+	context := slot.context
+	context.Clear()
+	context.Log.Info("IP", r.RemoteAddr)
+	context.Log.Info("reqlen", len(body))
+
+	t1 := time.Now().UnixNano()
+	v := this.dbs.Acquire()
+	reslen, err := v.searcher.Search(context, body, slot.resbuf)
+	this.dbs.Release(v)
+	t2 := time.Now().UnixNano()
+	context.Log.Info("time(ms)", Ns2Ms(t2-t1))
+	if err != nil {
+		atomic.AddInt64(&this.searchFailCount, 1)
+		log.Warn("HttpServer Search fail : %s", err.Error())
+		this.writeStyError(w, err)
+		context.Log.PrintAllInfo()
+		return
+	}
+
+	_, err = w.Write(slot.resbuf[:reslen])
+	if err != nil {
+		log.Warn("HttpServer write fail : %s", err.Error())
+	}
+	context.Log.PrintAllInfo()
+}
+
+func (this *httpServer) handleIndex(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		this.writeError(w, http.StatusMethodNotAllowed, "use POST")
+		return
+	}
+	if !this.dbs.CanIndex() {
+		this.writeError(w, http.StatusNotImplemented, "no index strategy")
+		return
+	}
+
+	body, status, err := this.readBody(r, this.indexReqBufSize)
+	if err != nil {
+		this.writeError(w, status, err.Error())
+		return
+	}
+
+	atomic.AddInt64(&this.indexCount, 1)
+	err = this.dbs.Index(body)
+	if err != nil {
+		atomic.AddInt64(&this.indexFailCount, 1)
+		log.Warn("HttpServer BuildIndex fail : %s", err.Error())
+		this.writeStyError(w, err)
+		return
+	}
+	this.writeJson(w, http.StatusOK, map[string]string{"status": "ok"})
+}
+
+func (this *httpServer) handleDelete(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		this.writeError(w, http.StatusMethodNotAllowed, "use POST")
+		return
+	}
+	if !this.dbs.CanIndex() {
+		this.writeError(w, http.StatusNotImplemented, "no index strategy")
+		return
+	}
+
+	body, status, err := this.readBody(r, this.indexReqBufSize)
+	if err != nil {
+		this.writeError(w, status, err.Error())
+		return
+	}
+
+	var outIdList []OutIdType
+	err = json.Unmarshal(body, &outIdList)
+	if err != nil || len(outIdList) == 0 {
+		this.writeError(w, http.StatusBadRequest, "body should be json array of outId")
+		return
+	}
+
+	atomic.AddInt64(&this.deleteCount, 1)
+	err = this.dbs.Delete(outIdList)
+	if err != nil {
+		atomic.AddInt64(&this.deleteFailCount, 1)
+		log.Warn("HttpServer DeleteDoc fail : %s", err.Error())
+		this.writeStyError(w, err)
+		return
+	}
+	this.writeJson(w, http.StatusOK, map[string]string{"status": "ok"})
+}
+
+func (this *httpServer) handleStatus(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" {
+		this.writeError(w, http.StatusMethodNotAllowed, "use GET")
+		return
+	}
+
+	st := httpStatus{}
+	st.Uptime = int64(time.Since(this.startTime).Seconds())
+	st.SearchCount = atomic.LoadInt64(&this.searchCount)
+	st.SearchFailCount = atomic.LoadInt64(&this.searchFailCount)
+	st.IndexCount = atomic.LoadInt64(&this.indexCount)
+	st.IndexFailCount = atomic.LoadInt64(&this.indexFailCount)
+	st.DeleteCount = atomic.LoadInt64(&this.deleteCount)
+	st.DeleteFailCount = atomic.LoadInt64(&this.deleteFailCount)
+
+	v := this.dbs.Acquire()
+	st.DbVersion = v.version.Version
+	var err error
+	st.IdStatus, err = v.db.GetIdStatus()
+	st.IndexCache = v.db.GetIndexCacheStatus()
+	if v.searcher != nil {
+		if cacheSt, ok := v.searcher.GetResultCacheStatus(); ok {
+			st.ResultCache = &cacheSt
+		}
+	}
+	this.dbs.Release(v)
+	if err != nil {
+		this.writeError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+	this.writeJson(w, http.StatusOK, st)
+}
+
+// 读取请求body,超过限制返回413
+func (this *httpServer) readBody(r *http.Request, limit int) ([]byte, int, error) {
+	body, err := ioutil.ReadAll(io.LimitReader(r.Body, int64(limit)+1))
+	if err != nil {
+		return nil, http.StatusBadRequest, err
+	}
+	if len(body) > limit {
+		return nil, http.StatusRequestEntityTooLarge,
+			fmt.Errorf("request body larger than %d", limit)
+	}
+	return body, http.StatusOK, nil
+}
+
+func (this *httpServer) writeStyError(w http.ResponseWriter, err error) {
+	this.writeError(w, styErrorStatus(err), err.Error())
+}
+
+func (this *httpServer) writeError(w http.ResponseWriter, status int, msg string) {
+	this.writeJson(w, status, map[string]string{"error": msg})
+}
+
+func (this *httpServer) writeJson(w http.ResponseWriter, status int, v interface{}) {
+	buf, err := json.Marshal(v)
+	if err != nil {
+		log.Warn("HttpServer json marshal fail : %s", err.Error())
+		status = http.StatusInternalServerError
+		buf = []byte(`{"error":"json marshal fail"}`)
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	w.Write(buf)
+}
+
+/* vim: set expandtab ts=4 sw=4 sts=4 tw=100: */
@@ -0,0 +1,141 @@
+package goose
+
+import (
+	"encoding/json"
+	"fmt"
+	"github.com/getwe/goose/config"
+	. "github.com/getwe/goose/database"
+	. "github.com/getwe/goose/utils"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+// doc格式"outId term",请求是一个term,返回命中的结果数量.
+// 格式错误的doc和请求返回StyError
+type httpTestSty struct{}
+
+func (httpTestSty) Init(conf config.Conf) error {
+	return nil
+}
+
+func (httpTestSty) ParseDoc(doc interface{}, context *StyContext) (OutIdType, []TermInDoc,
+	Value, Data, error) {
+
+	var outId, term int
+	_, err := fmt.Sscanf(string(doc.([]byte)), "%d %d", &outId, &term)
+	if err != nil {
+		return 0, nil, nil, nil, NewStyError(http.StatusUnprocessableEntity, "bad doc")
+	}
+	termList := []TermInDoc{TermInDoc{Sign: TermSign(term), Weight: 1}}
+	return OutIdType(outId), termList, Value("v"), Data("d"), nil
+}
+
+func (httpTestSty) ParseQuery(request []byte, context *StyContext) ([]TermInQuery,
+	interface{}, error) {
+	term, err := strconv.Atoi(string(request))
+	if err != nil {
+		return nil, nil, NewStyError(http.StatusBadRequest, "bad query")
+	}
+	return []TermInQuery{TermInQuery{Sign: TermSign(term), Weight: 1}}, nil, nil
+}
+
+func (httpTestSty) CalWeight(queryInfo interface{}, inId InIdType, outId OutIdType,
+	termInQuery []TermInQuery, termInDoc []TermInDoc, termCnt uint32,
+	context *StyContext) (TermWeight, error) {
+	return 1, nil
+}
+
+func (httpTestSty) Response(queryInfo interface{}, list SearchResultList,
+	valueReader ValueReader, dataReader DataReader, response []byte,
+	context *StyContext) (int, error) {
+	return copy(response, fmt.Sprintf("%d", len(list))), nil
+}
+
+func TestHttpServer(t *testing.T) {
+	dbPath := filepath.Join(os.Getenv("HOME"), "tmp", "goosedb", "test_http")
+	os.RemoveAll(dbPath)
+	os.MkdirAll(dbPath, 0755)
+	buildTestVersion(t, dbPath,
+		DBVersionStatus{Version: "db.20140101000000", BuildTime: time.Now().Unix()},
+		map[int]int{1: 10, 2: 10})
+
+	dbs, err := newDBSwitcher(dbPath, httpTestSty{}, httpTestSty{},
+		dbSwitcherOptions{indexCacheSize: DefaultIndexCacheSize})
+	if err != nil {
+		t.Fatalf("newDBSwitcher --- %s", err)
+	}
+	defer dbs.Close()
+
+	s := newHttpServer(dbs, 2, 64, 64, 64)
+	ts := httptest.NewServer(s.server.Handler)
+	defer ts.Close()
+
+	do := func(method string, path string, body string) (int, string) {
+		req, err := http.NewRequest(method, ts.URL+path, strings.NewReader(body))
+		if err != nil {
+			t.Fatalf("NewRequest --- %s", err)
+		}
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatalf("%s %s --- %s", method, path, err)
+		}
+		defer resp.Body.Close()
+		buf, _ := ioutil.ReadAll(resp.Body)
+		return resp.StatusCode, string(buf)
+	}
+	expect := func(method string, path string, body string, status int, res string) {
+		code, got := do(method, path, body)
+		if code != status || (len(res) > 0 && got != res) {
+			t.Errorf("%s %s [%s] get [%d][%s] expect [%d][%s]",
+				method, path, body, code, got, status, res)
+		}
+	}
+	large := strings.Repeat("1", 65)
+
+	// 检索
+	expect("GET", "/search", "", http.StatusMethodNotAllowed, "")
+	expect("POST", "/search", "10", http.StatusOK, "2")
+	expect("POST", "/search", "x", http.StatusBadRequest, "")
+	expect("POST", "/search", large, http.StatusRequestEntityTooLarge, "")
+
+	// 动态插入
+	expect("GET", "/index", "", http.StatusMethodNotAllowed, "")
+	expect("POST", "/index", "3 10", http.StatusOK, "")
+	expect("POST", "/index", "bad", http.StatusUnprocessableEntity, "")
+	expect("POST", "/index", large, http.StatusRequestEntityTooLarge, "")
+	expect("POST", "/search", "10", http.StatusOK, "3")
+
+	// 删除,不存在的id返回404,其它id依然删除
+	expect("GET", "/delete", "", http.StatusMethodNotAllowed, "")
+	expect("POST", "/delete", "1", http.StatusBadRequest, "")
+	expect("POST", "/delete", "[]", http.StatusBadRequest, "")
+	expect("POST", "/delete", "[1,99]", http.StatusNotFound, "")
+	expect("POST", "/search", "10", http.StatusOK, "2")
+	expect("POST", "/delete", "[2]", http.StatusOK, "")
+	expect("POST", "/search", "10", http.StatusOK, "1")
+
+	// 状态
+	expect("POST", "/status", "", http.StatusMethodNotAllowed, "")
+	code, body := do("GET", "/status", "")
+	if code != http.StatusOK {
+		t.Fatalf("status [%d] [%s]", code, body)
+	}
+	st := httpStatus{}
+	if err := json.Unmarshal([]byte(body), &st); err != nil {
+		t.Fatalf("status json [%s] --- %s", body, err)
+	}
+	if st.SearchCount != 5 || st.SearchFailCount != 1 || st.IndexCount != 2 ||
+		st.IndexFailCount != 1 || st.DeleteCount != 2 || st.DeleteFailCount != 1 ||
+		st.DbVersion != "db.20140101000000" {
+		t.Errorf("status %+v", st)
+	}
+}
+
+/* vim: set expandtab ts=4 sw=4 sts=4 tw=100: */
@@ -1,29 +1,70 @@
 package goose
 
 import (
+	"bufio"
+	"context"
 	"fmt"
 	"github.com/getwe/goose/config"
 	. "github.com/getwe/goose/database"
 	log "github.com/getwe/goose/log"
+	"github.com/getwe/goose/protocol"
 	. "github.com/getwe/goose/utils"
+	"io"
 	"net"
+	"net/http"
+	"os"
+	"os/signal"
 	"runtime"
+	"strconv"
+	"strings"
 	"sync"
+	"sync/atomic"
+	"syscall"
 	"time"
 )
 
+// 旧协议索引服务的删除命令前缀.请求格式:"DELETE outId1 outId2 ...",
+// 其它请求都当作待索引的doc交给建索引策略处理.
+// 帧协议用帧类型区分索引和删除请求,见protocol包.
+const indexDeleteCmdPrefix = "DELETE "
+
+// 帧协议的长连接空闲超时,超时没有新请求的连接被关闭
+var connIdleTimeout = 5 * time.Minute
+
+// 退出时等待正在处理的请求完成的默认超时时间(秒)
+const defaultShutdownTimeout = 10
+
+// 检索结果缓存的默认有效时间(秒)
+const defaultResultCacheTTL = 60
+
+// 拉链总长度达到这个值的检索才并行归并
+const defaultShardMinPostings = 100000
+
 // Goose检索程序.核心工作是提供检索服务,同时支持动态插入索引.
 type GooseSearch struct {
 	conf config.Conf
 
-	// 支持检索的db,同时提供动态插入索引功能
-	searchDB *DBSearcher
+	// 当前版本的db以及在其上的检索流程和动态索引生成器,支持切换到新建的版本
+	dbs *dbSwitcher
+
+	// HTTP服务,没有配置GooseSearch.Http.ServerPort时为nil
+	httpSvr *httpServer
+
+	// TCP服务的监听,退出时关闭,不再接受新连接
+	listeners []net.Listener
 
-	// 动态索引生成器
-	varIndexer *VarIndexer
+	// 已经建立的TCP连接,退出时打断空闲连接的读取
+	connLock sync.Mutex
+	conns    map[net.Conn]bool
 
-	// 检索流程
-	searcher *Searcher
+	// 正在处理的请求数量
+	inflight int64
+	// 非0表示正在退出,不再处理新请求
+	shutting int32
+
+	// 关闭后后台goroutine退出
+	quit       chan bool
+	background sync.WaitGroup
 }
 
 func (this *GooseSearch) Run() error {
@@ -65,11 +106,181 @@ func (this *GooseSearch) Run() error {
 		return err
 	}
 
-	neverReturn := sync.WaitGroup{}
-	neverReturn.Add(1)
-	neverReturn.Wait()
+	// 定时检查新建的db版本,0表示不检查
+	dbWatchInterval := config.Int64Default(this.conf, "GooseSearch.DbWatch.Interval", 0)
+	if dbWatchInterval > 0 {
+		this.runWatchServer(int(dbWatchInterval))
+	}
 
-	return nil
+	// 定时把动态索引合并进静态索引,0表示不合并
+	varFoldInterval := config.Int64Default(this.conf, "GooseSearch.VarFold.Interval", 0)
+	if varFoldInterval > 0 {
+		this.runFoldServer(int(varFoldInterval))
+	}
+
+	// 可选的HTTP服务,跟TCP服务同时提供
+	httpSvrPort := config.Int64Default(this.conf, "GooseSearch.Http.ServerPort", 0)
+	if httpSvrPort > 0 {
+		httpHost := config.StringDefault(this.conf, "GooseSearch.Http.Host", "localhost")
+		log.Debug("Read Conf httpHost[%s] httpSvrPort[%d]", httpHost, httpSvrPort)
+
+		err = this.runHttpServer(httpHost, int(httpSvrPort), int(searchGoroutineNum),
+			int(searchReqBufSize), int(searchResBufSize), int(indexReqBufSize))
+		if err != nil {
+			return err
+		}
+	}
+
+	shutdownTimeout := config.Int64Default(this.conf, "GooseSearch.Shutdown.Timeout",
+		defaultShutdownTimeout)
+
+	return this.waitShutdown(shutdownSignal(), time.Duration(shutdownTimeout)*time.Second)
+}
+
+// 注册退出信号,之后收到的SIGTERM或SIGINT从返回的channel读出
+func shutdownSignal() chan os.Signal {
+	sigChan := make(chan os.Signal, 1)
+	signal.Notify(sigChan, syscall.SIGTERM, syscall.SIGINT)
+	return sigChan
+}
+
+// 收到退出信号后优雅退出
+func (this *GooseSearch) waitShutdown(sigChan chan os.Signal, timeout time.Duration) error {
+	sig := <-sigChan
+	signal.Stop(sigChan)
+	log.Info("receive signal [%s], shutdown in [%s]", sig, timeout)
+
+	return this.shutdown(timeout)
+}
+
+// 优雅退出:停止接受新连接和新请求,等待正在处理的请求完成,
+// 最后把动态索引同步到磁盘并关闭数据库.
+// 超时后还有请求没有完成的时候只同步数据,不关闭mmap文件,避免请求访问已经unmap的内存.
+func (this *GooseSearch) shutdown(timeout time.Duration) error {
+	deadline := time.Now().Add(timeout)
+	atomic.StoreInt32(&this.shutting, 1)
+
+	for _, l := range this.listeners {
+		l.Close()
+	}
+
+	// 打断空闲连接的阻塞读取,正在处理请求的连接处理完当前请求后退出
+	this.connLock.Lock()
+	for conn, _ := range this.conns {
+		conn.SetReadDeadline(time.Now())
+	}
+	this.connLock.Unlock()
+
+	if this.httpSvr != nil {
+		ctx, cancel := context.WithDeadline(context.Background(), deadline)
+		err := this.httpSvr.server.Shutdown(ctx)
+		cancel()
+		if err != nil {
+			log.Warn("HttpServer shutdown : %s", err.Error())
+		}
+	}
+
+	// 等待TCP服务正在处理的请求
+	for atomic.LoadInt64(&this.inflight) > 0 && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+	drained := atomic.LoadInt64(&this.inflight) == 0
+
+	// 停止定时同步
+	close(this.quit)
+	this.background.Wait()
+
+	err := this.dbs.ForceSync()
+	if err != nil {
+		log.Error("final sync fail : %s", err)
+	}
+
+	if !drained {
+		return log.Error("shutdown timeout, [%d] requests unfinished, db not closed",
+			atomic.LoadInt64(&this.inflight))
+	}
+
+	closeErr := this.dbs.Close()
+	if closeErr != nil {
+		log.Error("close db fail : %s", closeErr)
+		if err == nil {
+			err = closeErr
+		}
+	}
+	log.Info("GooseSearch shutdown finish")
+	return err
+}
+
+// 开始处理一个请求,正在退出的时候返回false,不能处理这个请求.
+// 返回true的时候处理完需要调用endRequest
+func (this *GooseSearch) beginRequest() bool {
+	// 先计数再检查退出标记,shutdown先设置退出标记再等待计数归0,
+	// 保证shutdown不会漏掉已经开始的请求
+	atomic.AddInt64(&this.inflight, 1)
+	if atomic.LoadInt32(&this.shutting) != 0 {
+		atomic.AddInt64(&this.inflight, -1)
+		return false
+	}
+	return true
+}
+
+func (this *GooseSearch) endRequest() {
+	atomic.AddInt64(&this.inflight, -1)
+}
+
+func (this *GooseSearch) isShutting() bool {
+	return atomic.LoadInt32(&this.shutting) != 0
+}
+
+// 记录或移除一个TCP连接.正在退出时不再接受新连接,返回false
+func (this *GooseSearch) trackConn(conn net.Conn, add bool) bool {
+	this.connLock.Lock()
+	defer this.connLock.Unlock()
+	if !add {
+		delete(this.conns, conn)
+		return true
+	}
+	if this.isShutting() {
+		return false
+	}
+	this.conns[conn] = true
+	return true
+}
+
+// 设置帧协议连接等待下一个请求的超时时间.正在退出时返回false,连接应该关闭.
+// 跟shutdown打断空闲连接的操作在同一个锁里,不会覆盖shutdown设置的超时
+func (this *GooseSearch) armReadDeadline(conn net.Conn) bool {
+	this.connLock.Lock()
+	defer this.connLock.Unlock()
+	if this.isShutting() {
+		return false
+	}
+	conn.SetReadDeadline(time.Now().Add(connIdleTimeout))
+	return true
+}
+
+// 监听循环,listener关闭后退出
+func (this *GooseSearch) acceptLoop(name string, listener net.Listener,
+	serve func(conn net.Conn)) {
+
+	for {
+		conn, err := listener.Accept()
+		if err != nil {
+			if this.isShutting() {
+				return
+			}
+			log.Warn("%s accept fail : %s", name, err.Error())
+			continue
+		}
+		if !this.trackConn(conn, true) {
+			conn.Close()
+			continue
+		}
+		go func() {
+			defer this.trackConn(conn, false)
+			serve(conn)
+		}()
+	}
 }
 
 func (this *GooseSearch) runSearchServer(routineNum int, listenPort int,
@@ -87,60 +298,143 @@ func (this *GooseSearch) runSearchServer(routineNum int, listenPort int,
 		return err
 	}
 
+	// 检索资源池,连接可以有很多,同时进行的检索最多routineNum个
+	slots := make(chan *searchSlot, routineNum)
 	for i := 0; i < routineNum; i++ {
-		go func() {
-			reqbuf := make([]byte, requestBufSize)
-			resbuf := make([]byte, responseBufSize)
-			context := NewStyContext()
-
-			for {
-
-				var reqlen int
-				var reslen int
-				var t1, t2 int64
-				// clear buf
-				context.Clear()
-
-				conn, err := listener.Accept()
-				if err != nil {
-					log.Warn("SearchServer accept fail : %s", err.Error())
-					goto LabelError
-				}
-				context.Log.Info("IP", conn.RemoteAddr().String())
-				// receive data
-				reqlen, err = conn.Read(reqbuf)
-				if err != nil {
-					log.Warn("SearchServer read fail : %s receive len[%d]", err.Error(), reqlen)
-					goto LabelError
-				}
-				context.Log.Info("reqlen", reqlen)
-
-				// do search
-				t1 = time.Now().UnixNano()
-				reslen, err = this.searcher.Search(context, reqbuf, resbuf)
-				t2 = time.Now().UnixNano()
-				if err != nil {
-					log.Warn("SearchServer Search fail : %s", err.Error())
-					goto LabelError
-				}
-				context.Log.Info("time(ms)", Ns2Ms(t2-t1))
-
-				// write data
-				_, err = conn.Write(resbuf[:reslen])
-				if err != nil {
-					log.Warn("SearchServer conn write fail : %s", err.Error())
-					goto LabelError
-				}
-
-			LabelError:
-				conn.Close()
-				context.Log.PrintAllInfo()
-			}
-		}()
+		slots <- &searchSlot{
+			reqbuf:  make([]byte, requestBufSize),
+			resbuf:  make([]byte, responseBufSize),
+			context: NewStyContext()}
 	}
+
+	this.listeners = append(this.listeners, listener)
+	go this.acceptLoop("SearchServer", listener, func(conn net.Conn) {
+		this.serveSearchConn(conn, slots, requestBufSize)
+	})
 	return nil
 }
 
+// 检索复用的资源,同一时间只被一个请求使用
+type searchSlot struct {
+	reqbuf  []byte // 只有旧协议使用
+	resbuf  []byte
+	context *StyContext
+}
+
+// 处理一个检索连接.帧协议的连接可以连续处理多个请求,旧协议的连接处理一个请求后关闭.
+func (this *GooseSearch) serveSearchConn(conn net.Conn, slots chan *searchSlot,
+	requestBufSize int) {
+
+	defer conn.Close()
+	reader := protocol.NewConnReader(conn, requestBufSize)
+
+	framed, err := protocol.IsFramed(reader)
+	if err != nil {
+		return
+	}
+	if !framed {
+		// 旧协议,一次读取就是整个请求
+		slot := <-slots
+		defer func() {
+			slots <- slot
+		}()
+
+		slot.context.Clear()
+		slot.context.Log.Info("IP", conn.RemoteAddr().String())
+		reqlen, err := reader.Read(slot.reqbuf)
+		if err != nil {
+			log.Warn("SearchServer read fail : %s receive len[%d]", err.Error(), reqlen)
+			return
+		}
+		if !this.beginRequest() {
+			return
+		}
+		defer this.endRequest()
+		slot.context.Log.Info("reqlen", reqlen)
+
+		reslen, err := this.doSearch(slot, slot.reqbuf)
+		if err == nil {
+			_, err = conn.Write(slot.resbuf[:reslen])
+			if err != nil {
+				log.Warn("SearchServer conn write fail : %s", err.Error())
+			}
+		}
+		slot.context.Log.PrintAllInfo()
+		return
+	}
+
+	reqbuf := make([]byte, requestBufSize)
+	writer := bufio.NewWriter(conn)
+	for {
+		// 客户端发完请求后,等待响应全部写出再阻塞读取下一个请求
+		if reader.Buffered() == 0 {
+			err = writer.Flush()
+			if err != nil {
+				log.Warn("SearchServer conn write fail : %s", err.Error())
+				return
+			}
+		}
+
+		if !this.armReadDeadline(conn) {
+			writer.Flush()
+			return
+		}
+		h, payload, err := protocol.ReadFrame(reader, reqbuf)
+		if err != nil {
+			if tooLarge, ok := err.(*protocol.ErrFrameTooLarge); ok {
+				protocol.WriteError(writer, http.StatusRequestEntityTooLarge, tooLarge.Error())
+				continue
+			}
+			if err != io.EOF {
+				log.Warn("SearchServer read frame fail : %s", err.Error())
+			}
+			writer.Flush()
+			return
+		}
+		if h.Type != protocol.TypeSearch {
+			protocol.WriteError(writer, http.StatusBadRequest,
+				fmt.Sprintf("unknown request type [%d]", h.Type))
+			continue
+		}
+		if !this.beginRequest() {
+			protocol.WriteError(writer, http.StatusServiceUnavailable, "server shutting down")
+			writer.Flush()
+			return
+		}
+
+		slot := <-slots
+		slot.context.Clear()
+		slot.context.Log.Info("IP", conn.RemoteAddr().String())
+		slot.context.Log.Info("reqlen", len(payload))
+		reslen, err := this.doSearch(slot, payload)
+		if err != nil {
+			protocol.WriteError(writer, styErrorStatus(err), err.Error())
+		} else {
+			protocol.WriteFrame(writer, protocol.TypeOK, slot.resbuf[:reslen])
+		}
+		slot.context.Log.PrintAllInfo()
+		slots <- slot
+		this.endRequest()
+	}
+}
+
+// 执行一次检索,结果写在slot.resbuf中
+func (this *GooseSearch) doSearch(slot *searchSlot, req []byte) (int, error) {
+	// 检索过程中引用当前版本的db,切换版本不影响正在进行的检索
+	v := this.dbs.Acquire()
+	defer this.dbs.Release(v)
+
+	t1 := time.Now().UnixNano()
+	reslen, err := v.searcher.Search(slot.context, req, slot.resbuf)
+	t2 := time.Now().UnixNano()
+	if err != nil {
+		log.Warn("SearchServer Search fail : %s", err.Error())
+		return 0, err
+	}
+	slot.context.Log.Info("time(ms)", Ns2Ms(t2-t1))
+	return reslen, nil
+}
+
 func (this *GooseSearch) runIndexServer(listenPort int, requestBufSize int) error {
 
 	if 0 == listenPort || 0 == requestBufSize {
@@ -148,7 +442,7 @@ func (this *GooseSearch) runIndexServer(listenPort int, requestBufSize int) erro
 			listenPort, requestBufSize)
 	}
 
-	if this.varIndexer == nil {
+	if !this.dbs.CanIndex() {
 		return nil
 	}
 
@@ -158,38 +452,139 @@ func (this *GooseSearch) runIndexServer(listenPort int, requestBufSize int) erro
 		return err
 	}
 
-	// 简单一个协程完成接受请求和完成处理.索引更新不要求高并发性.
-	go func() {
-		reqbuf := make([]byte, requestBufSize)
-		for {
-			var reqlen int
+	// 索引更新不要求高并发性,VarIndexer内部加锁,多个连接的请求逐个处理
+	this.listeners = append(this.listeners, listener)
+	go this.acceptLoop("IndexServer", listener, func(conn net.Conn) {
+		this.serveIndexConn(conn, requestBufSize)
+	})
 
-			conn, err := listener.Accept()
-			if err != nil {
-				log.Warn("IndexServer accept fail : %s", err.Error())
-				goto LabelError
-			}
+	return nil
+}
+
+// 处理一个索引连接.帧协议的连接可以连续处理多个请求,旧协议的连接处理一个请求后关闭.
+func (this *GooseSearch) serveIndexConn(conn net.Conn, requestBufSize int) {
+	defer conn.Close()
+	reader := protocol.NewConnReader(conn, requestBufSize)
+	reqbuf := make([]byte, requestBufSize)
 
-			// receive data
-			reqlen, err = conn.Read(reqbuf)
+	framed, err := protocol.IsFramed(reader)
+	if err != nil {
+		return
+	}
+	if !framed {
+		// 旧协议,一次读取就是整个请求,以删除命令前缀区分删除请求
+		reqlen, err := reader.Read(reqbuf)
+		if err != nil {
+			log.Warn("IndexSearcher read fail : %s", err.Error())
+			return
+		}
+		if !this.beginRequest() {
+			return
+		}
+		defer this.endRequest()
+		if strings.HasPrefix(string(reqbuf[:reqlen]), indexDeleteCmdPrefix) {
+			this.doDelete(reqbuf[len(indexDeleteCmdPrefix):reqlen])
+		} else {
+			this.doIndex(reqbuf[:reqlen])
+		}
+		return
+	}
+
+	writer := bufio.NewWriter(conn)
+	for {
+		if reader.Buffered() == 0 {
+			err = writer.Flush()
 			if err != nil {
-				log.Warn("IndexSearcher read fail : %s", err.Error())
-				goto LabelError
+				log.Warn("IndexServer conn write fail : %s", err.Error())
+				return
 			}
+		}
 
-			// index
-			err = this.varIndexer.BuildIndex(NewBufferIterOnce(reqbuf[:reqlen]))
-			if err != nil {
-				log.Warn("IndexSearcher BuildIndex fail : %s", err.Error())
-				goto LabelError
+		if !this.armReadDeadline(conn) {
+			writer.Flush()
+			return
+		}
+		h, payload, err := protocol.ReadFrame(reader, reqbuf)
+		if err != nil {
+			if tooLarge, ok := err.(*protocol.ErrFrameTooLarge); ok {
+				protocol.WriteError(writer, http.StatusRequestEntityTooLarge, tooLarge.Error())
+				continue
 			}
+			if err != io.EOF {
+				log.Warn("IndexServer read frame fail : %s", err.Error())
+			}
+			writer.Flush()
+			return
+		}
 
-		LabelError:
-			conn.Close()
+		if !this.beginRequest() {
+			protocol.WriteError(writer, http.StatusServiceUnavailable, "server shutting down")
+			writer.Flush()
+			return
 		}
-	}()
+		switch h.Type {
+		case protocol.TypeIndex:
+			err = this.doIndex(payload)
+		case protocol.TypeDelete:
+			err = this.doDelete(payload)
+		default:
+			err = NewStyError(http.StatusBadRequest, "unknown request type [%d]", h.Type)
+		}
+		this.endRequest()
+		if err != nil {
+			protocol.WriteError(writer, styErrorStatus(err), err.Error())
+		} else {
+			protocol.WriteFrame(writer, protocol.TypeOK, nil)
+		}
+	}
+}
 
-	return nil
+// 动态插入一个doc
+func (this *GooseSearch) doIndex(doc []byte) error {
+	err := this.dbs.Index(doc)
+	if err != nil {
+		log.Warn("IndexSearcher BuildIndex fail : %s", err.Error())
+	}
+	return err
+}
+
+// 删除doc,cmd是空白分隔的外部id列表
+func (this *GooseSearch) doDelete(cmd []byte) error {
+	outIdList, err := parseDeleteCmd(cmd)
+	if err != nil {
+		log.Warn("IndexSearcher parse delete cmd fail : %s", err.Error())
+		return NewStyError(http.StatusBadRequest, "%s", err.Error())
+	}
+	err = this.dbs.Delete(outIdList)
+	if err != nil {
+		log.Warn("IndexSearcher DeleteDoc fail : %s", err.Error())
+	}
+	return err
+}
+
+// 策略返回StyError的使用其中的状态码,其它错误都是500
+func styErrorStatus(err error) int {
+	if styErr, ok := err.(*StyError); ok && styErr.Status > 0 {
+		return styErr.Status
+	}
+	return http.StatusInternalServerError
+}
+
+// 解析删除命令中的外部id列表,id之间用空白分隔
+func parseDeleteCmd(buf []byte) ([]OutIdType, error) {
+	fields := strings.Fields(string(buf))
+	if len(fields) == 0 {
+		return nil, log.Warn("no outId in delete cmd")
+	}
+	outIdList := make([]OutIdType, 0, len(fields))
+	for _, f := range fields {
+		id, err := strconv.ParseUint(f, 10, 32)
+		if err != nil {
+			return nil, err
+		}
+		outIdList = append(outIdList, OutIdType(id))
+	}
+	return outIdList, nil
 }
 
 func (this *GooseSearch) runRefreshServer(sleeptime int) error {
@@ -198,13 +593,19 @@ func (this *GooseSearch) runRefreshServer(sleeptime int) error {
 		return log.Error("arg error sleeptime[%d]", sleeptime)
 	}
 
+	this.background.Add(1)
 	go func() {
+		defer this.background.Done()
 		for {
-			time.Sleep(time.Duration(sleeptime) * time.Second)
+			select {
+			case <-this.quit:
+				return
+			case <-time.After(time.Duration(sleeptime) * time.Second):
+			}
 			log.Debug("refresh now")
 
 			// sync search db
-			err := this.searchDB.Sync()
+			err := this.dbs.Sync()
 			if err != nil {
 				log.Warn(err)
 			}
@@ -214,6 +615,48 @@ func (this *GooseSearch) runRefreshServer(sleeptime int) error {
 	return nil
 }
 
+// 定时检查是否有新建的db版本,有的话切换到新版本
+func (this *GooseSearch) runWatchServer(interval int) {
+	this.background.Add(1)
+	go func() {
+		defer this.background.Done()
+		for {
+			select {
+			case <-this.quit:
+				return
+			case <-time.After(time.Duration(interval) * time.Second):
+			}
+
+			switched, err := this.dbs.CheckNewVersion()
+			if err != nil {
+				log.Warn("switch db fail : %s", err)
+			} else if switched {
+				log.Info("switch db succ")
+			}
+		}
+	}()
+}
+
+// 定时把动态索引合并进静态索引,避免动态索引无限增长
+func (this *GooseSearch) runFoldServer(interval int) {
+	this.background.Add(1)
+	go func() {
+		defer this.background.Done()
+		for {
+			select {
+			case <-this.quit:
+				return
+			case <-time.After(time.Duration(interval) * time.Second):
+			}
+
+			err := this.dbs.FoldVarIndex()
+			if err != nil {
+				log.Warn("fold var index fail : %s", err)
+			}
+		}
+	}()
+}
+
 func (this *GooseSearch) Init(confPath string,
 	indexSty IndexStrategy, searchSty SearchStrategy) (err error) {
 
@@ -237,17 +680,6 @@ func (this *GooseSearch) Init(confPath string,
 	runtime.GOMAXPROCS(maxProcs)
 	log.Debug("set max procs [%d]", maxProcs)
 
-	// init dbsearcher
-	dbPath := this.conf.String("GooseBuild.DataBase.DbPath")
-	log.Debug("init db [%s]", dbPath)
-
-	this.searchDB = NewDBSearcher()
-	err = this.searchDB.Init(dbPath)
-	if err != nil {
-		return
-	}
-	log.Debug("init db [%s]", dbPath)
-
 	// index strategy global init
 	if indexSty != nil {
 		err = indexSty.Init(this.conf)
@@ -266,31 +698,44 @@ func (this *GooseSearch) Init(confPath string,
 	}
 	log.Debug("search strategy init finish")
 
-	// var indexer
-	if indexSty != nil {
-		this.varIndexer, err = NewVarIndexer(this.searchDB, indexSty)
-		if err != nil {
-			return
-		}
-	}
-	log.Debug("VarIndexer init finish")
-
-	// searcher
-	if searchSty != nil {
-		this.searcher, err = NewSearcher(this.searchDB, searchSty)
-		if err != nil {
-			return
-		}
+	// 打开最新版本的db,同时初始化检索流程和动态索引生成器.
+	// 开启版本检查的时候记录动态索引请求,切换版本时重放
+	dbPath := this.conf.String("GooseBuild.DataBase.DbPath")
+	dbWatchInterval := config.Int64Default(this.conf, "GooseSearch.DbWatch.Interval", 0)
+	indexCacheSize := config.Int64Default(this.conf, "GooseSearch.IndexCache.Size",
+		DefaultIndexCacheSize)
+	// 检索结果缓存,默认不开启
+	resultCacheSize := config.Int64Default(this.conf, "GooseSearch.ResultCache.Size", 0)
+	resultCacheTTL := config.Int64Default(this.conf, "GooseSearch.ResultCache.TTL",
+		defaultResultCacheTTL)
+	log.Debug("init db [%s] dbWatchInterval[%d] indexCacheSize[%d] resultCacheSize[%d] "+
+		"resultCacheTTL[%d]", dbPath, dbWatchInterval, indexCacheSize, resultCacheSize,
+		resultCacheTTL)
+
+	opts := dbSwitcherOptions{}
+	opts.enableSwitch = dbWatchInterval > 0
+	opts.indexCacheSize = int(indexCacheSize)
+	opts.resultCacheSize = int(resultCacheSize)
+	opts.resultCacheTTL = time.Duration(resultCacheTTL) * time.Second
+
+	// 单个检索按InId范围并行归并,默认不并行
+	opts.shardNum = int(config.Int64Default(this.conf, "GooseSearch.Search.ShardNum", 1))
+	opts.shardMinPostings = int(config.Int64Default(this.conf,
+		"GooseSearch.Search.ShardMinPostings", defaultShardMinPostings))
+	log.Debug("shardNum[%d] shardMinPostings[%d]", opts.shardNum, opts.shardMinPostings)
+	this.dbs, err = newDBSwitcher(dbPath, indexSty, searchSty, opts)
+	if err != nil {
+		return
 	}
-	log.Debug("Searcher init finish")
+	log.Debug("init db [%s] finish", dbPath)
 
 	return
 }
 
 func NewGooseSearch() *GooseSearch {
 	s := GooseSearch{}
-	s.searchDB = nil
-	s.searcher = nil
-	s.varIndexer = nil
+	s.dbs = nil
+	s.conns = make(map[net.Conn]bool)
+	s.quit = make(chan bool)
 	return &s
 }
@@ -0,0 +1,282 @@
+package goose
+
+import (
+	"fmt"
+	"github.com/getwe/goose/client"
+	. "github.com/getwe/goose/database"
+	. "github.com/getwe/goose/utils"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"syscall"
+	"testing"
+	"time"
+)
+
+// 找一个空闲的本地端口
+func freePort(t *testing.T) int {
+	l, err := net.Listen("tcp", "localhost:0")
+	if err != nil {
+		t.Fatalf("Listen --- %s", err)
+	}
+	defer l.Close()
+	return l.Addr().(*net.TCPAddr).Port
+}
+
+// 在dbPath建一个包含doc 1,2(term 10)的版本,启动检索服务和索引服务
+func startTestGooseSearch(t *testing.T, dbPath string, indexSty IndexStrategy) (s *GooseSearch,
+	searchPort int, indexPort int) {
+
+	os.RemoveAll(dbPath)
+	os.MkdirAll(dbPath, 0755)
+	buildTestVersion(t, dbPath,
+		DBVersionStatus{Version: "db.20140101000000", BuildTime: time.Now().Unix()},
+		map[int]int{1: 10, 2: 10})
+
+	dbs, err := newDBSwitcher(dbPath, indexSty, httpTestSty{},
+		dbSwitcherOptions{indexCacheSize: DefaultIndexCacheSize})
+	if err != nil {
+		t.Fatalf("newDBSwitcher --- %s", err)
+	}
+
+	s = NewGooseSearch()
+	s.dbs = dbs
+	searchPort = freePort(t)
+	if err = s.runSearchServer(2, searchPort, 64, 64); err != nil {
+		t.Fatalf("runSearchServer --- %s", err)
+	}
+	indexPort = freePort(t)
+	if err = s.runIndexServer(indexPort, 64); err != nil {
+		t.Fatalf("runIndexServer --- %s", err)
+	}
+	return s, searchPort, indexPort
+}
+
+func dialTestGooseSearch(t *testing.T, port int) *client.Client {
+	c, err := client.Dial(fmt.Sprintf("localhost:%d", port), time.Second)
+	if err != nil {
+		t.Fatalf("Dial --- %s", err)
+	}
+	return c
+}
+
+func TestGooseSearchClient(t *testing.T) {
+	dbPath := filepath.Join(os.Getenv("HOME"), "tmp", "goosedb", "test_goosesearch_client")
+	s, searchPort, indexPort := startTestGooseSearch(t, dbPath, httpTestSty{})
+	defer s.shutdown(time.Second)
+
+	sc := dialTestGooseSearch(t, searchPort)
+	defer sc.Close()
+	ic := dialTestGooseSearch(t, indexPort)
+	defer ic.Close()
+
+	// 一个连接上连续发送的检索按顺序返回,策略的StyError转换成ServerError
+	res := sc.SearchBatch([][]byte{[]byte("10"), []byte("x"), []byte("20")})
+	if res[0].Err != nil || string(res[0].Payload) != "2" {
+		t.Errorf("search 10 [%s] err[%v]", res[0].Payload, res[0].Err)
+	}
+	if serr, ok := res[1].Err.(*client.ServerError); !ok || serr.Status != http.StatusBadRequest {
+		t.Errorf("search x err[%v]", res[1].Err)
+	}
+	if res[2].Err != nil || string(res[2].Payload) != "0" {
+		t.Errorf("search 20 [%s] err[%v]", res[2].Payload, res[2].Err)
+	}
+
+	if err := ic.Index([]byte("3 10")); err != nil {
+		t.Fatalf("Index --- %s", err)
+	}
+	err := ic.Index([]byte("bad"))
+	if serr, ok := err.(*client.ServerError); !ok || serr.Status != http.StatusUnprocessableEntity {
+		t.Errorf("Index bad err[%v]", err)
+	}
+	// 不存在的id返回404,存在的id依然删除
+	err = ic.Delete([]OutIdType{1, 99})
+	if serr, ok := err.(*client.ServerError); !ok || serr.Status != http.StatusNotFound {
+		t.Errorf("Delete err[%v]", err)
+	}
+	if res, err := sc.Search([]byte("10")); err != nil || string(res) != "2" {
+		t.Errorf("search 10 after index [%s] err[%v]", res, err)
+	}
+
+	// 响应超过客户端限制
+	sc.SetMaxResponseSize(0)
+	if _, err := sc.Search([]byte("10")); err == nil {
+		t.Errorf("search with max response size 0 without error")
+	}
+}
+
+// doc以"slow "开头时,ParseDoc通知started之后等待release,用来模拟正在处理的请求
+type slowTestSty struct {
+	httpTestSty
+	started chan bool
+	release chan bool
+}
+
+func (this slowTestSty) ParseDoc(doc interface{}, context *StyContext) (OutIdType,
+	[]TermInDoc, Value, Data, error) {
+
+	buf := doc.([]byte)
+	if strings.HasPrefix(string(buf), "slow ") {
+		this.started <- true
+		<-this.release
+		buf = buf[len("slow "):]
+	}
+	return this.httpTestSty.ParseDoc(buf, context)
+}
+
+func newSlowTestSty() slowTestSty {
+	return slowTestSty{started: make(chan bool, 1), release: make(chan bool)}
+}
+
+// 动态索引日志只剩文件头,说明内存索引已经同步到磁盘
+func checkWalReset(t *testing.T, dbPath string) {
+	files, _ := filepath.Glob(filepath.Join(dbPath, "db.*", "var.wal"))
+	if len(files) != 1 {
+		t.Fatalf("wal files %v", files)
+	}
+	st, err := os.Stat(files[0])
+	if err != nil || st.Size() != 8 {
+		t.Fatalf("wal [%s] not reset after shutdown", files[0])
+	}
+	// 删掉日志,重新打开只能从磁盘索引读到动态写入的doc
+	os.Remove(files[0])
+}
+
+func countTestHit(t *testing.T, dbPath string, term TermSign) int {
+	dbs, err := newDBSwitcher(dbPath, httpTestSty{}, nil,
+		dbSwitcherOptions{indexCacheSize: DefaultIndexCacheSize})
+	if err != nil {
+		t.Fatalf("newDBSwitcher --- %s", err)
+	}
+	defer dbs.Close()
+	v := dbs.Acquire()
+	defer dbs.Release(v)
+	return countHit(t, v, term)
+}
+
+func TestGooseSearchShutdown(t *testing.T) {
+	dbPath := filepath.Join(os.Getenv("HOME"), "tmp", "goosedb", "test_goosesearch_shutdown")
+	sty := newSlowTestSty()
+	s, searchPort, indexPort := startTestGooseSearch(t, dbPath, sty)
+
+	ic := dialTestGooseSearch(t, indexPort)
+	defer ic.Close()
+	if err := ic.Index([]byte("3 10")); err != nil {
+		t.Fatalf("Index --- %s", err)
+	}
+
+	// 一个正在处理的请求
+	slowDone := make(chan error, 1)
+	go func() {
+		c, err := client.Dial(fmt.Sprintf("localhost:%d", indexPort), 10*time.Second)
+		if err != nil {
+			slowDone <- err
+			return
+		}
+		defer c.Close()
+		slowDone <- c.Index([]byte("slow 4 10"))
+	}()
+	select {
+	case <-sty.started:
+	case err := <-slowDone:
+		t.Fatalf("slow request finish before started : %v", err)
+	}
+
+	sigChan := shutdownSignal()
+	done := make(chan error, 1)
+	go func() {
+		done <- s.waitShutdown(sigChan, 5*time.Second)
+	}()
+	syscall.Kill(os.Getpid(), syscall.SIGTERM)
+
+	// 收到信号后不再接受新连接,但是要等正在处理的请求完成
+	for i := 0; i < 100 && !s.isShutting(); i++ {
+		time.Sleep(10 * time.Millisecond)
+	}
+	if !s.isShutting() {
+		t.Fatalf("no shutdown after signal")
+	}
+	time.Sleep(100 * time.Millisecond)
+	if conn, err := net.Dial("tcp", fmt.Sprintf("localhost:%d", searchPort)); err == nil {
+		conn.Close()
+		t.Errorf("accept new connection while shutting down")
+	}
+	select {
+	case err := <-done:
+		t.Fatalf("shutdown before request finish : %v", err)
+	default:
+	}
+
+	sty.release <- true
+	if err := <-slowDone; err != nil {
+		t.Errorf("in-flight request fail : %s", err)
+	}
+	select {
+	case err := <-done:
+		if err != nil {
+			t.Fatalf("shutdown --- %s", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatalf("shutdown not finish")
+	}
+
+	// 退出前的同步把内存索引写入磁盘,包括等待完成的请求
+	checkWalReset(t, dbPath)
+	if cnt := countTestHit(t, dbPath, 10); cnt != 4 {
+		t.Errorf("term 10 hit [%d] after reopen", cnt)
+	}
+}
+
+func TestGooseSearchShutdownTimeout(t *testing.T) {
+	dbPath := filepath.Join(os.Getenv("HOME"), "tmp", "goosedb", "test_goosesearch_timeout")
+	sty := newSlowTestSty()
+	s, _, indexPort := startTestGooseSearch(t, dbPath, sty)
+
+	ic := dialTestGooseSearch(t, indexPort)
+	defer ic.Close()
+	if err := ic.Index([]byte("3 10")); err != nil {
+		t.Fatalf("Index --- %s", err)
+	}
+
+	slowDone := make(chan error, 1)
+	go func() {
+		c, err := client.Dial(fmt.Sprintf("localhost:%d", indexPort), 10*time.Second)
+		if err != nil {
+			slowDone <- err
+			return
+		}
+		defer c.Close()
+		slowDone <- c.Index([]byte("slow 4 10"))
+	}()
+	select {
+	case <-sty.started:
+	case err := <-slowDone:
+		t.Fatalf("slow request finish before started : %v", err)
+	}
+
+	// 超时还有请求没有完成,只同步数据,不关闭数据库
+	begin := time.Now()
+	err := s.shutdown(200 * time.Millisecond)
+	if err == nil {
+		t.Errorf("shutdown with unfinished request without error")
+	}
+	if cost := time.Since(begin); cost < 200*time.Millisecond || cost > 2*time.Second {
+		t.Errorf("shutdown cost [%s]", cost)
+	}
+	checkWalReset(t, dbPath)
+
+	// 数据库没有关闭,请求依然可以完成
+	sty.release <- true
+	if err := <-slowDone; err != nil {
+		t.Errorf("in-flight request fail after timeout : %s", err)
+	}
+	s.dbs.Close()
+
+	if cnt := countTestHit(t, dbPath, 10); cnt < 3 {
+		t.Errorf("term 10 hit [%d] after reopen", cnt)
+	}
+}
+
+/* vim: set expandtab ts=4 sw=4 sts=4 tw=100: */
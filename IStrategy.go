@@ -1,6 +1,7 @@
 package goose
 
 import (
+	"fmt"
 	"github.com/getwe/goose/config"
 	. "github.com/getwe/goose/database"
 	log "github.com/getwe/goose/log"
@@ -34,6 +35,22 @@ func (this *StyContext) Clear() {
 	this.Log = log.NewGooseLogger()
 }
 
+// 策略可以返回的带状态码的错误.
+// 比如请求格式错误可以返回NewStyError(http.StatusBadRequest,...),
+// HTTP服务会用Status作为返回的状态码;其它错误一律当作服务内部错误.
+type StyError struct {
+	Status int
+	Msg    string
+}
+
+func (this *StyError) Error() string {
+	return this.Msg
+}
+
+func NewStyError(status int, format string, a ...interface{}) *StyError {
+	return &StyError{Status: status, Msg: fmt.Sprintf(format, a...)}
+}
+
 // 建索引策略.
 // 框架会调用一次Init接口进行初始化,建索引的时候会N个goroutine调用ParseDoc
 type IndexStrategy interface {
@@ -89,4 +106,51 @@ type SearchStrategy interface {
 		context *StyContext) (reslen int, err error)
 }
 
+// TopK检索策略,可选实现.
+// SearchStrategy同时实现了这个接口,Searcher会先调用TopK,返回K>0的检索只保留得分
+// 最高的K个结果,利用term得分上界提前剪枝(MaxScore),不再对全部命中的doc打分.
+// 这时候传给Response的结果已经按SearchResultList的顺序排好序.
+type TopKSearchStrategy interface {
+	// 本次检索需要的结果数量,返回K<=0表示不使用TopK模式
+	TopK(queryInfo interface{}, context *StyContext) int
+
+	// 计算每个term对doc得分贡献的上界
+	// termInQuery   : 所有term在query中的打分
+	// termMaxWeight : 每个term拉链中最大的TermInDoc.Weight,拉链为空的是0
+	// 返回每个term的上界,长度必须跟termInQuery一致.
+	// @NOTE 策略需要保证CalWeight的得分不超过doc命中的全部term的上界之和,
+	// 否则TopK结果不准确
+	TermUpperBound(queryInfo interface{}, termInQuery []TermInQuery,
+		termMaxWeight []TermWeight, context *StyContext) ([]TermWeight, error)
+}
+
+// 查询树检索策略,可选实现.
+// SearchStrategy同时实现了这个接口,Searcher调用ParseQueryTree代替ParseQuery,
+// 可以表达任意嵌套的AND/OR/NOT/至少命中N个.
+// 返回的query不为nil时,使用查询树检索,CalWeight的termInQuery是query.TermList()的结果;
+// query为nil时,使用termList按原来的扁平方式检索.查询树检索不支持TopK模式.
+type QueryTreeSearchStrategy interface {
+	ParseQueryTree(request []byte, context *StyContext) (query *QueryNode,
+		termList []TermInQuery, queryInfo interface{}, err error)
+}
+
+// 位置检索策略,可选实现.
+// SearchStrategy同时实现了这个接口,Searcher把拉链中每个归并得到的doc的term位置信息
+// 填写在传给CalWeight的TermInDoc.Pos中,并且丢弃不满足位置约束的doc.
+// 使用位置检索时不使用TopK模式;查询树检索不读取位置信息.
+type ProximitySearchStrategy interface {
+	// 本次检索的短语/邻近约束,返回空列表表示只需要位置信息打分,不做过滤
+	ParseProximity(queryInfo interface{}, termInQuery []TermInQuery,
+		context *StyContext) ([]ProximityInQuery, error)
+}
+
+// 检索结果缓存策略,可选实现.
+// 开启结果缓存时,SearchStrategy同时实现了这个接口才会缓存,使用CacheKey作为缓存的key.
+// key相同的检索必须得到相同的打分结果(Response之前的结果),打分或者过滤依赖queryInfo的话,
+// key必须包含queryInfo中的相关内容.返回空串表示本次检索不缓存.
+// 没有实现这个接口的策略不缓存.
+type CacheSearchStrategy interface {
+	CacheKey(queryInfo interface{}, termInQuery []TermInQuery, context *StyContext) string
+}
+
 /* vim: set expandtab ts=4 sw=4 sts=4 tw=100: */
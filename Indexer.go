@@ -4,8 +4,11 @@ import (
 	. "github.com/getwe/goose/database"
 	log "github.com/getwe/goose/log"
 	. "github.com/getwe/goose/utils"
+	"net/http"
 	"runtime"
 	"sync"
+	"sync/atomic"
+	"time"
 )
 
 type DocIterator interface {
@@ -13,12 +16,61 @@ type DocIterator interface {
 	NextDoc() interface{}
 }
 
+// 待解析的doc,seq是这一次BuildIndex中的输入顺序
+type docToParse struct {
+	seq uint64
+	doc interface{}
+}
+
 // 原始数据经过策略ParseDoc的产物
 type docParsed struct {
 	outId    OutIdType
 	termList []TermInDoc
 	value    Value
 	data     Data
+
+	// 原始doc,写入失败时记录
+	doc interface{}
+	seq uint64
+	// 解析失败,已经计数,不写入
+	failed bool
+}
+
+// StaticIndexer的doc计数,包括各个阶段失败的doc数量
+type StaticIndexerStatus struct {
+	// 读取的doc数量
+	DocCount int64
+	// 完成解析的doc数量,包括解析失败的
+	ParseCount int64
+	// 成功写入的doc数量
+	WriteCount int64
+
+	// 数据文件格式错误
+	FormatError int64
+	// IndexStrategy.ParseDoc失败
+	ParseError int64
+	// 分配内部id失败
+	AllocIdError int64
+	// 写入索引,value,data失败
+	WriteIndexError int64
+	WriteValueError int64
+	WriteDataError  int64
+	// 提交内部id失败
+	CommitError int64
+}
+
+// 全部阶段失败的doc数量
+func (this StaticIndexerStatus) ErrorCount() int64 {
+	return this.FormatError + this.ParseError + this.AllocIdError + this.WriteIndexError +
+		this.WriteValueError + this.WriteDataError + this.CommitError
+}
+
+// 失败的doc占读取的doc的比例
+func (this StaticIndexerStatus) ErrorRatio() float64 {
+	if this.DocCount == 0 {
+		return 0
+	}
+	return float64(this.ErrorCount()) / float64(this.DocCount)
 }
 
 // 静态索引生成类.
@@ -34,7 +86,7 @@ type StaticIndexer struct {
 	// 利用chan控制IndexStrategy.ParseDoc的并发数量
 	parseDocRoutineNum int
 	// 控制用的chan
-	parseDocChan chan interface{}
+	parseDocChan chan docToParse
 
 	// ParseDoc后待写入db的队列长度
 	writeDbQueueNum int
@@ -42,6 +94,103 @@ type StaticIndexer struct {
 
 	// 等待全部doc完成解析并写入db的事件
 	finishedWg sync.WaitGroup
+
+	// doc计数,原子操作
+	status StaticIndexerStatus
+
+	// 失败的doc写入的文件,nil不记录
+	deadLetter *DeadLetterFile
+
+	// BuildIndex期间报告进度的周期和报告函数
+	progressInterval time.Duration
+	progressReport   func(StaticIndexerProgress)
+
+	// 按输入顺序写入db.orderWindow限制已经读取但是还没写入的doc数量,即重排缓冲的大小
+	ordered     bool
+	orderWindow chan bool
+}
+
+// 设置是否按输入顺序写入db.按顺序写入时同样的输入总是分配同样的内部id,
+// 建库结果可以重现,代价是一个解析慢的doc会阻塞之后的doc写入
+func (this *StaticIndexer) SetOrdered(ordered bool) {
+	this.ordered = ordered
+}
+
+// StaticIndexer的建库进度
+type StaticIndexerProgress struct {
+	// 累计的doc计数
+	Status StaticIndexerStatus
+	// 最近一个周期每秒解析和写入的doc数量
+	ParseRate float64
+	WriteRate float64
+}
+
+// 设置BuildIndex期间报告进度的周期,每个周期调用一次report,report为nil时打印日志.
+// interval为0不报告
+func (this *StaticIndexer) SetProgress(interval time.Duration,
+	report func(StaticIndexerProgress)) {
+	this.progressInterval = interval
+	this.progressReport = report
+}
+
+// 周期报告进度直到done关闭
+func (this *StaticIndexer) reportProgress(done chan bool, exited *sync.WaitGroup) {
+	defer exited.Done()
+
+	ticker := time.NewTicker(this.progressInterval)
+	defer ticker.Stop()
+
+	last := this.GetStatus()
+	lastTime := time.Now()
+	for {
+		select {
+		case <-done:
+			return
+		case now := <-ticker.C:
+			p := StaticIndexerProgress{Status: this.GetStatus()}
+			sec := now.Sub(lastTime).Seconds()
+			p.ParseRate = float64(p.Status.ParseCount-last.ParseCount) / sec
+			p.WriteRate = float64(p.Status.WriteCount-last.WriteCount) / sec
+			last, lastTime = p.Status, now
+
+			if this.progressReport != nil {
+				this.progressReport(p)
+			} else {
+				log.Info("build progress doc [%d] parse [%.0f/s] write [%.0f/s] error [%d]",
+					p.Status.DocCount, p.ParseRate, p.WriteRate, p.Status.ErrorCount())
+			}
+		}
+	}
+}
+
+// 设置失败的doc写入的文件
+func (this *StaticIndexer) SetDeadLetter(f *DeadLetterFile) {
+	this.deadLetter = f
+}
+
+// 读取doc计数,多次BuildIndex累计
+func (this *StaticIndexer) GetStatus() StaticIndexerStatus {
+	st := StaticIndexerStatus{}
+	st.DocCount = atomic.LoadInt64(&this.status.DocCount)
+	st.ParseCount = atomic.LoadInt64(&this.status.ParseCount)
+	st.WriteCount = atomic.LoadInt64(&this.status.WriteCount)
+	st.FormatError = atomic.LoadInt64(&this.status.FormatError)
+	st.ParseError = atomic.LoadInt64(&this.status.ParseError)
+	st.AllocIdError = atomic.LoadInt64(&this.status.AllocIdError)
+	st.WriteIndexError = atomic.LoadInt64(&this.status.WriteIndexError)
+	st.WriteValueError = atomic.LoadInt64(&this.status.WriteValueError)
+	st.WriteDataError = atomic.LoadInt64(&this.status.WriteDataError)
+	st.CommitError = atomic.LoadInt64(&this.status.CommitError)
+	return st
+}
+
+// 记录一个失败的doc:计数,打日志,写入失败文件
+func (this *StaticIndexer) reject(stage string, counter *int64, doc interface{}, err error) {
+	atomic.AddInt64(counter, 1)
+	log.Error("%s doc fail : %s", stage, err)
+	if this.deadLetter != nil {
+		this.deadLetter.Write(stage, doc, err)
+	}
 }
 
 // 并发多个协程分析doc,最终阻塞完成写入db后返回
@@ -55,8 +204,11 @@ func (this *StaticIndexer) BuildIndex(iter DocIterator) error {
 	// 初始化
 	// 完成处理的doc计数
 	this.finishedWg = sync.WaitGroup{}
-	this.parseDocChan = make(chan interface{}, this.parseDocRoutineNum)
+	this.parseDocChan = make(chan docToParse, this.parseDocRoutineNum)
 	this.writeDbQueue = make(chan (*docParsed), this.writeDbQueueNum)
+	if this.ordered {
+		this.orderWindow = make(chan bool, this.parseDocRoutineNum*4)
+	}
 
 	// 启动一个写入db协程
 	go this.writeDoc()
@@ -66,11 +218,28 @@ func (this *StaticIndexer) BuildIndex(iter DocIterator) error {
 		go this.parseDoc()
 	}
 
+	// 进度报告协程,返回前退出
+	if this.progressInterval > 0 {
+		done := make(chan bool)
+		exited := sync.WaitGroup{}
+		exited.Add(1)
+		go this.reportProgress(done, &exited)
+		defer exited.Wait()
+		defer close(done)
+	}
+
 	// 把全部待处理的doc都塞入parseDocChan处理
+	var seq uint64
 	oneDoc := iter.NextDoc()
 	for ; oneDoc != nil; oneDoc = iter.NextDoc() {
+		atomic.AddInt64(&this.status.DocCount, 1)
 		this.finishedWg.Add(1)
-		this.parseDocChan <- oneDoc
+		if this.ordered {
+			// 重排缓冲满了等待前面的doc写入
+			this.orderWindow <- true
+		}
+		this.parseDocChan <- docToParse{seq: seq, doc: oneDoc}
+		seq++
 	}
 
 	// 等待全部doc处理完成的事件.
@@ -90,18 +259,26 @@ func (this *StaticIndexer) parseDoc() {
 	context := NewStyContext()
 
 	// 一直从chan中获取doc,直到这个chan被close
-	for doc := range this.parseDocChan {
+	for item := range this.parseDocChan {
+		doc := item.doc
 		var err error
 		// parse
-		parseRes := &docParsed{}
-		parseRes.outId, parseRes.termList, parseRes.value, parseRes.data,
-			err = this.strategy.ParseDoc(doc, context)
-		if err != nil {
-			log.Error(err)
-			parseRes = nil
+		parseRes := &docParsed{doc: doc, seq: item.seq}
+		if bad, ok := doc.(*BadDoc); ok {
+			// 数据文件中格式错误的记录,不交给策略
+			this.reject("format", &this.status.FormatError, doc, bad.Err)
+			parseRes.failed = true
+		} else {
+			parseRes.outId, parseRes.termList, parseRes.value, parseRes.data,
+				err = this.strategy.ParseDoc(doc, context)
+			if err != nil {
+				this.reject("parse", &this.status.ParseError, doc, err)
+				parseRes.failed = true
+			}
+			// 打印策略日志
+			context.Log.PrintAllInfo()
 		}
-		// 打印策略日志
-		context.Log.PrintAllInfo()
+		atomic.AddInt64(&this.status.ParseCount, 1)
 
 		// toWriteDbQueue是待写入db的队列.
 		// 阻塞等待队列有空余位置然后写入队列.
@@ -111,49 +288,75 @@ func (this *StaticIndexer) parseDoc() {
 }
 
 func (this *StaticIndexer) writeDoc() {
+	// 按输入顺序写入时,提前解析完的doc在重排缓冲中等待前面的doc
+	pending := make(map[uint64]*docParsed)
+	var next uint64
 
 	for parseRes := range this.writeDbQueue {
-
-		if parseRes == nil {
-			log.Error("get nil pointer from queue")
-			this.finishedWg.Done()
+		if !this.ordered {
+			this.finishOneDoc(parseRes)
 			continue
 		}
 
-		// id
-		inId, err := this.db.AllocID(parseRes.outId)
-		if err != nil {
-			log.Error(err)
-			this.finishedWg.Done()
-			continue
+		pending[parseRes.seq] = parseRes
+		for {
+			res, ok := pending[next]
+			if !ok {
+				break
+			}
+			delete(pending, next)
+			next++
+			<-this.orderWindow
+			this.finishOneDoc(res)
 		}
+	}
+	log.Info("Finish writeDoc,goroutine exit.")
+}
 
-		// index
-		err = this.db.WriteIndex(inId, parseRes.termList)
-		if err != nil {
-			log.Error(err)
-			this.finishedWg.Done()
-			continue
-		}
+func (this *StaticIndexer) finishOneDoc(parseRes *docParsed) {
+	// 解析失败的doc已经计数
+	if !parseRes.failed {
+		this.writeOneDoc(parseRes)
+	}
+	this.finishedWg.Done()
+}
 
-		// value
-		err = this.db.WriteValue(inId, parseRes.value)
-		if err != nil {
-			log.Error(err)
-			this.finishedWg.Done()
-			continue
-		}
+func (this *StaticIndexer) writeOneDoc(parseRes *docParsed) {
+	// id
+	inId, err := this.db.AllocID(parseRes.outId)
+	if err != nil {
+		this.reject("alloc", &this.status.AllocIdError, parseRes.doc, err)
+		return
+	}
 
-		// data
-		err = this.db.WriteData(inId, parseRes.data)
-		if err != nil {
-			log.Error(err)
-			this.finishedWg.Done()
-			continue
-		}
-		this.finishedWg.Done()
+	// index
+	err = this.db.WriteIndex(inId, parseRes.termList)
+	if err != nil {
+		this.reject("index", &this.status.WriteIndexError, parseRes.doc, err)
+		return
 	}
-	log.Info("Finish writeDoc,goroutine exit.")
+
+	// value
+	err = this.db.WriteValue(inId, parseRes.value)
+	if err != nil {
+		this.reject("value", &this.status.WriteValueError, parseRes.doc, err)
+		return
+	}
+
+	// data
+	err = this.db.WriteData(inId, parseRes.data)
+	if err != nil {
+		this.reject("data", &this.status.WriteDataError, parseRes.doc, err)
+		return
+	}
+
+	// commit
+	err = this.db.CommitID(inId)
+	if err != nil {
+		this.reject("commit", &this.status.CommitError, parseRes.doc, err)
+		return
+	}
+	atomic.AddInt64(&this.status.WriteCount, 1)
 }
 
 //
@@ -183,11 +386,19 @@ type VarIndexer struct {
 }
 
 // 单协程完成工作,分析doc然后写入索引结束.
-func (this *VarIndexer) BuildIndex(iter DocIterator) error {
+// 返回前把这一批写入的索引持久化,出错的时候之前已经写入的doc同样持久化.
+func (this *VarIndexer) BuildIndex(iter DocIterator) (err error) {
 	// 整个建库过程中加锁
 	this.lock.Lock()
 	defer this.lock.Unlock()
 
+	defer func() {
+		flushErr := this.db.Flush()
+		if err == nil {
+			err = flushErr
+		}
+	}()
+
 	context := NewStyContext()
 
 	oneDoc := iter.NextDoc()
@@ -231,11 +442,39 @@ func (this *VarIndexer) BuildIndex(iter DocIterator) error {
 			return err
 		}
 
+		// 全部写入后才提交,同一个外部id的旧版本doc被替代
+		err = this.db.CommitID(inId)
+		if err != nil {
+			return err
+		}
 	}
 
 	return nil
 }
 
+// 根据外部id删除doc,删除立即生效.
+// 不存在的外部id不影响其它id的删除,全部处理完后一起返回404的StyError
+func (this *VarIndexer) DeleteDoc(outIdList []OutIdType) error {
+	this.lock.Lock()
+	defer this.lock.Unlock()
+
+	var notFound []OutIdType
+	for _, outId := range outIdList {
+		err := this.db.DeleteDoc(outId)
+		if err == ErrOutIdNotFound {
+			notFound = append(notFound, outId)
+			continue
+		}
+		if err != nil {
+			return err
+		}
+	}
+	if len(notFound) > 0 {
+		return NewStyError(http.StatusNotFound, "outId %v not found", notFound)
+	}
+	return nil
+}
+
 func NewVarIndexer(db DataBaseWriter, sty IndexStrategy) (*VarIndexer, error) {
 	i := VarIndexer{}
 	i.db = db
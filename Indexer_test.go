@@ -0,0 +1,262 @@
+package goose
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"github.com/getwe/goose/config"
+	. "github.com/getwe/goose/database"
+	. "github.com/getwe/goose/utils"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+)
+
+// doc是外部id,不是数字的doc解析失败
+type errorTestSty struct{}
+
+func (errorTestSty) Init(conf config.Conf) error {
+	return nil
+}
+
+func (errorTestSty) ParseDoc(doc interface{}, context *StyContext) (OutIdType, []TermInDoc,
+	Value, Data, error) {
+	id, err := strconv.Atoi(string(doc.([]byte)))
+	if err != nil {
+		return 0, nil, nil, nil, err
+	}
+	return OutIdType(id), []TermInDoc{TermInDoc{Sign: 1, Weight: 1}}, Value("v"), Data("d"), nil
+}
+
+// 按顺序返回doc
+type sliceDocIter struct {
+	docs []interface{}
+}
+
+func (this *sliceDocIter) NextDoc() interface{} {
+	if len(this.docs) == 0 {
+		return nil
+	}
+	doc := this.docs[0]
+	this.docs = this.docs[1:]
+	return doc
+}
+
+func TestStaticIndexerError(t *testing.T) {
+	dir := filepath.Join(os.Getenv("HOME"), "tmp", "goosedb", "test_indexer_error")
+	os.RemoveAll(dir)
+	os.MkdirAll(dir, 0755)
+
+	db := NewDBBuilder()
+	if err := db.Init(filepath.Join(dir, "db"), 1000, 100, 1, 1024*1024, 1024*1024,
+		DefaultPostingCodec); err != nil {
+		t.Fatalf("Init --- %s", err)
+	}
+	indexer, _ := NewStaticIndexer(db, errorTestSty{})
+	letters := NewDeadLetterFile(filepath.Join(dir, "deadletter"))
+	indexer.SetDeadLetter(letters)
+
+	// 外部id为0的doc分配内部id失败
+	iter := &sliceDocIter{docs: []interface{}{
+		[]byte("1"), []byte("bad"), []byte("0"), []byte("2"),
+		&BadDoc{Raw: []byte("{"), Err: errors.New("format")}}}
+	if err := indexer.BuildIndex(iter); err != nil {
+		t.Fatalf("BuildIndex --- %s", err)
+	}
+	letters.Close()
+
+	st := indexer.GetStatus()
+	if st.DocCount != 5 || st.WriteCount != 2 || st.ParseError != 1 || st.AllocIdError != 1 ||
+		st.FormatError != 1 || st.ErrorCount() != 3 {
+		t.Errorf("status %+v", st)
+	}
+	if r := st.ErrorRatio(); r != 0.6 {
+		t.Errorf("error ratio %f", r)
+	}
+
+	f, err := os.Open(filepath.Join(dir, "deadletter"))
+	if err != nil {
+		t.Fatalf("open dead letter --- %s", err)
+	}
+	defer f.Close()
+	docs := make(map[string]string)
+	s := bufio.NewScanner(f)
+	for s.Scan() {
+		l := deadLetter{}
+		if err := json.Unmarshal(s.Bytes(), &l); err != nil {
+			t.Fatalf("dead letter [%s] --- %s", s.Text(), err)
+		}
+		docs[l.Stage] = l.Doc.(string)
+	}
+	if len(docs) != 3 || docs["parse"] != "bad" || docs["alloc"] != "0" ||
+		docs["format"] != "{" {
+		t.Errorf("dead letter %v", docs)
+	}
+}
+
+func TestDeadLetterTruncate(t *testing.T) {
+	path := filepath.Join(os.Getenv("HOME"), "tmp", "goosedb", "test_deadletter_truncate")
+	os.Remove(path)
+
+	letters := NewDeadLetterFile(path)
+	if size, err := letters.Size(); err != nil || size != 0 {
+		t.Fatalf("size of missing file [%d] err[%v]", size, err)
+	}
+	letters.Write("parse", []byte("a"), errors.New("e"))
+	done, _ := letters.Size()
+	// 中断的数据文件写入的doc
+	letters.Write("parse", []byte("b"), errors.New("e"))
+	letters.Close()
+
+	// 继续建库,丢弃中断的数据文件写入的doc后重新写入
+	letters = NewDeadLetterFile(path)
+	if err := letters.Truncate(done + 1000); err != nil {
+		t.Fatalf("Truncate --- %s", err)
+	}
+	if err := letters.Truncate(done); err != nil {
+		t.Fatalf("Truncate --- %s", err)
+	}
+	letters.Write("parse", []byte("b"), errors.New("e"))
+	letters.Close()
+
+	f, err := os.Open(path)
+	if err != nil {
+		t.Fatalf("open dead letter --- %s", err)
+	}
+	defer f.Close()
+	docs := make([]string, 0)
+	s := bufio.NewScanner(f)
+	for s.Scan() {
+		l := deadLetter{}
+		if err := json.Unmarshal(s.Bytes(), &l); err != nil {
+			t.Fatalf("dead letter [%s] --- %s", s.Text(), err)
+		}
+		docs = append(docs, l.Doc.(string))
+	}
+	if len(docs) != 2 || docs[0] != "a" || docs[1] != "b" {
+		t.Errorf("dead letter %v", docs)
+	}
+}
+
+// 每个doc间隔一段时间返回
+type slowDocIter struct {
+	sliceDocIter
+	interval time.Duration
+}
+
+func (this *slowDocIter) NextDoc() interface{} {
+	time.Sleep(this.interval)
+	return this.sliceDocIter.NextDoc()
+}
+
+func TestStaticIndexerProgress(t *testing.T) {
+	dir := filepath.Join(os.Getenv("HOME"), "tmp", "goosedb", "test_indexer_progress")
+	os.RemoveAll(dir)
+
+	db := NewDBBuilder()
+	if err := db.Init(dir, 1000, 100, 1, 1024*1024, 1024*1024, DefaultPostingCodec); err != nil {
+		t.Fatalf("Init --- %s", err)
+	}
+	indexer, _ := NewStaticIndexer(db, errorTestSty{})
+
+	lock := sync.Mutex{}
+	reports := make([]StaticIndexerProgress, 0)
+	indexer.SetProgress(10*time.Millisecond, func(p StaticIndexerProgress) {
+		lock.Lock()
+		defer lock.Unlock()
+		reports = append(reports, p)
+	})
+
+	iter := &slowDocIter{interval: 5 * time.Millisecond}
+	for i := 1; i <= 20; i++ {
+		iter.docs = append(iter.docs, []byte(strconv.Itoa(i)))
+	}
+	if err := indexer.BuildIndex(iter); err != nil {
+		t.Fatalf("BuildIndex --- %s", err)
+	}
+	st := indexer.GetStatus()
+	if st.DocCount != 20 || st.ParseCount != 20 || st.WriteCount != 20 {
+		t.Errorf("status %+v", st)
+	}
+
+	// BuildIndex返回后不再报告
+	lock.Lock()
+	n := len(reports)
+	lock.Unlock()
+	time.Sleep(30 * time.Millisecond)
+	lock.Lock()
+	defer lock.Unlock()
+	if n == 0 || len(reports) != n {
+		t.Fatalf("report count [%d] after return [%d]", n, len(reports))
+	}
+	if reports[0].ParseRate <= 0 || reports[n-1].Status.DocCount == 0 {
+		t.Errorf("report %+v", reports[0])
+	}
+}
+
+// 只记录分配内部id顺序的db
+type orderTestDB struct {
+	outIds []OutIdType
+}
+
+func (this *orderTestDB) AllocID(outID OutIdType) (InIdType, error) {
+	this.outIds = append(this.outIds, outID)
+	return InIdType(len(this.outIds)), nil
+}
+
+func (this *orderTestDB) CommitID(inID InIdType) error                  { return nil }
+func (this *orderTestDB) DeleteDoc(outID OutIdType) error               { return nil }
+func (this *orderTestDB) WriteIndex(inID InIdType, l []TermInDoc) error { return nil }
+func (this *orderTestDB) WriteValue(inID InIdType, v Value) error       { return nil }
+func (this *orderTestDB) WriteData(inID InIdType, d Data) error         { return nil }
+func (this *orderTestDB) Sync() error                                   { return nil }
+func (this *orderTestDB) Flush() error                                  { return nil }
+
+// 解析耗时随机,不是数字的doc解析失败
+type slowParseSty struct {
+	errorTestSty
+}
+
+func (this slowParseSty) ParseDoc(doc interface{}, context *StyContext) (OutIdType,
+	[]TermInDoc, Value, Data, error) {
+	time.Sleep(time.Duration(rand.Intn(500)) * time.Microsecond)
+	return this.errorTestSty.ParseDoc(doc, context)
+}
+
+func TestStaticIndexerOrdered(t *testing.T) {
+	db := &orderTestDB{}
+	indexer, _ := NewStaticIndexer(db, slowParseSty{})
+	indexer.SetOrdered(true)
+	// 多个解析协程才会乱序
+	indexer.parseDocRoutineNum = 8
+
+	// 两次BuildIndex都按输入顺序分配
+	for round := 0; round < 2; round++ {
+		iter := &sliceDocIter{}
+		for i := 1; i <= 500; i++ {
+			if i%50 == 0 {
+				iter.docs = append(iter.docs, []byte("bad"))
+				continue
+			}
+			iter.docs = append(iter.docs, []byte(strconv.Itoa(round*1000+i)))
+		}
+		if err := indexer.BuildIndex(iter); err != nil {
+			t.Fatalf("BuildIndex --- %s", err)
+		}
+	}
+
+	if len(db.outIds) != 980 {
+		t.Fatalf("alloc count [%d]", len(db.outIds))
+	}
+	for i := 1; i < len(db.outIds); i++ {
+		if db.outIds[i] <= db.outIds[i-1] {
+			t.Fatalf("alloc [%d] outId [%d] after [%d]", i, db.outIds[i], db.outIds[i-1])
+		}
+	}
+}
+
+/* vim: set expandtab ts=4 sw=4 sts=4 tw=100: */
@@ -8,34 +8,28 @@ import (
 )
 
 type listMinHeapItem struct {
-	sign TermSign // term签名
-	no   int      // term编号
-	list *InvList // term对应拉链
-	pos  int      // 当前遍历到位置
-	omit int      // term是否可省.0表示可省,大于0表示不可省.
-	// 不可省需赋值为1<<no,可以表示第no个term不可省
+	sign   TermSign       // term签名
+	no     int            // term编号
+	cursor *InvListCursor // term对应拉链的遍历器
+	must   bool           // term是否不可省
 }
 
 // 当前遍历到的元素
 func (this *listMinHeapItem) Curr() Index {
-	return (*this.list)[this.pos]
+	return this.cursor.Curr()
 }
 
 // 开始遍历下一个元素,如果结束返回false
 func (this *listMinHeapItem) Next() bool {
-	// 后移一个元素
-	this.pos++
-
-	// this.pos == len(*this.list) 表示拉链遍历完
-	// 操作list[pos]是非法的
+	return this.cursor.Next()
+}
 
-	if this.pos < len(*this.list) {
-		return true
-	}
-	return false
+// 跳到第一个InID>=inId的元素,如果结束返回false
+func (this *listMinHeapItem) SkipTo(inId InIdType) bool {
+	return this.cursor.SkipTo(inId)
 }
 
-type listMinHeap []listMinHeapItem
+type listMinHeap []*listMinHeapItem
 
 // 堆必须支持接口:Len
 func (ih listMinHeap) Len() int {
@@ -44,10 +38,8 @@ func (ih listMinHeap) Len() int {
 
 // 堆排序必须支持接口:Less
 func (ih listMinHeap) Less(i, j int) bool {
-	indexa := ih[i].pos
-	indexb := ih[j].pos
 	// InID小的先归并
-	return (*ih[i].list)[indexa].InID < (*ih[j].list)[indexb].InID
+	return ih[i].Curr().InID < ih[j].Curr().InID
 }
 
 // 堆排序必须支持接口:Swap
@@ -57,7 +49,7 @@ func (ih listMinHeap) Swap(i, j int) {
 
 // 堆排序必须支持接口:Push
 func (ih *listMinHeap) Push(x interface{}) {
-	*ih = append(*ih, x.(listMinHeapItem))
+	*ih = append(*ih, x.(*listMinHeapItem))
 }
 
 // 堆排序必须支持接口:Pop
@@ -75,57 +67,123 @@ func (ih listMinHeap) Top() interface{} {
 
 type MergeEngine struct {
 	lstheap   *listMinHeap // 归并用最小堆
-	omitflag  int          // 不可省term的标记
+	mustCount int          // 不可省term的数量
 	termCount int
+
+	// 不可省term的拉链,跟堆中的元素是同一个指针.
+	// 利用不可省term的拉链跳表,跳过不可能命中全部不可省term的doc.
+	mustItems []*listMinHeapItem
+	// 存在拉链为空的不可省term,不可能有任何结果
+	mustEmpty bool
+
+	// 是否需要位置信息
+	withPos bool
+	// 位置约束,不满足的doc丢弃
+	proximity []ProximityInQuery
+	// 忽略位置信息的term,不读取位置
+	skipOffset []bool
 }
 
 func NewMergeEngine(db DataBaseReader, termList []TermInQuery) (*MergeEngine, error) {
-	mg := MergeEngine{}
-	if len(termList) >= GOOSE_MAX_QUERY_TERM {
+	tables, err := readTermLists(db, termList)
+	if err != nil {
+		return nil, err
+	}
+	return newMergeEngine(termList, tables, 0, 0), nil
+}
+
+// 读取全部term的拉链和跳表,读取失败的term是空拉链
+func readTermLists(db IndexReader, termList []TermInQuery) ([]*SkipTable, error) {
+	if len(termList) > GOOSE_MAX_QUERY_TERM {
 		return nil, log.Warn("to much terms [%d]", len(termList))
 	}
 
-	mg.omitflag = 0
+	tables := make([]*SkipTable, len(termList))
+	for i, e := range termList {
+		table, err := ReadSkipTable(db, e.Sign)
+		if err != nil {
+			log.Warn("read term[%d] : %s", e.Sign, err)
+			table = NewSkipTable(nil)
+		}
+		tables[i] = table
+	}
+	return tables, nil
+}
+
+// 只归并InID在[begin,end)范围内的doc,end为0表示不限制上界.
+// 拉链只会被读取,多个归并引擎可以共享同一组拉链,并行归并不同的范围
+func newMergeEngine(termList []TermInQuery, tables []*SkipTable,
+	begin InIdType, end InIdType) *MergeEngine {
+
+	mg := MergeEngine{}
+	mg.mustCount = 0
 	mg.lstheap = &listMinHeap{}
 	mg.termCount = len(termList)
 	heap.Init(mg.lstheap)
 
 	// 把全部拉链建成小顶堆
 	for i, e := range termList {
-		var err error
-		item := listMinHeapItem{}
+		item := &listMinHeapItem{}
 
-		item.list, err = db.ReadIndex(e.Sign)
-		if err != nil {
-			log.Warn("read term[%d] : %s", e.Sign, err)
-			item.list = nil
+		item.cursor = tables[i].NewCursor()
+		if begin > 0 || end > 0 {
+			item.cursor.SetRange(begin, end)
 		}
 		item.no = i
-		item.pos = 0
 		item.sign = e.Sign
-		if e.CanOmit {
-			item.omit = 0 // 0表示可省
-		} else {
-			item.omit = 1 << uint(i) // 不可省term
-		}
+		item.must = !e.CanOmit
 
-		// 拉链有效才放入堆
-		if item.list != nil && item.list.Len() > 0 {
+		// 拉链在范围内有元素才放入堆
+		if item.cursor.Valid() {
 			heap.Push(mg.lstheap, item)
 		}
 
 		// 同时记下不可省term的标记
 		if e.CanOmit == false {
-			mg.omitflag ^= 1 << uint(i)
+			mg.mustCount++
+			if item.cursor.Valid() {
+				mg.mustItems = append(mg.mustItems, item)
+			} else {
+				mg.mustEmpty = true
+			}
 		}
 
-		log.Debug("term[%d] omit[%d] weight[%d] listLen[%d]", item.sign,
-			item.omit, e.Weight, len(*item.list))
+		log.Debug("term[%d] must[%v] weight[%d] listLen[%d]", item.sign,
+			item.must, e.Weight, item.cursor.Len())
 	}
 
-	log.Debug("termCnt[%d] omitflag[%d]", mg.termCount, mg.omitflag)
+	log.Debug("termCnt[%d] mustCount[%d]", mg.termCount, mg.mustCount)
 
-	return &mg, nil
+	return &mg
+}
+
+// 设置位置约束.之后归并得到的doc把拉链中的位置信息填写在TermInDoc.Pos中,
+// 不满足全部约束的doc丢弃.list为空表示只需要位置信息,不做过滤.
+// TermInQuery.SkipOffset为true的term不填写位置,也不能出现在约束中.
+func (this *MergeEngine) SetProximity(termList []TermInQuery, list []ProximityInQuery) error {
+
+	if len(termList) != this.termCount {
+		return log.Warn("len(termList)[%d] != termCount[%d]", len(termList), this.termCount)
+	}
+
+	this.skipOffset = make([]bool, len(termList))
+	for i, t := range termList {
+		this.skipOffset[i] = t.SkipOffset
+	}
+	for _, p := range list {
+		for _, no := range p.Terms {
+			if no < 0 || no >= this.termCount {
+				return log.Warn("proximity term no[%d] illegal termCnt[%d]", no, this.termCount)
+			}
+			if this.skipOffset[no] {
+				return log.Warn("proximity term no[%d] skip offset", no)
+			}
+		}
+	}
+
+	this.withPos = true
+	this.proximity = list
+	return nil
 }
 
 func (this *MergeEngine) Next(termInDoclist []TermInDoc) (inId InIdType, currValid, allfinish bool) {
@@ -135,7 +193,12 @@ func (this *MergeEngine) Next(termInDoclist []TermInDoc) (inId InIdType, currVal
 		return 0, false, true
 	}
 
-	if this.lstheap.Len() == 0 {
+	if this.lstheap.Len() == 0 || this.mustEmpty {
+		return 0, false, true
+	}
+
+	// 跳到全部不可省term都可能命中的doc
+	if len(this.mustItems) > 0 && this.skipToMust() == false {
 		return 0, false, true
 	}
 
@@ -143,8 +206,10 @@ func (this *MergeEngine) Next(termInDoclist []TermInDoc) (inId InIdType, currVal
 	for i, _ := range termInDoclist {
 		termInDoclist[i].Sign = 0
 		termInDoclist[i].Weight = 0
+		termInDoclist[i].Pos = nil
 	}
-	oflag := 0
+	// 当前doc命中的不可省term数量
+	mustHit := 0
 
 	/*
 	   // 先看当前id最小的堆顶
@@ -154,17 +219,19 @@ func (this *MergeEngine) Next(termInDoclist []TermInDoc) (inId InIdType, currVal
 	   // 记下当前doc
 	   termInDoclist[ item.no ].Sign = item.sign
 	   termInDoclist[ item.no ].Weight = item.Curr().Weight
-	   oflag ^= item.omit
+	   if item.must {
+	       mustHit++
+	   }
 	*/
 
-	top := this.lstheap.Top().(listMinHeapItem)
+	top := this.lstheap.Top().(*listMinHeapItem)
 	currInID := top.Curr().InID
 
 	currValid = true
 	allfinish = false
 
 	for this.lstheap.Len() > 0 {
-		top := this.lstheap.Top().(listMinHeapItem)
+		top := this.lstheap.Top().(*listMinHeapItem)
 
 		if top.Curr().InID != currInID {
 			// 遇到新的doc了,就是归并完一个doc
@@ -173,12 +240,17 @@ func (this *MergeEngine) Next(termInDoclist []TermInDoc) (inId InIdType, currVal
 		}
 
 		// 堆里面还有相同的doc,先弹出
-		item := heap.Pop(this.lstheap).(listMinHeapItem)
+		item := heap.Pop(this.lstheap).(*listMinHeapItem)
 
 		// 记下当前doc
 		termInDoclist[item.no].Sign = item.sign
 		termInDoclist[item.no].Weight = item.Curr().Weight
-		oflag ^= item.omit
+		if this.withPos && !this.skipOffset[item.no] {
+			termInDoclist[item.no].Pos = item.Curr().Pos
+		}
+		if item.must {
+			mustHit++
+		}
 
 		// 如果拉链没遍历完,继续加入堆
 		if item.Next() {
@@ -186,22 +258,71 @@ func (this *MergeEngine) Next(termInDoclist []TermInDoc) (inId InIdType, currVal
 		} else {
 			// 如果拉链遍历完,且这个拉链是不可省term
 			// 处理完当前doc后后面不需要再归并了
-			if item.omit > 0 {
+			if item.must {
 				allfinish = true
-				log.Debug("not omit item travel end no[%d] pos[%d] list.len[%d]",
-					item.no, item.pos, len(*item.list))
+				log.Debug("not omit item travel end no[%d] list.len[%d]",
+					item.no, item.cursor.Len())
 			}
 		}
 	}
 
 	// 检查不可省term是否有全部命中
-	if oflag != this.omitflag {
+	if mustHit != this.mustCount {
 		// 这次归并得到的doc没有用,丢掉吧
 		currValid = false
 	} else {
 		currValid = true
 	}
 
+	if currValid && len(this.proximity) > 0 {
+		currValid = this.checkProximity(termInDoclist)
+	}
+
 	inId = currInID
 	return
 }
+
+// 检查doc是否满足全部位置约束
+func (this *MergeEngine) checkProximity(termInDoclist []TermInDoc) bool {
+	for _, p := range this.proximity {
+		if !matchProximity(p, termInDoclist) {
+			return false
+		}
+	}
+	return true
+}
+
+// 不可省term拉链的leapfrog:所有不可省term的当前doc都一致之前,把堆中InID较小的拉链
+// 直接跳到不可省term中最大的InID,中间的doc不可能命中全部不可省term,不需要逐个归并.
+// 有不可省term的拉链遍历结束,返回false.
+func (this *MergeEngine) skipToMust() bool {
+	for {
+		// 不可省term当前doc的最大值
+		target := this.mustItems[0].Curr().InID
+		for _, item := range this.mustItems[1:] {
+			if item.Curr().InID > target {
+				target = item.Curr().InID
+			}
+		}
+
+		if this.lstheap.Top().(*listMinHeapItem).Curr().InID >= target {
+			// 堆顶已经到达target,所有不可省term都在target上
+			return true
+		}
+
+		// 把堆中InID小于target的拉链都跳到target
+		for this.lstheap.Len() > 0 {
+			item := this.lstheap.Top().(*listMinHeapItem)
+			if item.Curr().InID >= target {
+				break
+			}
+			heap.Pop(this.lstheap)
+			if item.SkipTo(target) {
+				heap.Push(this.lstheap, item)
+			} else if item.must {
+				return false
+			}
+		}
+		// 可省term跳过之后,不可省term有可能跳到了大于target的位置,再检查一遍
+	}
+}
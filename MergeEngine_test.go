@@ -0,0 +1,241 @@
+package goose
+
+import (
+	"github.com/getwe/goose/config"
+	. "github.com/getwe/goose/database"
+	. "github.com/getwe/goose/utils"
+	"math/rand"
+	"strings"
+	"testing"
+)
+
+// 只有内存倒排的测试库
+type memDB struct {
+	index map[TermSign]*InvList
+}
+
+func (this *memDB) GetOutID(inId InIdType) (OutIdType, error) {
+	return OutIdType(inId), nil
+}
+
+func (this *memDB) IsDeleted(inId InIdType) bool {
+	return false
+}
+
+func (this *memDB) ReadIndex(t TermSign) (*InvList, error) {
+	l := NewInvList()
+	if tmp, ok := this.index[t]; ok {
+		l.Concat(*tmp)
+	}
+	return &l, nil
+}
+
+func (this *memDB) ReadValue(inId InIdType) (Value, error) {
+	return nil, nil
+}
+
+func (this *memDB) ReadData(inId InIdType, buf *Data) error {
+	return nil
+}
+
+// 构造termCnt条拉链,每条拉链listLen个doc,doc从[1,maxId]中随机选
+func newMemDB(termCnt int, listLen int, maxId int) *memDB {
+	db := &memDB{index: make(map[TermSign]*InvList)}
+	for i := 1; i <= termCnt; i++ {
+		hit := make(map[int]bool)
+		for len(hit) < listLen {
+			hit[rand.Intn(maxId)+1] = true
+		}
+		l := NewInvList(listLen)
+		for id := 1; id <= maxId; id++ {
+			if hit[id] {
+				l.Append(Index{InID: InIdType(id), Weight: TermWeight(i)})
+			}
+		}
+		db.index[TermSign(i)] = &l
+	}
+	return db
+}
+
+func newTermList(termCnt int, mustCnt int) []TermInQuery {
+	termList := make([]TermInQuery, termCnt)
+	for i, _ := range termList {
+		termList[i].Sign = TermSign(i + 1)
+		termList[i].CanOmit = i >= mustCnt
+	}
+	return termList
+}
+
+func TestMergeEngineManyTerms(t *testing.T) {
+	termCnt := 300
+	mustCnt := 40
+	maxId := 200
+	db := newMemDB(termCnt, maxId*9/10, maxId)
+	termList := newTermList(termCnt, mustCnt)
+
+	// 逐个doc检查应该命中的结果
+	expect := make(map[InIdType]int)
+	for id := 1; id <= maxId; id++ {
+		hitMust, hitAll := 0, 0
+		for i, term := range termList {
+			for _, e := range *db.index[term.Sign] {
+				if e.InID == InIdType(id) {
+					hitAll++
+					if i < mustCnt {
+						hitMust++
+					}
+				}
+			}
+		}
+		if hitMust == mustCnt {
+			expect[InIdType(id)] = hitAll
+		}
+	}
+
+	me, err := NewMergeEngine(db, termList)
+	if err != nil {
+		t.Fatalf("NewMergeEngine : %s", err)
+	}
+	termInDoc := make([]TermInDoc, termCnt)
+	got := 0
+	for {
+		inId, valid, finish := me.Next(termInDoc)
+		if valid {
+			hitAll, ok := expect[inId]
+			if !ok {
+				t.Fatalf("unexpected doc [%d]", inId)
+			}
+			for _, e := range termInDoc {
+				if e.Sign != 0 {
+					hitAll--
+				}
+			}
+			if hitAll != 0 {
+				t.Errorf("doc [%d] hit term count error", inId)
+			}
+			got++
+		}
+		if finish {
+			break
+		}
+	}
+	if got != len(expect) {
+		t.Errorf("get [%d] docs expect [%d]", got, len(expect))
+	}
+}
+
+// 固定的查询,doc得分是命中term的权重之和,每个doc打一条日志,Response保存结果和日志
+type shardTestSty struct {
+	termList []TermInQuery
+	result   *SearchResultList
+	logs     *[]string
+}
+
+func (this shardTestSty) Init(conf config.Conf) error {
+	return nil
+}
+
+func (this shardTestSty) ParseQuery(request []byte, context *StyContext) ([]TermInQuery,
+	interface{}, error) {
+	return this.termList, nil, nil
+}
+
+func (this shardTestSty) CalWeight(queryInfo interface{}, inId InIdType, outId OutIdType,
+	termInQuery []TermInQuery, termInDoc []TermInDoc, termCnt uint32,
+	context *StyContext) (TermWeight, error) {
+	context.Log.Info("doc", inId)
+	weight := TermWeight(0)
+	for _, e := range termInDoc {
+		weight += e.Weight
+	}
+	return weight, nil
+}
+
+func (this shardTestSty) Response(queryInfo interface{}, list SearchResultList,
+	valueReader ValueReader, dataReader DataReader, response []byte,
+	context *StyContext) (int, error) {
+	*this.result = list
+	*this.logs = nil
+	for _, l := range context.Log.Infos() {
+		if strings.HasPrefix(l, "doc:") {
+			*this.logs = append(*this.logs, l)
+		}
+	}
+	return 0, nil
+}
+
+func TestSearcherShard(t *testing.T) {
+	db := newMemDB(8, 300, 1000)
+	sty := shardTestSty{termList: newTermList(8, 2), result: new(SearchResultList),
+		logs: new([]string)}
+
+	search := func(shardNum int) SearchResultList {
+		s, _ := NewSearcher(db, sty)
+		s.SetParallel(shardNum, 0)
+		_, err := s.Search(NewStyContext(), nil, nil)
+		if err != nil {
+			t.Fatalf("Search --- %s", err)
+		}
+		return *sty.result
+	}
+
+	expect := search(1)
+	if len(expect) == 0 {
+		t.Fatalf("no result")
+	}
+	expectLogs := *sty.logs
+	for _, shardNum := range []int{2, 3, 7, 2000} {
+		got := search(shardNum)
+		// 分片中策略打的日志按分片顺序合并,跟不分片一致
+		if strings.Join(*sty.logs, " ") != strings.Join(expectLogs, " ") {
+			t.Fatalf("shard[%d] get [%d] logs expect [%d]", shardNum, len(*sty.logs),
+				len(expectLogs))
+		}
+		if len(got) != len(expect) {
+			t.Fatalf("shard[%d] get [%d] results expect [%d]", shardNum, len(got), len(expect))
+		}
+		for i := range got {
+			if got[i] != expect[i] {
+				t.Fatalf("shard[%d] result[%d] %v expect %v", shardNum, i, got[i], expect[i])
+			}
+		}
+	}
+}
+
+func benchmarkMergeEngine(b *testing.B, termCnt int, mustCnt int) {
+	db := newMemDB(termCnt, 20000, 100000)
+	termList := newTermList(termCnt, mustCnt)
+	termInDoc := make([]TermInDoc, termCnt)
+
+	b.ResetTimer()
+	for n := 0; n < b.N; n++ {
+		me, err := NewMergeEngine(db, termList)
+		if err != nil {
+			b.Fatalf("NewMergeEngine : %s", err)
+		}
+		for {
+			_, _, finish := me.Next(termInDoc)
+			if finish {
+				break
+			}
+		}
+	}
+}
+
+func BenchmarkMergeEngine3Terms(b *testing.B) {
+	benchmarkMergeEngine(b, 3, 1)
+}
+
+func BenchmarkMergeEngine3TermsAllOmit(b *testing.B) {
+	benchmarkMergeEngine(b, 3, 0)
+}
+
+func BenchmarkMergeEngine8Terms(b *testing.B) {
+	benchmarkMergeEngine(b, 8, 2)
+}
+
+func BenchmarkMergeEngine200Terms(b *testing.B) {
+	benchmarkMergeEngine(b, 200, 2)
+}
+
+/* vim: set expandtab ts=4 sw=4 sts=4 tw=100: */
@@ -0,0 +1,79 @@
+package goose
+
+import (
+	. "github.com/getwe/goose/utils"
+	"sort"
+)
+
+// 检查doc中term的位置是否满足约束.termInDoc中需要已经填写好位置信息
+func matchProximity(p ProximityInQuery, termInDoc []TermInDoc) bool {
+	if len(p.Terms) == 0 {
+		return true
+	}
+
+	plist := make([][]uint32, len(p.Terms))
+	for i, no := range p.Terms {
+		plist[i] = termInDoc[no].Pos
+		if len(plist[i]) == 0 {
+			// 有term没有命中或者没有位置信息
+			return false
+		}
+	}
+
+	switch p.Type {
+	case ProximityPhrase:
+		return matchPhrase(plist)
+	case ProximityNear:
+		return matchNear(plist, p.Distance)
+	}
+	return false
+}
+
+// 短语:存在位置p,第i个term出现在p+i
+func matchPhrase(plist [][]uint32) bool {
+	for _, start := range plist[0] {
+		match := true
+		for i := 1; i < len(plist); i++ {
+			if !hasPosition(plist[i], start+uint32(i)) {
+				match = false
+				break
+			}
+		}
+		if match {
+			return true
+		}
+	}
+	return false
+}
+
+// 邻近:每个term各取一个位置,最大位置和最小位置之差不超过distance.
+// 每次移动当前位置最小的term,找出覆盖全部term的最小窗口.
+func matchNear(plist [][]uint32, distance uint32) bool {
+	idx := make([]int, len(plist))
+	for {
+		min, max := 0, 0
+		for i := 1; i < len(plist); i++ {
+			if plist[i][idx[i]] < plist[min][idx[min]] {
+				min = i
+			}
+			if plist[i][idx[i]] > plist[max][idx[max]] {
+				max = i
+			}
+		}
+		if plist[max][idx[max]]-plist[min][idx[min]] <= distance {
+			return true
+		}
+		idx[min]++
+		if idx[min] >= len(plist[min]) {
+			return false
+		}
+	}
+}
+
+// 升序位置列表中是否有p
+func hasPosition(list []uint32, p uint32) bool {
+	i := sort.Search(len(list), func(i int) bool { return list[i] >= p })
+	return i < len(list) && list[i] == p
+}
+
+/* vim: set expandtab ts=4 sw=4 sts=4 tw=100: */
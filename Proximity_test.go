@@ -0,0 +1,182 @@
+package goose
+
+import (
+	. "github.com/getwe/goose/database"
+	. "github.com/getwe/goose/utils"
+	"math/rand"
+	"testing"
+)
+
+// 在[0,maxPos)中随机取不超过maxLen个位置,升序
+func newRandPositions(r *rand.Rand, maxLen int, maxPos int) []uint32 {
+	hit := make(map[uint32]bool)
+	for i := r.Intn(maxLen) + 1; i > 0; i-- {
+		hit[uint32(r.Intn(maxPos))] = true
+	}
+	list := make([]uint32, 0, len(hit))
+	for p := 0; p < maxPos; p++ {
+		if hit[uint32(p)] {
+			list = append(list, uint32(p))
+		}
+	}
+	return list
+}
+
+// 枚举每个term的全部位置组合,作为matchPhrase和matchNear的对照
+func bruteProximity(plist [][]uint32, fn func(pick []uint32) bool) bool {
+	pick := make([]uint32, len(plist))
+	var walk func(i int) bool
+	walk = func(i int) bool {
+		if i == len(plist) {
+			return fn(pick)
+		}
+		for _, p := range plist[i] {
+			pick[i] = p
+			if walk(i + 1) {
+				return true
+			}
+		}
+		return false
+	}
+	return walk(0)
+}
+
+func brutePhrase(plist [][]uint32) bool {
+	return bruteProximity(plist, func(pick []uint32) bool {
+		for i := 1; i < len(pick); i++ {
+			if pick[i] != pick[0]+uint32(i) {
+				return false
+			}
+		}
+		return true
+	})
+}
+
+func bruteNear(plist [][]uint32, distance uint32) bool {
+	return bruteProximity(plist, func(pick []uint32) bool {
+		min, max := pick[0], pick[0]
+		for _, p := range pick {
+			if p < min {
+				min = p
+			}
+			if p > max {
+				max = p
+			}
+		}
+		return max-min <= distance
+	})
+}
+
+func TestProximityRandom(t *testing.T) {
+	r := rand.New(rand.NewSource(1))
+	phraseHit, nearHit := 0, 0
+	for round := 0; round < 5000; round++ {
+		plist := make([][]uint32, r.Intn(4)+1)
+		for i := range plist {
+			plist[i] = newRandPositions(r, 6, 20)
+		}
+		// 同一个term在短语中出现多次
+		if len(plist) > 1 && r.Intn(4) == 0 {
+			plist[1] = plist[0]
+		}
+		distance := uint32(r.Intn(6))
+
+		if got, expect := matchPhrase(plist), brutePhrase(plist); got != expect {
+			t.Fatalf("matchPhrase %v get [%v] expect [%v]", plist, got, expect)
+		} else if got {
+			phraseHit++
+		}
+		if got, expect := matchNear(plist, distance), bruteNear(plist, distance); got != expect {
+			t.Fatalf("matchNear %v distance[%d] get [%v] expect [%v]",
+				plist, distance, got, expect)
+		} else if got {
+			nearHit++
+		}
+	}
+	// 命中和不命中都要覆盖到
+	if phraseHit < 100 || nearHit < 500 || nearHit > 4500 {
+		t.Errorf("phrase hit [%d] near hit [%d]", phraseHit, nearHit)
+	}
+}
+
+func TestMatchProximity(t *testing.T) {
+	termInDoc := []TermInDoc{
+		TermInDoc{Sign: 1, Pos: []uint32{3, 10}},
+		TermInDoc{Sign: 2, Pos: []uint32{4, 20}},
+		TermInDoc{Sign: 3, Pos: nil},
+		TermInDoc{Sign: 4, Pos: []uint32{7}},
+	}
+	cases := []struct {
+		p      ProximityInQuery
+		expect bool
+	}{
+		{ProximityInQuery{Type: ProximityPhrase}, true},
+		{ProximityInQuery{Type: ProximityPhrase, Terms: []int{0, 1}}, true},
+		// 短语按Terms的顺序
+		{ProximityInQuery{Type: ProximityPhrase, Terms: []int{1, 0}}, false},
+		// 没有位置信息的term不满足约束
+		{ProximityInQuery{Type: ProximityPhrase, Terms: []int{0, 2}}, false},
+		{ProximityInQuery{Type: ProximityNear, Terms: []int{0, 2}, Distance: 100}, false},
+		{ProximityInQuery{Type: ProximityNear, Terms: []int{1, 3, 0}, Distance: 3}, false},
+		{ProximityInQuery{Type: ProximityNear, Terms: []int{1, 3, 0}, Distance: 4}, true},
+		{ProximityInQuery{Type: ProximityNear, Terms: []int{3}, Distance: 0}, true},
+	}
+	for i, c := range cases {
+		if got := matchProximity(c.p, termInDoc); got != c.expect {
+			t.Errorf("case[%d] %+v get [%v] expect [%v]", i, c.p, got, c.expect)
+		}
+	}
+}
+
+func TestMergeEngineProximity(t *testing.T) {
+	// 位置信息跟拉链一起存储
+	db := &memDB{index: map[TermSign]*InvList{
+		1: &InvList{Index{InID: 1, Pos: []uint32{0}}, Index{InID: 2, Pos: []uint32{5}},
+			Index{InID: 3, Pos: []uint32{1, 8}}},
+		2: &InvList{Index{InID: 1, Pos: []uint32{1}}, Index{InID: 2, Pos: []uint32{2}},
+			Index{InID: 3, Pos: []uint32{9}}},
+		3: &InvList{Index{InID: 2, Pos: []uint32{3}}},
+	}}
+	termList := newTermList(3, 2)
+	termList[2].SkipOffset = true
+
+	me, err := NewMergeEngine(db, termList)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = me.SetProximity(termList, []ProximityInQuery{
+		ProximityInQuery{Type: ProximityPhrase, Terms: []int{0, 1}}})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	termInDoc := make([]TermInDoc, len(termList))
+	var hit []InIdType
+	for {
+		inId, valid, finish := me.Next(termInDoc)
+		if valid {
+			hit = append(hit, inId)
+			if len(termInDoc[0].Pos) == 0 || len(termInDoc[1].Pos) == 0 {
+				t.Errorf("InId[%d] without position", inId)
+			}
+		}
+		if inId == 2 && termInDoc[2].Pos != nil {
+			t.Errorf("skip offset term get position %v", termInDoc[2].Pos)
+		}
+		if finish {
+			break
+		}
+	}
+	if len(hit) != 2 || hit[0] != 1 || hit[1] != 3 {
+		t.Errorf("phrase hit %v", hit)
+	}
+
+	// 约束中不能有忽略位置的term
+	err = me.SetProximity(termList, []ProximityInQuery{
+		ProximityInQuery{Type: ProximityNear, Terms: []int{0, 2}}})
+	if err == nil {
+		t.Errorf("proximity with skip offset term")
+	}
+}
+
+/* vim: set expandtab ts=4 sw=4 sts=4 tw=100: */
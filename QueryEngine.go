@@ -0,0 +1,363 @@
+package goose
+
+import (
+	. "github.com/getwe/goose/database"
+	log "github.com/getwe/goose/log"
+	. "github.com/getwe/goose/utils"
+)
+
+// 遍历结束的标记
+const queryEnd = ^InIdType(0)
+
+// 查询树节点的遍历器.每个遍历器只返回命中该节点的doc,InID严格递增.
+type queryIterator interface {
+	// 当前doc,还没开始遍历返回0,遍历结束返回queryEnd
+	Curr() InIdType
+
+	// 跳到第一个InID>=inId并且命中的doc,返回新的当前doc.
+	// inId不大于当前doc的时候不移动.
+	SkipTo(inId InIdType) InIdType
+
+	// 把命中inId的term写入termInDoc,调用前需要保证当前doc就是inId
+	Collect(inId InIdType, termInDoc []TermInDoc)
+}
+
+// 叶子节点,一条拉链
+type termIterator struct {
+	no     int
+	sign   TermSign
+	cursor *InvListCursor
+}
+
+func (this *termIterator) Curr() InIdType {
+	if !this.cursor.Valid() {
+		return queryEnd
+	}
+	return this.cursor.Curr().InID
+}
+
+func (this *termIterator) SkipTo(inId InIdType) InIdType {
+	this.cursor.SkipTo(inId)
+	return this.Curr()
+}
+
+func (this *termIterator) Collect(inId InIdType, termInDoc []TermInDoc) {
+	if this.Curr() == inId {
+		termInDoc[this.no].Sign = this.sign
+		termInDoc[this.no].Weight = this.cursor.Curr().Weight
+	}
+}
+
+// AND节点.pos全部命中,neg全部不命中,opt可以命中任意doc只参与打分
+type andIterator struct {
+	curr InIdType
+	pos  []queryIterator
+	neg  []queryIterator
+	opt  []queryIterator
+}
+
+func (this *andIterator) Curr() InIdType {
+	return this.curr
+}
+
+func (this *andIterator) SkipTo(inId InIdType) InIdType {
+	if inId <= this.curr {
+		return this.curr
+	}
+
+	target := inId
+	for {
+		// leapfrog,全部pos都停在同一个doc
+		same := true
+		for _, p := range this.pos {
+			c := p.SkipTo(target)
+			if c == queryEnd {
+				this.curr = queryEnd
+				return this.curr
+			}
+			if c > target {
+				target = c
+				same = false
+				break
+			}
+		}
+		if !same {
+			continue
+		}
+
+		// 排除命中neg的doc
+		excluded := false
+		for _, n := range this.neg {
+			if n.SkipTo(target) == target {
+				excluded = true
+				break
+			}
+		}
+		if excluded {
+			target++
+			continue
+		}
+
+		this.curr = target
+		return this.curr
+	}
+}
+
+func (this *andIterator) Collect(inId InIdType, termInDoc []TermInDoc) {
+	for _, p := range this.pos {
+		p.Collect(inId, termInDoc)
+	}
+	for _, o := range this.opt {
+		if o.SkipTo(inId) == inId {
+			o.Collect(inId, termInDoc)
+		}
+	}
+}
+
+// 至少命中need个子节点,OR节点就是need为1.
+// sub是需要计数的子节点,all是可以命中任意doc的子节点,只参与打分
+type atLeastIterator struct {
+	curr InIdType
+	need int
+	sub  []queryIterator
+	all  []queryIterator
+}
+
+func (this *atLeastIterator) Curr() InIdType {
+	return this.curr
+}
+
+func (this *atLeastIterator) SkipTo(inId InIdType) InIdType {
+	if inId <= this.curr {
+		return this.curr
+	}
+
+	for {
+		// 子节点中最小的doc,以及命中这个doc的子节点数量
+		min := queryEnd
+		cnt := 0
+		for _, s := range this.sub {
+			c := s.SkipTo(inId)
+			if c < min {
+				min = c
+				cnt = 1
+			} else if c == min {
+				cnt++
+			}
+		}
+		if min == queryEnd || cnt >= this.need {
+			this.curr = min
+			return this.curr
+		}
+		inId = min + 1
+	}
+}
+
+func (this *atLeastIterator) Collect(inId InIdType, termInDoc []TermInDoc) {
+	for _, s := range this.sub {
+		if s.Curr() == inId {
+			s.Collect(inId, termInDoc)
+		}
+	}
+	for _, a := range this.all {
+		if a.SkipTo(inId) == inId {
+			a.Collect(inId, termInDoc)
+		}
+	}
+}
+
+// 可以命中任意doc的节点,比如MinMatch为0的节点.不能用来驱动遍历,只参与打分
+type matchAllIterator struct {
+	curr     InIdType
+	children []queryIterator
+}
+
+func (this *matchAllIterator) Curr() InIdType {
+	return this.curr
+}
+
+func (this *matchAllIterator) SkipTo(inId InIdType) InIdType {
+	if inId > this.curr {
+		this.curr = inId
+	}
+	return this.curr
+}
+
+func (this *matchAllIterator) Collect(inId InIdType, termInDoc []TermInDoc) {
+	for _, c := range this.children {
+		if c.SkipTo(inId) == inId {
+			c.Collect(inId, termInDoc)
+		}
+	}
+}
+
+// 不命中任何doc的节点
+type emptyIterator struct{}
+
+func (emptyIterator) Curr() InIdType {
+	return queryEnd
+}
+
+func (emptyIterator) SkipTo(inId InIdType) InIdType {
+	return queryEnd
+}
+
+func (emptyIterator) Collect(inId InIdType, termInDoc []TermInDoc) {
+}
+
+// 基于遍历器的查询树归并引擎.
+// 支持任意嵌套的AND/OR/NOT/至少命中N个,跟MergeEngine的使用方法一致.
+type QueryEngine struct {
+	root      queryIterator
+	termList  []TermInQuery
+	termCount int
+	last      InIdType
+}
+
+func NewQueryEngine(db DataBaseReader, query *QueryNode) (*QueryEngine, error) {
+	if query == nil {
+		return nil, log.Warn("nil query")
+	}
+
+	qe := QueryEngine{}
+	qe.termList = query.TermList()
+	if len(qe.termList) > GOOSE_MAX_QUERY_TERM {
+		return nil, log.Warn("to much terms [%d]", len(qe.termList))
+	}
+
+	root, matchAll, err := qe.build(db, query)
+	if err != nil {
+		return nil, err
+	}
+	if matchAll {
+		return nil, log.Warn("query match all docs")
+	}
+	qe.root = root
+
+	log.Debug("termCnt[%d]", qe.termCount)
+	return &qe, nil
+}
+
+// 全部叶子节点的term,按先序遍历的顺序
+func (this *QueryEngine) TermList() []TermInQuery {
+	return this.termList
+}
+
+// 递归构建遍历器,第二个返回值表示这个节点可以命中任意doc.
+// 叶子节点需要按先序遍历的顺序编号,子节点必须按顺序构建.
+func (this *QueryEngine) build(db DataBaseReader, n *QueryNode) (queryIterator, bool, error) {
+	switch n.Op {
+	case QueryOpTerm:
+		table, err := ReadSkipTable(db, n.Term.Sign)
+		if err != nil {
+			log.Warn("read term[%d] : %s", n.Term.Sign, err)
+			table = NewSkipTable(nil)
+		}
+		it := &termIterator{no: this.termCount, sign: n.Term.Sign}
+		it.cursor = table.NewCursor()
+		this.termCount++
+		log.Debug("term[%d] no[%d] listLen[%d]", it.sign, it.no, it.cursor.Len())
+		return it, false, nil
+
+	case QueryOpAnd:
+		it := &andIterator{}
+		nothing := false
+		for _, c := range n.Children {
+			if c.Op == QueryOpNot {
+				if len(c.Children) != 1 {
+					return nil, false, log.Warn("NOT node children count [%d]", len(c.Children))
+				}
+				sub, all, err := this.build(db, c.Children[0])
+				if err != nil {
+					return nil, false, err
+				}
+				if all {
+					// NOT一个命中任意doc的节点,整个AND不会有结果
+					nothing = true
+				}
+				it.neg = append(it.neg, sub)
+				continue
+			}
+			sub, all, err := this.build(db, c)
+			if err != nil {
+				return nil, false, err
+			}
+			if all {
+				it.opt = append(it.opt, sub)
+			} else {
+				it.pos = append(it.pos, sub)
+			}
+		}
+		if nothing {
+			return emptyIterator{}, false, nil
+		}
+		if len(it.pos) == 0 {
+			if len(it.neg) > 0 {
+				return nil, false, log.Warn("AND node with only NOT children")
+			}
+			return &matchAllIterator{children: it.opt}, true, nil
+		}
+		return it, false, nil
+
+	case QueryOpOr, QueryOpAtLeast:
+		need := 1
+		if n.Op == QueryOpAtLeast {
+			need = n.MinMatch
+		}
+		it := &atLeastIterator{}
+		for _, c := range n.Children {
+			sub, all, err := this.build(db, c)
+			if err != nil {
+				return nil, false, err
+			}
+			if all {
+				// 命中任意doc的子节点,总是计入命中数量
+				it.all = append(it.all, sub)
+				need--
+			} else {
+				it.sub = append(it.sub, sub)
+			}
+		}
+		if need <= 0 {
+			return &matchAllIterator{children: append(it.sub, it.all...)}, true, nil
+		}
+		if need > len(it.sub) {
+			return emptyIterator{}, false, nil
+		}
+		it.need = need
+		return it, false, nil
+
+	case QueryOpNot:
+		return nil, false, log.Warn("NOT node must be child of AND node")
+	}
+	return nil, false, log.Warn("unknown query op [%d]", n.Op)
+}
+
+// 获取下一个命中的doc.返回值的含义跟MergeEngine.Next一致
+func (this *QueryEngine) Next(termInDoclist []TermInDoc) (inId InIdType, currValid, allfinish bool) {
+
+	if len(termInDoclist) != this.termCount {
+		log.Warn("len(termInDoclist) != this.termCount")
+		return 0, false, true
+	}
+
+	if this.last == queryEnd {
+		return 0, false, true
+	}
+
+	inId = this.root.SkipTo(this.last + 1)
+	this.last = inId
+	if inId == queryEnd {
+		return 0, false, true
+	}
+
+	for i, _ := range termInDoclist {
+		termInDoclist[i].Sign = 0
+		termInDoclist[i].Weight = 0
+	}
+	this.root.Collect(inId, termInDoclist)
+
+	return inId, true, false
+}
+
+/* vim: set expandtab ts=4 sw=4 sts=4 tw=100: */
@@ -0,0 +1,209 @@
+package goose
+
+import (
+	. "github.com/getwe/goose/utils"
+	"math/rand"
+	"testing"
+)
+
+// 逐个doc按集合运算求值,作为QueryEngine的对照
+func evalQuery(db *memDB, n *QueryNode, inId InIdType) bool {
+	switch n.Op {
+	case QueryOpTerm:
+		for _, e := range *db.index[n.Term.Sign] {
+			if e.InID == inId {
+				return true
+			}
+		}
+		return false
+	case QueryOpAnd:
+		for _, c := range n.Children {
+			if c.Op == QueryOpNot {
+				if evalQuery(db, c.Children[0], inId) {
+					return false
+				}
+			} else if !evalQuery(db, c, inId) {
+				return false
+			}
+		}
+		return true
+	case QueryOpOr, QueryOpAtLeast:
+		need := 1
+		if n.Op == QueryOpAtLeast {
+			need = n.MinMatch
+		}
+		cnt := 0
+		for _, c := range n.Children {
+			if evalQuery(db, c, inId) {
+				cnt++
+			}
+		}
+		return cnt >= need
+	}
+	return false
+}
+
+// 存在只靠NOT子节点限定范围的AND节点,也就是其它子节点都可以命中任意doc.
+// phantom是不在任何拉链中的doc,命中它的节点可以命中任意doc
+func hasNotOnlyAnd(db *memDB, n *QueryNode, phantom InIdType) bool {
+	if n.Op == QueryOpAnd {
+		pos, neg := 0, 0
+		for _, c := range n.Children {
+			if c.Op == QueryOpNot {
+				neg++
+			} else if !evalQuery(db, c, phantom) {
+				pos++
+			}
+		}
+		if pos == 0 && neg > 0 {
+			return true
+		}
+	}
+	for _, c := range n.Children {
+		if c.Op == QueryOpNot {
+			c = c.Children[0]
+		}
+		if hasNotOnlyAnd(db, c, phantom) {
+			return true
+		}
+	}
+	return false
+}
+
+// 随机查询树,叶子节点是[1,termCnt]中的term
+func newRandQuery(r *rand.Rand, termCnt int, depth int) *QueryNode {
+	if depth == 0 || r.Intn(3) == 0 {
+		return NewTermQuery(TermInQuery{Sign: TermSign(r.Intn(termCnt) + 1)})
+	}
+	children := make([]*QueryNode, r.Intn(3)+1)
+	for i := range children {
+		children[i] = newRandQuery(r, termCnt, depth-1)
+	}
+	switch r.Intn(3) {
+	case 0:
+		// 部分子节点取反,可能全部取反
+		for i := range children {
+			if r.Intn(3) == 0 {
+				children[i] = NewNotQuery(children[i])
+			}
+		}
+		return NewAndQuery(children...)
+	case 1:
+		return NewOrQuery(children...)
+	}
+	// MinMatch覆盖0到len+1
+	return NewAtLeastQuery(r.Intn(len(children)+2), children...)
+}
+
+// 检查QueryEngine的结果跟逐个doc求值一致,返回false表示查询树被拒绝
+func checkQuery(t *testing.T, db *memDB, maxId int, q *QueryNode) bool {
+	// 不在任何拉链中的doc,命中的话说明查询可以命中任意doc
+	phantomId := InIdType(maxId + 1)
+	phantom := evalQuery(db, q, phantomId)
+
+	qe, err := NewQueryEngine(db, q)
+	if err != nil {
+		if !phantom && !hasNotOnlyAnd(db, q, phantomId) {
+			t.Fatalf("query rejected : %s", err)
+		}
+		return false
+	}
+	if phantom {
+		t.Fatalf("query match all docs accepted")
+	}
+
+	termList := qe.TermList()
+	termInDoc := make([]TermInDoc, len(termList))
+	got := make(map[InIdType]bool)
+	last := InIdType(0)
+	for {
+		inId, valid, finish := qe.Next(termInDoc)
+		if finish {
+			break
+		}
+		if !valid {
+			continue
+		}
+		if inId <= last {
+			t.Fatalf("doc [%d] after [%d]", inId, last)
+		}
+		last = inId
+		got[inId] = true
+
+		// 写入的term都命中了这个doc
+		for i, e := range termInDoc {
+			if e.Sign == 0 {
+				continue
+			}
+			if e.Sign != termList[i].Sign ||
+				!evalQuery(db, NewTermQuery(termList[i]), inId) {
+				t.Fatalf("doc [%d] term[%d] sign[%d] not hit", inId, i, e.Sign)
+			}
+		}
+	}
+
+	for id := 1; id <= maxId; id++ {
+		expect := evalQuery(db, q, InIdType(id))
+		if got[InIdType(id)] != expect {
+			t.Fatalf("doc [%d] get [%v] expect [%v]", id, got[InIdType(id)], expect)
+		}
+	}
+	return true
+}
+
+func TestQueryEngineRandom(t *testing.T) {
+	r := rand.New(rand.NewSource(1))
+	termCnt := 6
+	maxId := 60
+	accepted := 0
+	for round := 0; round < 2000; round++ {
+		db := newRandMemDB(r, termCnt, maxId/2, maxId, 10)
+		if checkQuery(t, db, maxId, newRandQuery(r, termCnt, 3)) {
+			accepted++
+		}
+	}
+	if accepted < 1000 {
+		t.Errorf("only [%d] queries accepted", accepted)
+	}
+}
+
+func TestQueryEngineEdge(t *testing.T) {
+	maxId := 100
+	db := newMemDB(4, 40, maxId)
+	term := func(sign int) *QueryNode {
+		return NewTermQuery(TermInQuery{Sign: TermSign(sign)})
+	}
+	terms := func() []*QueryNode {
+		return []*QueryNode{term(1), term(2), term(3), term(4)}
+	}
+
+	// AtLeast的边界:0命中任意doc被拒绝,len等价于AND,len+1没有结果
+	if _, err := NewQueryEngine(db, NewAtLeastQuery(0, terms()...)); err == nil {
+		t.Errorf("AtLeast(0) accepted")
+	}
+	checkQuery(t, db, maxId, NewAtLeastQuery(4, terms()...))
+	checkQuery(t, db, maxId, NewAtLeastQuery(5, terms()...))
+	checkQuery(t, db, maxId, NewAtLeastQuery(1, terms()...))
+
+	// 只有NOT子节点的AND被拒绝,嵌在其它节点中也一样
+	if _, err := NewQueryEngine(db, NewAndQuery(NewNotQuery(term(1)))); err == nil {
+		t.Errorf("NOT only AND accepted")
+	}
+	if _, err := NewQueryEngine(db,
+		NewOrQuery(term(1), NewAndQuery(NewNotQuery(term(2))))); err == nil {
+		t.Errorf("nested NOT only AND accepted")
+	}
+
+	// NOT分支本身是复杂的子树
+	checkQuery(t, db, maxId, NewAndQuery(term(1),
+		NewNotQuery(NewOrQuery(term(2), term(3))), NewNotQuery(term(4))))
+	checkQuery(t, db, maxId, NewAndQuery(term(1),
+		NewNotQuery(NewAndQuery(term(2), NewNotQuery(term(3))))))
+	// NOT一个命中任意doc的节点,没有结果
+	checkQuery(t, db, maxId, NewAndQuery(term(1),
+		NewNotQuery(NewAtLeastQuery(0, term(2)))))
+	// MinMatch为0的子节点只参与打分
+	checkQuery(t, db, maxId, NewAndQuery(term(1), NewAtLeastQuery(0, term(2), term(3))))
+}
+
+/* vim: set expandtab ts=4 sw=4 sts=4 tw=100: */
@@ -0,0 +1,119 @@
+package goose
+
+import (
+	"container/list"
+	. "github.com/getwe/goose/utils"
+	"sync"
+	"time"
+)
+
+// 检索结果缓存的状态
+type ResultCacheStatus struct {
+	// 命中次数
+	Hit int64
+	// 未命中次数,包括过期和数据变化导致的失效
+	Miss int64
+	// 缓存的结果数量
+	Count int
+	// 最大结果数量
+	MaxCount int
+}
+
+type resultCacheItem struct {
+	key    string
+	gen    uint64
+	expire time.Time
+	result SearchResultList
+}
+
+// 打分后的检索结果的LRU缓存,容量按结果数量计算.
+// 每个结果记录检索时的数据代数,数据库有写入或者同步后失效;超过ttl也失效.
+type ResultCache struct {
+	lock sync.Mutex
+
+	// 最近使用的在前
+	lru   *list.List
+	items map[string]*list.Element
+
+	maxCount int
+	ttl      time.Duration
+
+	hit  int64
+	miss int64
+}
+
+// 读取代数为gen的检索结果,返回的是副本,可以修改
+func (this *ResultCache) Get(key string, gen uint64) (SearchResultList, bool) {
+	this.lock.Lock()
+	defer this.lock.Unlock()
+
+	e, ok := this.items[key]
+	if !ok {
+		this.miss++
+		return nil, false
+	}
+	item := e.Value.(*resultCacheItem)
+	if item.gen != gen || time.Now().After(item.expire) {
+		this.remove(e)
+		this.miss++
+		return nil, false
+	}
+	this.lru.MoveToFront(e)
+	this.hit++
+
+	result := make(SearchResultList, len(item.result))
+	copy(result, item.result)
+	return result, true
+}
+
+// 写入代数为gen的检索结果,内部保存副本.超过容量时淘汰最久没有使用的结果
+func (this *ResultCache) Put(key string, gen uint64, result SearchResultList) {
+	if this.maxCount <= 0 {
+		return
+	}
+
+	item := resultCacheItem{key: key, gen: gen, expire: time.Now().Add(this.ttl)}
+	item.result = make(SearchResultList, len(result))
+	copy(item.result, result)
+
+	this.lock.Lock()
+	defer this.lock.Unlock()
+
+	if e, ok := this.items[key]; ok {
+		this.remove(e)
+	}
+	this.items[key] = this.lru.PushFront(&item)
+
+	for this.lru.Len() > this.maxCount {
+		this.remove(this.lru.Back())
+	}
+}
+
+func (this *ResultCache) remove(e *list.Element) {
+	item := this.lru.Remove(e).(*resultCacheItem)
+	delete(this.items, item.key)
+}
+
+func (this *ResultCache) GetStatus() ResultCacheStatus {
+	this.lock.Lock()
+	defer this.lock.Unlock()
+
+	st := ResultCacheStatus{}
+	st.Hit = this.hit
+	st.Miss = this.miss
+	st.Count = this.lru.Len()
+	st.MaxCount = this.maxCount
+	return st
+}
+
+// 构造函数.maxCount是最多缓存的检索结果数量,ttl是每个结果的有效时间
+func NewResultCache(maxCount int, ttl time.Duration) *ResultCache {
+	c := ResultCache{}
+	c.lru = list.New()
+	c.items = make(map[string]*list.Element)
+	c.maxCount = maxCount
+	c.ttl = ttl
+	return &c
+}
+
+/* vim: set expandtab ts=4 sw=4 sts=4 tw=100: */
@@ -0,0 +1,177 @@
+package goose
+
+import (
+	"fmt"
+	"github.com/getwe/goose/config"
+	. "github.com/getwe/goose/database"
+	. "github.com/getwe/goose/utils"
+	"os"
+	"path/filepath"
+	"strconv"
+	"testing"
+	"time"
+)
+
+// 请求是一个term,返回结果数量
+type cacheTestSty struct{}
+
+func (cacheTestSty) Init(conf config.Conf) error {
+	return nil
+}
+
+func (cacheTestSty) ParseQuery(request []byte, context *StyContext) ([]TermInQuery,
+	interface{}, error) {
+	term, err := strconv.Atoi(string(request))
+	if err != nil {
+		return nil, nil, err
+	}
+	return []TermInQuery{TermInQuery{Sign: TermSign(term), Weight: 1}}, nil, nil
+}
+
+func (cacheTestSty) CalWeight(queryInfo interface{}, inId InIdType, outId OutIdType,
+	termInQuery []TermInQuery, termInDoc []TermInDoc, termCnt uint32,
+	context *StyContext) (TermWeight, error) {
+	return 1, nil
+}
+
+func (cacheTestSty) Response(queryInfo interface{}, list SearchResultList,
+	valueReader ValueReader, dataReader DataReader, response []byte,
+	context *StyContext) (int, error) {
+	// 修改结果列表不影响缓存
+	for i := range list {
+		list[i].Weight = 0
+	}
+	return copy(response, fmt.Sprintf("%d", len(list))), nil
+}
+
+func TestResultCache(t *testing.T) {
+	c := NewResultCache(2, time.Hour)
+	c.Put("a", 1, SearchResultList{SearchResult{InId: 1, OutId: 1, Weight: 10}})
+	r, ok := c.Get("a", 1)
+	if !ok || len(r) != 1 || r[0].Weight != 10 {
+		t.Fatalf("get a %v %v", r, ok)
+	}
+	// 返回的是副本
+	r[0].Weight = 0
+	if r, _ := c.Get("a", 1); r[0].Weight != 10 {
+		t.Errorf("cached result modified")
+	}
+	// 数据代数变化后失效
+	if _, ok := c.Get("a", 2); ok {
+		t.Errorf("hit with new gen")
+	}
+	c.Put("a", 2, nil)
+	c.Put("b", 2, nil)
+	c.Put("c", 2, nil)
+	if _, ok := c.Get("a", 2); ok {
+		t.Errorf("a not evicted")
+	}
+
+	// 过期失效
+	c = NewResultCache(2, time.Millisecond)
+	c.Put("a", 1, nil)
+	time.Sleep(5 * time.Millisecond)
+	if _, ok := c.Get("a", 1); ok {
+		t.Errorf("hit after ttl")
+	}
+}
+
+// 请求的term作为缓存key
+type cacheKeyTestSty struct {
+	cacheTestSty
+}
+
+func (cacheKeyTestSty) CacheKey(queryInfo interface{}, termInQuery []TermInQuery,
+	context *StyContext) string {
+	return fmt.Sprintf("%d", termInQuery[0].Sign)
+}
+
+func TestSearcherResultCache(t *testing.T) {
+	dbPath := filepath.Join(os.Getenv("HOME"), "tmp", "goosedb", "test_result_cache")
+	os.RemoveAll(dbPath)
+	os.MkdirAll(dbPath, 0755)
+	buildTestVersion(t, dbPath, DBVersionStatus{Version: "db.20140101000000", BuildTime: 1},
+		map[int]int{1: 10, 2: 10})
+
+	dbs, err := newDBSwitcher(dbPath, switchTestSty{}, cacheKeyTestSty{},
+		dbSwitcherOptions{resultCacheSize: 10, resultCacheTTL: time.Hour})
+	if err != nil {
+		t.Fatalf("newDBSwitcher --- %s", err)
+	}
+	defer dbs.Close()
+
+	search := func() string {
+		v := dbs.Acquire()
+		defer dbs.Release(v)
+		res := make([]byte, 16)
+		n, err := v.searcher.Search(NewStyContext(), []byte("10"), res)
+		if err != nil {
+			t.Fatalf("Search --- %s", err)
+		}
+		return string(res[:n])
+	}
+	status := func() ResultCacheStatus {
+		v := dbs.Acquire()
+		defer dbs.Release(v)
+		st, _ := v.searcher.GetResultCacheStatus()
+		return st
+	}
+
+	if r := search(); r != "2" {
+		t.Errorf("first search [%s]", r)
+	}
+	if r := search(); r != "2" {
+		t.Errorf("cached search [%s]", r)
+	}
+	if st := status(); st.Hit != 1 || st.Miss != 1 {
+		t.Errorf("status %+v", st)
+	}
+
+	// 动态写入后缓存失效
+	if err = dbs.Index([]byte("3 10")); err != nil {
+		t.Fatalf("Index --- %s", err)
+	}
+	if r := search(); r != "3" {
+		t.Errorf("search after index [%s]", r)
+	}
+	if err = dbs.Delete([]OutIdType{1}); err != nil {
+		t.Fatalf("Delete --- %s", err)
+	}
+	if r := search(); r != "2" {
+		t.Errorf("search after delete [%s]", r)
+	}
+	if st := status(); st.Hit != 1 || st.Miss != 3 {
+		t.Errorf("status %+v", st)
+	}
+}
+
+func TestSearcherResultCacheNoKey(t *testing.T) {
+	dbPath := filepath.Join(os.Getenv("HOME"), "tmp", "goosedb", "test_result_cache_nokey")
+	os.RemoveAll(dbPath)
+	os.MkdirAll(dbPath, 0755)
+	buildTestVersion(t, dbPath, DBVersionStatus{Version: "db.20140101000000", BuildTime: 1},
+		map[int]int{1: 10, 2: 10})
+
+	// 策略没有实现CacheSearchStrategy,不使用缓存
+	dbs, err := newDBSwitcher(dbPath, switchTestSty{}, cacheTestSty{},
+		dbSwitcherOptions{resultCacheSize: 10, resultCacheTTL: time.Hour})
+	if err != nil {
+		t.Fatalf("newDBSwitcher --- %s", err)
+	}
+	defer dbs.Close()
+
+	v := dbs.Acquire()
+	defer dbs.Release(v)
+	res := make([]byte, 16)
+	for i := 0; i < 2; i++ {
+		_, err = v.searcher.Search(NewStyContext(), []byte("10"), res)
+		if err != nil {
+			t.Fatalf("Search --- %s", err)
+		}
+	}
+	if st, _ := v.searcher.GetResultCacheStatus(); st.Hit != 0 || st.Miss != 0 {
+		t.Errorf("status %+v", st)
+	}
+}
+
+/* vim: set expandtab ts=4 sw=4 sts=4 tw=100: */
@@ -3,6 +3,7 @@ package goose
 import (
 	. "github.com/getwe/goose/database"
 	. "github.com/getwe/goose/utils"
+	"sync"
 )
 
 type Searcher struct {
@@ -11,22 +12,144 @@ type Searcher struct {
 
 	// 检索策略逻辑
 	strategy SearchStrategy
+
+	// 检索结果缓存,nil表示不缓存
+	cache *ResultCache
+
+	// 并行归并的分片数量,InId空间切分成shardNum个范围并行归并打分,1表示不并行
+	shardNum int
+	// 全部拉链总长度达到这个值才并行归并,短的查询并行得不偿失
+	shardMinPostings int
 }
 
 func (this *Searcher) Search(context *StyContext, reqbuf []byte, resbuf []byte) (reslen int, err error) {
 
-	// 解析请求
-	termInQList, queryInfo, err := this.strategy.ParseQuery(reqbuf, context)
+	// 解析请求,策略支持查询树的话使用查询树
+	var query *QueryNode
+	var termInQList []TermInQuery
+	var queryInfo interface{}
+	treeSty, isTree := this.strategy.(QueryTreeSearchStrategy)
+	if isTree {
+		query, termInQList, queryInfo, err = treeSty.ParseQueryTree(reqbuf, context)
+	} else {
+		termInQList, queryInfo, err = this.strategy.ParseQuery(reqbuf, context)
+	}
 	if err != nil {
 		return 0, err
 	}
 
-	// 构建查询树
-	me, err := NewMergeEngine(this.db, termInQList)
+	// 先读取数据代数再检索,检索过程中有写入的话结果不会被当作最新的结果
+	key := this.cacheKey(context, query, termInQList, queryInfo)
+	var gen uint64
+	var result SearchResultList
+	hit := false
+	if len(key) > 0 {
+		gen = this.generation()
+		result, hit = this.cache.Get(key, gen)
+		context.Log.Info("cache", hit)
+	}
+	if !hit {
+		result, err = this.retrieve(context, query, termInQList, queryInfo)
+		if err != nil {
+			return 0, err
+		}
+		if len(key) > 0 {
+			this.cache.Put(key, gen, result)
+		}
+	}
+
+	// 完成
+	reslen, err = this.strategy.Response(queryInfo, result, this.db, this.db, resbuf, context)
 	if err != nil {
 		return 0, err
 	}
 
+	return reslen, nil
+}
+
+// 归并拉链并打分,得到Response之前的检索结果
+func (this *Searcher) retrieve(context *StyContext, query *QueryNode,
+	termInQList []TermInQuery, queryInfo interface{}) (result SearchResultList, err error) {
+
+	if query != nil {
+		// 查询树检索
+		var qe *QueryEngine
+		qe, err = NewQueryEngine(this.db, query)
+		if err != nil {
+			return nil, err
+		}
+		result, err = this.searchAll(context, queryInfo, qe.TermList(), qe)
+	} else {
+		// 策略支持TopK模式的话,优先使用TopK模式.位置检索需要逐个doc检查位置,不使用TopK
+		k := 0
+		proxSty, isProx := this.strategy.(ProximitySearchStrategy)
+		topkSty, ok := this.strategy.(TopKSearchStrategy)
+		if ok && !isProx {
+			k = topkSty.TopK(queryInfo, context)
+		}
+		if k > 0 {
+			context.Log.Info("topk", k)
+			result, err = this.searchTopK(context, queryInfo, termInQList, topkSty, k)
+		} else {
+			var lists []*SkipTable
+			lists, err = readTermLists(this.db, termInQList)
+			if err != nil {
+				return nil, err
+			}
+			var proximity []ProximityInQuery
+			if isProx {
+				proximity, err = proxSty.ParseProximity(queryInfo, termInQList, context)
+				if err != nil {
+					return nil, err
+				}
+			}
+			result, err = this.searchShards(context, queryInfo, termInQList, lists,
+				isProx, proximity)
+		}
+	}
+	return result, err
+}
+
+// 检索结果缓存的key,空串表示不缓存.
+// 只有策略实现了CacheSearchStrategy才缓存,打分可能依赖queryInfo,框架无法自己生成key
+func (this *Searcher) cacheKey(context *StyContext, query *QueryNode,
+	termInQList []TermInQuery, queryInfo interface{}) string {
+
+	if this.cache == nil {
+		return ""
+	}
+	cacheSty, ok := this.strategy.(CacheSearchStrategy)
+	if !ok {
+		return ""
+	}
+	return cacheSty.CacheKey(queryInfo, termInQList, context)
+}
+
+// 数据代数.数据库没有实现GenerationReader的话总是0,缓存的结果只依赖ttl失效
+func (this *Searcher) generation() uint64 {
+	if genReader, ok := this.db.(GenerationReader); ok {
+		return genReader.Generation()
+	}
+	return 0
+}
+
+// 检索结果缓存的命中情况,没有开启缓存返回false
+func (this *Searcher) GetResultCacheStatus() (ResultCacheStatus, bool) {
+	if this.cache == nil {
+		return ResultCacheStatus{}, false
+	}
+	return this.cache.GetStatus(), true
+}
+
+// 归并引擎,MergeEngine和QueryEngine都满足
+type mergeIterator interface {
+	Next(termInDoclist []TermInDoc) (inId InIdType, currValid, allfinish bool)
+}
+
+// 归并全部拉链,对每个命中的doc打分
+func (this *Searcher) searchAll(context *StyContext, queryInfo interface{},
+	termInQList []TermInQuery, me mergeIterator) (SearchResultList, error) {
+
 	result := make([]SearchResult, 0, GOOSE_DEFAULT_SEARCH_RESULT_CAPACITY)
 
 	// term命中doc的情况
@@ -42,21 +165,9 @@ func (this *Searcher) Search(context *StyContext, reqbuf []byte, resbuf []byte)
 			continue
 		}
 
-		outId, err := this.db.GetOutID(inId)
-		if err != nil {
-			context.Log.Warn("GetOutId fail [%s] InId[%d] OutId[%d]", err, inId, outId)
-			continue
-		}
-
-		if inId == 0 || outId == 0 {
-			context.Log.Warn("MergeEngine get illeagl doc InId[%d] OutId[%d]", inId, outId)
-			continue
-		}
-
-		weight, err := this.strategy.CalWeight(queryInfo, inId, outId,
-			termInQList, termInDocList, uint32(len(termInQList)), context)
-		if err != nil {
-			context.Log.Warn("CalWeight fail %s", err)
+		outId, weight, valid := this.calWeight(context, queryInfo, inId,
+			termInQList, termInDocList)
+		if !valid {
 			continue
 		}
 
@@ -66,19 +177,169 @@ func (this *Searcher) Search(context *StyContext, reqbuf []byte, resbuf []byte)
 			Weight: weight})
 
 	}
+	return result, nil
+}
 
-	// 完成
-	reslen, err = this.strategy.Response(queryInfo, result, this.db, this.db, resbuf, context)
+// 按InId范围把拉链分片,每个分片一个归并引擎并行归并打分,结果按分片顺序拼接,
+// 跟不分片的结果顺序一致.不需要分片时只有一个归并引擎
+func (this *Searcher) searchShards(context *StyContext, queryInfo interface{},
+	termInQList []TermInQuery, lists []*SkipTable, isProx bool,
+	proximity []ProximityInQuery) (SearchResultList, error) {
+
+	search := func(context *StyContext, begin, end InIdType) (SearchResultList, error) {
+		me := newMergeEngine(termInQList, lists, begin, end)
+		if isProx {
+			err := me.SetProximity(termInQList, proximity)
+			if err != nil {
+				return nil, err
+			}
+		}
+		return this.searchAll(context, queryInfo, termInQList, me)
+	}
+
+	bounds := this.shardBounds(lists)
+	if len(bounds) == 0 {
+		return search(context, 0, 0)
+	}
+	context.Log.Info("shard", len(bounds)+1)
+
+	// 分片i的范围是[bounds[i-1],bounds[i]),第一个分片从0开始,最后一个分片不限制上界
+	results := make([]SearchResultList, len(bounds)+1)
+	errs := make([]error, len(bounds)+1)
+	contexts := make([]*StyContext, len(bounds)+1)
+	var wg sync.WaitGroup
+	for i := range results {
+		begin, end := InIdType(0), InIdType(0)
+		if i > 0 {
+			begin = bounds[i-1]
+		}
+		if i < len(bounds) {
+			end = bounds[i]
+		}
+		contexts[i] = context.Clone()
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			results[i], errs[i] = search(contexts[i], begin, end)
+		}(i)
+	}
+	wg.Wait()
+
+	// 分片的日志按分片顺序合并回来
+	for _, c := range contexts {
+		context.Log.Merge(c.Log)
+	}
+
+	total := 0
+	for i, r := range results {
+		if errs[i] != nil {
+			return nil, errs[i]
+		}
+		total += len(r)
+	}
+	result := make(SearchResultList, 0, total)
+	for _, r := range results {
+		result = append(result, r...)
+	}
+	return result, nil
+}
+
+// 分片的分界InId,按拉链中最大的InId均分.不需要分片返回nil
+func (this *Searcher) shardBounds(lists []*SkipTable) []InIdType {
+	if this.shardNum <= 1 {
+		return nil
+	}
+	total := 0
+	maxInId := InIdType(0)
+	for _, table := range lists {
+		total += table.Len()
+		if last := table.LastInID(); last > maxInId {
+			maxInId = last
+		}
+	}
+	if total < this.shardMinPostings || int(maxInId) < this.shardNum {
+		return nil
+	}
+
+	step := maxInId/InIdType(this.shardNum) + 1
+	bounds := make([]InIdType, this.shardNum-1)
+	for i := range bounds {
+		bounds[i] = step * InIdType(i+1)
+	}
+	return bounds
+}
+
+// 设置并行归并.shardNum是分片数量,拉链总长度达到minPostings才并行.
+// 并行时策略的CalWeight会被多个goroutine同时调用,每个goroutine使用克隆的StyContext
+func (this *Searcher) SetParallel(shardNum int, minPostings int) {
+	this.shardNum = shardNum
+	this.shardMinPostings = minPostings
+}
+
+// 只保留得分最高的k个结果,利用term得分上界剪枝
+func (this *Searcher) searchTopK(context *StyContext, queryInfo interface{},
+	termInQList []TermInQuery, topkSty TopKSearchStrategy, k int) (SearchResultList, error) {
+
+	te, err := NewTopKEngine(this.db, termInQList)
 	if err != nil {
+		return nil, err
 	}
 
-	return reslen, nil
+	upperBound, err := topkSty.TermUpperBound(queryInfo, termInQList, te.MaxWeights(), context)
+	if err != nil {
+		return nil, err
+	}
+
+	scoreCnt := 0
+	result, err := te.Search(k, upperBound,
+		func(inId InIdType, termInDocList []TermInDoc) (OutIdType, TermWeight, bool) {
+			scoreCnt++
+			return this.calWeight(context, queryInfo, inId, termInQList, termInDocList)
+		})
+	if err != nil {
+		return nil, err
+	}
+	context.Log.Info("scoreCnt", scoreCnt)
+	return result, nil
 }
 
-func NewSearcher(db DataBaseReader, sty SearchStrategy) (*Searcher, error) {
+// 对一个归并得到的doc打分,返回false表示丢弃这个doc
+func (this *Searcher) calWeight(context *StyContext, queryInfo interface{}, inId InIdType,
+	termInQList []TermInQuery, termInDocList []TermInDoc) (OutIdType, TermWeight, bool) {
+
+	// 已删除的doc不再参与打分
+	if this.db.IsDeleted(inId) {
+		return 0, 0, false
+	}
+
+	outId, err := this.db.GetOutID(inId)
+	if err != nil {
+		context.Log.Warn("GetOutId fail [%s] InId[%d] OutId[%d]", err, inId, outId)
+		return 0, 0, false
+	}
+
+	if inId == 0 || outId == 0 {
+		context.Log.Warn("MergeEngine get illeagl doc InId[%d] OutId[%d]", inId, outId)
+		return 0, 0, false
+	}
+
+	weight, err := this.strategy.CalWeight(queryInfo, inId, outId,
+		termInQList, termInDocList, uint32(len(termInQList)), context)
+	if err != nil {
+		context.Log.Warn("CalWeight fail %s", err)
+		return 0, 0, false
+	}
+	return outId, weight, true
+}
+
+// 创建检索流程.可选参数1是检索结果缓存
+func NewSearcher(db DataBaseReader, sty SearchStrategy, cache ...*ResultCache) (*Searcher, error) {
 	var s Searcher
 	s.db = db
 	s.strategy = sty
+	if len(cache) > 0 {
+		s.cache = cache[0]
+	}
 	return &s, nil
 }
 
@@ -0,0 +1,290 @@
+package goose
+
+import (
+	"container/heap"
+	. "github.com/getwe/goose/database"
+	log "github.com/getwe/goose/log"
+	. "github.com/getwe/goose/utils"
+	"sort"
+)
+
+// TopK模式中的一个term
+type topKTerm struct {
+	sign   TermSign       // term签名
+	no     int            // term编号
+	cursor *InvListCursor // term对应拉链的遍历器
+	ub     int64          // term对doc得分贡献的上界
+}
+
+// 保存当前最好的K个结果,堆顶是其中最差的一个
+type topKHeap []SearchResult
+
+// 堆必须支持接口:Len
+func (h topKHeap) Len() int {
+	return len(h)
+}
+
+// 堆排序必须支持接口:Less.排在SearchResultList后面的结果更差,放在堆顶
+func (h topKHeap) Less(i, j int) bool {
+	return SearchResultList(h).Less(j, i)
+}
+
+// 堆排序必须支持接口:Swap
+func (h topKHeap) Swap(i, j int) {
+	h[i], h[j] = h[j], h[i]
+}
+
+// 堆排序必须支持接口:Push
+func (h *topKHeap) Push(x interface{}) {
+	*h = append(*h, x.(SearchResult))
+}
+
+// 堆排序必须支持接口:Pop
+func (h *topKHeap) Pop() interface{} {
+	old := *h
+	n := len(old)
+	item := old[n-1]
+	*h = old[0 : n-1]
+	return item
+}
+
+// 对doc打分的回调,返回false表示丢弃这个doc
+type topKScoreFunc func(inId InIdType, termInDoc []TermInDoc) (OutIdType, TermWeight, bool)
+
+// TopK检索引擎,使用MaxScore算法.
+// 每个term有一个得分上界,已经得到K个结果之后,当前第K个结果的得分就是门槛,
+// 一个doc命中的全部term的上界之和不超过门槛,就不需要再打分.
+// 另外,只命中上界之和不超过门槛的那部分可省term的doc也不可能进入TopK,
+// 这部分拉链不再驱动遍历,只在其它拉链找到候选doc后跳表查找.
+type TopKEngine struct {
+	termCount int
+
+	// 不可省term,检索结果必须全部命中
+	must []*topKTerm
+	// 可省term,按上界升序
+	opt []*topKTerm
+	// 存在拉链为空的不可省term,不可能有任何结果
+	mustEmpty bool
+
+	// 所有term的拉链最大Weight,按term编号
+	maxWeight []TermWeight
+}
+
+// 读取全部term的拉链,构建TopK检索引擎
+func NewTopKEngine(db DataBaseReader, termList []TermInQuery) (*TopKEngine, error) {
+	if len(termList) > GOOSE_MAX_QUERY_TERM {
+		return nil, log.Warn("to much terms [%d]", len(termList))
+	}
+
+	e := TopKEngine{}
+	e.termCount = len(termList)
+	e.maxWeight = make([]TermWeight, len(termList))
+
+	for i, t := range termList {
+		table, err := ReadSkipTable(db, t.Sign)
+		if err != nil {
+			log.Warn("read term[%d] : %s", t.Sign, err)
+			table = NewSkipTable(nil)
+		}
+
+		term := &topKTerm{}
+		term.sign = t.Sign
+		term.no = i
+		term.cursor = table.NewCursor()
+		e.maxWeight[i] = term.cursor.MaxWeight()
+
+		if term.cursor.Len() == 0 {
+			if t.CanOmit == false {
+				e.mustEmpty = true
+			}
+			continue
+		}
+		if t.CanOmit {
+			e.opt = append(e.opt, term)
+		} else {
+			e.must = append(e.must, term)
+		}
+	}
+	return &e, nil
+}
+
+// 每个term拉链中最大的Weight,按term编号,拉链为空的term为0
+func (this *TopKEngine) MaxWeights() []TermWeight {
+	return this.maxWeight
+}
+
+// 检索得分最高的k个结果,返回结果按SearchResultList的顺序排序.
+// upperBound是每个term(按term编号)对doc得分贡献的上界.
+func (this *TopKEngine) Search(k int, upperBound []TermWeight,
+	score topKScoreFunc) (SearchResultList, error) {
+
+	if k <= 0 {
+		return nil, log.Warn("illegal k [%d]", k)
+	}
+	if len(upperBound) != this.termCount {
+		return nil, log.Warn("len(upperBound)[%d] != termCount[%d]",
+			len(upperBound), this.termCount)
+	}
+
+	result := make(topKHeap, 0, k)
+	if this.mustEmpty || len(this.must)+len(this.opt) == 0 {
+		return SearchResultList(result), nil
+	}
+
+	var mustUb int64
+	for _, t := range this.must {
+		t.ub = int64(upperBound[t.no])
+		mustUb += t.ub
+	}
+	for _, t := range this.opt {
+		t.ub = int64(upperBound[t.no])
+	}
+	sort.Sort(topKTermByUb(this.opt))
+
+	// prefix[i]是opt[0:i]的上界之和
+	prefix := make([]int64, len(this.opt)+1)
+	for i, t := range this.opt {
+		prefix[i+1] = prefix[i] + t.ub
+	}
+	optUb := prefix[len(this.opt)]
+
+	termInDoc := make([]TermInDoc, this.termCount)
+
+	for {
+		// 门槛,没凑够k个结果之前没有门槛
+		full := len(result) >= k
+		var threshold int64
+		if full {
+			threshold = int64(result[0].Weight)
+		}
+
+		// 找到下一个候选doc
+		var inId InIdType
+		var ok bool
+		if len(this.must) > 0 {
+			inId, ok = this.nextMust()
+		} else {
+			// opt[0:essential]这些term的上界之和不超过门槛,只命中这些term的doc不需要考虑
+			essential := 0
+			if full {
+				for essential < len(this.opt) && prefix[essential+1] <= threshold {
+					essential++
+				}
+			}
+			inId, ok = this.nextOpt(essential)
+		}
+		if !ok {
+			break
+		}
+
+		// 计算上界,逐个确认可省term是否命中,上界越大的越先确认
+		for i := range termInDoc {
+			termInDoc[i].Sign = 0
+			termInDoc[i].Weight = 0
+		}
+		for _, t := range this.must {
+			termInDoc[t.no].Sign = t.sign
+			termInDoc[t.no].Weight = t.cursor.Curr().Weight
+		}
+		bound := mustUb + optUb
+		pruned := false
+		for i := len(this.opt) - 1; i >= 0; i-- {
+			if full && bound <= threshold {
+				pruned = true
+				break
+			}
+			t := this.opt[i]
+			if t.cursor.SkipTo(inId) && t.cursor.Curr().InID == inId {
+				termInDoc[t.no].Sign = t.sign
+				termInDoc[t.no].Weight = t.cursor.Curr().Weight
+			} else {
+				bound -= t.ub
+			}
+		}
+		if full && bound <= threshold {
+			pruned = true
+		}
+
+		if !pruned {
+			outId, weight, valid := score(inId, termInDoc)
+			if valid {
+				r := SearchResult{InId: inId, OutId: outId, Weight: weight}
+				if !full {
+					heap.Push(&result, r)
+				} else if SearchResultList([]SearchResult{r, result[0]}).Less(0, 1) {
+					result[0] = r
+					heap.Fix(&result, 0)
+				}
+			}
+		}
+
+		// 命中当前doc的拉链后移
+		for _, t := range this.must {
+			t.cursor.Next()
+		}
+		for _, t := range this.opt {
+			if t.cursor.Valid() && t.cursor.Curr().InID == inId {
+				t.cursor.Next()
+			}
+		}
+	}
+
+	sort.Sort(SearchResultList(result))
+	return SearchResultList(result), nil
+}
+
+// 不可省term的leapfrog,找到全部不可省term都命中的下一个doc
+func (this *TopKEngine) nextMust() (InIdType, bool) {
+	for {
+		if !this.must[0].cursor.Valid() {
+			return 0, false
+		}
+		target := this.must[0].cursor.Curr().InID
+		for _, t := range this.must[1:] {
+			if !t.cursor.SkipTo(target) {
+				return 0, false
+			}
+			if t.cursor.Curr().InID > target {
+				target = t.cursor.Curr().InID
+			}
+		}
+
+		same := true
+		for _, t := range this.must {
+			if !t.cursor.SkipTo(target) {
+				return 0, false
+			}
+			if t.cursor.Curr().InID != target {
+				same = false
+			}
+		}
+		if same {
+			return target, true
+		}
+	}
+}
+
+// opt[essential:]中最小的InID
+func (this *TopKEngine) nextOpt(essential int) (InIdType, bool) {
+	var inId InIdType
+	ok := false
+	for _, t := range this.opt[essential:] {
+		if !t.cursor.Valid() {
+			continue
+		}
+		if !ok || t.cursor.Curr().InID < inId {
+			inId = t.cursor.Curr().InID
+			ok = true
+		}
+	}
+	return inId, ok
+}
+
+// 可省term按上界升序排序
+type topKTermByUb []*topKTerm
+
+func (s topKTermByUb) Len() int           { return len(s) }
+func (s topKTermByUb) Less(i, j int) bool { return s[i].ub < s[j].ub }
+func (s topKTermByUb) Swap(i, j int)      { s[i], s[j] = s[j], s[i] }
+
+/* vim: set expandtab ts=4 sw=4 sts=4 tw=100: */
@@ -0,0 +1,133 @@
+package goose
+
+import (
+	. "github.com/getwe/goose/database"
+	. "github.com/getwe/goose/utils"
+	"math/rand"
+	"sort"
+	"testing"
+)
+
+// 构造termCnt条拉链,长度在[1,maxLen]之间随机,Weight在[1,maxWeight]之间随机,
+// Weight范围小的时候会出现大量得分相同的doc
+func newRandMemDB(r *rand.Rand, termCnt int, maxLen int, maxId int, maxWeight int) *memDB {
+	db := &memDB{index: make(map[TermSign]*InvList)}
+	for i := 1; i <= termCnt; i++ {
+		listLen := r.Intn(maxLen) + 1
+		if listLen > maxId {
+			listLen = maxId
+		}
+		hit := make(map[int]bool)
+		for len(hit) < listLen {
+			hit[r.Intn(maxId)+1] = true
+		}
+		l := NewInvList(listLen)
+		for id := 1; id <= maxId; id++ {
+			if hit[id] {
+				l.Append(Index{InID: InIdType(id),
+					Weight: TermWeight(r.Intn(maxWeight) + 1)})
+			}
+		}
+		db.index[TermSign(i)] = &l
+	}
+	return db
+}
+
+// doc得分是命中term的Weight之和,InId是7的倍数的doc丢弃
+func topKTestScore(inId InIdType, termInDoc []TermInDoc) (OutIdType, TermWeight, bool) {
+	if inId%7 == 0 {
+		return 0, 0, false
+	}
+	weight := TermWeight(0)
+	for _, e := range termInDoc {
+		weight += e.Weight
+	}
+	return OutIdType(inId), weight, true
+}
+
+// MergeEngine归并全部doc逐个打分,排序后取前k个
+func exhaustiveTopK(t *testing.T, db *memDB, termList []TermInQuery, k int) SearchResultList {
+	me, err := NewMergeEngine(db, termList)
+	if err != nil {
+		t.Fatalf("NewMergeEngine : %s", err)
+	}
+	termInDoc := make([]TermInDoc, len(termList))
+	all := SearchResultList{}
+	for {
+		inId, valid, finish := me.Next(termInDoc)
+		if valid {
+			outId, weight, ok := topKTestScore(inId, termInDoc)
+			if ok {
+				all = append(all, SearchResult{InId: inId, OutId: outId, Weight: weight})
+			}
+		}
+		if finish {
+			break
+		}
+	}
+	sort.Sort(all)
+	if len(all) > k {
+		all = all[:k]
+	}
+	return all
+}
+
+func TestTopKEngineRandom(t *testing.T) {
+	r := rand.New(rand.NewSource(1))
+	for round := 0; round < 200; round++ {
+		termCnt := r.Intn(6) + 1
+		maxId := r.Intn(500) + 1
+		// 一半的轮次Weight范围很小,制造大量同分
+		maxWeight := 100
+		if round%2 == 0 {
+			maxWeight = 2
+		}
+		db := newRandMemDB(r, termCnt, maxId, maxId, maxWeight)
+		termList := newTermList(termCnt, r.Intn(termCnt+1))
+
+		// k覆盖1,比命中数少,比命中数多
+		for _, k := range []int{1, r.Intn(20) + 1, maxId + 10} {
+			expect := exhaustiveTopK(t, db, termList, k)
+
+			te, err := NewTopKEngine(db, termList)
+			if err != nil {
+				t.Fatalf("NewTopKEngine : %s", err)
+			}
+			// 得分是Weight之和,每个term的上界是拉链中最大的Weight
+			got, err := te.Search(k, te.MaxWeights(), topKTestScore)
+			if err != nil {
+				t.Fatalf("Search : %s", err)
+			}
+
+			if len(got) != len(expect) {
+				t.Fatalf("round[%d] k[%d] get [%d] results expect [%d]",
+					round, k, len(got), len(expect))
+			}
+			for i := range got {
+				if got[i] != expect[i] {
+					t.Fatalf("round[%d] k[%d] result[%d] %v expect %v",
+						round, k, i, got[i], expect[i])
+				}
+			}
+		}
+	}
+}
+
+func TestTopKEngineMustEmpty(t *testing.T) {
+	db := newMemDB(2, 10, 20)
+	termList := newTermList(3, 3)
+	te, err := NewTopKEngine(db, termList)
+	if err != nil {
+		t.Fatalf("NewTopKEngine : %s", err)
+	}
+	// 不可省的term 3没有拉链,没有结果
+	got, err := te.Search(5, te.MaxWeights(), topKTestScore)
+	if err != nil || len(got) != 0 {
+		t.Errorf("get [%d] results err[%v]", len(got), err)
+	}
+	if _, err = te.Search(0, te.MaxWeights(), topKTestScore); err == nil {
+		t.Errorf("search k=0 without error")
+	}
+}
+
+/* vim: set expandtab ts=4 sw=4 sts=4 tw=100: */
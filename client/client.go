@@ -0,0 +1,173 @@
+// goose检索服务和索引服务的Go客户端,使用protocol包定义的帧协议.
+package client
+
+import (
+	"bufio"
+	"fmt"
+	. "github.com/getwe/goose/protocol"
+	. "github.com/getwe/goose/utils"
+	"io"
+	"net"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// 服务端返回的错误
+type ServerError struct {
+	Status int
+	Msg    string
+}
+
+func (this *ServerError) Error() string {
+	return fmt.Sprintf("goose server error [%d] %s", this.Status, this.Msg)
+}
+
+// 一个请求的响应
+type Response struct {
+	Payload []byte
+	Err     error
+}
+
+// 客户端,维持一个长连接.可以并发调用,同一时间只有一个请求(或一批请求)在连接上.
+// 网络错误之后连接不再可用,需要重新Dial.
+type Client struct {
+	lock    sync.Mutex
+	conn    net.Conn
+	reader  *bufio.Reader
+	timeout time.Duration
+	// 响应最大长度
+	maxResponseSize int
+}
+
+// 连接服务端.timeout是每次请求的超时时间,0表示不超时
+func Dial(addr string, timeout time.Duration) (*Client, error) {
+	conn, err := net.DialTimeout("tcp", addr, timeout)
+	if err != nil {
+		return nil, err
+	}
+	c := Client{}
+	c.conn = conn
+	c.reader = bufio.NewReader(conn)
+	c.timeout = timeout
+	c.maxResponseSize = 64 * 1024 * 1024
+	return &c, nil
+}
+
+// 设置响应最大长度,超过的响应返回错误
+func (this *Client) SetMaxResponseSize(n int) {
+	this.lock.Lock()
+	defer this.lock.Unlock()
+	this.maxResponseSize = n
+}
+
+// 检索,返回检索策略Response写入的结果
+func (this *Client) Search(req []byte) ([]byte, error) {
+	res := this.Pipeline(TypeSearch, [][]byte{req})
+	return res[0].Payload, res[0].Err
+}
+
+// 动态插入一个doc的索引
+func (this *Client) Index(doc []byte) error {
+	res := this.Pipeline(TypeIndex, [][]byte{doc})
+	return res[0].Err
+}
+
+// 根据外部id删除doc
+func (this *Client) Delete(outIdList []OutIdType) error {
+	buf := make([]byte, 0, len(outIdList)*8)
+	for i, id := range outIdList {
+		if i > 0 {
+			buf = append(buf, ' ')
+		}
+		buf = strconv.AppendUint(buf, uint64(id), 10)
+	}
+	res := this.Pipeline(TypeDelete, [][]byte{buf})
+	return res[0].Err
+}
+
+// 批量检索,一次发送全部请求再按顺序读取全部响应
+func (this *Client) SearchBatch(reqs [][]byte) []Response {
+	return this.Pipeline(TypeSearch, reqs)
+}
+
+// 连续发送多个同类型的请求,不等待响应,最后按顺序读取全部响应.
+// 返回的Response跟reqs一一对应.
+func (this *Client) Pipeline(typ uint8, reqs [][]byte) []Response {
+	this.lock.Lock()
+	defer this.lock.Unlock()
+
+	res := make([]Response, len(reqs))
+	// 网络或者协议错误,连接上的数据已经不可信,关闭连接
+	setErr := func(err error) []Response {
+		if this.conn != nil {
+			this.conn.Close()
+			this.conn = nil
+		}
+		for i, _ := range res {
+			if res[i].Err == nil && res[i].Payload == nil {
+				res[i].Err = err
+			}
+		}
+		return res
+	}
+
+	if this.conn == nil {
+		return setErr(fmt.Errorf("client closed"))
+	}
+	if this.timeout > 0 {
+		this.conn.SetDeadline(time.Now().Add(this.timeout))
+	}
+
+	w := bufio.NewWriter(this.conn)
+	for _, req := range reqs {
+		err := WriteFrame(w, typ, req)
+		if err != nil {
+			return setErr(err)
+		}
+	}
+	err := w.Flush()
+	if err != nil {
+		return setErr(err)
+	}
+
+	for i, _ := range reqs {
+		h, err := ReadHeader(this.reader)
+		if err != nil {
+			return setErr(err)
+		}
+		if int64(h.Length) > int64(this.maxResponseSize) {
+			return setErr(&ErrFrameTooLarge{Length: h.Length, Limit: this.maxResponseSize})
+		}
+		payload := make([]byte, h.Length)
+		_, err = io.ReadFull(this.reader, payload)
+		if err != nil {
+			return setErr(err)
+		}
+
+		switch h.Type {
+		case TypeOK:
+			res[i].Payload = payload
+		case TypeError:
+			status, msg := ParseError(payload)
+			res[i].Err = &ServerError{Status: status, Msg: msg}
+		default:
+			return setErr(fmt.Errorf("unknown response type [%d]", h.Type))
+		}
+	}
+	return res
+}
+
+// 关闭连接
+func (this *Client) Close() error {
+	this.lock.Lock()
+	defer this.lock.Unlock()
+	if this.conn == nil {
+		return nil
+	}
+	err := this.conn.Close()
+	this.conn = nil
+	return err
+}
+
+/* vim: set expandtab ts=4 sw=4 sts=4 tw=100: */
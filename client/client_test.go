@@ -0,0 +1,153 @@
+package client
+
+import (
+	"bufio"
+	"bytes"
+	. "github.com/getwe/goose/protocol"
+	"net"
+	"testing"
+	"time"
+)
+
+// 启动一个帧协议的测试服务端,收齐batch个请求之后才按顺序返回响应,
+// 客户端没有连续发送的话会一直等到超时.
+// 检索请求"error"返回404,"large"返回1KB的结果,"sleep"等待200ms后返回,其它请求原样返回.
+func startTestServer(t *testing.T, batch int) net.Listener {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Listen --- %s", err)
+	}
+	serve := func(conn net.Conn) {
+		defer conn.Close()
+		r := bufio.NewReader(conn)
+		w := bufio.NewWriter(conn)
+		buf := make([]byte, 1024)
+		reqs := make([][]byte, 0, batch)
+		for {
+			_, payload, err := ReadFrame(r, buf)
+			if err != nil {
+				return
+			}
+			reqs = append(reqs, append([]byte(nil), payload...))
+			if len(reqs) < batch {
+				continue
+			}
+			for _, req := range reqs {
+				switch string(req) {
+				case "error":
+					WriteError(w, 404, "not found")
+				case "large":
+					WriteFrame(w, TypeOK, bytes.Repeat([]byte("x"), 1024))
+				case "sleep":
+					time.Sleep(200 * time.Millisecond)
+					WriteFrame(w, TypeOK, req)
+				default:
+					WriteFrame(w, TypeOK, req)
+				}
+			}
+			reqs = reqs[:0]
+			if w.Flush() != nil {
+				return
+			}
+		}
+	}
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go serve(conn)
+		}
+	}()
+	return l
+}
+
+func TestClientSearchBatch(t *testing.T) {
+	l := startTestServer(t, 3)
+	defer l.Close()
+
+	c, err := Dial(l.Addr().String(), time.Second)
+	if err != nil {
+		t.Fatalf("Dial --- %s", err)
+	}
+	defer c.Close()
+
+	// 三个请求一起发送,服务端收齐后才返回
+	for round := 0; round < 2; round++ {
+		res := c.SearchBatch([][]byte{[]byte("a"), []byte("error"), []byte("c")})
+		if res[0].Err != nil || string(res[0].Payload) != "a" {
+			t.Fatalf("round[%d] res[0] [%s] err[%v]", round, res[0].Payload, res[0].Err)
+		}
+		// 错误响应转换成ServerError,连接依然可用
+		serr, ok := res[1].Err.(*ServerError)
+		if !ok || serr.Status != 404 || serr.Msg != "not found" || res[1].Payload != nil {
+			t.Fatalf("round[%d] res[1] err[%v]", round, res[1].Err)
+		}
+		if res[2].Err != nil || string(res[2].Payload) != "c" {
+			t.Fatalf("round[%d] res[2] [%s] err[%v]", round, res[2].Payload, res[2].Err)
+		}
+	}
+}
+
+func TestClientMaxResponseSize(t *testing.T) {
+	l := startTestServer(t, 1)
+	defer l.Close()
+
+	c, err := Dial(l.Addr().String(), time.Second)
+	if err != nil {
+		t.Fatalf("Dial --- %s", err)
+	}
+	defer c.Close()
+
+	if res, err := c.Search([]byte("large")); err != nil || len(res) != 1024 {
+		t.Fatalf("Search len[%d] err[%v]", len(res), err)
+	}
+	c.SetMaxResponseSize(100)
+	_, err = c.Search([]byte("large"))
+	if tooLarge, ok := err.(*ErrFrameTooLarge); !ok || tooLarge.Length != 1024 ||
+		tooLarge.Limit != 100 {
+		t.Fatalf("Search large err[%v]", err)
+	}
+	// 响应没有读完,连接已经关闭
+	if _, err = c.Search([]byte("a")); err == nil {
+		t.Errorf("Search after too large response without error")
+	}
+}
+
+func TestClientTimeout(t *testing.T) {
+	l := startTestServer(t, 1)
+	defer l.Close()
+
+	c, err := Dial(l.Addr().String(), 50*time.Millisecond)
+	if err != nil {
+		t.Fatalf("Dial --- %s", err)
+	}
+	defer c.Close()
+
+	if res, err := c.Search([]byte("a")); err != nil || string(res) != "a" {
+		t.Fatalf("Search [%s] err[%v]", res, err)
+	}
+	_, err = c.Search([]byte("sleep"))
+	if nerr, ok := err.(net.Error); !ok || !nerr.Timeout() {
+		t.Fatalf("Search sleep err[%v]", err)
+	}
+	// 超时的响应可能之后才到达,连接不再使用
+	if _, err = c.Search([]byte("a")); err == nil {
+		t.Errorf("Search after timeout without error")
+	}
+
+	// 没有连续发送的批量请求等不到响应
+	l2 := startTestServer(t, 2)
+	defer l2.Close()
+	c2, err := Dial(l2.Addr().String(), 50*time.Millisecond)
+	if err != nil {
+		t.Fatalf("Dial --- %s", err)
+	}
+	defer c2.Close()
+	if _, err = c2.Search([]byte("a")); err == nil {
+		t.Errorf("single request to batch server without error")
+	}
+}
+
+/* vim: set expandtab ts=4 sw=4 sts=4 tw=100: */
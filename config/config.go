@@ -35,3 +35,55 @@ func register(name string, parser confParser) {
 	}
 	parsers[name] = parser
 }
+
+// 读取可选的整数配置项,配置项不存在或者为0时返回def
+func Int64Default(c Conf, key string, def int64) (v int64) {
+	defer func() {
+		if r := recover(); r != nil {
+			v = def
+		}
+	}()
+	v = c.Int64(key)
+	if v == 0 {
+		v = def
+	}
+	return v
+}
+
+// 读取可选的浮点数配置项,配置项不存在或者为0时返回def
+func Float64Default(c Conf, key string, def float64) (v float64) {
+	defer func() {
+		if r := recover(); r != nil {
+			v = def
+		}
+	}()
+	v = c.Float64(key)
+	if v == 0 {
+		v = def
+	}
+	return v
+}
+
+// 读取可选的布尔配置项,配置项不存在时返回def
+func BoolDefault(c Conf, key string, def bool) (v bool) {
+	defer func() {
+		if r := recover(); r != nil {
+			v = def
+		}
+	}()
+	return c.Bool(key)
+}
+
+// 读取可选的字符串配置项,配置项不存在或者为空时返回def
+func StringDefault(c Conf, key string, def string) (v string) {
+	defer func() {
+		if r := recover(); r != nil {
+			v = def
+		}
+	}()
+	v = c.String(key)
+	if len(v) == 0 {
+		v = def
+	}
+	return v
+}
@@ -1,9 +1,13 @@
 package database
 
 import (
+	"errors"
 	. "github.com/getwe/goose/utils"
 )
 
+// 删除doc时外部ID不存在
+var ErrOutIdNotFound = errors.New("outId not found")
+
 // 索引迭代器.
 type IndexIterator interface {
 	// 获取索引库中的下一个TermSign
@@ -29,8 +33,13 @@ type IndexReader interface {
 	ReadIndex(t TermSign) (*InvList, error)
 }
 
+// 可以读取带跳表的拉链,跳表跟拉链一起缓存,检索时不需要重新构建
+type SkipTableReader interface {
+	ReadSkipTable(t TermSign) (*SkipTable, error)
+}
+
 type IndexWriter interface {
-	// 写入索引
+	// 写入索引,TermInDoc中的位置信息跟拉链一起写入
 	WriteIndex(InID InIdType, termlist []TermInDoc) error
 }
 
@@ -59,6 +68,9 @@ type DataBaseReader interface {
 	// 查询外部ID
 	GetOutID(inId InIdType) (OutIdType, error)
 
+	// 内部ID是否已经被删除
+	IsDeleted(inId InIdType) bool
+
 	// 支持索引写入
 	IndexReader
 
@@ -69,11 +81,24 @@ type DataBaseReader interface {
 	DataReader
 }
 
+// 数据代数接口,可选实现.写入索引,删除doc或者同步之后返回值变化,
+// 上层根据代数判断缓存的检索结果是否失效
+type GenerationReader interface {
+	Generation() uint64
+}
+
 // 可写入数据库接口
 type DataBaseWriter interface {
 	// 根据唯一外部ID,分配内部ID
 	AllocID(outID OutIdType) (InIdType, error)
 
+	// 提交内部ID,doc的索引,Value,Data全部写入后调用,提交后检索可见.
+	// 同一个外部ID已有的旧版本doc会被新版本替代.
+	CommitID(inID InIdType) error
+
+	// 根据外部ID删除doc,删除后检索不再返回该doc.外部ID不存在返回ErrOutIdNotFound
+	DeleteDoc(outID OutIdType) error
+
 	// 支持索引写入
 	IndexWriter
 
@@ -85,4 +110,7 @@ type DataBaseWriter interface {
 
 	// 进行一次同步
 	Sync() error
+
+	// 一批写入完成后调用,保证之前写入的索引不会因为崩溃丢失
+	Flush() error
 }
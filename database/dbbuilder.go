@@ -3,9 +3,73 @@ package database
 import (
 	log "github.com/getwe/goose/log"
 	. "github.com/getwe/goose/utils"
+	"io"
+	"io/ioutil"
 	"os"
+	"path/filepath"
+	"strings"
+	"time"
 )
 
+// 建库统计中保留的最长拉链数量
+const buildStatLongestLists = 10
+
+// 建库生成的最终索引的统计
+type DBBuilderStatus struct {
+	// 最终索引的term数量和拉链总长度,包括建库过程中被删除的doc
+	TermCount    int64
+	PostingCount int64
+	// 最长的拉链,从长到短
+	LongestLists []TermListLen
+	// 正排转倒排暂存到磁盘的次数和耗时(秒)
+	SpillCount   int
+	SpillSeconds float64
+	// 生成最终索引的耗时(秒),包括合并暂存的索引以及增量建库合并基础版本
+	MergeSeconds float64
+	// 建库分配到的内部id,之后的id是检索程序动态分配的
+	CurId InIdType
+}
+
+// 一个term的拉链长度
+type TermListLen struct {
+	Term TermSign
+	Len  int
+}
+
+// 写入索引的同时统计拉链
+type indexStatWriter struct {
+	dst  WriteOnlyIndex
+	stat *DBBuilderStatus
+}
+
+func (this *indexStatWriter) WriteIndex(t TermSign, l *InvList) error {
+	err := this.dst.WriteIndex(t, l)
+	if err != nil {
+		return err
+	}
+
+	this.stat.TermCount++
+	this.stat.PostingCount += int64(l.Len())
+
+	// 按长度从长到短插入,只保留最长的几个
+	longest := this.stat.LongestLists
+	if len(longest) == buildStatLongestLists && longest[len(longest)-1].Len >= l.Len() {
+		return nil
+	}
+	i := len(longest)
+	for i > 0 && longest[i-1].Len < l.Len() {
+		i--
+	}
+	longest = append(longest, TermListLen{})
+	copy(longest[i+1:], longest[i:])
+	longest[i] = TermListLen{Term: t, Len: l.Len()}
+	if len(longest) > buildStatLongestLists {
+		longest = longest[:buildStatLongestLists]
+	}
+	this.stat.LongestLists = longest
+	return nil
+}
+
 // 静态索引生成器.并发不安全,内部不加锁浪费性能.调用者需要保证不并发使用.
 type DBBuilder struct {
 
@@ -21,6 +85,12 @@ type DBBuilder struct {
 	// data管理
 	dataMgr *DataManager
 
+	// 增量建库的基础版本目录,全量建库为空
+	basePath string
+
+	// 最终索引的统计,Sync之后有效
+	status DBBuilderStatus
+
 	filePath       string
 	indexFileName  string
 	maxTermCnt     int
@@ -28,6 +98,7 @@ type DBBuilder struct {
 	valueSz        uint32
 	maxDataFileSz  uint32
 	maxIndexFileSz uint32
+	codec          PostingCodecType
 }
 
 // 根据唯一外部ID,分配内部ID,可并发内部有锁控制按顺序分配
@@ -38,6 +109,22 @@ func (this *DBBuilder) AllocID(outID OutIdType) (InIdType, error) {
 	return this.idMgr.AllocID(outID)
 }
 
+// 根据外部ID删除doc.建库过程中删除的doc,在索引中依然存在,检索时被过滤
+func (this *DBBuilder) DeleteDoc(outID OutIdType) error {
+	if this.idMgr == nil {
+		return log.Error("no id manager")
+	}
+	return this.idMgr.DeleteByOutId(outID)
+}
+
+// 提交内部ID.同一个外部ID多次写入,只有最后提交的有效
+func (this *DBBuilder) CommitID(inID InIdType) error {
+	if this.idMgr == nil {
+		return log.Error("no id manager")
+	}
+	return this.idMgr.CommitID(inID)
+}
+
 // 写入索引,不可并发写入
 func (this *DBBuilder) WriteIndex(InID InIdType, termlist []TermInDoc) error {
 	if this.transformMgr == nil {
@@ -66,26 +153,50 @@ func (this *DBBuilder) WriteData(InID InIdType, d Data) error {
 	return this.dataMgr.Append(InID, d)
 }
 
+// 最终索引的统计,Sync之后有效
+func (this *DBBuilder) GetStatus() DBBuilderStatus {
+	return this.status
+}
+
+// 设置正排转倒排合并索引时打印进度的周期,0不打印
+func (this *DBBuilder) SetProgressInterval(interval time.Duration) {
+	this.transformMgr.SetProgressInterval(interval)
+}
+
 // 进行一次数据同步.对于DBBuilder,一次同步后全部数据写入磁盘,只允许一次写入
 func (this *DBBuilder) Sync() error {
+	begin := time.Now()
+	this.status = DBBuilderStatus{}
+
 	this.dataMgr.Close()
 
 	this.valueMgr.Sync()
 
 	this.idMgr.Sync()
+	this.status.CurId = this.idMgr.GetStatus().CurId
 
-	// 打开一个最终可写入的磁盘索引并写入全部索引
-	db := NewDiskIndex()
-	err := db.Init(this.filePath, this.indexFileName, this.maxIndexFileSz,
-		this.transformMgr.GetTermCount())
-	if err != nil {
-		return err
+	var err error
+	if len(this.basePath) == 0 {
+		// 打开一个最终可写入的磁盘索引并写入全部索引
+		err = this.dumpIndex(this.indexFileName, this.statIndex)
+	} else {
+		err = this.mergeIndex()
+		if err == nil {
+			removeDiskIndex(this.filePath, baseSnapshotName)
+			os.Remove(filepath.Join(this.filePath, baseSnapshotFile))
+		}
 	}
-	err = this.transformMgr.Dump(db)
 	if err != nil {
 		return err
 	}
-	db.Close()
+
+	// 最后一次暂存磁盘发生在Sync中,计入统计
+	tfStatus := this.transformMgr.GetStatus()
+	this.status.SpillCount = tfStatus.SpillCount
+	this.status.SpillSeconds = tfStatus.SpillSeconds
+	this.status.MergeSeconds = time.Since(begin).Seconds()
+	log.Info("db sync finish, term [%d] posting [%d] cost [%s]", this.status.TermCount,
+		this.status.PostingCount, time.Since(begin))
 
 	this.transformMgr = nil
 	this.idMgr = nil
@@ -94,6 +205,104 @@ func (this *DBBuilder) Sync() error {
 	return nil
 }
 
+// 写入最终索引的同时统计
+func (this *DBBuilder) statIndex(db *DiskIndex) WriteOnlyIndex {
+	return &indexStatWriter{dst: db, stat: &this.status}
+}
+
+// 正排转倒排的全部索引写入一个新的磁盘索引,dst可以对写入的磁盘索引进行包装
+func (this *DBBuilder) dumpIndex(name string, dst func(*DiskIndex) WriteOnlyIndex) error {
+	db := NewDiskIndex()
+	err := db.Init(this.filePath, name, this.maxIndexFileSz, this.transformMgr.GetTermCount(),
+		this.codec)
+	if err != nil {
+		return err
+	}
+	err = this.transformMgr.Dump(dst(db))
+	if err != nil {
+		return err
+	}
+	db.Close()
+	return nil
+}
+
+// 增量建库:新增doc的索引先写入增量磁盘索引,再跟基础版本的静态索引合并成新的静态索引
+func (this *DBBuilder) mergeIndex() error {
+	deltaName := "delta"
+	err := this.dumpIndex(deltaName, func(db *DiskIndex) WriteOnlyIndex { return db })
+	if err != nil {
+		return err
+	}
+
+	delta := NewDiskIndex()
+	err = delta.Open(this.filePath, deltaName)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		delta.Close()
+		files, _ := filepath.Glob(filepath.Join(this.filePath, deltaName+".*"))
+		for _, f := range files {
+			os.Remove(f)
+		}
+	}()
+
+	// 基础版本的静态索引在InitIncremental时已经做了快照
+	snapshot := baseSnapshot{}
+	err = JsonDecodeFromFile(&snapshot, filepath.Join(this.filePath, baseSnapshotFile))
+	if err != nil {
+		return log.Error("read base snapshot fail : %s", err)
+	}
+	base := NewDiskIndex()
+	err = base.Open(this.filePath, baseSnapshotName)
+	if err != nil {
+		return err
+	}
+	defer base.Close()
+
+	db := NewDiskIndex()
+	err = db.Init(this.filePath, this.indexFileName, this.maxIndexFileSz,
+		base.GetTermCount()+delta.GetTermCount(), this.codec)
+	if err != nil {
+		return err
+	}
+	// 新增doc的内部id都比基础版本的大,合并后拉链依然有序.
+	// 基础版本中检索程序动态分配的id已经丢弃,它们的索引同样丢弃
+	err = IndexMerge(&idLimitIndex{src: base, curId: snapshot.CurId}, delta,
+		&emptyFilterIndex{dst: this.statIndex(db)})
+	if err != nil {
+		return err
+	}
+	db.Close()
+
+	log.Info("merge index base term[%d] delta term[%d]", base.GetTermCount(),
+		delta.GetTermCount())
+	return nil
+}
+
+// 已经写入的全部数据持久化到磁盘.建库过程崩溃后可以用Open恢复到最近一次Flush的状态,
+// 之后写入的doc需要重新写入.
+func (this *DBBuilder) Flush() error {
+	if this.transformMgr == nil {
+		return log.Error("db already synced")
+	}
+
+	err := this.dataMgr.Sync()
+	if err != nil {
+		return err
+	}
+	err = this.valueMgr.Sync()
+	if err != nil {
+		return err
+	}
+	err = this.transformMgr.Checkpoint()
+	if err != nil {
+		return err
+	}
+	// id状态最后保存,打开时以分配到的id为准
+	return this.idMgr.Sync()
+}
+
 // 初始化工作.
 // fPath:工作目录.
 // MaxTermCnt:内部正排转倒排一次在内存中写入的最大term数量.
@@ -101,9 +310,10 @@ func (this *DBBuilder) Sync() error {
 // valueSz:value数据固定大小.
 // maxIndexFileSz:index数据分文件每个文件的最大大小.
 // maxDataFileSz:data数据分文件每个文件的最大大小.
+// codec:最终索引的拉链序列化格式.
 func (this *DBBuilder) Init(fPath string, MaxTermCnt int,
 	Maxid InIdType, valueSz uint32,
-	maxIndexFileSz uint32, maxDataFileSz uint32) error {
+	maxIndexFileSz uint32, maxDataFileSz uint32, codec PostingCodecType) error {
 
 	var err error
 
@@ -114,7 +324,12 @@ func (this *DBBuilder) Init(fPath string, MaxTermCnt int,
 	this.valueSz = valueSz
 	this.maxDataFileSz = maxDataFileSz
 	this.maxIndexFileSz = maxIndexFileSz
+	this.codec = codec
 
+	// 已经发布的版本目录可能正在被检索程序使用,不能删除
+	if _, err := os.Stat(filepath.Join(this.filePath, DBVersionStatFile)); err == nil {
+		return log.Error("[%s] is a published db version, refuse to overwrite", this.filePath)
+	}
 	os.RemoveAll(this.filePath)
 
 	if _, err := os.Stat(this.filePath); os.IsNotExist(err) {
@@ -147,6 +362,276 @@ func (this *DBBuilder) Init(fPath string, MaxTermCnt int,
 	return nil
 }
 
+// 增量建库的初始化工作.
+// 复制基础版本的id,value,data到工作目录,之后写入的doc追加在基础版本的doc之后,
+// 同一个外部id的旧版本doc在提交时被删除.Sync时新增的索引跟基础版本的静态索引合并.
+// 基础版本可能正在被检索程序使用,id等文件一直在变化,静态索引也可能被合并替换:
+//   - 只保留基础版本建库时分配的id,检索程序动态写入的doc丢弃,由检索程序重放请求日志恢复
+//   - 基础版本的静态索引硬链接到工作目录作为快照,之后基础版本的变化不影响增量建库
+//
+// fPath:工作目录.
+// basePath:基础版本目录.
+// MaxTermCnt:内部正排转倒排一次在内存中写入的最大term数量.
+// maxIndexFileSz:index数据分文件每个文件的最大大小.
+// codec:合并后的静态索引的拉链序列化格式.
+func (this *DBBuilder) InitIncremental(fPath string, basePath string, MaxTermCnt int,
+	maxIndexFileSz uint32, codec PostingCodecType) error {
+
+	var err error
+
+	this.filePath = fPath
+	this.basePath = basePath
+	this.indexFileName = "static"
+	this.maxTermCnt = MaxTermCnt
+	this.maxIndexFileSz = maxIndexFileSz
+	this.codec = codec
+
+	if _, err := os.Stat(filepath.Join(this.filePath, DBVersionStatFile)); err == nil {
+		return log.Error("[%s] is a published db version, refuse to overwrite", this.filePath)
+	}
+	os.RemoveAll(this.filePath)
+
+	err = os.MkdirAll(this.filePath, 0755)
+	if err != nil {
+		return err
+	}
+
+	// 读取基础版本的过程中不能被清理
+	ref, err := RefDBVersion(basePath)
+	if err != nil {
+		return err
+	}
+	defer ref.Release()
+
+	snapshot, err := snapshotBaseIndex(basePath, fPath)
+	if err != nil {
+		return err
+	}
+
+	err = copyDBFiles(basePath, fPath, []string{"id", "value.", "data."})
+	if err != nil {
+		return err
+	}
+
+	err = this.transformMgr.Init(fPath, MaxTermCnt)
+	if err != nil {
+		return err
+	}
+
+	err = this.idMgr.Open(fPath)
+	if err != nil {
+		return err
+	}
+
+	// 早期的版本没有记录建库时的id,以复制时的id为准,之后分配的id的索引同样丢弃
+	curId := this.idMgr.GetStatus().CurId
+	if snapshot.CurId == 0 || snapshot.CurId > curId {
+		snapshot.CurId = curId
+	}
+	err = this.idMgr.Truncate(snapshot.CurId)
+	if err != nil {
+		return err
+	}
+	err = JsonEncodeToFile(snapshot, filepath.Join(fPath, baseSnapshotFile))
+	if err != nil {
+		return err
+	}
+
+	err = this.valueMgr.Open(fPath)
+	if err != nil {
+		return err
+	}
+
+	err = this.dataMgr.Open(fPath)
+	if err != nil {
+		return err
+	}
+	this.maxId = this.dataMgr.dataStatus.MaxInId
+
+	return nil
+}
+
+// 打开Flush过的工作目录继续建库.参数跟Init或InitIncremental相同,全量建库basePath为空.
+// 最近一次Flush之后写入的doc被丢弃,调用者需要重新写入.
+func (this *DBBuilder) Open(fPath string, basePath string, MaxTermCnt int,
+	maxIndexFileSz uint32, codec PostingCodecType) error {
+
+	this.filePath = fPath
+	this.basePath = basePath
+	this.indexFileName = "static"
+	this.maxTermCnt = MaxTermCnt
+	this.maxIndexFileSz = maxIndexFileSz
+	this.codec = codec
+
+	if _, err := os.Stat(filepath.Join(this.filePath, DBVersionStatFile)); err == nil {
+		return log.Error("[%s] is a published db version, refuse to overwrite", this.filePath)
+	}
+
+	err := this.transformMgr.Open(fPath, MaxTermCnt)
+	if err != nil {
+		return log.Error("open transform status fail : %s", err)
+	}
+
+	err = this.idMgr.Open(fPath)
+	if err != nil {
+		return err
+	}
+
+	err = this.valueMgr.Open(fPath)
+	if err != nil {
+		return err
+	}
+	this.valueSz = this.valueMgr.valueStatus.ValueSize
+
+	err = this.dataMgr.Open(fPath)
+	if err != nil {
+		return err
+	}
+	this.maxId = this.dataMgr.dataStatus.MaxInId
+
+	return nil
+}
+
+const (
+	// 工作目录中基础版本静态索引快照的索引名
+	baseSnapshotName = "base"
+	// 快照的状态文件
+	baseSnapshotFile = "base.stat"
+)
+
+// 增量建库的基础版本快照
+type baseSnapshot struct {
+	// 快照的基础版本静态索引名
+	Name string
+	// 基础版本建库时分配到的id,之后的id丢弃
+	CurId InIdType
+}
+
+// 把基础版本的静态索引硬链接到工作目录,不在同一个文件系统时复制.
+// 磁盘索引写完之后不再修改,硬链接得到的就是一致的快照,基础版本删除索引文件也不受影响.
+// 基础版本记录了建库时的id的话,使用建库生成的静态索引,其中只有建库时分配的id;
+// 早期的版本使用当前的静态索引,链接过程中被合并替换的话重试.
+func snapshotBaseIndex(basePath string, fPath string) (baseSnapshot, error) {
+	snapshot := baseSnapshot{}
+	version, err := ReadDBVersion(basePath)
+	if err == nil && version.CurId > 0 {
+		snapshot.CurId = version.CurId
+	}
+
+	for retry := 0; retry < 3; retry++ {
+		snapshot.Name = staticIndexDefaultName
+		if snapshot.CurId == 0 {
+			snapshot.Name = StaticIndexName(basePath)
+		}
+		removeDiskIndex(fPath, baseSnapshotName)
+		err = linkDiskIndex(basePath, snapshot.Name, fPath, baseSnapshotName)
+		if err == nil && (snapshot.CurId > 0 || snapshot.Name == StaticIndexName(basePath)) {
+			return snapshot, nil
+		}
+	}
+	return snapshot, log.Error("snapshot base static index [%s] fail : %v", basePath, err)
+}
+
+// 把src目录下的磁盘索引name链接为dst目录下的磁盘索引dstName
+func linkDiskIndex(src string, name string, dst string, dstName string) error {
+	files, err := filepath.Glob(filepath.Join(src, name+".index*"))
+	if err != nil {
+		return err
+	}
+	if len(files) == 0 {
+		return log.Error("disk index [%s] not found in [%s]", name, src)
+	}
+	for _, f := range files {
+		target := filepath.Join(dst, dstName+strings.TrimPrefix(filepath.Base(f), name))
+		if os.Link(f, target) == nil {
+			continue
+		}
+		err = copyFile(f, target)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// 过滤掉拉链中curId及之后的id
+type idLimitIndex struct {
+	src   ReadOnlyIndex
+	curId InIdType
+}
+
+func (this *idLimitIndex) NewIterator() IndexIterator {
+	return this.src.NewIterator()
+}
+
+func (this *idLimitIndex) ReadIndex(t TermSign) (*InvList, error) {
+	l, err := this.src.ReadIndex(t)
+	if err != nil {
+		return nil, err
+	}
+	lst := NewInvList(l.Len())
+	for _, index := range *l {
+		if index.InID < this.curId {
+			lst.Append(index)
+		}
+	}
+	return &lst, nil
+}
+
+// 空拉链不写入
+type emptyFilterIndex struct {
+	dst WriteOnlyIndex
+}
+
+func (this *emptyFilterIndex) WriteIndex(t TermSign, l *InvList) error {
+	if l.Len() == 0 {
+		return nil
+	}
+	return this.dst.WriteIndex(t, l)
+}
+
+// 复制src目录下以prefixes之一开头的文件到dst目录
+func copyDBFiles(src string, dst string, prefixes []string) error {
+	infos, err := ioutil.ReadDir(src)
+	if err != nil {
+		return err
+	}
+	for _, info := range infos {
+		if info.IsDir() {
+			continue
+		}
+		for _, prefix := range prefixes {
+			if strings.HasPrefix(info.Name(), prefix) {
+				err = copyFile(filepath.Join(src, info.Name()), filepath.Join(dst, info.Name()))
+				if err != nil {
+					return log.Error("copy [%s] fail : %s", info.Name(), err)
+				}
+				break
+			}
+		}
+	}
+	return nil
+}
+
+func copyFile(src string, dst string) error {
+	in, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+
+	out, err := os.OpenFile(dst, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0644)
+	if err != nil {
+		return err
+	}
+	_, err = io.Copy(out, in)
+	if err != nil {
+		out.Close()
+		return err
+	}
+	return out.Close()
+}
+
 func NewDBBuilder() *DBBuilder {
 	db := DBBuilder{}
 
@@ -33,7 +33,8 @@ func TestDBBuilder(t *testing.T) {
 	var valueSz uint32 = 32
 
 	db := NewDBBuilder()
-	err := db.Init(testpath, transformMaxTermCnt, maxId, valueSz, maxFileSz, maxFileSz)
+	err := db.Init(testpath, transformMaxTermCnt, maxId, valueSz, maxFileSz, maxFileSz,
+		DefaultPostingCodec)
 	if err != nil {
 		t.Error(err.Error())
 		return
@@ -67,6 +68,12 @@ func TestDBBuilder(t *testing.T) {
 			return
 		}
 
+		err = db.CommitID(inId)
+		if err != nil {
+			t.Error(err.Error())
+			return
+		}
+
 	}
 
 	t1 := time.Now().Unix()
@@ -76,3 +83,268 @@ func TestDBBuilder(t *testing.T) {
 	t2 := time.Now().Unix()
 	t.Logf("db.Sync() use time(s) : %d", t2-t1)
 }
+
+func TestDBBuilderIncremental(t *testing.T) {
+	dbPath := filepath.Join(os.Getenv("HOME"), "tmp", "goosedb", "test_dbbuilder_incremental")
+	os.RemoveAll(dbPath)
+	basePath := filepath.Join(dbPath, "base")
+	deltaPath := filepath.Join(dbPath, "delta")
+
+	write := func(db *DBBuilder, outId OutIdType, term TermSign, d string) {
+		inId, err := db.AllocID(outId)
+		if err != nil {
+			t.Fatalf("AllocID --- %s", err)
+		}
+		db.WriteIndex(inId, []TermInDoc{TermInDoc{Sign: term, Weight: 1}})
+		db.WriteValue(inId, Value("v"))
+		db.WriteData(inId, Data(d))
+		db.CommitID(inId)
+	}
+
+	base := NewDBBuilder()
+	if err := base.Init(basePath, 1000, 100, 1, 1024*1024, 1024*1024, DefaultPostingCodec); err != nil {
+		t.Fatalf("Init --- %s", err)
+	}
+	write(base, 1, 10, "a")
+	write(base, 2, 10, "b")
+	if err := base.Sync(); err != nil {
+		t.Fatalf("Sync --- %s", err)
+	}
+
+	// 新增doc 3,替换doc 2
+	delta := NewDBBuilder()
+	if err := delta.InitIncremental(deltaPath, basePath, 1000, 1024*1024,
+		DefaultPostingCodec); err != nil {
+		t.Fatalf("InitIncremental --- %s", err)
+	}
+	write(delta, 3, 20, "c")
+	write(delta, 2, 20, "B")
+	if err := delta.Sync(); err != nil {
+		t.Fatalf("Sync --- %s", err)
+	}
+
+	db := NewDBSearcher()
+	if err := db.Init(deltaPath); err != nil {
+		t.Fatalf("DBSearcher.Init --- %s", err)
+	}
+	defer db.Close()
+
+	hits := func(term TermSign) map[OutIdType]string {
+		l, err := db.ReadIndex(term)
+		if err != nil {
+			t.Fatalf("ReadIndex --- %s", err)
+		}
+		res := make(map[OutIdType]string)
+		for _, index := range *l {
+			if db.IsDeleted(index.InID) {
+				continue
+			}
+			outId, _ := db.GetOutID(index.InID)
+			var d Data
+			db.ReadData(index.InID, &d)
+			res[outId] = string(d)
+		}
+		return res
+	}
+	if r := hits(10); len(r) != 1 || r[1] != "a" {
+		t.Errorf("term10 hit %v", r)
+	}
+	if r := hits(20); len(r) != 2 || r[2] != "B" || r[3] != "c" {
+		t.Errorf("term20 hit %v", r)
+	}
+}
+
+func TestDBBuilderIncrementalLiveBase(t *testing.T) {
+	dbPath := filepath.Join(os.Getenv("HOME"), "tmp", "goosedb", "test_dbbuilder_incremental_live")
+	os.RemoveAll(dbPath)
+	basePath := filepath.Join(dbPath, "base")
+	deltaPath := filepath.Join(dbPath, "delta")
+
+	base := NewDBBuilder()
+	if err := base.Init(basePath, 1000, 100, 1, 1024*1024, 1024*1024, DefaultPostingCodec); err != nil {
+		t.Fatalf("Init --- %s", err)
+	}
+	for _, outId := range []OutIdType{1, 2} {
+		inId, _ := base.AllocID(outId)
+		base.WriteIndex(inId, []TermInDoc{TermInDoc{Sign: 10, Weight: 1}})
+		base.WriteValue(inId, Value("v"))
+		base.WriteData(inId, Data("a"))
+		base.CommitID(inId)
+	}
+	if err := base.Sync(); err != nil {
+		t.Fatalf("Sync --- %s", err)
+	}
+	err := SaveDBVersion(basePath, DBVersionStatus{Version: "base", CurId: base.GetStatus().CurId})
+	if err != nil {
+		t.Fatalf("SaveDBVersion --- %s", err)
+	}
+
+	// 检索程序在基础版本上动态写入doc并合并进静态索引
+	searcher := NewDBSearcher()
+	if err := searcher.Init(basePath); err != nil {
+		t.Fatalf("DBSearcher.Init --- %s", err)
+	}
+	defer searcher.Close()
+	live := func(outId OutIdType) {
+		inId, err := searcher.AllocID(outId)
+		if err != nil {
+			t.Fatalf("AllocID --- %s", err)
+		}
+		searcher.WriteIndex(inId, []TermInDoc{TermInDoc{Sign: 10, Weight: 1}})
+		searcher.WriteValue(inId, Value("v"))
+		searcher.WriteData(inId, Data("live"))
+		searcher.CommitID(inId)
+		if err := searcher.ForceSync(); err != nil {
+			t.Fatalf("ForceSync --- %s", err)
+		}
+	}
+	live(4)
+
+	delta := NewDBBuilder()
+	if err := delta.InitIncremental(deltaPath, basePath, 1000, 1024*1024,
+		DefaultPostingCodec); err != nil {
+		t.Fatalf("InitIncremental --- %s", err)
+	}
+
+	// 增量建库过程中基础版本继续写入并合并,替换掉快照的静态索引
+	live(5)
+	if err := searcher.FoldVarIndex(); err != nil {
+		t.Fatalf("FoldVarIndex --- %s", err)
+	}
+	live(6)
+	if err := searcher.FoldVarIndex(); err != nil {
+		t.Fatalf("FoldVarIndex --- %s", err)
+	}
+
+	for _, outId := range []OutIdType{3, 2} {
+		inId, _ := delta.AllocID(outId)
+		delta.WriteIndex(inId, []TermInDoc{TermInDoc{Sign: 20, Weight: 1}})
+		delta.WriteValue(inId, Value("v"))
+		delta.WriteData(inId, Data("delta"))
+		delta.CommitID(inId)
+	}
+	if err := delta.Sync(); err != nil {
+		t.Fatalf("Sync --- %s", err)
+	}
+	if files, _ := filepath.Glob(filepath.Join(deltaPath, "base.*")); len(files) != 0 {
+		t.Errorf("base snapshot not removed : %v", files)
+	}
+
+	db := NewDBSearcher()
+	if err := db.Init(deltaPath); err != nil {
+		t.Fatalf("DBSearcher.Init --- %s", err)
+	}
+	defer db.Close()
+
+	// 动态写入的doc不在增量版本中,由检索程序重放请求日志恢复;
+	// 它们的索引不会跟新增doc的id冲突
+	hits := func(term TermSign) map[OutIdType]string {
+		l, err := db.ReadIndex(term)
+		if err != nil {
+			t.Fatalf("ReadIndex --- %s", err)
+		}
+		res := make(map[OutIdType]string)
+		for _, index := range *l {
+			if db.IsDeleted(index.InID) {
+				continue
+			}
+			outId, _ := db.GetOutID(index.InID)
+			var d Data
+			db.ReadData(index.InID, &d)
+			res[outId] = string(d)
+		}
+		return res
+	}
+	if r := hits(10); len(r) != 1 || r[1] != "a" {
+		t.Errorf("term10 hit %v", r)
+	}
+	if r := hits(20); len(r) != 2 || r[2] != "delta" || r[3] != "delta" {
+		t.Errorf("term20 hit %v", r)
+	}
+	if _, ok := db.idMgr.GetInID(4); ok {
+		t.Errorf("live doc 4 in incremental version")
+	}
+}
+
+func TestDBBuilderResume(t *testing.T) {
+	path := filepath.Join(os.Getenv("HOME"), "tmp", "goosedb", "test_dbbuilder_resume")
+	os.RemoveAll(path)
+
+	write := func(db *DBBuilder, outId OutIdType, term TermSign) {
+		inId, err := db.AllocID(outId)
+		if err != nil {
+			t.Fatalf("AllocID --- %s", err)
+		}
+		db.WriteIndex(inId, []TermInDoc{TermInDoc{Sign: term, Weight: 1}})
+		db.WriteValue(inId, Value("v"))
+		db.WriteData(inId, Data("d"))
+		db.CommitID(inId)
+	}
+
+	// 每个IndexTransform只能写两个doc,Flush前后都有暂存到磁盘的索引
+	db := NewDBBuilder()
+	if err := db.Init(path, 2, 100, 1, 1024*1024, 1024*1024, DefaultPostingCodec); err != nil {
+		t.Fatalf("Init --- %s", err)
+	}
+	for i := 1; i <= 5; i++ {
+		write(db, OutIdType(i), 10)
+	}
+	if err := db.Flush(); err != nil {
+		t.Fatalf("Flush --- %s", err)
+	}
+	// Flush之后写入的doc在崩溃后丢失
+	for i := 6; i <= 10; i++ {
+		write(db, OutIdType(i), 20)
+	}
+
+	db = NewDBBuilder()
+	if err := db.Open(path, "", 2, 1024*1024, DefaultPostingCodec); err != nil {
+		t.Fatalf("Open --- %s", err)
+	}
+	for i := 6; i <= 8; i++ {
+		write(db, OutIdType(i), 30)
+	}
+	if err := db.Sync(); err != nil {
+		t.Fatalf("Sync --- %s", err)
+	}
+
+	// 崩溃前写入的term20不在最终索引中
+	st := db.GetStatus()
+	if st.TermCount != 2 || st.PostingCount != 8 || len(st.LongestLists) != 2 ||
+		st.LongestLists[0] != (TermListLen{Term: 10, Len: 5}) ||
+		st.LongestLists[1] != (TermListLen{Term: 30, Len: 3}) || st.SpillCount < 3 {
+		t.Errorf("status %+v", st)
+	}
+
+	searcher := NewDBSearcher()
+	if err := searcher.Init(path); err != nil {
+		t.Fatalf("DBSearcher.Init --- %s", err)
+	}
+	defer searcher.Close()
+
+	count := func(term TermSign) int {
+		l, err := searcher.ReadIndex(term)
+		if err != nil {
+			t.Fatalf("ReadIndex --- %s", err)
+		}
+		n := 0
+		for _, index := range *l {
+			if !searcher.IsDeleted(index.InID) {
+				n++
+			}
+		}
+		return n
+	}
+	if n := count(10); n != 5 {
+		t.Errorf("term10 hit [%d]", n)
+	}
+	if n := count(20); n != 0 {
+		t.Errorf("term20 hit [%d]", n)
+	}
+	if n := count(30); n != 3 {
+		t.Errorf("term30 hit [%d]", n)
+	}
+	if outId, err := searcher.GetOutID(8); err != nil || outId != 8 {
+		t.Errorf("inId 8 outId [%d] err [%v]", outId, err)
+	}
+}
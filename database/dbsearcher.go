@@ -3,8 +3,13 @@ package database
 import (
 	log "github.com/getwe/goose/log"
 	. "github.com/getwe/goose/utils"
+	"sync"
+	"sync/atomic"
 )
 
+// 默认的拉链缓存大小(拉链总长度)
+const DefaultIndexCacheSize = 1024 * 1024
+
 type DBSearcher struct {
 
 	// 静态索引库
@@ -22,6 +27,18 @@ type DBSearcher struct {
 	// data管理
 	dataMgr *DataManager
 
+	// 读索引跟动态索引合并进静态索引的切换互斥,保证读到的静态索引和动态索引是一致的
+	indexLock sync.RWMutex
+
+	// 同一时间只有一个合并过程
+	foldLock sync.Mutex
+
+	// 静态索引和动态索引磁盘段合并后的拉链缓存
+	cache *InvListCache
+
+	// 写入索引,删除和提交doc的次数,跟动态索引段列表的代数一起组成数据代数
+	writeGen uint64
+
 	// 工作目录
 	filePath string
 }
@@ -44,44 +61,137 @@ func (this *DBSearcher) GetOutID(inId InIdType) (OutIdType, error) {
 	return this.idMgr.GetOutID(inId)
 }
 
+// 内部ID是否已经被删除,可并发
+func (this *DBSearcher) IsDeleted(inId InIdType) bool {
+	if this.idMgr == nil {
+		return true
+	}
+	return this.idMgr.IsDeleted(inId)
+}
+
+// 根据外部ID删除doc.只打删除标记,索引数据依然保留,检索时过滤
+func (this *DBSearcher) DeleteDoc(outID OutIdType) error {
+	if this.varIndex == nil {
+		return log.Error("No Var Index")
+	}
+	if this.idMgr == nil {
+		return log.Error("no id manager")
+	}
+	// 修改完成之后代数才变化,之前读取代数的检索结果不会被当作最新的结果
+	defer atomic.AddUint64(&this.writeGen, 1)
+	return this.idMgr.DeleteByOutId(outID)
+}
+
+// 提交内部ID,doc全部数据写入后调用,之后检索可见.
+// 同一个外部ID的旧版本doc同时被删除.
+func (this *DBSearcher) CommitID(inID InIdType) error {
+	if this.varIndex == nil {
+		return log.Error("No Var Index")
+	}
+	if this.idMgr == nil {
+		return log.Error("no id manager")
+	}
+	defer atomic.AddUint64(&this.writeGen, 1)
+	return this.idMgr.CommitID(inID)
+}
+
 // 写入索引,不可并发写入.
 func (this *DBSearcher) WriteIndex(InID InIdType, termlist []TermInDoc) error {
 	if this.varIndex == nil {
 		return log.Error("No Var Index")
 	}
+	defer atomic.AddUint64(&this.writeGen, 1)
 	for _, term := range termlist {
 		l := NewInvList(1)
-		l.Append(Index{InID: InID, Weight: term.Weight})
-		this.varIndex.WriteIndex(term.Sign, &l)
+		l.Append(Index{InID: InID, Weight: term.Weight, Pos: term.Pos})
+		err := this.varIndex.WriteIndex(term.Sign, &l)
+		if err != nil {
+			return err
+		}
 	}
 	return nil
 }
 
-// 读取索引,可并发
+// 动态写入的doc持久化,一批doc写入完成后调用.
+// 先把id分配和删除标记,value,data写入磁盘,最后是动态索引的预写日志,
+// 崩溃后重放日志中的doc一定已经分配了id,不会再分配给其它doc
+func (this *DBSearcher) Flush() error {
+	if this.varIndex == nil {
+		return log.Error("No Var Index")
+	}
+	err := this.syncDocs()
+	if err != nil {
+		return err
+	}
+	return this.varIndex.Flush()
+}
+
+// id分配状态,包括已分配的最大id和删除的doc数量
+func (this *DBSearcher) GetIdStatus() (IdManagerStatus, error) {
+	if this.idMgr == nil {
+		return IdManagerStatus{}, log.Error("no id manager")
+	}
+	return this.idMgr.GetStatus(), nil
+}
+
+// 读取索引,可并发.返回的拉链可能是缓存中共享的,只能读取
 func (this *DBSearcher) ReadIndex(t TermSign) (*InvList, error) {
-	var err error
-	var staticlist *InvList
-	var varlist *InvList
-	if this.staticIndex != nil {
-		staticlist, err = this.staticIndex.ReadIndex(t)
-		if err != nil {
-			staticlist = NewInvListPointer(0)
-		}
-	} else {
-		staticlist = NewInvListPointer(0)
+	table, err := this.ReadSkipTable(t)
+	if err != nil {
+		return nil, err
 	}
+	return table.List(), nil
+}
 
-	if this.varIndex != nil {
-		varlist, err = this.varIndex.ReadIndex(t)
-		if err != nil {
-			varlist = NewInvListPointer(0)
-		}
-	} else {
-		varlist = NewInvListPointer(0)
+// 读取拉链和跳表,可并发.
+// 静态索引只解析块目录,动态索引磁盘段的拉链追加在后面,一起缓存,
+// 动态索引生成新的段或者合并进静态索引后失效.
+// 内存索引的拉链每次读取,内存索引中有这个term的时候追加成新的跳表.
+func (this *DBSearcher) ReadSkipTable(t TermSign) (*SkipTable, error) {
+	this.indexLock.RLock()
+	defer this.indexLock.RUnlock()
+
+	table, err := this.varIndex.readIndex(t,
+		func(gen uint64, readSegments func() (*InvList, error)) (*SkipTable, error) {
+			if table, ok := this.cache.Get(t, gen); ok {
+				return table, nil
+			}
+
+			table, err := this.staticIndex.ReadSkipTable(t)
+			if err != nil {
+				table = NewSkipTable(nil)
+			}
+			seglist, err := readSegments()
+			if err != nil {
+				return nil, err
+			}
+			table = table.Merge(seglist)
+			this.cache.Put(t, gen, table)
+			return table, nil
+		})
+	if err != nil {
+		return NewSkipTable(nil), nil
 	}
+	return table, nil
+}
 
-	staticlist.Merge(*varlist)
-	return staticlist, nil
+// 数据代数,动态写入,删除或者动态索引同步,合并之后变化
+func (this *DBSearcher) Generation() uint64 {
+	return atomic.LoadUint64(&this.writeGen) + this.varIndex.segmentGeneration()
+}
+
+// 设置拉链缓存大小(拉链总长度),0表示不缓存.已经缓存的拉链被清空
+func (this *DBSearcher) SetIndexCacheSize(maxSize int) {
+	this.indexLock.Lock()
+	defer this.indexLock.Unlock()
+	this.cache = NewInvListCache(maxSize)
+}
+
+// 拉链缓存的命中情况
+func (this *DBSearcher) GetIndexCacheStatus() InvListCacheStatus {
+	this.indexLock.RLock()
+	defer this.indexLock.RUnlock()
+	return this.cache.GetStatus()
 }
 
 // 写入Value数据,可并发写入.
@@ -155,8 +265,8 @@ func (this *DBSearcher) Init(fPath string) error {
 		return err
 	}
 
-	// var index
-	err = this.varIndex.Open(this.filePath)
+	// var index,丢弃上次合并过程中崩溃时残留的已合并的段
+	err = this.varIndex.Open(this.filePath, this.staticIndex.status.FoldedSegments...)
 	if err != nil {
 		return err
 	}
@@ -164,16 +274,140 @@ func (this *DBSearcher) Init(fPath string) error {
 	return nil
 }
 
-// 进行一次数据同步.在支持动态库情况下进行一次磁盘同步
+// 进行一次数据同步.在支持动态库情况下进行一次磁盘同步.
+// id信息先于动态索引写入磁盘,磁盘索引中的doc一定已经分配了id
 func (this *DBSearcher) Sync() error {
+	err := this.syncManagers()
+	if err != nil {
+		return err
+	}
 	// for var index
-	err := this.varIndex.Sync()
+	return this.varIndex.Sync()
+}
+
+// 不受同步间隔限制的完整同步,内存索引以及mmap的value和data全部写入磁盘.
+// 用于程序退出前保存动态写入的数据.
+func (this *DBSearcher) ForceSync() error {
+	err := this.syncDocs()
+	if err != nil {
+		return err
+	}
+	return this.varIndex.ForceSync()
+}
+
+// 同步id以及value和data
+func (this *DBSearcher) syncDocs() error {
+	err := this.syncManagers()
+	if err != nil {
+		return err
+	}
+	err = this.valueMgr.Sync()
+	if err != nil {
+		return err
+	}
+	return this.dataMgr.Sync()
+}
+
+// 同步删除标记等id信息
+func (this *DBSearcher) syncManagers() error {
+	return this.idMgr.Sync()
+}
+
+// 把动态索引的全部磁盘段合并进一个新的静态索引并切换,动态索引只保留内存索引和合并期间
+// 新生成的段.已经删除的doc不再写入新的静态索引.
+// 合并过程不影响检索和动态写入,最后切换的瞬间暂停读索引.
+func (this *DBSearcher) FoldVarIndex() error {
+	this.foldLock.Lock()
+	defer this.foldLock.Unlock()
+
+	segments := this.varIndex.beginFold()
+	defer this.varIndex.endFold()
+	if len(segments) == 0 {
+		return nil
+	}
+
+	src := make([]ReadOnlyIndex, len(segments))
+	names := make([]string, len(segments))
+	termCount := int64(0)
+	for i, seg := range segments {
+		src[i] = seg.disk
+		names[i] = seg.Name
+		termCount += seg.disk.GetTermCount()
+	}
+	name, disk, err := this.staticIndex.writeFold(src, termCount,
+		func(disk *DiskIndex) WriteOnlyIndex {
+			return &deletedFilterIndex{dst: disk, idMgr: this.idMgr}
+		})
 	if err != nil {
 		return err
 	}
+
+	// 静态索引的状态文件记录了合并的段,之后崩溃也不会重复读到这些段
+	this.indexLock.Lock()
+	oldName, oldDisk, err := this.staticIndex.swap(name, disk, names)
+	if err != nil {
+		this.indexLock.Unlock()
+		disk.Close()
+		removeDiskIndex(this.filePath, name)
+		return log.Error("swap static index fail : %s", err)
+	}
+	err = this.varIndex.dropSegments(segments)
+	this.indexLock.Unlock()
+	if err != nil {
+		log.Warn("save var index status fail : %s", err)
+	}
+
+	// 建库生成的static索引在版本的文件清单中,保留不删除.
+	// 之前合并生成的static.N不在清单中,被替换后删除
+	oldDisk.Close()
+	if oldName != staticIndexDefaultName {
+		removeDiskIndex(this.filePath, oldName)
+	}
+	for _, seg := range segments {
+		seg.disk.Close()
+		removeDiskIndex(this.filePath, seg.Name)
+	}
+	log.Info("fold [%d] var index segments into static index [%s]", len(segments), name)
 	return nil
 }
 
+// 写入拉链时过滤掉已经删除的doc.已分配还未提交的doc同样置了删除标记,保留它的索引
+type deletedFilterIndex struct {
+	dst   WriteOnlyIndex
+	idMgr *IdManager
+}
+
+func (this *deletedFilterIndex) WriteIndex(t TermSign, l *InvList) error {
+	lst := NewInvList(l.Len())
+	for _, index := range *l {
+		if this.idMgr.IsPending(index.InID) || !this.idMgr.IsDeleted(index.InID) {
+			lst.Append(index)
+		}
+	}
+	if lst.Len() == 0 {
+		return nil
+	}
+	return this.dst.WriteIndex(t, &lst)
+}
+
+// 关闭全部文件.不会同步内存索引,需要保存的话先调用ForceSync.
+// 调用者需要保证没有正在进行的读写操作,关闭之后不能再使用.
+func (this *DBSearcher) Close() error {
+	var firstErr error
+	keep := func(err error) {
+		if err != nil && firstErr == nil {
+			firstErr = err
+		}
+	}
+
+	this.varIndex.Close()
+	this.staticIndex.Close()
+	keep(this.idMgr.Close())
+	keep(this.valueMgr.Close())
+	keep(this.dataMgr.Close())
+	return firstErr
+}
+
 func NewDBSearcher() *DBSearcher {
 	db := DBSearcher{}
 
@@ -182,6 +416,7 @@ func NewDBSearcher() *DBSearcher {
 	db.idMgr = NewIdManager()
 	db.staticIndex = NewStaticIndex()
 	db.varIndex = NewVarIndex()
+	db.cache = NewInvListCache(DefaultIndexCacheSize)
 
 	return &db
 }
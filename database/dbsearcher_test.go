@@ -0,0 +1,302 @@
+package database
+
+import (
+	. "github.com/getwe/goose/utils"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+func TestDBSearcherFoldVarIndex(t *testing.T) {
+	path := filepath.Join(os.Getenv("HOME"), "tmp", "goosedb", "test_dbsearcher_fold")
+	os.RemoveAll(path)
+
+	builder := NewDBBuilder()
+	if err := builder.Init(path, 1000, 100, 1, 1024*1024, 1024*1024, DefaultPostingCodec); err != nil {
+		t.Fatalf("Init --- %s", err)
+	}
+	inId, _ := builder.AllocID(1)
+	builder.WriteIndex(inId, []TermInDoc{TermInDoc{Sign: 10, Weight: 1}})
+	builder.WriteValue(inId, Value("v"))
+	builder.WriteData(inId, Data("d"))
+	builder.CommitID(inId)
+	if err := builder.Sync(); err != nil {
+		t.Fatalf("Sync --- %s", err)
+	}
+
+	db := NewDBSearcher()
+	if err := db.Init(path); err != nil {
+		t.Fatalf("DBSearcher.Init --- %s", err)
+	}
+	write := func(outId OutIdType) {
+		inId, err := db.AllocID(outId)
+		if err != nil {
+			t.Fatalf("AllocID --- %s", err)
+		}
+		db.WriteIndex(inId, []TermInDoc{TermInDoc{Sign: 10, Weight: 1}})
+		db.WriteValue(inId, Value("v"))
+		db.WriteData(inId, Data("d"))
+		db.CommitID(inId)
+	}
+	check := func(db *DBSearcher, expect []InIdType) {
+		l, err := db.ReadIndex(10)
+		if err != nil {
+			t.Fatalf("ReadIndex --- %s", err)
+		}
+		ids := make([]InIdType, 0)
+		for _, index := range *l {
+			if !db.IsDeleted(index.InID) {
+				ids = append(ids, index.InID)
+			}
+		}
+		if len(ids) != len(expect) {
+			t.Fatalf("hit %v expect %v", ids, expect)
+		}
+		for i := range ids {
+			if ids[i] != expect[i] {
+				t.Fatalf("hit %v expect %v", ids, expect)
+			}
+		}
+	}
+
+	write(2)
+	write(3)
+	if err := db.ForceSync(); err != nil {
+		t.Fatalf("ForceSync --- %s", err)
+	}
+	db.DeleteDoc(2)
+	// 没有Sync的doc留在内存索引
+	write(4)
+	check(db, []InIdType{1, 3, 4})
+	// 第二次读取命中缓存,内存索引的写入依然可见
+	check(db, []InIdType{1, 3, 4})
+	if st := db.GetIndexCacheStatus(); st.Hit != 1 || st.Miss != 1 {
+		t.Errorf("cache status %+v", st)
+	}
+	write(5)
+	check(db, []InIdType{1, 3, 4, 5})
+	// 生成新的磁盘段后缓存失效
+	if err := db.ForceSync(); err != nil {
+		t.Fatalf("ForceSync --- %s", err)
+	}
+	check(db, []InIdType{1, 3, 4, 5})
+	if st := db.GetIndexCacheStatus(); st.Hit != 2 || st.Miss != 2 {
+		t.Errorf("cache status %+v", st)
+	}
+	// 内存索引中没有这个term的时候,跳表跟拉链一起缓存,不再重新构建
+	table1, _ := db.ReadSkipTable(10)
+	table2, _ := db.ReadSkipTable(10)
+	if table1 != table2 || table1.Len() != 5 {
+		t.Errorf("skip table rebuilt on cache hit, len [%d]", table1.Len())
+	}
+
+	if err := db.FoldVarIndex(); err != nil {
+		t.Fatalf("FoldVarIndex --- %s", err)
+	}
+	check(db, []InIdType{1, 3, 4, 5})
+	if name := StaticIndexName(path); name == staticIndexDefaultName {
+		t.Errorf("static index name [%s] after fold", name)
+	}
+	// 删除的doc不再写入静态索引,合并过的段已经从动态索引去掉
+	l, _ := db.staticIndex.ReadIndex(10)
+	if l.Len() != 4 {
+		t.Errorf("static index len [%d]", l.Len())
+	}
+	if len(db.varIndex.segments) != 0 {
+		t.Errorf("var index segments [%d]", len(db.varIndex.segments))
+	}
+	// 静态索引的拉链只解析了块目录,块数据在遍历时才解码
+	if table, _ := db.ReadSkipTable(10); table.encoded != 1 || table.Len() != 4 {
+		t.Errorf("static skip table encoded blocks [%d] len [%d]", table.encoded, table.Len())
+	}
+	// 建库生成的静态索引在文件清单中,合并之后保留
+	if _, err := os.Stat(filepath.Join(path, "static.index2")); err != nil {
+		t.Errorf("build static index removed : %s", err)
+	}
+
+	if err := db.ForceSync(); err != nil {
+		t.Fatalf("ForceSync --- %s", err)
+	}
+	db.Close()
+
+	db = NewDBSearcher()
+	if err := db.Init(path); err != nil {
+		t.Fatalf("DBSearcher.Init --- %s", err)
+	}
+	check(db, []InIdType{1, 3, 4, 5})
+
+	// 分配还未提交的doc同样置了删除标记,合并时它的索引不能丢弃
+	inId, err := db.AllocID(6)
+	if err != nil {
+		t.Fatalf("AllocID --- %s", err)
+	}
+	db.WriteIndex(inId, []TermInDoc{TermInDoc{Sign: 10, Weight: 1}})
+	db.WriteValue(inId, Value("v"))
+	db.WriteData(inId, Data("d"))
+	if err := db.ForceSync(); err != nil {
+		t.Fatalf("ForceSync --- %s", err)
+	}
+	foldName := StaticIndexName(path)
+	if err := db.FoldVarIndex(); err != nil {
+		t.Fatalf("FoldVarIndex --- %s", err)
+	}
+	db.CommitID(inId)
+	check(db, []InIdType{1, 3, 4, 5, inId})
+
+	// 之前合并生成的静态索引被替换后删除,建库生成的依然保留
+	if files, _ := filepath.Glob(filepath.Join(path, foldName+".index*")); len(files) != 0 {
+		t.Errorf("old fold static index not removed : %v", files)
+	}
+	if _, err := os.Stat(filepath.Join(path, "static.index2")); err != nil {
+		t.Errorf("build static index removed : %s", err)
+	}
+	db.Close()
+}
+
+func TestDBSearcherCrashReopen(t *testing.T) {
+	path := filepath.Join(os.Getenv("HOME"), "tmp", "goosedb", "test_dbsearcher_crash")
+	os.RemoveAll(path)
+
+	builder := NewDBBuilder()
+	if err := builder.Init(path, 1000, 100, 1, 1024*1024, 1024*1024, DefaultPostingCodec); err != nil {
+		t.Fatalf("Init --- %s", err)
+	}
+	inId, _ := builder.AllocID(1)
+	builder.WriteIndex(inId, []TermInDoc{TermInDoc{Sign: 777, Weight: 1}})
+	builder.WriteValue(inId, Value("v"))
+	builder.WriteData(inId, Data("d"))
+	builder.CommitID(inId)
+	if err := builder.Sync(); err != nil {
+		t.Fatalf("Sync --- %s", err)
+	}
+
+	write := func(db *DBSearcher, outId OutIdType) InIdType {
+		inId, err := db.AllocID(outId)
+		if err != nil {
+			t.Fatalf("AllocID --- %s", err)
+		}
+		db.WriteIndex(inId, []TermInDoc{TermInDoc{Sign: 777, Weight: TermWeight(outId)}})
+		db.WriteValue(inId, Value("v"))
+		db.WriteData(inId, Data("d"))
+		db.CommitID(inId)
+		if err := db.Flush(); err != nil {
+			t.Fatalf("Flush --- %s", err)
+		}
+		return inId
+	}
+
+	db := NewDBSearcher()
+	if err := db.Init(path); err != nil {
+		t.Fatalf("DBSearcher.Init --- %s", err)
+	}
+	crashed := write(db, 50)
+
+	// 不关闭直接重新打开,相当于Flush之后崩溃
+	db2 := NewDBSearcher()
+	if err := db2.Init(path); err != nil {
+		t.Fatalf("DBSearcher.Init --- %s", err)
+	}
+	defer db2.Close()
+	if inId, ok := db2.idMgr.GetInID(50); !ok || inId != crashed {
+		t.Fatalf("OutId[50] InId[%d] expect [%d]", inId, crashed)
+	}
+
+	// 重放之后分配的id不能跟日志中的doc重复
+	inId = write(db2, 60)
+	if inId <= crashed {
+		t.Fatalf("InId[%d] reused after crash, crashed doc InId[%d]", inId, crashed)
+	}
+	l, _ := db2.ReadIndex(777)
+	hits := make(map[OutIdType]TermWeight)
+	for _, index := range *l {
+		if db2.IsDeleted(index.InID) {
+			continue
+		}
+		outId, _ := db2.GetOutID(index.InID)
+		if _, ok := hits[outId]; ok {
+			t.Errorf("OutId[%d] hit twice", outId)
+		}
+		hits[outId] = index.Weight
+	}
+	if len(hits) != 3 || hits[50] != 50 || hits[60] != 60 {
+		t.Errorf("hits %v", hits)
+	}
+}
+
+func TestDBSearcherPosition(t *testing.T) {
+	path := filepath.Join(os.Getenv("HOME"), "tmp", "goosedb", "test_dbsearcher_pos")
+	os.RemoveAll(path)
+
+	builder := NewDBBuilder()
+	if err := builder.Init(path, 1000, 100, 1, 1024*1024, 1024*1024, DefaultPostingCodec); err != nil {
+		t.Fatalf("Init --- %s", err)
+	}
+	inId, _ := builder.AllocID(1)
+	builder.WriteIndex(inId, []TermInDoc{TermInDoc{Sign: 10, Weight: 1, Pos: []uint32{0, 7}}})
+	builder.WriteValue(inId, Value("v"))
+	builder.WriteData(inId, Data("d"))
+	builder.CommitID(inId)
+	if err := builder.Sync(); err != nil {
+		t.Fatalf("Sync --- %s", err)
+	}
+
+	write := func(db *DBSearcher, outId OutIdType, pos []uint32) {
+		inId, err := db.AllocID(outId)
+		if err != nil {
+			t.Fatalf("AllocID --- %s", err)
+		}
+		db.WriteIndex(inId, []TermInDoc{TermInDoc{Sign: 10, Weight: 1, Pos: pos}})
+		db.WriteValue(inId, Value("v"))
+		db.WriteData(inId, Data("d"))
+		db.CommitID(inId)
+	}
+	// 位置信息跟拉链一起读出
+	check := func(db *DBSearcher, expect map[OutIdType][]uint32) {
+		l, err := db.ReadIndex(10)
+		if err != nil {
+			t.Fatalf("ReadIndex --- %s", err)
+		}
+		if l.Len() != len(expect) {
+			t.Fatalf("list len [%d] expect [%d]", l.Len(), len(expect))
+		}
+		for _, index := range *l {
+			outId, _ := db.GetOutID(index.InID)
+			if !reflect.DeepEqual(index.Pos, expect[outId]) {
+				t.Fatalf("OutId[%d] pos %v expect %v", outId, index.Pos, expect[outId])
+			}
+		}
+	}
+
+	db := NewDBSearcher()
+	if err := db.Init(path); err != nil {
+		t.Fatalf("DBSearcher.Init --- %s", err)
+	}
+	write(db, 2, []uint32{3})
+	write(db, 3, nil)
+	if err := db.Flush(); err != nil {
+		t.Fatalf("Flush --- %s", err)
+	}
+	expect := map[OutIdType][]uint32{1: []uint32{0, 7}, 2: []uint32{3}, 3: nil}
+	check(db, expect)
+
+	// 不关闭直接重新打开,内存索引从日志重放
+	db2 := NewDBSearcher()
+	if err := db2.Init(path); err != nil {
+		t.Fatalf("DBSearcher.Init --- %s", err)
+	}
+	defer db2.Close()
+	check(db2, expect)
+
+	// 写入磁盘段,再合并到静态索引
+	write(db2, 4, []uint32{1, 2, 100})
+	expect[4] = []uint32{1, 2, 100}
+	if err := db2.ForceSync(); err != nil {
+		t.Fatalf("ForceSync --- %s", err)
+	}
+	check(db2, expect)
+	if err := db2.FoldVarIndex(); err != nil {
+		t.Fatalf("FoldVarIndex --- %s", err)
+	}
+	check(db2, expect)
+}
@@ -0,0 +1,374 @@
+package database
+
+import (
+	"crypto/md5"
+	"encoding/hex"
+	log "github.com/getwe/goose/log"
+	. "github.com/getwe/goose/utils"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"syscall"
+	"time"
+)
+
+// 版本化的数据库目录.
+// 每次建库在DbPath下新建一个以建库时间命名的临时目录,建库成功后写入文件清单和版本状态文件,
+// 改名为正式的版本目录,最后原子地把DbPath/current软链接指向新版本.
+// 检索程序打开current指向的版本,并且可以在运行中切换到新的版本.
+// 没有current的时候使用最新的有版本状态文件的目录(早期的版本目录),
+// 没有任何版本目录的时候,DbPath本身就是数据库(旧的目录结构).
+const (
+	// 版本目录名前缀,后面是建库时间
+	DBVersionPrefix = "db."
+	// 建库过程中的临时目录后缀
+	DBVersionStagingSuffix = ".staging"
+	// 指向当前版本的软链接
+	DBVersionCurrent = "current"
+	// 版本状态文件,建库成功后写入
+	DBVersionStatFile = "version.stat"
+	// 文件清单,记录建库生成的每个文件的大小和md5
+	DBManifestFile = "manifest.stat"
+)
+
+type DBVersionStatus struct {
+	// 版本名,跟目录名一致
+	Version string
+
+	// 建库数据的时间(unix秒).这个时间之后动态插入的doc不一定在这个版本中
+	BuildTime int64
+
+	// 建库分配到的内部id,之后的id是检索程序动态分配的.早期的版本为0
+	CurId InIdType
+}
+
+// 文件清单中的一个文件
+type DBManifestItem struct {
+	Name string
+	Size int64
+	Md5  string
+}
+
+type DBManifest struct {
+	Files []DBManifestItem
+}
+
+// 版本目录的引用.检索程序打开的版本,增量建库读取的基础版本,以及正在建库的临时目录
+// 持有目录的共享文件锁,清理旧版本时跳过有引用的目录.进程退出后锁自动释放.
+type DBVersionRef struct {
+	dir *os.File
+}
+
+// 引用版本目录,使用完需要调用Release
+func RefDBVersion(path string) (*DBVersionRef, error) {
+	dir, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	err = syscall.Flock(int(dir.Fd()), syscall.LOCK_SH)
+	if err != nil {
+		dir.Close()
+		return nil, log.Error("lock db version [%s] fail : %s", path, err)
+	}
+	return &DBVersionRef{dir: dir}, nil
+}
+
+// 释放引用,nil以及重复释放不报错
+func (this *DBVersionRef) Release() {
+	if this == nil || this.dir == nil {
+		return
+	}
+	this.dir.Close()
+	this.dir = nil
+}
+
+// 目录是否被引用
+func DBVersionInUse(path string) bool {
+	dir, err := os.Open(path)
+	if err != nil {
+		return false
+	}
+	defer dir.Close()
+	err = syscall.Flock(int(dir.Fd()), syscall.LOCK_EX|syscall.LOCK_NB)
+	if err != nil {
+		return true
+	}
+	syscall.Flock(int(dir.Fd()), syscall.LOCK_UN)
+	return false
+}
+
+// 在dbPath下生成一个新版本的临时目录名,目录本身由DBBuilder.Init创建
+func NewDBVersion(dbPath string) (string, DBVersionStatus, error) {
+	now := time.Now()
+	st := DBVersionStatus{}
+	st.Version = DBVersionPrefix + now.Format("20060102150405")
+	st.BuildTime = now.Unix()
+
+	if _, err := os.Stat(filepath.Join(dbPath, st.Version)); err == nil {
+		return "", st, log.Error("db version [%s] already exist", st.Version)
+	}
+	return filepath.Join(dbPath, st.Version+DBVersionStagingSuffix), st, nil
+}
+
+// 发布建库完成的临时目录:写入文件清单和版本状态文件,改名为正式的版本目录,
+// 最后把current软链接原子地指向新版本.任何一步失败current都还指向旧版本.
+func PublishDBVersion(dbPath string, stagingPath string, st DBVersionStatus) error {
+	err := WriteDBManifest(stagingPath)
+	if err != nil {
+		return err
+	}
+	err = SaveDBVersion(stagingPath, st)
+	if err != nil {
+		return err
+	}
+
+	path := filepath.Join(dbPath, st.Version)
+	err = os.Rename(stagingPath, path)
+	if err != nil {
+		return log.Error("rename [%s] to [%s] fail : %s", stagingPath, path, err)
+	}
+
+	// 软链接使用相对路径,整个DbPath可以移动.
+	// 先建立临时软链接再改名覆盖,rename保证current任何时刻都指向一个完整的版本
+	tmpLink := filepath.Join(dbPath, DBVersionCurrent+".tmp")
+	os.Remove(tmpLink)
+	err = os.Symlink(st.Version, tmpLink)
+	if err != nil {
+		return log.Error("symlink [%s] fail : %s", tmpLink, err)
+	}
+	err = os.Rename(tmpLink, filepath.Join(dbPath, DBVersionCurrent))
+	if err != nil {
+		os.Remove(tmpLink)
+		return log.Error("flip current to [%s] fail : %s", st.Version, err)
+	}
+	syncDir(dbPath)
+	return nil
+}
+
+// 写入版本状态文件,标记这个版本建库完成
+func SaveDBVersion(path string, st DBVersionStatus) error {
+	return JsonEncodeToFile(st, filepath.Join(path, DBVersionStatFile))
+}
+
+// 读取版本状态文件,没有状态文件的是没有完成的版本
+func ReadDBVersion(path string) (DBVersionStatus, error) {
+	st := DBVersionStatus{}
+	err := JsonDecodeFromFile(&st, filepath.Join(path, DBVersionStatFile))
+	return st, err
+}
+
+// 计算目录下全部文件的大小和md5,写入文件清单.文件内容同时fsync到磁盘
+func WriteDBManifest(path string) error {
+	infos, err := ioutil.ReadDir(path)
+	if err != nil {
+		return err
+	}
+
+	m := DBManifest{}
+	for _, info := range infos {
+		if info.IsDir() || info.Name() == DBManifestFile || info.Name() == DBVersionStatFile {
+			continue
+		}
+		sum, err := fileMd5(filepath.Join(path, info.Name()), true)
+		if err != nil {
+			return log.Error("md5 [%s] fail : %s", info.Name(), err)
+		}
+		m.Files = append(m.Files, DBManifestItem{
+			Name: info.Name(), Size: info.Size(), Md5: sum})
+	}
+	return JsonEncodeToFile(m, filepath.Join(path, DBManifestFile))
+}
+
+// 根据文件清单校验版本目录下的文件.没有文件清单的目录(早期的版本)不校验
+func VerifyDBManifest(path string) error {
+	m := DBManifest{}
+	err := JsonDecodeFromFile(&m, filepath.Join(path, DBManifestFile))
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return log.Error("read manifest [%s] fail : %s", path, err)
+	}
+
+	for _, item := range m.Files {
+		full := filepath.Join(path, item.Name)
+		info, err := os.Stat(full)
+		if err != nil {
+			return log.Error("manifest check [%s] fail : %s", full, err)
+		}
+		if info.Size() != item.Size {
+			return log.Error("manifest check [%s] size [%d] expect [%d]",
+				full, info.Size(), item.Size)
+		}
+		sum, err := fileMd5(full, false)
+		if err != nil {
+			return log.Error("md5 [%s] fail : %s", full, err)
+		}
+		if sum != item.Md5 {
+			return log.Error("manifest check [%s] md5 [%s] expect [%s]", full, sum, item.Md5)
+		}
+	}
+	return nil
+}
+
+// 当前版本.优先使用current软链接指向的版本,没有current时使用最新的完成的版本目录.
+// 没有任何版本目录时返回dbPath本身,版本名为空.
+func LatestDBVersion(dbPath string) (string, DBVersionStatus, error) {
+	target, err := os.Readlink(filepath.Join(dbPath, DBVersionCurrent))
+	if err == nil {
+		if !filepath.IsAbs(target) {
+			target = filepath.Join(dbPath, target)
+		}
+		st, err := ReadDBVersion(target)
+		if err != nil {
+			return "", st, log.Error("read current version [%s] fail : %s", target, err)
+		}
+		return target, st, nil
+	}
+
+	infos, err := ioutil.ReadDir(dbPath)
+	if err != nil {
+		return "", DBVersionStatus{}, err
+	}
+
+	names := make([]string, 0)
+	for _, info := range infos {
+		if info.IsDir() && strings.HasPrefix(info.Name(), DBVersionPrefix) &&
+			!strings.HasSuffix(info.Name(), DBVersionStagingSuffix) {
+			names = append(names, info.Name())
+		}
+	}
+	// 版本名中的时间格式保证字典序就是时间顺序
+	sort.Sort(sort.Reverse(sort.StringSlice(names)))
+
+	for _, name := range names {
+		path := filepath.Join(dbPath, name)
+		st, err := ReadDBVersion(path)
+		if err != nil {
+			continue
+		}
+		if st.Version != name {
+			log.Warn("db version [%s] mismatch dir [%s]", st.Version, path)
+			continue
+		}
+		return path, st, nil
+	}
+	return dbPath, DBVersionStatus{}, nil
+}
+
+// dbPath下没有发布的建库临时目录,最新的在前
+func ListDBStaging(dbPath string) ([]string, error) {
+	infos, err := ioutil.ReadDir(dbPath)
+	if err != nil {
+		return nil, err
+	}
+
+	paths := make([]string, 0)
+	for _, info := range infos {
+		if info.IsDir() && strings.HasPrefix(info.Name(), DBVersionPrefix) &&
+			strings.HasSuffix(info.Name(), DBVersionStagingSuffix) {
+			paths = append(paths, filepath.Join(dbPath, info.Name()))
+		}
+	}
+	sort.Sort(sort.Reverse(sort.StringSlice(paths)))
+	return paths, nil
+}
+
+// 清理旧版本,保留最新的keep个版本,keep不大于0时不清理.
+// current指向的版本以及有引用的版本不删除.
+// 没有引用并且比最新的版本更早的临时目录是中断后不会再继续的建库,同样删除.
+func CleanDBVersions(dbPath string, keep int) error {
+	if keep <= 0 {
+		return nil
+	}
+
+	infos, err := ioutil.ReadDir(dbPath)
+	if err != nil {
+		return err
+	}
+	names := make([]string, 0)
+	for _, info := range infos {
+		if info.IsDir() && strings.HasPrefix(info.Name(), DBVersionPrefix) &&
+			!strings.HasSuffix(info.Name(), DBVersionStagingSuffix) {
+			if _, err := ReadDBVersion(filepath.Join(dbPath, info.Name())); err == nil {
+				names = append(names, info.Name())
+			}
+		}
+	}
+	if len(names) == 0 {
+		return nil
+	}
+	sort.Sort(sort.Reverse(sort.StringSlice(names)))
+
+	current, _ := os.Readlink(filepath.Join(dbPath, DBVersionCurrent))
+	current = filepath.Base(current)
+
+	for i, name := range names {
+		path := filepath.Join(dbPath, name)
+		if i < keep {
+			continue
+		}
+		if name == current || DBVersionInUse(path) {
+			log.Info("db version [%s] in use, keep it", path)
+			continue
+		}
+		err = os.RemoveAll(path)
+		if err != nil {
+			return log.Error("remove db version [%s] fail : %s", path, err)
+		}
+		log.Info("remove old db version [%s]", path)
+	}
+
+	stagings, err := ListDBStaging(dbPath)
+	if err != nil {
+		return err
+	}
+	for _, path := range stagings {
+		name := strings.TrimSuffix(filepath.Base(path), DBVersionStagingSuffix)
+		if name >= names[0] || DBVersionInUse(path) {
+			continue
+		}
+		err = os.RemoveAll(path)
+		if err != nil {
+			return log.Error("remove stale staging [%s] fail : %s", path, err)
+		}
+		log.Info("remove stale staging [%s]", path)
+	}
+	return nil
+}
+
+func fileMd5(fullpath string, sync bool) (string, error) {
+	f, err := os.Open(fullpath)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+
+	h := md5.New()
+	_, err = io.Copy(h, f)
+	if err != nil {
+		return "", err
+	}
+	if sync {
+		err = f.Sync()
+		if err != nil {
+			return "", err
+		}
+	}
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
+
+// 目录项的修改写入磁盘,失败不影响正确性
+func syncDir(path string) {
+	d, err := os.Open(path)
+	if err != nil {
+		return
+	}
+	d.Sync()
+	d.Close()
+}
+
+/* vim: set expandtab ts=4 sw=4 sts=4 tw=100: */
@@ -0,0 +1,139 @@
+package database
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestPublishDBVersion(t *testing.T) {
+	dbPath := filepath.Join(os.Getenv("HOME"), "tmp", "goosedb", "test_dbversion")
+	os.RemoveAll(dbPath)
+	os.MkdirAll(dbPath, 0755)
+
+	// 没有任何版本时使用dbPath本身
+	path, st, err := LatestDBVersion(dbPath)
+	if err != nil || path != dbPath || st.Version != "" {
+		t.Fatalf("LatestDBVersion path[%s] version[%s] err[%v]", path, st.Version, err)
+	}
+
+	publish := func(version string, content string) string {
+		st := DBVersionStatus{Version: version, BuildTime: 1}
+		staging := filepath.Join(dbPath, version+DBVersionStagingSuffix)
+		os.MkdirAll(staging, 0755)
+		ioutil.WriteFile(filepath.Join(staging, "data"), []byte(content), 0644)
+
+		// 临时目录不会被使用
+		path, _, _ := LatestDBVersion(dbPath)
+		if path == staging {
+			t.Errorf("staging dir [%s] used", staging)
+		}
+		if err := PublishDBVersion(dbPath, staging, st); err != nil {
+			t.Fatalf("PublishDBVersion --- %s", err)
+		}
+		return filepath.Join(dbPath, version)
+	}
+
+	v1 := publish("db.20140101000000", "hello")
+	v2 := publish("db.20140102000000", "world")
+
+	path, st, err = LatestDBVersion(dbPath)
+	if err != nil || path != v2 || st.Version != "db.20140102000000" {
+		t.Errorf("LatestDBVersion path[%s] version[%s] err[%v]", path, st.Version, err)
+	}
+	if err = VerifyDBManifest(v2); err != nil {
+		t.Errorf("VerifyDBManifest --- %s", err)
+	}
+
+	// 已经发布的版本不能被DBBuilder覆盖
+	db := NewDBBuilder()
+	if err = db.Init(v2, 1000, 100, 8, 1024, 1024, DefaultPostingCodec); err == nil {
+		t.Errorf("DBBuilder.Init overwrite published version")
+	}
+
+	// current指回旧版本,重启检索程序时使用
+	os.Remove(filepath.Join(dbPath, DBVersionCurrent))
+	os.Symlink("db.20140101000000", filepath.Join(dbPath, DBVersionCurrent))
+	path, _, _ = LatestDBVersion(dbPath)
+	if path != v1 {
+		t.Errorf("LatestDBVersion after rollback [%s]", path)
+	}
+
+	// 文件内容被破坏
+	ioutil.WriteFile(filepath.Join(v1, "data"), []byte("hellp"), 0644)
+	if err = VerifyDBManifest(v1); err == nil {
+		t.Errorf("VerifyDBManifest broken file succ")
+	}
+}
+
+func TestCleanDBVersions(t *testing.T) {
+	dbPath := filepath.Join(os.Getenv("HOME"), "tmp", "goosedb", "test_dbversion_clean")
+	os.RemoveAll(dbPath)
+	os.MkdirAll(dbPath, 0755)
+
+	versions := []string{"db.20140101000000", "db.20140102000000",
+		"db.20140103000000", "db.20140104000000"}
+	for _, version := range versions {
+		staging := filepath.Join(dbPath, version+DBVersionStagingSuffix)
+		os.MkdirAll(staging, 0755)
+		err := PublishDBVersion(dbPath, staging, DBVersionStatus{Version: version, BuildTime: 1})
+		if err != nil {
+			t.Fatalf("PublishDBVersion --- %s", err)
+		}
+	}
+	stagings := []string{"db.20140101120000", "db.20140102120000", "db.20140105000000"}
+	for _, version := range stagings {
+		os.MkdirAll(filepath.Join(dbPath, version+DBVersionStagingSuffix), 0755)
+	}
+	exist := func(name string) bool {
+		_, err := os.Stat(filepath.Join(dbPath, name))
+		return err == nil
+	}
+
+	// current指向旧版本,最旧的版本和一个临时目录有引用
+	os.Remove(filepath.Join(dbPath, DBVersionCurrent))
+	os.Symlink(versions[1], filepath.Join(dbPath, DBVersionCurrent))
+	ref, err := RefDBVersion(filepath.Join(dbPath, versions[0]))
+	if err != nil {
+		t.Fatalf("RefDBVersion --- %s", err)
+	}
+	stagingRef, err := RefDBVersion(filepath.Join(dbPath, stagings[1]+DBVersionStagingSuffix))
+	if err != nil {
+		t.Fatalf("RefDBVersion --- %s", err)
+	}
+	defer stagingRef.Release()
+
+	// keep为0不清理
+	if err = CleanDBVersions(dbPath, 0); err != nil || !exist(versions[2]) {
+		t.Fatalf("CleanDBVersions keep 0 err[%v]", err)
+	}
+
+	if err = CleanDBVersions(dbPath, 1); err != nil {
+		t.Fatalf("CleanDBVersions --- %s", err)
+	}
+	expect := map[string]bool{
+		versions[0]: true, versions[1]: true, versions[2]: false, versions[3]: true,
+		// 比最新版本早并且没有引用的临时目录被删除,正在建库的和更新的保留
+		stagings[0] + DBVersionStagingSuffix: false,
+		stagings[1] + DBVersionStagingSuffix: true,
+		stagings[2] + DBVersionStagingSuffix: true,
+	}
+	for name, e := range expect {
+		if exist(name) != e {
+			t.Errorf("[%s] exist [%v] expect [%v]", name, exist(name), e)
+		}
+	}
+
+	// 引用释放之后可以删除
+	ref.Release()
+	if err = CleanDBVersions(dbPath, 1); err != nil {
+		t.Fatalf("CleanDBVersions --- %s", err)
+	}
+	if exist(versions[0]) || !exist(versions[1]) || !exist(versions[3]) {
+		t.Errorf("versions after release %v %v %v",
+			exist(versions[0]), exist(versions[1]), exist(versions[3]))
+	}
+}
+
+/* vim: set expandtab ts=4 sw=4 sts=4 tw=100: */
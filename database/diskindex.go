@@ -33,6 +33,9 @@ type DiskIndexStatus struct {
 
 	// 实际索引数量
 	TermCount int64
+
+	// 拉链序列化格式,旧的状态文件没有该字段,解析后为PostingCodecGob
+	Codec PostingCodecType
 }
 
 // 磁盘索引.只支持一次性写入后只读操作.
@@ -53,6 +56,9 @@ type DiskIndex struct {
 	// 索引状态(这个不能也不应该持久化存储在磁盘)
 	indexStatus string
 
+	// 拉链序列化实现,Init时由创建者指定,Open时根据状态文件确定
+	codec PostingCodec
+
 	// 当前term总数
 	// 在只读索引中应该等于DiskIndexStatus.TermCount
 	// 在只写索引(建库阶段)表示当前已经写入的term数量
@@ -187,7 +193,7 @@ func (this *DiskIndex) readIndex2(t TermSign) (*BigFileIndex, error) {
 	return &bigFileI, nil
 }
 
-func (this *DiskIndex) readIndex3(t TermSign) (*InvList, error) {
+func (this *DiskIndex) readIndex3(t TermSign) ([]byte, error) {
 	// 查二级索引
 	bigFileI, err := this.readIndex2(t)
 	if err != nil {
@@ -200,15 +206,7 @@ func (this *DiskIndex) readIndex3(t TermSign) (*InvList, error) {
 	if err != nil {
 		return nil, err
 	}
-
-	// 把二进制buf根据gob协议反序列化为InvList
-	var list InvList
-	err = GobDecode(buff, &list)
-	if err != nil {
-		return nil, err
-	}
-
-	return &list, nil
+	return buff, nil
 }
 
 func (this *DiskIndex) writeIndex1(t TermSign) error {
@@ -239,7 +237,7 @@ func (this *DiskIndex) writeIndex2(t TermSign, bigFileI *BigFileIndex) error {
 
 func (this *DiskIndex) writeIndex3(t TermSign, l *InvList) error {
 	// 先对InvList进行序列化
-	binBuf, err := GobEncode(*l)
+	binBuf, err := this.codec.Encode(l)
 	if err != nil {
 		return err
 	}
@@ -262,7 +260,33 @@ func (this *DiskIndex) ReadIndex(t TermSign) (*InvList, error) {
 	if this.indexStatus != DiskIndexReadOnly {
 		return nil, log.Error("DiskIndex.Read status error")
 	}
-	return this.readIndex3(t)
+	buff, err := this.readIndex3(t)
+	if err != nil {
+		return nil, err
+	}
+
+	// 把二进制buf反序列化为InvList
+	return this.codec.Decode(buff)
+}
+
+// 读取拉链和跳表.拉链格式带有块目录的时候只解析块目录,块数据在遍历时按需解码
+func (this *DiskIndex) ReadSkipTable(t TermSign) (*SkipTable, error) {
+	if this.indexStatus != DiskIndexReadOnly {
+		return nil, log.Error("DiskIndex.Read status error")
+	}
+	buff, err := this.readIndex3(t)
+	if err != nil {
+		return nil, err
+	}
+
+	if codec, ok := this.codec.(skipTableCodec); ok {
+		return codec.DecodeSkipTable(buff)
+	}
+	l, err := this.codec.Decode(buff)
+	if err != nil {
+		return nil, err
+	}
+	return NewSkipTable(l), nil
 }
 
 // 写入索引,内部加锁保证顺序写入.
@@ -293,6 +317,11 @@ func (this *DiskIndex) WriteIndex(t TermSign, l *InvList) error {
 	return nil
 }
 
+// 拉链序列化格式
+func (this *DiskIndex) GetCodec() PostingCodecType {
+	return this.diskStatus.Codec
+}
+
 // 库中有多少条拉链
 func (this *DiskIndex) GetTermCount() int64 {
 	return this.diskStatus.TermCount
@@ -315,11 +344,18 @@ func (this *DiskIndex) Open(path string, name string) error {
 	// 磁盘状态文件需要设置的两个步骤:(1)指示要写入的结构;(2)设置写入路径
 	this.SelfStatus = &this.diskStatus
 
+	// 状态文件中没有记录格式的旧索引,都是gob格式
+	this.diskStatus.Codec = PostingCodecGob
 	err := this.ParseJsonFile()
 	if err != nil {
 		return log.Error("parse file [%s] : %s", this.StatusFilePath, err)
 	}
 
+	this.codec, err = GetPostingCodec(this.diskStatus.Codec)
+	if err != nil {
+		return err
+	}
+
 	// 打开三级索引
 	this.index3 = new(BigFile)
 	ind3name := fmt.Sprintf("%s.index3", this.fileName)
@@ -375,7 +411,9 @@ func (this *DiskIndex) Open(path string, name string) error {
 // 创建全新的磁盘索引,初始化后只允许进行索引写入.
 // maxFileSz 索引大文件单个文件的最大大小.
 // MaxTermCnt 是预期要写入的term的总数量.
-func (this *DiskIndex) Init(path string, name string, maxFileSz uint32, MaxTermCnt int64) error {
+// codec 拉链序列化格式,记录在状态文件中,打开时根据状态文件选择.
+func (this *DiskIndex) Init(path string, name string, maxFileSz uint32, MaxTermCnt int64,
+	codec PostingCodecType) error {
 	this.lock.Lock()
 	defer this.lock.Unlock()
 
@@ -396,11 +434,18 @@ func (this *DiskIndex) Init(path string, name string, maxFileSz uint32, MaxTermC
 	this.SelfStatus = &this.diskStatus
 
 	this.diskStatus.MaxTermCount = MaxTermCnt
+	this.diskStatus.Codec = codec
+
+	var err error
+	this.codec, err = GetPostingCodec(this.diskStatus.Codec)
+	if err != nil {
+		return err
+	}
 
 	// 初始化三级索引
 	this.index3 = &BigFile{}
 	ind3name := fmt.Sprintf("%s.index3", this.fileName)
-	err := this.index3.Init(this.filePath, ind3name, maxFileSz)
+	err = this.index3.Init(this.filePath, ind3name, maxFileSz)
 	if err != nil {
 		return log.Error(err)
 	}
@@ -453,7 +498,7 @@ func (this *DiskIndex) Close() {
 	this.indexStatus = DiskIndexClose
 }
 
-// DiskIndex构造函数,简单初始化
+// DiskIndex构造函数,简单初始化.
 func NewDiskIndex() *DiskIndex {
 	index := DiskIndex{}
 	index.indexStatus = DiskIndexInit
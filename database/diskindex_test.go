@@ -10,7 +10,7 @@ import (
 func createList(sz int, weight int) *InvList {
 	var lst InvList = make([]Index, 0, sz)
 	for i := 1; i < sz; i++ {
-		lst = append(lst, Index{InIdType(i), TermWeight(weight)})
+		lst = append(lst, Index{InID: InIdType(i), Weight: TermWeight(weight)})
 	}
 	return &lst
 }
@@ -24,7 +24,7 @@ func TestDiskIndex(t *testing.T) {
 	{
 		index := NewDiskIndex()
 		t.Logf("maxFileSize : %d", maxFileSz)
-		err := index.Init(testpath, "static", maxFileSz, maxTermCnt)
+		err := index.Init(testpath, "static", maxFileSz, maxTermCnt, DefaultPostingCodec)
 		if err != nil {
 			t.Error("init index", err.Error())
 			return
@@ -20,6 +20,9 @@ type IdManagerStatus struct {
 
 	// 最大id
 	MaxInId InIdType
+
+	// 已删除doc数量
+	DelCount InIdType
 }
 
 // 在goose设计解决百万级别的doc数.
@@ -35,6 +38,17 @@ type IdManager struct {
 	// mmap文件
 	mfile MmapFile
 
+	// 删除标记位图,每个内部id占用1个bit,置1表示doc已经被删除
+	// 刚分配还未提交的id也置1,CommitID之后才对检索可见
+	delfile MmapFile
+
+	// 外部id到当前有效内部id的反查表
+	outIdMap map[OutIdType]InIdType
+
+	// 已分配还未提交的id.跟删除的id一样置了删除标记,但是它的索引还在写入,不能丢弃.
+	// 只在内存中,分配后没有提交的id重启后就是删除的id
+	pending map[InIdType]bool
+
 	// 本身status
 	idStatus IdManagerStatus
 }
@@ -59,6 +73,37 @@ func (this *IdManager) Open(path string) error {
 		return err
 	}
 
+	// 旧版本的库没有删除位图,打开时会自动创建一个全0(没有删除)的位图
+	err = this.delfile.OpenFile(path, "id.del", delFileSize(this.idStatus.MaxInId))
+	if err != nil {
+		return err
+	}
+
+	return this.buildOutIdMap()
+}
+
+// 遍历全部已分配的id构建反查表.
+// 同一个外部id存在多个有效的内部id(旧版本的库允许重复),只保留最后分配的,
+// 其它的打上删除标记.
+func (this *IdManager) buildOutIdMap() error {
+	this.outIdMap = make(map[OutIdType]InIdType)
+	this.pending = make(map[InIdType]bool)
+	for inId := InIdType(1); inId < this.idStatus.CurId; inId++ {
+		if this.IsDeleted(inId) {
+			continue
+		}
+		outId, err := this.GetOutID(inId)
+		if err != nil {
+			return err
+		}
+		if oldId, ok := this.outIdMap[outId]; ok {
+			err = this.delete(oldId)
+			if err != nil {
+				return err
+			}
+		}
+		this.outIdMap[outId] = inId
+	}
 	return nil
 }
 
@@ -82,6 +127,13 @@ func (this *IdManager) Init(path string, maxId InIdType) error {
 		return err
 	}
 
+	err = this.delfile.OpenFile(path, "id.del", delFileSize(maxId))
+	if err != nil {
+		return err
+	}
+	this.outIdMap = make(map[OutIdType]InIdType)
+	this.pending = make(map[InIdType]bool)
+
 	return this.SaveJsonFile()
 }
 
@@ -93,7 +145,10 @@ func (this *IdManager) Sync() error {
 	this.SaveJsonFile()
 
 	err := this.mfile.Flush()
-	return err
+	if err != nil {
+		return err
+	}
+	return this.delfile.Flush()
 }
 
 func (this *IdManager) Close() error {
@@ -102,10 +157,15 @@ func (this *IdManager) Close() error {
 
 	this.SaveJsonFile()
 
+	err := this.delfile.Close()
+	if err != nil {
+		return err
+	}
 	return this.mfile.Close()
 }
 
-// 分配内部id
+// 分配内部id.新分配的id处于未提交状态,检索不可见,
+// 写完doc的全部数据后需要调用CommitID.
 func (this *IdManager) AllocID(outId OutIdType) (InIdType, error) {
 	this.lock.Lock()
 	defer this.lock.Unlock()
@@ -127,12 +187,91 @@ func (this *IdManager) AllocID(outId OutIdType) (InIdType, error) {
 		return 0, err
 	}
 
+	// 未提交的id先标记为删除
+	_, err = this.setDelBit(inID)
+	if err != nil {
+		return 0, err
+	}
+
 	// 确认分配成功才真正占用这个id
 	this.idStatus.CurId++
+	this.pending[inID] = true
 
 	return inID, nil
 }
 
+// 提交内部id,使其对检索可见.
+// 如果同一个外部id已经有旧版本的doc,旧版本同时被删除,新版本取而代之.
+func (this *IdManager) CommitID(inId InIdType) error {
+	this.lock.Lock()
+	defer this.lock.Unlock()
+
+	if inId == 0 || inId >= this.idStatus.CurId {
+		return log.Warn("illegal inId [%d] CurId[%d]", inId, this.idStatus.CurId)
+	}
+
+	outId, err := this.GetOutID(inId)
+	if err != nil {
+		return err
+	}
+
+	// 先让新版本可见,再删除旧版本
+	err = this.clearDelBit(inId)
+	if err != nil {
+		return err
+	}
+	if oldId, ok := this.outIdMap[outId]; ok && oldId != inId {
+		err = this.delete(oldId)
+		if err != nil {
+			return err
+		}
+	}
+	this.outIdMap[outId] = inId
+	delete(this.pending, inId)
+	return nil
+}
+
+// 丢弃curId及之后分配的id,之后从curId开始重新分配.
+// 增量建库用来丢弃基础版本中检索程序动态分配的id
+func (this *IdManager) Truncate(curId InIdType) error {
+	this.lock.Lock()
+	defer this.lock.Unlock()
+
+	if curId == 0 || curId > this.idStatus.CurId {
+		return log.Error("truncate to [%d] illegal CurId[%d]", curId, this.idStatus.CurId)
+	}
+
+	// 丢弃的id标记为删除,重新分配之前对检索不可见
+	for inId := curId; inId < this.idStatus.CurId; inId++ {
+		_, err := this.setDelBit(inId)
+		if err != nil {
+			return err
+		}
+	}
+	this.idStatus.CurId = curId
+
+	err := this.buildOutIdMap()
+	if err != nil {
+		return err
+	}
+	this.idStatus.DelCount = 0
+	for inId := InIdType(1); inId < curId; inId++ {
+		if this.IsDeleted(inId) {
+			this.idStatus.DelCount++
+		}
+	}
+	return this.SaveJsonFile()
+}
+
+// 查询外部id当前有效的内部id
+func (this *IdManager) GetInID(outId OutIdType) (InIdType, bool) {
+	this.lock.RLock()
+	defer this.lock.RUnlock()
+
+	inId, ok := this.outIdMap[outId]
+	return inId, ok
+}
+
 // 获取外部id
 func (this *IdManager) GetOutID(inId InIdType) (OutIdType, error) {
 	// 获取外部id只读操作,不需要加锁
@@ -157,6 +296,112 @@ func (this *IdManager) GetOutID(inId InIdType) (OutIdType, error) {
 	return outId, nil
 }
 
+// 删除一个内部id,被删除的id在检索时会被忽略.重复删除不报错.
+func (this *IdManager) Delete(inId InIdType) error {
+	this.lock.Lock()
+	defer this.lock.Unlock()
+
+	return this.delete(inId)
+}
+
+func (this *IdManager) delete(inId InIdType) error {
+	if inId == 0 || inId >= this.idStatus.CurId {
+		return log.Warn("illegal inId [%d] CurId[%d]", inId, this.idStatus.CurId)
+	}
+
+	changed, err := this.setDelBit(inId)
+	if err != nil {
+		return err
+	}
+	if changed {
+		this.idStatus.DelCount++
+	}
+	return nil
+}
+
+// 设置删除标记,返回标记是否有变化
+func (this *IdManager) setDelBit(inId InIdType) (bool, error) {
+	b, err := this.delfile.ReadUint8(uint32(inId / 8))
+	if err != nil {
+		return false, err
+	}
+	mask := uint8(1) << (inId % 8)
+	if b&mask != 0 {
+		return false, nil
+	}
+	return true, this.delfile.WriteNum(uint32(inId/8), b|mask)
+}
+
+// 清除删除标记
+func (this *IdManager) clearDelBit(inId InIdType) error {
+	b, err := this.delfile.ReadUint8(uint32(inId / 8))
+	if err != nil {
+		return err
+	}
+	mask := uint8(1) << (inId % 8)
+	return this.delfile.WriteNum(uint32(inId/8), b&^mask)
+}
+
+// 删除外部id当前有效的内部id.
+// 删除位图会马上同步到磁盘,保证删除操作不会因为程序退出丢失.
+func (this *IdManager) DeleteByOutId(outId OutIdType) error {
+	this.lock.Lock()
+	defer this.lock.Unlock()
+
+	inId, ok := this.outIdMap[outId]
+	if !ok {
+		log.Warn("outId [%d] not found", outId)
+		return ErrOutIdNotFound
+	}
+
+	err := this.delete(inId)
+	if err != nil {
+		return err
+	}
+	delete(this.outIdMap, outId)
+
+	this.SaveJsonFile()
+	return this.delfile.Flush()
+}
+
+// 内部id是否已经被删除.只读操作,不加锁.
+func (this *IdManager) IsDeleted(inId InIdType) bool {
+	if inId >= this.idStatus.MaxInId {
+		return true
+	}
+	b, err := this.delfile.ReadUint8(uint32(inId / 8))
+	if err != nil {
+		return true
+	}
+	return b&(uint8(1)<<(inId%8)) != 0
+}
+
+// 内部id是否已分配还未提交.删除标记清除之后才移出,
+// 先判断IsPending再判断IsDeleted,不会把正在提交的doc当成已删除
+func (this *IdManager) IsPending(inId InIdType) bool {
+	this.lock.RLock()
+	defer this.lock.RUnlock()
+	return this.pending[inId]
+}
+
+// 已删除的doc数量
+func (this *IdManager) GetDelCount() InIdType {
+	return this.idStatus.DelCount
+}
+
+// id分配状态
+func (this *IdManager) GetStatus() IdManagerStatus {
+	this.lock.RLock()
+	defer this.lock.RUnlock()
+	return this.idStatus
+}
+
+// 删除位图文件大小.MmapFile创建新文件时会在最后一个字节写入数据,
+// 多预留一个字节,保证最后一个字节不会对应到任何有效的id
+func delFileSize(maxId InIdType) uint32 {
+	return uint32(maxId/8) + 2
+}
+
 func NewIdManager() *IdManager {
 	id := IdManager{}
 
@@ -65,4 +65,83 @@ func TestIdManager(t *testing.T) {
 	}
 }
 
+func TestIdManagerDelete(t *testing.T) {
+	var testpath = filepath.Join(os.Getenv("HOME"), "hehe", "tmp", "goosedb", "test_idmanager_del")
+
+	os.RemoveAll(testpath)
+	os.MkdirAll(testpath, 0755)
+
+	var idMgr IdManager
+	err := idMgr.Init(testpath, 1000)
+	if err != nil {
+		t.Error(err.Error())
+		return
+	}
+
+	// 外部id 1~9 各写入多个版本,只有最后提交的版本有效
+	lastInId := make(map[OutIdType]InIdType)
+	for i := 1; i < 100; i++ {
+		outId := OutIdType(i % 10)
+		inId, err := idMgr.AllocID(outId)
+		if outId == 0 {
+			if err == nil {
+				t.Errorf("alloc illegal outId without error")
+			}
+			continue
+		}
+		if err != nil {
+			t.Error(err.Error())
+			return
+		}
+		if !idMgr.IsDeleted(inId) {
+			t.Errorf("InId[%d] visible before commit", inId)
+		}
+		err = idMgr.CommitID(inId)
+		if err != nil {
+			t.Error(err.Error())
+			return
+		}
+		lastInId[outId] = inId
+	}
+
+	// 未提交的id检索不可见
+	pendingId, _ := idMgr.AllocID(OutIdType(1))
+
+	err = idMgr.DeleteByOutId(OutIdType(3))
+	if err != nil {
+		t.Error(err.Error())
+		return
+	}
+	err = idMgr.DeleteByOutId(OutIdType(3))
+	if err == nil {
+		t.Errorf("delete outId twice without error")
+	}
+	idMgr.Close()
+
+	// 重新打开,删除标记和反查表都还在
+	idMgr2 := NewIdManager()
+	err = idMgr2.Open(testpath)
+	if err != nil {
+		t.Error(err.Error())
+		return
+	}
+	if !idMgr2.IsDeleted(pendingId) {
+		t.Errorf("pending InId[%d] visible", pendingId)
+	}
+	for i := InIdType(1); i < pendingId; i++ {
+		outId, _ := idMgr2.GetOutID(i)
+		visible := outId != 3 && lastInId[outId] == i
+		if idMgr2.IsDeleted(i) == visible {
+			t.Errorf("InId[%d] OutId[%d] deleted[%v]", i, outId, idMgr2.IsDeleted(i))
+		}
+	}
+	if _, ok := idMgr2.GetInID(OutIdType(3)); ok {
+		t.Errorf("deleted OutId[3] still in map")
+	}
+	if inId, _ := idMgr2.GetInID(OutIdType(7)); inId != lastInId[7] {
+		t.Errorf("OutId[7] InId[%d] != [%d]", inId, lastInId[7])
+	}
+	idMgr2.Close()
+}
+
 /* vim: set expandtab ts=4 sw=4 sts=4 tw=100: */
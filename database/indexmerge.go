@@ -93,3 +93,53 @@ func IndexMerge(indexA, indexB ReadOnlyIndex, indexC WriteOnlyIndex) error {
 
 	return nil
 }
+
+// 多路合并索引库,写入到索引库dst.同一个term的拉链使用KMerge归并.
+// 写入失败返回错误,dst不完整需要丢弃
+func IndexKMerge(src []ReadOnlyIndex, dst WriteOnlyIndex) error {
+	iters := make([]IndexIterator, len(src))
+	terms := make([]TermSign, len(src))
+	for i, index := range src {
+		iters[i] = index.NewIterator()
+		terms[i] = iters[i].Next()
+	}
+
+	for {
+		// 各个库当前最小的term
+		currTerm := TermSign(0)
+		for _, t := range terms {
+			if t != TermSign(0) && (currTerm == TermSign(0) || t < currTerm) {
+				currTerm = t
+			}
+		}
+		if currTerm == TermSign(0) {
+			break
+		}
+
+		lists := make([]*InvList, 0, len(src))
+		for i, t := range terms {
+			if t != currTerm {
+				continue
+			}
+			terms[i] = iters[i].Next()
+
+			lst, err := src[i].ReadIndex(currTerm)
+			if err != nil {
+				// 跟IndexMerge一致,读取失败的拉链跳过
+				continue
+			}
+			lists = append(lists, lst)
+		}
+		if len(lists) == 0 {
+			continue
+		}
+
+		lst := lists[0]
+		lst.KMerge(lists[1:], math.MaxInt32)
+		err := dst.WriteIndex(currTerm, lst)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -107,7 +107,7 @@ func (this *IndexTransform) addOneTerm(id InIdType, t TermInDoc) error {
 		return log.Error("add new value fail")
 	}
 
-	list.Append(Index{InID: id, Weight: t.Weight})
+	list.Append(Index{InID: id, Weight: t.Weight, Pos: t.Pos})
 	return nil
 }
 
@@ -1,15 +1,18 @@
 package database
 
 import (
+	"fmt"
 	. "github.com/getwe/goose/utils"
+	"os"
+	"path/filepath"
 	"testing"
 )
 
 func createTermInDoc(base uint8) []TermInDoc {
 	td := make([]TermInDoc, 0)
-	td = append(td, TermInDoc{TermSign(100 + base + 1), TermWeight(base + 100 + 1)})
-	td = append(td, TermInDoc{TermSign(100 + base + 2), TermWeight(base + 100 + 2)})
-	td = append(td, TermInDoc{TermSign(100 + base + 3), TermWeight(base + 100 + 3)})
+	td = append(td, TermInDoc{Sign: TermSign(100 + base + 1), Weight: TermWeight(base + 100 + 1)})
+	td = append(td, TermInDoc{Sign: TermSign(100 + base + 2), Weight: TermWeight(base + 100 + 2)})
+	td = append(td, TermInDoc{Sign: TermSign(100 + base + 3), Weight: TermWeight(base + 100 + 3)})
 	return td
 }
 
@@ -33,3 +36,68 @@ func TestIndexTransform(t *testing.T) {
 
 	tf.Dump(printdb{t})
 }
+
+// 记录写入的拉链
+type recorddb map[TermSign][]InIdType
+
+func (this recorddb) WriteIndex(t TermSign, l *InvList) error {
+	if _, ok := this[t]; ok {
+		return fmt.Errorf("term [%d] written twice", t)
+	}
+	for _, e := range *l {
+		this[t] = append(this[t], e.InID)
+	}
+	return nil
+}
+
+func TestIndexTransformManagerDump(t *testing.T) {
+	path := filepath.Join(os.Getenv("HOME"), "tmp", "goosedb", "test_transform_dump")
+
+	// 每个doc写入一个磁盘索引.term 3只在第一个索引中,第一个索引最先遍历结束;
+	// term 20是最后一个term,只在最后一个索引中
+	docs := [][]TermSign{{1, 2, 3}, {1, 10, 11}, {2, 10, 20}}
+	expect := map[TermSign][]InIdType{
+		1: {1, 2}, 2: {1, 3}, 3: {1}, 10: {2, 3}, 11: {2}, 20: {3}}
+
+	for _, maxTermCnt := range []int{3, 100} {
+		os.RemoveAll(path)
+		os.MkdirAll(path, 0755)
+
+		tfMgr := NewIndexTransformManager()
+		tfMgr.Init(path, maxTermCnt)
+		for i, terms := range docs {
+			termlist := make([]TermInDoc, len(terms))
+			for j, sign := range terms {
+				termlist[j] = TermInDoc{Sign: sign, Weight: 1}
+			}
+			err := tfMgr.WriteIndex(InIdType(i+1), termlist)
+			if err != nil {
+				t.Fatalf("WriteIndex --- %s", err)
+			}
+		}
+
+		got := make(recorddb)
+		err := tfMgr.Dump(got)
+		if err != nil {
+			t.Fatalf("maxTermCnt[%d] Dump --- %s", maxTermCnt, err)
+		}
+		if len(got) != len(expect) {
+			t.Errorf("maxTermCnt[%d] get [%d] terms expect [%d]", maxTermCnt,
+				len(got), len(expect))
+		}
+		for sign, ids := range expect {
+			if len(got[sign]) != len(ids) {
+				t.Errorf("maxTermCnt[%d] term [%d] get %v expect %v", maxTermCnt, sign,
+					got[sign], ids)
+				continue
+			}
+			for i := range ids {
+				if got[sign][i] != ids[i] {
+					t.Errorf("maxTermCnt[%d] term [%d] get %v expect %v", maxTermCnt,
+						sign, got[sign], ids)
+					break
+				}
+			}
+		}
+	}
+}
@@ -3,16 +3,32 @@ package database
 import (
 	"container/heap"
 	"fmt"
+	log "github.com/getwe/goose/log"
 	. "github.com/getwe/goose/utils"
 	"math"
 	"os"
 	"path/filepath"
+	"strings"
+	"time"
 	//"runtime"
 )
 
+// 正排转倒排的持久化状态,Checkpoint时写入工作目录
+type IndexTransformStatus struct {
+	// 已经暂存到磁盘的索引名称
+	DiskIndexName []string
+	// 已经写入的term数量
+	TermCount int64
+	// 内存中的索引写入磁盘的次数和耗时(秒)
+	SpillCount   int
+	SpillSeconds float64
+}
+
 // IndexTransform的管理器.当IndexTransform无法再写入的时候,进行写入到磁盘操作.
 // 当全部工作完成后,进行把已写入磁盘的索引合并成一个大索引.
 type IndexTransformManager struct {
+	JsonStatusFile
+
 	// 磁盘存储目录
 	filePath string
 
@@ -29,12 +45,34 @@ type IndexTransformManager struct {
 	maxTermInDocCount int
 	// 当前可用的IndexTransform
 	currIndexTf *IndexTransform
+
+	// 内存中的索引写入磁盘的次数和耗时
+	spillCount int
+	spillTime  time.Duration
+
+	// 合并索引时打印进度的周期,0不打印
+	progressInterval time.Duration
 }
 
 func (this *IndexTransformManager) GetTermCount() int64 {
 	return this.termCount
 }
 
+// 当前状态,包括暂存到磁盘的统计
+func (this *IndexTransformManager) GetStatus() IndexTransformStatus {
+	st := IndexTransformStatus{}
+	st.DiskIndexName = this.diskIndexName
+	st.TermCount = this.termCount
+	st.SpillCount = this.spillCount
+	st.SpillSeconds = this.spillTime.Seconds()
+	return st
+}
+
+// 设置合并索引时打印进度的周期,0不打印
+func (this *IndexTransformManager) SetProgressInterval(interval time.Duration) {
+	this.progressInterval = interval
+}
+
 // MaxTermCnt指的是在内存中最多的索引数(非拉链数).
 // fPath是工作目录
 func (this *IndexTransformManager) Init(fPath string, MaxTermCnt int) error {
@@ -45,9 +83,60 @@ func (this *IndexTransformManager) Init(fPath string, MaxTermCnt int) error {
 
 	this.termCount = 0
 
+	this.SelfStatus = &IndexTransformStatus{}
+	this.StatusFilePath = filepath.Join(this.filePath, "transform.stat")
+
+	return nil
+}
+
+// 打开最近一次Checkpoint的状态继续写入.
+// Checkpoint之后暂存到磁盘的索引被丢弃,这些索引对应的doc需要重新写入
+func (this *IndexTransformManager) Open(fPath string, MaxTermCnt int) error {
+	this.maxTermInDocCount = MaxTermCnt
+	this.filePath = fPath
+	this.tmpDiskPath = filepath.Join(this.filePath, "_tf_tmp")
+
+	st := IndexTransformStatus{}
+	this.SelfStatus = &st
+	this.StatusFilePath = filepath.Join(this.filePath, "transform.stat")
+	err := this.ParseJsonFile()
+	if err != nil {
+		return err
+	}
+	this.diskIndexName = st.DiskIndexName
+	this.termCount = st.TermCount
+	this.spillCount = st.SpillCount
+	this.spillTime = time.Duration(st.SpillSeconds * float64(time.Second))
+	this.currIndexTf = nil
+
+	keep := make(map[string]bool)
+	for _, name := range this.diskIndexName {
+		keep[name] = true
+	}
+	files, _ := filepath.Glob(filepath.Join(this.tmpDiskPath, "indextransform*"))
+	for _, f := range files {
+		name := filepath.Base(f)
+		if i := strings.Index(name, ".index"); i >= 0 {
+			name = name[:i]
+		}
+		if !keep[name] {
+			os.Remove(f)
+		}
+	}
 	return nil
 }
 
+// 内存中的索引写入磁盘,并且保存状态.之后可以通过Open恢复到这个状态
+func (this *IndexTransformManager) Checkpoint() error {
+	err := this.saveTransform()
+	if err != nil {
+		return err
+	}
+	st := this.GetStatus()
+	this.SelfStatus = &st
+	return this.SaveJsonFile()
+}
+
 // 写入索引.不支持并发写入,调用者需要自己控制.
 func (this *IndexTransformManager) WriteIndex(InID InIdType, termlist []TermInDoc) error {
 	err := this.checkTransform()
@@ -83,6 +172,7 @@ func (this *IndexTransformManager) saveTransform() error {
 	if this.currIndexTf == nil {
 		return nil
 	}
+	begin := time.Now()
 
 	db, err := this.newDiskIndex()
 	if err != nil {
@@ -96,6 +186,12 @@ func (this *IndexTransformManager) saveTransform() error {
 	}
 	db.Close()
 	this.currIndexTf = nil
+
+	cost := time.Since(begin)
+	this.spillCount++
+	this.spillTime += cost
+	log.Info("transform spill [%d] to disk, term [%d], cost [%s]", this.spillCount,
+		this.termCount, cost)
 	return nil
 }
 
@@ -115,7 +211,8 @@ func (this *IndexTransformManager) newDiskIndex() (*DiskIndex, error) {
 	name := fmt.Sprintf("indextransform%d", len(this.diskIndexName))
 	this.diskIndexName = append(this.diskIndexName, name)
 	path := this.tmpDiskPath
-	err := index.Init(path, name, maxFileSz, int64(this.currIndexTf.GetInvListSize()))
+	err := index.Init(path, name, maxFileSz, int64(this.currIndexTf.GetInvListSize()),
+		DefaultPostingCodec)
 	if err != nil {
 		return nil, err
 	}
@@ -150,7 +247,8 @@ func (this *IndexTransformManager) Dump(dstdb WriteOnlyIndex) error {
 	indexheap := &diskIndexMinHeap{}
 	heap.Init(indexheap)
 
-	// 打开全部磁盘索引
+	// 打开全部磁盘索引.各个索引的term数量之和作为合并进度的总量,重复的term使得总量偏大
+	var totalTerm, mergedTerm int64
 	dblist := make([](*DiskIndex), 0, len(this.diskIndexName))
 	for _, name := range this.diskIndexName {
 		db := NewDiskIndex()
@@ -160,6 +258,7 @@ func (this *IndexTransformManager) Dump(dstdb WriteOnlyIndex) error {
 		}
 		// 磁盘索引
 		dblist = append(dblist, db)
+		totalTerm += db.GetTermCount()
 
 		// 创建一个迭代器
 		iter := db.NewIterator()
@@ -178,6 +277,22 @@ func (this *IndexTransformManager) Dump(dstdb WriteOnlyIndex) error {
 	var lastTerm TermSign = TermSign(0)
 	// 已经弹出的未写入的term
 	lastItemLst := make([]diskIndexMinHeapItem, 0)
+	lastReport := time.Now()
+
+	// 把上一个term未写入的写入目标索引库
+	writeLast := func() error {
+		alllist := make([](*InvList), len(lastItemLst))
+		for i, e := range lastItemLst {
+			alllist[i], err = e.Index.ReadIndex(e.Term)
+			if err != nil {
+				// TODO warnning log
+				alllist[i] = nil
+			}
+		}
+		tmplst := NewInvList()
+		tmplst.KMerge(alllist, math.MaxInt32)
+		return dstdb.WriteIndex(lastTerm, &tmplst)
+	}
 
 	for indexheap.Len() > 0 {
 		// 堆顶term最小元素
@@ -185,46 +300,50 @@ func (this *IndexTransformManager) Dump(dstdb WriteOnlyIndex) error {
 		// 多个索引中会存在相同的term,得收集起来合并后再写入
 
 		if item.Term != lastTerm && len(lastItemLst) > 0 {
-			// 把上一个term未写入的先写入目标索引库
-			alllist := make([](*InvList), len(lastItemLst))
-			for i, e := range lastItemLst {
-				alllist[i], err = e.Index.ReadIndex(e.Term)
-				if err != nil {
-					// TODO warnning log
-					alllist[i] = nil
-				}
-			}
-			tmplst := NewInvList()
-			tmplst.KMerge(alllist, math.MaxInt32)
-			err := dstdb.WriteIndex(lastTerm, &tmplst)
+			err := writeLast()
 			if err != nil {
 				return err
 			}
+			mergedTerm += int64(len(lastItemLst))
+			if this.progressInterval > 0 && time.Since(lastReport) >= this.progressInterval {
+				lastReport = time.Now()
+				log.Info("merge transform [%d] index, term [%d/%d] %.1f%%",
+					len(dblist), mergedTerm, totalTerm,
+					float64(mergedTerm)*100/float64(totalTerm))
+			}
 
 			// 开始新的term,清空状态
 			lastItemLst = lastItemLst[:0]
-		} else {
-			// nothing
 		}
 		lastTerm = item.Term
 
 		// 无论是新term还是跟上一个一样的term,都是加入待写入列表
 		lastItemLst = append(lastItemLst, item)
 
-		// 检查当前索引是否还有更多的term,再push进堆
+		// 检查当前索引是否还有更多的term,再push进堆.
+		// 遍历结束的索引还要读取最后一个term,全部写完后再关闭
 		newterm := item.Iter.Next()
 		if newterm != 0 {
 			heap.Push(indexheap, diskIndexMinHeapItem{
 				Term:  newterm,
 				Index: item.Index,
 				Iter:  item.Iter})
-		} else {
-			// 索引已经遍历结束的尽早关闭
-			item.Index.Close()
 		}
 	}
 
-	// 删除磁盘临时索引
+	// 最后一个term
+	if len(lastItemLst) > 0 {
+		err = writeLast()
+		if err != nil {
+			return err
+		}
+	}
+	for _, db := range dblist {
+		db.Close()
+	}
+
+	// 删除磁盘临时索引.先删除状态文件,之后不能再Open
+	os.Remove(this.StatusFilePath)
 	err = os.RemoveAll(this.tmpDiskPath)
 	if err != nil {
 		return err
@@ -240,5 +359,6 @@ func NewIndexTransformManager() *IndexTransformManager {
 
 	tfMgr.diskIndexName = nil
 	tfMgr.currIndexTf = nil
+	tfMgr.progressInterval = 10 * time.Second
 	return &tfMgr
 }
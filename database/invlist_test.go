@@ -4,15 +4,16 @@ import (
 	. "github.com/getwe/goose/utils"
 	"math"
 	"math/rand"
+	"reflect"
 	"testing"
 	"time"
 )
 
 func TestInvList(t *testing.T) {
 	lst := NewInvList()
-	lst.Append(Index{1, 101})
-	lst.Append(Index{2, 102})
-	lst.Append(Index{3, 103})
+	lst.Append(Index{InID: 1, Weight: 101})
+	lst.Append(Index{InID: 2, Weight: 102})
+	lst.Append(Index{InID: 3, Weight: 103})
 
 	if lst.Len() != 3 {
 		t.Errorf("append error")
@@ -31,7 +32,7 @@ func TestInvListKMerge(t *testing.T) {
 		// 每个拉链多个元素
 		lstLen := int(rand.Uint32() % 5)
 		for j := 0; j < lstLen; j++ {
-			lst.Append(Index{InIdType(i + j*10), TermWeight(i + j*10 + 500)})
+			lst.Append(Index{InID: InIdType(i + j*10), Weight: TermWeight(i + j*10 + 500)})
 		}
 		alllst = append(alllst, &lst)
 	}
@@ -54,16 +55,16 @@ func TestInvListKMerge(t *testing.T) {
 
 func TestInvListMerge(t *testing.T) {
 	lst1 := NewInvList()
-	lst1.Append(Index{1, 101})
-	lst1.Append(Index{3, 103})
-	lst1.Append(Index{5, 105})
-	lst1.Append(Index{7, 107})
+	lst1.Append(Index{InID: 1, Weight: 101})
+	lst1.Append(Index{InID: 3, Weight: 103})
+	lst1.Append(Index{InID: 5, Weight: 105})
+	lst1.Append(Index{InID: 7, Weight: 107})
 
 	lst2 := NewInvList()
-	lst2.Append(Index{2, 102})
-	lst2.Append(Index{4, 104})
-	lst2.Append(Index{6, 106})
-	lst2.Append(Index{8, 108})
+	lst2.Append(Index{InID: 2, Weight: 102})
+	lst2.Append(Index{InID: 4, Weight: 104})
+	lst2.Append(Index{InID: 6, Weight: 106})
+	lst2.Append(Index{InID: 8, Weight: 108})
 
 	alllst := make([](*InvList), 0)
 	alllst = append(alllst, &lst1)
@@ -80,7 +81,7 @@ func TestInvListMerge(t *testing.T) {
 	t.Log("多路归并算法归并一个拉链")
 	t.Log(k1lst)
 	for i := 0; i < lst1.Len(); i++ {
-		if lst1[i] != k1lst[i] {
+		if !reflect.DeepEqual(lst1[i], k1lst[i]) {
 			t.Error("merge error")
 		}
 	}
@@ -100,7 +101,7 @@ func TestInvListMerge(t *testing.T) {
 
 	// 检查两个算法归并结果是否相同
 	for i := 0; i < lst1.Len(); i++ {
-		if lst1[i] != klst[i] {
+		if !reflect.DeepEqual(lst1[i], klst[i]) {
 			t.Error("merge error")
 		}
 	}
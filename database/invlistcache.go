@@ -0,0 +1,114 @@
+package database
+
+import (
+	"container/list"
+	. "github.com/getwe/goose/utils"
+	"sync"
+)
+
+// 拉链缓存的状态
+type InvListCacheStatus struct {
+	// 命中次数
+	Hit int64
+	// 未命中次数,包括缓存的拉链已经失效
+	Miss int64
+	// 缓存的拉链数量
+	Count int
+	// 缓存的拉链总长度
+	Size int
+	// 最大总长度
+	MaxSize int
+}
+
+type invListCacheItem struct {
+	term  TermSign
+	gen   uint64
+	table *SkipTable
+}
+
+// 反序列化后的拉链以及跳表的LRU缓存,容量按拉链总长度计算.
+// 每个拉链记录读取时数据的代数,代数变化(比如动态索引生成了新的磁盘段)后缓存的拉链失效.
+// 缓存的拉链是共享的,使用者只能读取.
+type InvListCache struct {
+	lock sync.Mutex
+
+	// 最近使用的在前
+	lru   *list.List
+	items map[TermSign]*list.Element
+
+	size    int
+	maxSize int
+
+	hit  int64
+	miss int64
+}
+
+// 读取代数为gen的拉链
+func (this *InvListCache) Get(t TermSign, gen uint64) (*SkipTable, bool) {
+	this.lock.Lock()
+	defer this.lock.Unlock()
+
+	e, ok := this.items[t]
+	if !ok {
+		this.miss++
+		return nil, false
+	}
+	item := e.Value.(*invListCacheItem)
+	if item.gen != gen {
+		this.remove(e)
+		this.miss++
+		return nil, false
+	}
+	this.lru.MoveToFront(e)
+	this.hit++
+	return item.table, true
+}
+
+// 写入代数为gen的拉链.超过容量时淘汰最久没有使用的拉链
+func (this *InvListCache) Put(t TermSign, gen uint64, table *SkipTable) {
+	// 超过总容量的拉链不缓存
+	if this.maxSize <= 0 || table.Len() > this.maxSize {
+		return
+	}
+
+	this.lock.Lock()
+	defer this.lock.Unlock()
+
+	if e, ok := this.items[t]; ok {
+		this.remove(e)
+	}
+	this.items[t] = this.lru.PushFront(&invListCacheItem{term: t, gen: gen, table: table})
+	this.size += table.Len()
+
+	for this.size > this.maxSize {
+		this.remove(this.lru.Back())
+	}
+}
+
+func (this *InvListCache) remove(e *list.Element) {
+	item := this.lru.Remove(e).(*invListCacheItem)
+	delete(this.items, item.term)
+	this.size -= item.table.Len()
+}
+
+func (this *InvListCache) GetStatus() InvListCacheStatus {
+	this.lock.Lock()
+	defer this.lock.Unlock()
+
+	st := InvListCacheStatus{}
+	st.Hit = this.hit
+	st.Miss = this.miss
+	st.Count = this.lru.Len()
+	st.Size = this.size
+	st.MaxSize = this.maxSize
+	return st
+}
+
+// 构造函数,maxSize是缓存的拉链总长度上限,0表示不缓存
+func NewInvListCache(maxSize int) *InvListCache {
+	c := InvListCache{}
+	c.lru = list.New()
+	c.items = make(map[TermSign]*list.Element)
+	c.maxSize = maxSize
+	return &c
+}
@@ -0,0 +1,45 @@
+package database
+
+import (
+	. "github.com/getwe/goose/utils"
+	"testing"
+)
+
+func TestInvListCache(t *testing.T) {
+	newList := func(n int) *SkipTable {
+		l := NewInvList(n)
+		for i := 0; i < n; i++ {
+			l.Append(Index{InID: InIdType(i + 1), Weight: 1})
+		}
+		return NewSkipTable(&l)
+	}
+
+	c := NewInvListCache(10)
+	c.Put(1, 0, newList(4))
+	c.Put(2, 0, newList(4))
+	if _, ok := c.Get(1, 0); !ok {
+		t.Errorf("term 1 miss")
+	}
+	// 超过容量淘汰最久没有使用的term 2
+	c.Put(3, 0, newList(4))
+	if _, ok := c.Get(2, 0); ok {
+		t.Errorf("term 2 not evicted")
+	}
+	if l, ok := c.Get(1, 0); !ok || l.Len() != 4 {
+		t.Errorf("term 1 miss")
+	}
+	// 代数变化后失效
+	if _, ok := c.Get(3, 1); ok {
+		t.Errorf("term 3 hit with new gen")
+	}
+	// 超过总容量的拉链不缓存
+	c.Put(4, 0, newList(11))
+	if _, ok := c.Get(4, 0); ok {
+		t.Errorf("term 4 cached")
+	}
+
+	st := c.GetStatus()
+	if st.Hit != 2 || st.Miss != 3 || st.Count != 1 || st.Size != 4 {
+		t.Errorf("status %+v", st)
+	}
+}
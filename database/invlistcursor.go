@@ -0,0 +1,324 @@
+package database
+
+import (
+	log "github.com/getwe/goose/log"
+	. "github.com/getwe/goose/utils"
+	"sort"
+	"sync"
+)
+
+const (
+	// 拉链跳表的块大小,每个块记录第一个InID和块内最大Weight
+	SkipBlockSize = 128
+)
+
+// 拉链跳表中的一个块
+type SkipBlock struct {
+	// 块内第一个(最小)InID
+	FirstInID InIdType
+	// 块内最大的Weight
+	MaxWeight TermWeight
+	// 块内第一个元素在整条拉链中的序号
+	start int
+	// 还没有解码的块在编码数据中的偏移
+	offset int
+}
+
+// 拉链以及它的跳表.拉链按InID升序分块,每个块记录第一个InID和块内最大Weight.
+// 磁盘索引中块目录跟拉链一起序列化(PostingCodecBlock),读取时只解析块目录,
+// 块数据保持编码状态,遍历器只解码实际到达的块.
+// 构建之后只读,可以跟拉链一起缓存,多个遍历器共享,不需要每次检索重新构建.
+type SkipTable struct {
+	blocks []SkipBlock
+
+	// 前encoded个块只有编码数据
+	encoded int
+	buf     []byte
+	// 从第encoded个块开始的元素,已经解码
+	tail InvList
+
+	// 拉链长度
+	length int
+	// 整条拉链的最大Weight
+	maxWeight TermWeight
+
+	// 完整的拉链,有编码块的时候第一次调用List才解码
+	listOnce sync.Once
+	list     *InvList
+}
+
+// 完整的拉链,只能读取.会解码全部的块,检索时应该使用遍历器
+func (this *SkipTable) List() *InvList {
+	this.listOnce.Do(func() {
+		if this.list != nil {
+			return
+		}
+		l := NewInvList(this.length)
+		var buf InvList
+		for i := 0; i < this.encoded; i++ {
+			l.Concat(this.block(i, &buf))
+		}
+		l.Concat(this.tail)
+		this.list = &l
+	})
+	return this.list
+}
+
+// 拉链长度
+func (this *SkipTable) Len() int {
+	return this.length
+}
+
+// 拉链中最大的InID,只解码最后一个块.空拉链返回0
+func (this *SkipTable) LastInID() InIdType {
+	if len(this.tail) > 0 {
+		return this.tail[len(this.tail)-1].InID
+	}
+	if len(this.blocks) == 0 {
+		return 0
+	}
+	var buf InvList
+	b := this.block(len(this.blocks)-1, &buf)
+	if len(b) == 0 {
+		return 0
+	}
+	return b[len(b)-1].InID
+}
+
+// 创建从头开始的遍历器
+func (this *SkipTable) NewCursor() *InvListCursor {
+	c := &InvListCursor{table: this}
+	c.load(0)
+	return c
+}
+
+// 归并一条有序拉链,返回新的跳表,原跳表不变.
+// l的InID都比跳表中的大的时候(动态写入的doc一般如此),l追加成新的块,已经编码的块不需要解码;
+// 否则解码整条拉链后归并.之后l不能再被修改
+func (this *SkipTable) Merge(l *InvList) *SkipTable {
+	if l == nil || l.Len() == 0 {
+		return this
+	}
+	if this.length == 0 {
+		return NewSkipTable(l)
+	}
+	if (*l)[0].InID <= this.LastInID() {
+		merged := *this.List()
+		merged.Merge(*l)
+		return NewSkipTable(&merged)
+	}
+
+	t := SkipTable{}
+	t.blocks = make([]SkipBlock, len(this.blocks), len(this.blocks)+l.Len()/SkipBlockSize+1)
+	copy(t.blocks, this.blocks)
+	t.encoded = this.encoded
+	t.buf = this.buf
+	t.tail = NewInvList(len(this.tail) + l.Len())
+	t.tail.Concat(this.tail)
+	t.tail.Concat(*l)
+	t.length = this.length
+	t.maxWeight = this.maxWeight
+	t.appendBlocks(*l)
+	return &t
+}
+
+// lst按SkipBlockSize分块追加到块目录,lst的元素已经在tail中
+func (this *SkipTable) appendBlocks(lst InvList) {
+	for i := 0; i < len(lst); i += SkipBlockSize {
+		end := i + SkipBlockSize
+		if end > len(lst) {
+			end = len(lst)
+		}
+		b := SkipBlock{FirstInID: lst[i].InID, MaxWeight: lst[i].Weight, start: this.length + i}
+		for _, e := range lst[i+1 : end] {
+			if e.Weight > b.MaxWeight {
+				b.MaxWeight = e.Weight
+			}
+		}
+		if len(this.blocks) == 0 || b.MaxWeight > this.maxWeight {
+			this.maxWeight = b.MaxWeight
+		}
+		this.blocks = append(this.blocks, b)
+	}
+	this.length += len(lst)
+}
+
+// 第i个块的元素个数
+func (this *SkipTable) blockLen(i int) int {
+	if i+1 < len(this.blocks) {
+		return this.blocks[i+1].start - this.blocks[i].start
+	}
+	return this.length - this.blocks[i].start
+}
+
+// 第i个编码块的数据
+func (this *SkipTable) blockData(i int) []byte {
+	end := len(this.buf)
+	if i+1 < this.encoded {
+		end = this.blocks[i+1].offset
+	}
+	return this.buf[this.blocks[i].offset:end]
+}
+
+// 第i个块的元素.已经解码的块直接返回tail的一段,编码的块解码到buf中,buf可以复用.
+// 解码失败返回空,遍历在这里结束
+func (this *SkipTable) block(i int, buf *InvList) InvList {
+	b := this.blocks[i]
+	if i >= this.encoded {
+		tailStart := this.length - len(this.tail)
+		return this.tail[b.start-tailStart : b.start-tailStart+this.blockLen(i)]
+	}
+	l, err := decodeSkipBlock(this.blockData(i), b.FirstInID, this.blockLen(i), (*buf)[:0])
+	if err != nil {
+		log.Warn("decode skip block [%d] : %s", i, err)
+		return nil
+	}
+	*buf = l
+	return l
+}
+
+// 一次遍历拉链构建跳表,l为nil的时候是空拉链.之后l不能再被修改
+func NewSkipTable(l *InvList) *SkipTable {
+	t := SkipTable{}
+	if l == nil {
+		l = NewInvListPointer()
+	}
+	t.list = l
+	t.tail = *l
+	t.blocks = make([]SkipBlock, 0, (len(*l)+SkipBlockSize-1)/SkipBlockSize)
+	t.appendBlocks(*l)
+	return &t
+}
+
+// 读取term的拉链和跳表.db实现了SkipTableReader的话使用它的跳表
+func ReadSkipTable(db IndexReader, t TermSign) (*SkipTable, error) {
+	if reader, ok := db.(SkipTableReader); ok {
+		return reader.ReadSkipTable(t)
+	}
+	l, err := db.ReadIndex(t)
+	if err != nil {
+		return nil, err
+	}
+	return NewSkipTable(l), nil
+}
+
+// 带跳表的拉链遍历器.
+// SkipTo先在块上二分查找,再在块内二分查找,长拉链可以跳过大量元素而不必逐个遍历,
+// 跳过的块也不需要解码.
+// 遍历器只读拉链和跳表,多个遍历器可以共享同一个SkipTable.
+type InvListCursor struct {
+	table *SkipTable
+	// 当前块的序号以及块内的元素,块序号等于块数量表示遍历结束
+	block int
+	items InvList
+	// 当前元素在块内的位置
+	pos int
+	// 解码块使用的缓冲
+	buf InvList
+	// 遍历范围的上界(不包含),InID>=end的元素当作遍历结束,0表示不限制
+	end InIdType
+}
+
+// 切换到第block个块的开头
+func (this *InvListCursor) load(block int) {
+	this.block = block
+	this.pos = 0
+	this.items = nil
+	if block < len(this.table.blocks) {
+		this.items = this.table.block(block, &this.buf)
+	}
+}
+
+// 当前遍历位置是否有效
+func (this *InvListCursor) Valid() bool {
+	if this.pos >= len(this.items) {
+		return false
+	}
+	return this.end == 0 || this.items[this.pos].InID < this.end
+}
+
+// 只遍历InID在[begin,end)范围内的元素,end为0表示不限制上界.
+// 跳表二分查找到begin,如果范围内没有元素返回false
+func (this *InvListCursor) SetRange(begin InIdType, end InIdType) bool {
+	this.end = end
+	return this.SkipTo(begin)
+}
+
+// 当前遍历到的元素,调用者需要保证Valid()
+func (this *InvListCursor) Curr() Index {
+	return this.items[this.pos]
+}
+
+// 后移一个元素,如果遍历结束返回false
+func (this *InvListCursor) Next() bool {
+	if this.pos < len(this.items) {
+		this.pos++
+		if this.pos == len(this.items) {
+			this.load(this.block + 1)
+		}
+	}
+	return this.Valid()
+}
+
+// 跳到第一个InID>=inId的元素,如果遍历结束返回false.
+// 只会向后跳,inId小于当前元素的时候不移动.
+func (this *InvListCursor) SkipTo(inId InIdType) bool {
+	if !this.Valid() {
+		return false
+	}
+	if this.Curr().InID >= inId {
+		return true
+	}
+
+	// 在后续的块中找到最后一个FirstInID<=inId的块
+	rest := this.table.blocks[this.block+1:]
+	n := sort.Search(len(rest), func(i int) bool {
+		return rest[i].FirstInID > inId
+	})
+	if n > 0 {
+		this.load(this.block + n)
+	}
+
+	// 块内二分查找,找不到的话就落在下一个块的开头
+	lst := this.items[this.pos:]
+	this.pos += sort.Search(len(lst), func(i int) bool {
+		return lst[i].InID >= inId
+	})
+	if this.pos >= len(this.items) {
+		this.load(this.block + 1)
+	}
+	return this.Valid()
+}
+
+// 当前元素所在块的最大Weight,遍历结束返回0
+func (this *InvListCursor) BlockMaxWeight() TermWeight {
+	if !this.Valid() {
+		return 0
+	}
+	return this.table.blocks[this.block].MaxWeight
+}
+
+// 当前元素所在块的最后一个InID,遍历结束返回0
+func (this *InvListCursor) BlockLastInID() InIdType {
+	if !this.Valid() {
+		return 0
+	}
+	return this.items[len(this.items)-1].InID
+}
+
+// 整条拉链的最大Weight
+func (this *InvListCursor) MaxWeight() TermWeight {
+	return this.table.maxWeight
+}
+
+// 拉链长度
+func (this *InvListCursor) Len() int {
+	return this.table.length
+}
+
+// 创建遍历器,一次遍历拉链构建跳表
+func NewInvListCursor(l *InvList) *InvListCursor {
+	return NewSkipTable(l).NewCursor()
+}
+
+/* vim: set expandtab ts=4 sw=4 sts=4 tw=100: */
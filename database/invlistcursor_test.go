@@ -0,0 +1,192 @@
+package database
+
+import (
+	. "github.com/getwe/goose/utils"
+	"math/rand"
+	"reflect"
+	"testing"
+)
+
+// 同一条拉链的几种跳表:解码的拉链,编码的块,编码的块后面追加解码的拉链
+func newTestSkipTables(t *testing.T, lst InvList) map[string]*SkipTable {
+	codec := blockPostingCodec{}
+	encode := func(l InvList) *SkipTable {
+		buf, err := codec.Encode(&l)
+		if err != nil {
+			t.Fatalf("encode : %s", err)
+		}
+		table, err := codec.DecodeSkipTable(buf)
+		if err != nil {
+			t.Fatalf("decode skip table : %s", err)
+		}
+		return table
+	}
+	half := len(lst)/2 + 3
+	tail := NewInvList()
+	tail.Concat(lst[half:])
+	return map[string]*SkipTable{
+		"list":    NewSkipTable(&lst),
+		"encoded": encode(lst),
+		"tail":    encode(lst[:half]).Merge(&tail),
+	}
+}
+
+func TestInvListCursorSkipTo(t *testing.T) {
+	lst := NewInvList()
+	var id InIdType
+	for i := 0; i < 10*SkipBlockSize+7; i++ {
+		id += InIdType(rand.Intn(5) + 1)
+		e := Index{InID: id, Weight: TermWeight(rand.Intn(1000))}
+		// 部分doc带有位置信息
+		if i%3 == 0 {
+			e.Pos = []uint32{uint32(i), uint32(i) + 3}
+		}
+		lst.Append(e)
+	}
+
+	for name, table := range newTestSkipTables(t, lst) {
+		if table.Len() != len(lst) || table.LastInID() != lst[len(lst)-1].InID {
+			t.Errorf("[%s] len[%d] last InID[%d]", name, table.Len(), table.LastInID())
+		}
+		// 跟逐个遍历的结果对比
+		for round := 0; round < 100; round++ {
+			c := table.NewCursor()
+			pos := 0
+			target := InIdType(0)
+			for {
+				target += InIdType(rand.Intn(3 * SkipBlockSize))
+				for pos < len(lst) && lst[pos].InID < target {
+					pos++
+				}
+				valid := c.SkipTo(target)
+				if valid != (pos < len(lst)) {
+					t.Errorf("[%s] SkipTo[%d] valid[%v] pos[%d]", name, target, valid, pos)
+					return
+				}
+				if !valid {
+					break
+				}
+				if !reflect.DeepEqual(c.Curr(), lst[pos]) {
+					t.Errorf("[%s] SkipTo[%d] get %v expect %v", name, target, c.Curr(), lst[pos])
+					return
+				}
+				if c.BlockMaxWeight() < c.Curr().Weight || c.MaxWeight() < c.BlockMaxWeight() {
+					t.Errorf("[%s] max weight error block[%d] all[%d] curr[%d]", name,
+						c.BlockMaxWeight(), c.MaxWeight(), c.Curr().Weight)
+					return
+				}
+				if c.BlockLastInID() < c.Curr().InID {
+					t.Errorf("[%s] block last InID[%d] < curr[%d]", name,
+						c.BlockLastInID(), c.Curr().InID)
+					return
+				}
+			}
+		}
+
+		// 逐个遍历
+		c := table.NewCursor()
+		for i := range lst {
+			if !c.Valid() || !reflect.DeepEqual(c.Curr(), lst[i]) {
+				t.Fatalf("[%s] Next pos[%d] error", name, i)
+			}
+			c.Next()
+		}
+		if c.Valid() || c.Next() {
+			t.Errorf("[%s] cursor valid after end", name)
+		}
+		l := table.List()
+		for i := range lst {
+			if !reflect.DeepEqual((*l)[i], lst[i]) {
+				t.Fatalf("[%s] List pos[%d] %v expect %v", name, i, (*l)[i], lst[i])
+			}
+		}
+
+		// 限制范围的遍历
+		begin, end := lst[SkipBlockSize+3].InID, lst[3*SkipBlockSize].InID
+		c = table.NewCursor()
+		if !c.SetRange(begin, end) || c.Curr().InID != begin {
+			t.Fatalf("[%s] SetRange[%d,%d] fail", name, begin, end)
+		}
+		cnt := 1
+		for c.Next() {
+			cnt++
+		}
+		if cnt != 2*SkipBlockSize-3 {
+			t.Errorf("[%s] range [%d,%d] count [%d]", name, begin, end, cnt)
+		}
+		c = table.NewCursor()
+		if c.SetRange(begin, begin) {
+			t.Errorf("[%s] empty range valid", name)
+		}
+	}
+
+	// 空拉链
+	c := NewInvListCursor(nil)
+	if c.Valid() || c.SkipTo(1) || c.Next() {
+		t.Errorf("empty list cursor valid")
+	}
+}
+
+func TestSkipTableLazyDecode(t *testing.T) {
+	lst := NewInvList()
+	for i := 0; i < 10*SkipBlockSize; i++ {
+		lst.Append(Index{InID: InIdType(2*i + 1), Weight: TermWeight(i)})
+	}
+	codec := blockPostingCodec{}
+	buf, _ := codec.Encode(&lst)
+	table, err := codec.DecodeSkipTable(buf)
+	if err != nil {
+		t.Fatalf("decode skip table : %s", err)
+	}
+	if table.maxWeight != TermWeight(len(lst)-1) {
+		t.Errorf("max weight [%d]", table.maxWeight)
+	}
+
+	// 破坏中间的块,跳过的块不会被解码
+	for i := table.blocks[1].offset; i < table.blocks[9].offset; i++ {
+		table.buf[i] = 0xff
+	}
+	c := table.NewCursor()
+	target := lst[9*SkipBlockSize+5]
+	if !c.SkipTo(target.InID) || !reflect.DeepEqual(c.Curr(), target) {
+		t.Fatalf("SkipTo[%d] fail", target.InID)
+	}
+	// 到达破坏的块,遍历结束
+	c = table.NewCursor()
+	if c.SkipTo(lst[SkipBlockSize].InID) {
+		t.Errorf("broken block decoded")
+	}
+}
+
+func TestSkipTableMerge(t *testing.T) {
+	a, b := NewInvList(), NewInvList()
+	for i := 1; i <= 3*SkipBlockSize; i++ {
+		a.Append(Index{InID: InIdType(2 * i), Weight: 1})
+		b.Append(Index{InID: InIdType(2*i + 1), Weight: 2})
+	}
+	buf, _ := blockPostingCodec{}.Encode(&a)
+	table, _ := blockPostingCodec{}.DecodeSkipTable(buf)
+
+	// 交错的拉链解码后归并,原跳表不变
+	merged := table.Merge(&b)
+	if merged.Len() != a.Len()+b.Len() || table.Len() != a.Len() {
+		t.Fatalf("merged len[%d] table len[%d]", merged.Len(), table.Len())
+	}
+	c := merged.NewCursor()
+	for i := InIdType(2); i <= InIdType(6*SkipBlockSize+1); i++ {
+		if !c.Valid() || c.Curr().InID != i {
+			t.Fatalf("merged InID[%d] error", i)
+		}
+		c.Next()
+	}
+	if merged.NewCursor().MaxWeight() != 2 || table.NewCursor().MaxWeight() != 1 {
+		t.Errorf("max weight error")
+	}
+
+	// 空拉链不产生新的跳表
+	if table.Merge(NewInvListPointer()) != table {
+		t.Errorf("merge empty list")
+	}
+}
+
+/* vim: set expandtab ts=4 sw=4 sts=4 tw=100: */
@@ -0,0 +1,338 @@
+package database
+
+import (
+	"encoding/binary"
+	log "github.com/getwe/goose/log"
+	. "github.com/getwe/goose/utils"
+)
+
+// 拉链序列化格式的版本号,记录在磁盘索引的状态文件中.
+// 读取的时候根据状态文件自动选择,新增格式只能追加,不能修改已有的版本号.
+type PostingCodecType int
+
+const (
+	// gob序列化.最早的格式,状态文件中没有记录版本号的索引都是这个格式
+	PostingCodecGob PostingCodecType = 0
+
+	// InID差值编码+varint,Weight使用zigzag varint.不存储位置信息
+	PostingCodecVarint PostingCodecType = 1
+
+	// 分块的varint格式,块目录跟拉链一起存储,检索时只解码跳表到达的块.
+	// 每个元素带有term在doc中的位置信息
+	PostingCodecBlock PostingCodecType = 2
+)
+
+// 建库没有配置格式时使用的格式,检索程序生成的磁盘索引也使用这个格式
+const DefaultPostingCodec = PostingCodecBlock
+
+// 拉链序列化接口
+type PostingCodec interface {
+	// 序列化拉链,函数内部分配内存
+	Encode(l *InvList) ([]byte, error)
+
+	// 反序列化拉链
+	Decode(buf []byte) (*InvList, error)
+}
+
+// 序列化数据中带有块目录的格式,可选实现.
+// 只解析块目录得到跳表,块数据在遍历时按需解码,buf在跳表的生命期内不能修改
+type skipTableCodec interface {
+	DecodeSkipTable(buf []byte) (*SkipTable, error)
+}
+
+// 根据配置中的格式名称获取版本号,空串是DefaultPostingCodec
+func ParsePostingCodec(name string) (PostingCodecType, error) {
+	switch name {
+	case "":
+		return DefaultPostingCodec, nil
+	case "gob":
+		return PostingCodecGob, nil
+	case "varint":
+		return PostingCodecVarint, nil
+	case "block":
+		return PostingCodecBlock, nil
+	}
+	return 0, log.Error("unknown posting codec [%s]", name)
+}
+
+// 根据版本号获取序列化实现
+func GetPostingCodec(t PostingCodecType) (PostingCodec, error) {
+	switch t {
+	case PostingCodecGob:
+		return gobPostingCodec{}, nil
+	case PostingCodecVarint:
+		return varintPostingCodec{}, nil
+	case PostingCodecBlock:
+		return blockPostingCodec{}, nil
+	}
+	return nil, log.Error("unknown posting codec [%d]", t)
+}
+
+// gob格式,每条拉链都带有gob类型头,空间和解析速度都不理想.只为兼容旧的索引.
+type gobPostingCodec struct{}
+
+func (gobPostingCodec) Encode(l *InvList) ([]byte, error) {
+	return GobEncode(*l)
+}
+
+func (gobPostingCodec) Decode(buf []byte) (*InvList, error) {
+	var list InvList
+	err := GobDecode(buf, &list)
+	if err != nil {
+		return nil, err
+	}
+	return &list, nil
+}
+
+// 紧凑格式:
+//
+//	[uvarint:拉链长度][uvarint:InID差值][varint:Weight] ... [uvarint:InID差值][varint:Weight]
+//
+// 拉链按InID升序,第一个InID的差值就是InID本身.不存储Index.Pos.
+type varintPostingCodec struct{}
+
+func (varintPostingCodec) Encode(l *InvList) ([]byte, error) {
+	// 每个元素最多占用 5+5 个字节
+	buf := make([]byte, binary.MaxVarintLen64+l.Len()*2*binary.MaxVarintLen32)
+	n := binary.PutUvarint(buf, uint64(l.Len()))
+
+	var last InIdType
+	for i, e := range *l {
+		if i > 0 && e.InID < last {
+			return nil, log.Error("InvList not sorted pos[%d] InID[%d] < [%d]",
+				i, e.InID, last)
+		}
+		n += binary.PutUvarint(buf[n:], uint64(e.InID-last))
+		n += binary.PutVarint(buf[n:], int64(e.Weight))
+		last = e.InID
+	}
+	return buf[:n], nil
+}
+
+func (varintPostingCodec) Decode(buf []byte) (*InvList, error) {
+	cnt, n := binary.Uvarint(buf)
+	if n <= 0 {
+		return nil, log.Error("decode list length fail")
+	}
+	// 每个元素至少占用两个字节,防止错误数据导致分配超大内存
+	if cnt > uint64(len(buf)) {
+		return nil, log.Error("list length [%d] error buf len[%d]", cnt, len(buf))
+	}
+	pos := n
+
+	list := NewInvList(int(cnt))
+	var last InIdType
+	for i := uint64(0); i < cnt; i++ {
+		delta, n := binary.Uvarint(buf[pos:])
+		if n <= 0 {
+			return nil, log.Error("decode InID fail pos[%d]", i)
+		}
+		pos += n
+		weight, n := binary.Varint(buf[pos:])
+		if n <= 0 {
+			return nil, log.Error("decode Weight fail pos[%d]", i)
+		}
+		pos += n
+
+		last += InIdType(delta)
+		list = append(list, Index{InID: last, Weight: TermWeight(weight)})
+	}
+	return &list, nil
+}
+
+// 分块格式:
+//
+//	[uvarint:拉链长度][uvarint:块大小]
+//	{[uvarint:FirstInID差值][varint:MaxWeight][uvarint:块数据长度]}...
+//	{[uvarint:InID差值][varint:Weight][uvarint:位置个数][uvarint:位置差值]...}...
+//
+// 前面是块目录,FirstInID是跟上一个块的差值;后面依次是每个块的数据,
+// 块内InID是跟前一个元素的差值,块内第一个元素跟FirstInID的差值是0.
+// 位置升序,第一个位置的差值就是位置本身.
+// 除了最后一个块,每个块都有块大小个元素.
+type blockPostingCodec struct{}
+
+func (blockPostingCodec) Encode(l *InvList) ([]byte, error) {
+	lst := *l
+	blockCnt := (len(lst) + SkipBlockSize - 1) / SkipBlockSize
+
+	head := make([]byte, 0, (2+3*blockCnt)*binary.MaxVarintLen64)
+	head = appendUvarint(head, uint64(len(lst)))
+	head = appendUvarint(head, SkipBlockSize)
+	data := make([]byte, 0, len(lst)*2*binary.MaxVarintLen32)
+
+	var lastFirst InIdType
+	for i := 0; i < len(lst); i += SkipBlockSize {
+		end := i + SkipBlockSize
+		if end > len(lst) {
+			end = len(lst)
+		}
+		if i > 0 && lst[i].InID < lst[i-1].InID {
+			return nil, log.Error("InvList not sorted pos[%d] InID[%d] < [%d]",
+				i, lst[i].InID, lst[i-1].InID)
+		}
+
+		blockBegin := len(data)
+		maxWeight := lst[i].Weight
+		last := lst[i].InID
+		for j, e := range lst[i:end] {
+			if e.InID < last {
+				return nil, log.Error("InvList not sorted pos[%d] InID[%d] < [%d]",
+					i+j, e.InID, last)
+			}
+			if e.Weight > maxWeight {
+				maxWeight = e.Weight
+			}
+			data = appendUvarint(data, uint64(e.InID-last))
+			data = appendVarint(data, int64(e.Weight))
+			data = appendUvarint(data, uint64(len(e.Pos)))
+			var lastPos uint32
+			for k, p := range e.Pos {
+				if k > 0 && p < lastPos {
+					return nil, log.Error("Pos not sorted InID[%d] pos[%d] < [%d]",
+						e.InID, p, lastPos)
+				}
+				data = appendUvarint(data, uint64(p-lastPos))
+				lastPos = p
+			}
+			last = e.InID
+		}
+
+		head = appendUvarint(head, uint64(lst[i].InID-lastFirst))
+		head = appendVarint(head, int64(maxWeight))
+		head = appendUvarint(head, uint64(len(data)-blockBegin))
+		lastFirst = lst[i].InID
+	}
+	return append(head, data...), nil
+}
+
+func (this blockPostingCodec) Decode(buf []byte) (*InvList, error) {
+	table, err := this.DecodeSkipTable(buf)
+	if err != nil {
+		return nil, err
+	}
+	list := NewInvList(table.Len())
+	for i, b := range table.blocks {
+		list, err = decodeSkipBlock(table.blockData(i), b.FirstInID, table.blockLen(i), list)
+		if err != nil {
+			return nil, err
+		}
+	}
+	return &list, nil
+}
+
+func (blockPostingCodec) DecodeSkipTable(buf []byte) (*SkipTable, error) {
+	cnt, n := binary.Uvarint(buf)
+	if n <= 0 {
+		return nil, log.Error("decode list length fail")
+	}
+	// 每个元素至少占用两个字节,防止错误数据导致分配超大内存
+	if cnt > uint64(len(buf)) {
+		return nil, log.Error("list length [%d] error buf len[%d]", cnt, len(buf))
+	}
+	pos := n
+	blockSz, n := binary.Uvarint(buf[pos:])
+	if n <= 0 || (blockSz == 0 && cnt > 0) {
+		return nil, log.Error("decode block size fail")
+	}
+	pos += n
+
+	t := SkipTable{}
+	t.length = int(cnt)
+	blockCnt := 0
+	if cnt > 0 {
+		blockCnt = int((cnt-1)/blockSz) + 1
+	}
+	t.blocks = make([]SkipBlock, blockCnt)
+	t.encoded = blockCnt
+
+	var first InIdType
+	offset := 0
+	for i := range t.blocks {
+		delta, n := binary.Uvarint(buf[pos:])
+		if n <= 0 {
+			return nil, log.Error("decode block[%d] FirstInID fail", i)
+		}
+		pos += n
+		weight, n := binary.Varint(buf[pos:])
+		if n <= 0 {
+			return nil, log.Error("decode block[%d] MaxWeight fail", i)
+		}
+		pos += n
+		length, n := binary.Uvarint(buf[pos:])
+		if n <= 0 || length > uint64(len(buf)) {
+			return nil, log.Error("decode block[%d] length fail", i)
+		}
+		pos += n
+
+		first += InIdType(delta)
+		t.blocks[i] = SkipBlock{FirstInID: first, MaxWeight: TermWeight(weight),
+			start: i * int(blockSz), offset: offset}
+		if i == 0 || t.blocks[i].MaxWeight > t.maxWeight {
+			t.maxWeight = t.blocks[i].MaxWeight
+		}
+		offset += int(length)
+	}
+	if pos+offset != len(buf) {
+		return nil, log.Error("block data length [%d] error buf len[%d]", offset, len(buf)-pos)
+	}
+	t.buf = buf[pos:]
+	return &t, nil
+}
+
+// 解码一个块的cnt个元素,追加到dst后返回
+func decodeSkipBlock(buf []byte, first InIdType, cnt int, dst InvList) (InvList, error) {
+	pos := 0
+	last := first
+	for i := 0; i < cnt; i++ {
+		delta, n := binary.Uvarint(buf[pos:])
+		if n <= 0 {
+			return dst, log.Error("decode InID fail pos[%d]", i)
+		}
+		pos += n
+		weight, n := binary.Varint(buf[pos:])
+		if n <= 0 {
+			return dst, log.Error("decode Weight fail pos[%d]", i)
+		}
+		pos += n
+		posCnt, n := binary.Uvarint(buf[pos:])
+		if n <= 0 || posCnt > uint64(len(buf)) {
+			return dst, log.Error("decode Pos count fail pos[%d]", i)
+		}
+		pos += n
+
+		// 位置数组每个元素单独分配,遍历器复用dst时不会改写已经返回的位置
+		var positions []uint32
+		if posCnt > 0 {
+			positions = make([]uint32, posCnt)
+			var lastPos uint32
+			for k := range positions {
+				d, n := binary.Uvarint(buf[pos:])
+				if n <= 0 {
+					return dst, log.Error("decode Pos fail pos[%d]", i)
+				}
+				pos += n
+				lastPos += uint32(d)
+				positions[k] = lastPos
+			}
+		}
+
+		last += InIdType(delta)
+		dst = append(dst, Index{InID: last, Weight: TermWeight(weight), Pos: positions})
+	}
+	return dst, nil
+}
+
+func appendUvarint(buf []byte, v uint64) []byte {
+	var tmp [binary.MaxVarintLen64]byte
+	n := binary.PutUvarint(tmp[:], v)
+	return append(buf, tmp[:n]...)
+}
+
+func appendVarint(buf []byte, v int64) []byte {
+	var tmp [binary.MaxVarintLen64]byte
+	n := binary.PutVarint(tmp[:], v)
+	return append(buf, tmp[:n]...)
+}
+
+/* vim: set expandtab ts=4 sw=4 sts=4 tw=100: */
@@ -0,0 +1,196 @@
+package database
+
+import (
+	. "github.com/getwe/goose/utils"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+func TestPostingCodec(t *testing.T) {
+	lst := NewInvList()
+	var id InIdType
+	for i := 0; i < 1000; i++ {
+		id += InIdType(rand.Intn(1000))
+		e := Index{InID: id, Weight: TermWeight(rand.Int31() - rand.Int31())}
+		if i%2 == 0 {
+			e.Pos = []uint32{uint32(i), uint32(i) + 1, uint32(i) + 100}
+		}
+		lst.Append(e)
+	}
+	empty := NewInvList()
+	// varint格式不存储位置信息
+	noPos := NewInvList(lst.Len())
+	for _, e := range lst {
+		noPos.Append(Index{InID: e.InID, Weight: e.Weight})
+	}
+
+	for _, c := range []PostingCodecType{PostingCodecGob, PostingCodecVarint, PostingCodecBlock} {
+		codec, err := GetPostingCodec(c)
+		if err != nil {
+			t.Error(err.Error())
+			return
+		}
+		for _, l := range []*InvList{&lst, &empty} {
+			buf, err := codec.Encode(l)
+			if err != nil {
+				t.Error(err.Error())
+				return
+			}
+			t.Logf("codec[%d] list len[%d] encode len[%d]", c, l.Len(), len(buf))
+
+			res, err := codec.Decode(buf)
+			if err != nil {
+				t.Error(err.Error())
+				return
+			}
+			if res.Len() != l.Len() {
+				t.Errorf("codec[%d] decode len[%d] != [%d]", c, res.Len(), l.Len())
+				return
+			}
+			expect := *l
+			if c == PostingCodecVarint && l == &lst {
+				expect = noPos
+			}
+			for i := range expect {
+				if !reflect.DeepEqual((*res)[i], expect[i]) {
+					t.Errorf("codec[%d] pos[%d] %v != %v", c, i, (*res)[i], expect[i])
+					return
+				}
+			}
+		}
+	}
+
+	// 乱序拉链不能使用差值编码
+	unsorted := InvList{Index{InID: 3}, Index{InID: 1}}
+	for _, c := range []PostingCodecType{PostingCodecVarint, PostingCodecBlock} {
+		codec, _ := GetPostingCodec(c)
+		if _, err := codec.Encode(&unsorted); err == nil {
+			t.Errorf("codec[%d] encode unsorted list without error", c)
+		}
+	}
+	unsorted = InvList{Index{InID: 1, Pos: []uint32{5, 2}}}
+	codec, _ := GetPostingCodec(PostingCodecBlock)
+	if _, err := codec.Encode(&unsorted); err == nil {
+		t.Errorf("encode unsorted position without error")
+	}
+}
+
+func TestDiskIndexGobCompatible(t *testing.T) {
+	var testpath = filepath.Join(os.Getenv("HOME"), "hehe", "tmp", "goosedb", "test_codec")
+	os.RemoveAll(testpath)
+	os.MkdirAll(testpath, 0755)
+
+	var maxFileSz uint32 = 1024 * 1024
+
+	for _, c := range []PostingCodecType{PostingCodecGob, PostingCodecVarint, PostingCodecBlock} {
+		index := NewDiskIndex()
+		err := index.Init(testpath, "codec", maxFileSz, 100, c)
+		if err != nil {
+			t.Error(err.Error())
+			return
+		}
+		for i := 1; i < 100; i++ {
+			err = index.WriteIndex(TermSign(i), createList(i+1, i))
+			if err != nil {
+				t.Error(err.Error())
+				return
+			}
+		}
+		index.Close()
+
+		// 打开时由状态文件决定格式
+		index = NewDiskIndex()
+		err = index.Open(testpath, "codec")
+		if err != nil {
+			t.Error(err.Error())
+			return
+		}
+		if index.diskStatus.Codec != c {
+			t.Errorf("open codec[%d] != [%d]", index.diskStatus.Codec, c)
+		}
+		for i := 1; i < 100; i++ {
+			lst, err := index.ReadIndex(TermSign(i))
+			if err != nil {
+				t.Error(err.Error())
+				return
+			}
+			if lst.Len() != i {
+				t.Errorf("codec[%d] term[%d] len[%d]", c, i, lst.Len())
+				return
+			}
+			for _, e := range *lst {
+				if e.Weight != TermWeight(i) {
+					t.Errorf("codec[%d] term[%d] weight[%d]", c, i, e.Weight)
+					return
+				}
+			}
+			// 不带块目录的格式读取后构建跳表
+			table, err := index.ReadSkipTable(TermSign(i))
+			if err != nil || table.Len() != i || table.LastInID() != (*lst)[i-1].InID {
+				t.Errorf("codec[%d] term[%d] skip table error : %v", c, i, err)
+				return
+			}
+		}
+		index.Close()
+	}
+}
+
+func TestDBBuilderPostingCodec(t *testing.T) {
+	for name, expect := range map[string]PostingCodecType{
+		"": DefaultPostingCodec, "gob": PostingCodecGob, "varint": PostingCodecVarint,
+		"block": PostingCodecBlock} {
+		if c, err := ParsePostingCodec(name); err != nil || c != expect {
+			t.Errorf("parse [%s] get [%d] expect [%d]", name, c, expect)
+		}
+	}
+	if _, err := ParsePostingCodec("zip"); err == nil {
+		t.Errorf("parse unknown codec without error")
+	}
+
+	path := filepath.Join(os.Getenv("HOME"), "tmp", "goosedb", "test_builder_codec")
+	os.RemoveAll(path)
+
+	builder := NewDBBuilder()
+	if err := builder.Init(path, 1000, 100, 1, 1024*1024, 1024*1024, PostingCodecGob); err != nil {
+		t.Fatalf("Init --- %s", err)
+	}
+	inId, _ := builder.AllocID(1)
+	builder.WriteIndex(inId, []TermInDoc{TermInDoc{Sign: 10, Weight: 1}})
+	builder.WriteValue(inId, Value("v"))
+	builder.WriteData(inId, Data("d"))
+	builder.CommitID(inId)
+	if err := builder.Sync(); err != nil {
+		t.Fatalf("Sync --- %s", err)
+	}
+
+	db := NewDBSearcher()
+	if err := db.Init(path); err != nil {
+		t.Fatalf("DBSearcher.Init --- %s", err)
+	}
+	defer db.Close()
+	if c := db.staticIndex.disk.GetCodec(); c != PostingCodecGob {
+		t.Errorf("build codec [%d]", c)
+	}
+
+	inId, _ = db.AllocID(2)
+	db.WriteIndex(inId, []TermInDoc{TermInDoc{Sign: 10, Weight: 1}})
+	db.CommitID(inId)
+	if err := db.ForceSync(); err != nil {
+		t.Fatalf("ForceSync --- %s", err)
+	}
+	if err := db.FoldVarIndex(); err != nil {
+		t.Fatalf("FoldVarIndex --- %s", err)
+	}
+	// 合并生成的静态索引沿用建库的格式
+	if c := db.staticIndex.disk.GetCodec(); c != PostingCodecGob {
+		t.Errorf("fold codec [%d]", c)
+	}
+	if l, _ := db.ReadIndex(10); l.Len() != 2 {
+		t.Errorf("list len [%d] after fold", l.Len())
+	}
+}
+
+/* vim: set expandtab ts=4 sw=4 sts=4 tw=100: */
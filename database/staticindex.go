@@ -1,18 +1,61 @@
 package database
 
 import (
+	"fmt"
+	log "github.com/getwe/goose/log"
 	. "github.com/getwe/goose/utils"
+	"path/filepath"
 )
 
+// 建库生成的静态索引名
+const staticIndexDefaultName = "static"
+
+type StaticIndexStatus struct {
+	// 当前使用的磁盘索引名,没有状态文件时是建库生成的static
+	Name string
+
+	// 最近一次合并进当前磁盘索引的动态索引段,打开动态索引时丢弃这些段
+	FoldedSegments []string
+
+	// 下一次合并生成的磁盘索引序号
+	NextFold uint64
+}
+
 // StaticIndex是静态索引的读取接口.只允许打开磁盘已存在的索引后进行读操作.
+// 动态索引可以整体合并进一个新的磁盘索引后替换当前的磁盘索引,见DBSearcher.FoldVarIndex.
 type StaticIndex struct {
-	// 目前的设计,静态索引只由一个磁盘索引构成
+	JsonStatusFile
+
+	// 静态索引只由一个磁盘索引构成
 	disk *DiskIndex
+
+	status StaticIndexStatus
+
+	filePath string
+}
+
+// 读取path下静态索引当前使用的磁盘索引名
+func StaticIndexName(path string) string {
+	st := StaticIndexStatus{}
+	err := JsonDecodeFromFile(&st, filepath.Join(path, "static.stat"))
+	if err != nil || len(st.Name) == 0 {
+		return staticIndexDefaultName
+	}
+	return st.Name
 }
 
 // 打开已存在的磁盘索引
 func (this *StaticIndex) Open(path string) error {
-	return this.disk.Open(path, "static")
+	this.filePath = path
+
+	this.SelfStatus = &this.status
+	this.StatusFilePath = filepath.Join(this.filePath, "static.stat")
+	err := this.ParseJsonFile()
+	if err != nil || len(this.status.Name) == 0 {
+		// 没有合并过动态索引
+		this.status = StaticIndexStatus{Name: staticIndexDefaultName}
+	}
+	return this.disk.Open(path, this.status.Name)
 }
 
 // 读取索引
@@ -20,6 +63,74 @@ func (this *StaticIndex) ReadIndex(t TermSign) (*InvList, error) {
 	return this.disk.ReadIndex(t)
 }
 
+// 读取拉链和跳表
+func (this *StaticIndex) ReadSkipTable(t TermSign) (*SkipTable, error) {
+	return this.disk.ReadSkipTable(t)
+}
+
+// 当前磁盘索引的term数量
+func (this *StaticIndex) GetTermCount() int64 {
+	return this.disk.GetTermCount()
+}
+
+// 当前磁盘索引合并src写入一个新的磁盘索引,写完后只读打开.不影响当前磁盘索引的读取
+func (this *StaticIndex) writeFold(src []ReadOnlyIndex, termCount int64,
+	dst func(*DiskIndex) WriteOnlyIndex) (string, *DiskIndex, error) {
+
+	// maxFileSz 索引大文件单个文件的最大大小.
+	maxFileSz := uint32(1024 * 1024 * 1024)
+
+	name := fmt.Sprintf("%s.%d", staticIndexDefaultName, this.status.NextFold)
+	this.status.NextFold++
+
+	// 沿用建库时配置的拉链格式
+	disk := NewDiskIndex()
+	err := disk.Init(this.filePath, name, maxFileSz, this.disk.GetTermCount()+termCount,
+		this.disk.GetCodec())
+	if err != nil {
+		return "", nil, log.Error(err)
+	}
+	err = IndexKMerge(append([]ReadOnlyIndex{this.disk}, src...), dst(disk))
+	disk.Close()
+	if err != nil {
+		removeDiskIndex(this.filePath, name)
+		return "", nil, log.Error("write static index [%s] fail : %s", name, err)
+	}
+
+	disk = NewDiskIndex()
+	err = disk.Open(this.filePath, name)
+	if err != nil {
+		removeDiskIndex(this.filePath, name)
+		return "", nil, log.Error(err)
+	}
+	return name, disk, nil
+}
+
+// 切换到新的磁盘索引,状态文件保存成功后生效.返回旧的磁盘索引名和磁盘索引,由调用者关闭删除.
+// 调用者需要保证切换期间没有读操作
+func (this *StaticIndex) swap(name string, disk *DiskIndex,
+	folded []string) (string, *DiskIndex, error) {
+
+	oldStatus := this.status
+	this.status.Name = name
+	this.status.FoldedSegments = folded
+	err := this.SaveJsonFile()
+	if err != nil {
+		this.status = oldStatus
+		return "", nil, err
+	}
+	oldName := oldStatus.Name
+
+	old := this.disk
+	this.disk = disk
+	return oldName, old, nil
+}
+
+// 关闭索引文件
+func (this *StaticIndex) Close() {
+	this.disk.Close()
+}
+
 // StaticIndex构造函数
 func NewStaticIndex() *StaticIndex {
 	s := StaticIndex{}
@@ -121,6 +121,20 @@ func (this *ValueManager) Sync() error {
 	return nil
 }
 
+func (this *ValueManager) Close() error {
+	this.lock.Lock()
+	defer this.lock.Unlock()
+
+	for i := 0; uint32(i) < this.fileCnt; i++ {
+		err := this.mfile[i].Close()
+		if err != nil {
+			return err
+		}
+	}
+	this.fileCnt = 0
+	return nil
+}
+
 // 写入Value.可并发写
 func (this *ValueManager) WriteValue(inId InIdType, v Value) error {
 	if inId > this.valueStatus.MaxInId {
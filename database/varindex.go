@@ -1,46 +1,96 @@
 package database
 
 import (
+	"fmt"
 	log "github.com/getwe/goose/log"
 	. "github.com/getwe/goose/utils"
+	"os"
 	"path/filepath"
+	"strings"
 	"sync"
 	"time"
 )
 
+const (
+	// 同一层的段数量达到这个值时合并成一个段
+	varSegmentMergeFactor = 4
+	// 第0层段的大小上限,第n层是varSegmentBaseSize*varSegmentMergeFactor^n
+	varSegmentBaseSize = 4 * 1024 * 1024
+	// 段文件名前缀,后面是段序号
+	varSegmentPrefix = "var.seg."
+)
+
+// 一个磁盘索引段的状态
+type VarSegmentStatus struct {
+	// 磁盘索引名
+	Name string
+	// 索引文件总大小,用于分层合并
+	Size int64
+}
+
 type VarIndexStatus struct {
-	// 当前使用哪个磁盘索引
+	// 旧版本固定两个磁盘索引时使用的磁盘索引,Open时转换为一个段,之后总是-1
 	CurrDisk int
+
+	// 有效的磁盘索引段,按生成顺序
+	Segments []VarSegmentStatus
+
+	// 下一个段的序号
+	NextSegment uint64
+
+	// 有效的预写日志代数,每次内存索引写入磁盘后加1
+	WalGen uint64
 }
 
-// VarIndex利用内存索引和磁盘索引组成.
+// 内存中打开的段
+type varSegment struct {
+	VarSegmentStatus
+	disk *DiskIndex
+}
+
+// VarIndex利用内存索引和多个磁盘索引段组成.
 // 支持检索的时候进行插入索引操作.
+// 写入内存索引的数据同时追加到预写日志,调用Flush后即使崩溃也可以在Open时恢复.
+// 每次Sync把内存索引写成一个新的小段,后台按段大小分层,同一层的段数量达到
+// varSegmentMergeFactor时合并成一个大段,Sync的耗时只跟内存索引大小有关.
 type VarIndex struct {
 	JsonStatusFile
 
-	// 读操作读写锁,切库的时候先暂停索引读取.
+	// 读操作读写锁,修改段列表和清空内存索引的时候暂停索引读取.
 	readLock sync.RWMutex
 
 	// 写操作互斥锁,用于互斥WriteIndex和Sync接口.
 	writelock sync.Mutex
 
+	// 段列表修改和状态文件保存互斥,Sync和后台合并都会修改
+	segLock sync.Mutex
+
+	// 同一时间只有一个合并过程
+	compactLock sync.Mutex
+
 	// 内存索引
 	mem *MemoryIndex
 
-	// 两个磁盘索引
-	disk []*DiskIndex
+	// 内存索引的预写日志
+	wal *varWal
 
-	// 两个磁盘索引的文件路径
-	diskName []string
+	// 磁盘索引段
+	segments []*varSegment
+	// 段列表的代数,段列表每次变化加1,用于上层缓存磁盘段的拉链
+	segGen uint64
 
 	// 索引状态信息
 	varIndexStatus VarIndexStatus
-	// 状态信息存放的文件
-	statFileFullPath string
 
 	// 上次sync操作的时间
 	lastSyncTime int64
 
+	// 通知后台合并检查段列表
+	compactSignal chan bool
+	// 关闭后台合并
+	quit       chan bool
+	background sync.WaitGroup
+
 	filePath string
 }
 
@@ -50,12 +100,48 @@ func (this *VarIndex) WriteIndex(t TermSign, l *InvList) error {
 	this.writelock.Lock()
 	defer this.writelock.Unlock()
 
+	if this.wal != nil {
+		err := this.wal.Append(t, l)
+		if err != nil {
+			return log.Error("append wal fail : %s", err)
+		}
+	}
 	return this.mem.WriteIndex(t, l)
 }
 
-// 读取索引
+// 预写日志写入磁盘,之前写入的索引不会因为崩溃丢失
+func (this *VarIndex) Flush() error {
+	this.writelock.Lock()
+	defer this.writelock.Unlock()
+
+	if this.wal == nil {
+		return nil
+	}
+	return this.wal.Flush()
+}
+
+// 读取索引,多路归并内存索引和全部段的拉链
 func (this *VarIndex) ReadIndex(t TermSign) (*InvList, error) {
-	// 加多锁
+	table, err := this.readIndex(t,
+		func(gen uint64, readSegments func() (*InvList, error)) (*SkipTable, error) {
+			l, err := readSegments()
+			if err != nil {
+				return nil, err
+			}
+			return NewSkipTable(l), nil
+		})
+	if err != nil {
+		return nil, err
+	}
+	return table.List(), nil
+}
+
+// 读取索引和跳表,磁盘段部分由disk提供,disk可以根据段列表的代数gen缓存readSegments的结果.
+// disk返回的拉链和跳表只会被读取
+func (this *VarIndex) readIndex(t TermSign,
+	disk func(gen uint64, readSegments func() (*InvList, error)) (*SkipTable, error)) (
+	*SkipTable, error) {
+
 	this.readLock.RLock()
 	defer this.readLock.RUnlock()
 
@@ -64,23 +150,45 @@ func (this *VarIndex) ReadIndex(t TermSign) (*InvList, error) {
 		return nil, err
 	}
 
-	// 怎么保证this.disk[currDisk]一定可用,有可能被sync操作破坏
-	// readlock保证disk[currDisk]一定可用
-	disklst := NewInvListPointer()
-	if this.varIndexStatus.CurrDisk >= 0 &&
-		this.disk[this.varIndexStatus.CurrDisk] != nil {
-
-		disklst, err = this.disk[this.varIndexStatus.CurrDisk].ReadIndex(t)
-		if err != nil {
-			return nil, err
+	// readlock保证segments中的段一定可用
+	disktable, err := disk(this.segGen, func() (*InvList, error) {
+		lists := make([]*InvList, 0, len(this.segments))
+		for _, seg := range this.segments {
+			l, err := seg.disk.ReadIndex(t)
+			if err != nil {
+				return nil, err
+			}
+			lists = append(lists, l)
 		}
+		l := NewInvList()
+		l.KMerge(lists)
+		return &l, nil
+	})
+	if err != nil {
+		return nil, err
 	}
-	memlst.Merge(*disklst)
-	return memlst, nil
+	// 内存索引中没有这个term的话Merge直接返回磁盘拉链的跳表
+	return disktable.Merge(memlst), nil
+}
+
+// 段列表的代数
+func (this *VarIndex) segmentGeneration() uint64 {
+	this.readLock.RLock()
+	defer this.readLock.RUnlock()
+	return this.segGen
 }
 
 // 同步操作.耗时加锁型操作.
 func (this *VarIndex) Sync() error {
+	return this.sync(false)
+}
+
+// 不受两次同步间隔限制的同步操作,用于退出前保存内存索引
+func (this *VarIndex) ForceSync() error {
+	return this.sync(true)
+}
+
+func (this *VarIndex) sync(force bool) error {
 	// 整个同步过程暂停写操作
 	this.writelock.Lock()
 	defer this.writelock.Unlock()
@@ -91,83 +199,246 @@ func (this *VarIndex) Sync() error {
 	}
 
 	now := time.Now().Unix()
-	if now-this.lastSyncTime < 10 {
+	if !force && now-this.lastSyncTime < 10 {
 		// 强制限制两次sync的间隔时间
 		return nil
 	}
 
-	// 目前还没有任何磁盘库
-	if this.varIndexStatus.CurrDisk < 0 {
-		// 假设当前磁盘库是1库
-		this.varIndexStatus.CurrDisk = 1
-		// 空的库
-		this.disk[this.varIndexStatus.CurrDisk] = NewDiskIndex()
+	// 内存索引写成新段,期间不影响整个动态库的ReadIndex操作
+	seg, err := this.writeSegment([]ReadOnlyIndex{this.mem}, this.mem.GetTermCount())
+	if err != nil {
+		return err
 	}
 
-	// 目标写入的磁盘库
-	dstDisk := (this.varIndexStatus.CurrDisk + 1) % 2
-
-	// 接下来从memory库和currDisk库读索引,合并写入dstDisk
-	// 期间不影响整个动态库的ReadIndex操作
+	this.segLock.Lock()
 	{
-		// maxFileSz 索引大文件单个文件的最大大小.
-		maxFileSz := uint32(1024 * 1024 * 1024)
+		// 期间会影响整个动态库的ReadIndex操作,操作很快
+		this.readLock.Lock()
 
-		// 新库预期最多的term数量
-		dstTermCount := this.mem.GetTermCount() +
-			this.disk[this.varIndexStatus.CurrDisk].GetTermCount()
+		// 新段已经包含了内存索引的全部数据
+		this.segments = append(this.segments, seg)
+		this.segGen++
+		this.mem.Clear()
 
-		if this.disk[dstDisk] != nil {
-			this.disk[dstDisk].Close()
-		}
+		// 日志中的数据都已经在新段中,旧日志作废
+		this.varIndexStatus.WalGen++
 
-		this.disk[dstDisk] = NewDiskIndex()
-		err := this.disk[dstDisk].Init(this.filePath, this.diskName[dstDisk],
-			maxFileSz, dstTermCount)
-		if err != nil {
-			return log.Error(err)
-		}
+		this.readLock.Unlock()
+	}
+	err = this.saveStatus()
+	this.segLock.Unlock()
+	if err != nil {
+		return err
+	}
+	// 现在ReadIndex已经可以正常工作了,WriteIndex也可以了
 
-		// merge (mem,currDisk) to dstDisk
-		err = IndexMerge(this.mem, this.disk[this.varIndexStatus.CurrDisk],
-			this.disk[dstDisk])
-		if err != nil {
-			return log.Error(err)
-		}
+	this.lastSyncTime = time.Now().Unix()
+	this.notifyCompact()
 
-		// 关闭后重新打开,后面就只读操作
-		this.disk[dstDisk].Close()
+	// 状态文件保存之后才清空日志,中间崩溃的话旧日志的代数不一致,不会重放
+	if this.wal != nil {
+		return this.wal.Reset(this.varIndexStatus.WalGen)
+	}
+	return nil
+}
 
-		this.disk[dstDisk] = NewDiskIndex()
-		err = this.disk[dstDisk].Open(this.filePath, this.diskName[dstDisk])
-		if err != nil {
-			return log.Error(err)
+// 把多个索引合并写成一个新段,写完后只读打开.termCount是预期最多的term数量
+func (this *VarIndex) writeSegment(src []ReadOnlyIndex, termCount int64) (*varSegment, error) {
+	// maxFileSz 索引大文件单个文件的最大大小.
+	maxFileSz := uint32(1024 * 1024 * 1024)
+
+	this.segLock.Lock()
+	name := fmt.Sprintf("%s%d", varSegmentPrefix, this.varIndexStatus.NextSegment)
+	this.varIndexStatus.NextSegment++
+	this.segLock.Unlock()
+
+	disk := NewDiskIndex()
+	err := disk.Init(this.filePath, name, maxFileSz, termCount, DefaultPostingCodec)
+	if err != nil {
+		return nil, log.Error(err)
+	}
+	err = IndexKMerge(src, disk)
+	// 关闭后重新打开,后面就只读操作
+	disk.Close()
+	if err != nil {
+		removeDiskIndex(this.filePath, name)
+		return nil, log.Error("write segment [%s] fail : %s", name, err)
+	}
+
+	seg := varSegment{}
+	seg.Name = name
+	seg.Size = diskIndexSize(this.filePath, name)
+	seg.disk = NewDiskIndex()
+	err = seg.disk.Open(this.filePath, name)
+	if err != nil {
+		removeDiskIndex(this.filePath, name)
+		return nil, log.Error(err)
+	}
+	return &seg, nil
+}
+
+// 段所在的层,越大的段层数越高
+func varSegmentTier(size int64) int {
+	tier := 0
+	for limit := int64(varSegmentBaseSize); size >= limit; limit *= varSegmentMergeFactor {
+		tier++
+	}
+	return tier
+}
+
+// 进行一次分层合并:最低的段数量达到varSegmentMergeFactor的层,全部段合并成一个.
+// 合并过程中不影响读写和Sync.返回是否进行了合并
+func (this *VarIndex) compact() (bool, error) {
+	this.compactLock.Lock()
+	defer this.compactLock.Unlock()
+
+	// 选出要合并的段
+	this.segLock.Lock()
+	tiers := make(map[int][]*varSegment)
+	for _, seg := range this.segments {
+		tier := varSegmentTier(seg.Size)
+		tiers[tier] = append(tiers[tier], seg)
+	}
+	this.segLock.Unlock()
+
+	var picked []*varSegment
+	for tier := 0; len(tiers) > 0; tier++ {
+		if len(tiers[tier]) >= varSegmentMergeFactor {
+			picked = tiers[tier]
+			break
 		}
+		delete(tiers, tier)
+	}
+	if len(picked) == 0 {
+		return false, nil
+	}
+
+	src := make([]ReadOnlyIndex, len(picked))
+	termCount := int64(0)
+	for i, seg := range picked {
+		src[i] = seg.disk
+		termCount += seg.disk.GetTermCount()
+	}
+	merged, err := this.writeSegment(src, termCount)
+	if err != nil {
+		return false, err
 	}
 
-	// 进行两个操作
-	// 期间会影响整个动态库的ReadIndex操作
-	// 操作很快,采用读写锁应该问题不大吧....(我这里不是很自信这样做)
+	// 合并后的段替换被合并的段,位置在被合并的第一个段
+	isPicked := make(map[*varSegment]bool)
+	for _, seg := range picked {
+		isPicked[seg] = true
+	}
+	this.segLock.Lock()
 	{
 		this.readLock.Lock()
+		segments := make([]*varSegment, 0, len(this.segments))
+		for _, seg := range this.segments {
+			if !isPicked[seg] {
+				segments = append(segments, seg)
+			} else if merged != nil {
+				segments = append(segments, merged)
+				merged = nil
+			}
+		}
+		this.segments = segments
+		this.segGen++
+		this.readLock.Unlock()
+	}
+	err = this.saveStatus()
+	this.segLock.Unlock()
+	if err != nil {
+		return false, err
+	}
 
-		// 清空memory库
-		this.mem.Clear()
+	// 状态文件已经不再引用旧段,崩溃后Open时会清理残留的文件
+	for _, seg := range picked {
+		seg.disk.Close()
+		removeDiskIndex(this.filePath, seg.Name)
+	}
+	log.Info("var index compact [%d] segments", len(picked))
+	return true, nil
+}
+
+// 开始把段合并进静态索引,返回当前的全部段.调用endFold之前暂停后台合并,
+// 返回的段不会被替换,期间Sync生成的新段不受影响
+func (this *VarIndex) beginFold() []*varSegment {
+	this.compactLock.Lock()
 
-		// 将当前磁盘库切换到新库,这个新库已经包含了全部动态索引
-		this.varIndexStatus.CurrDisk = dstDisk
+	this.segLock.Lock()
+	defer this.segLock.Unlock()
+	return append([]*varSegment(nil), this.segments...)
+}
+
+func (this *VarIndex) endFold() {
+	this.compactLock.Unlock()
+}
+
+// 从段列表中去掉已经合并进静态索引的段并保存状态文件.
+// 状态文件保存失败也不影响正确性,下次Open时根据静态索引的状态丢弃这些段
+func (this *VarIndex) dropSegments(folded []*varSegment) error {
+	isFolded := make(map[*varSegment]bool)
+	for _, seg := range folded {
+		isFolded[seg] = true
+	}
 
+	this.segLock.Lock()
+	defer this.segLock.Unlock()
+	{
+		this.readLock.Lock()
+		segments := make([]*varSegment, 0, len(this.segments))
+		for _, seg := range this.segments {
+			if !isFolded[seg] {
+				segments = append(segments, seg)
+			}
+		}
+		this.segments = segments
+		this.segGen++
 		this.readLock.Unlock()
 	}
-	// 现在ReadIndex已经可以正常工作了,WriteIndex也可以了
+	return this.saveStatus()
+}
 
-	this.lastSyncTime = time.Now().Unix()
+// 后台合并,每次Sync之后检查
+func (this *VarIndex) compactLoop() {
+	defer this.background.Done()
+	for {
+		select {
+		case <-this.quit:
+			return
+		case <-this.compactSignal:
+		}
+		for {
+			ok, err := this.compact()
+			if err != nil {
+				log.Warn("var index compact fail : %s", err)
+			}
+			if !ok {
+				break
+			}
+		}
+	}
+}
+
+func (this *VarIndex) notifyCompact() {
+	select {
+	case this.compactSignal <- true:
+	default:
+	}
+}
+
+// 保存段列表到状态文件,调用者持有segLock
+func (this *VarIndex) saveStatus() error {
+	this.varIndexStatus.Segments = make([]VarSegmentStatus, len(this.segments))
+	for i, seg := range this.segments {
+		this.varIndexStatus.Segments[i] = seg.VarSegmentStatus
+	}
 	return this.SaveJsonFile()
-	return nil
 }
 
 // 打开动态库接口.
-func (this *VarIndex) Open(path string) error {
+// folded是已经合并进静态索引的段,合并过程中崩溃时状态文件里可能还有这些段,打开时丢弃.
+func (this *VarIndex) Open(path string, folded ...string) error {
 
 	this.filePath = path
 
@@ -176,37 +447,121 @@ func (this *VarIndex) Open(path string) error {
 	this.StatusFilePath = filepath.Join(this.filePath, "var.stat")
 	err := this.ParseJsonFile()
 	if err != nil {
-		// 解析失败
-		this.varIndexStatus.CurrDisk = -1
+		// 解析失败,没有任何磁盘索引
+		this.varIndexStatus = VarIndexStatus{CurrDisk: -1}
 	}
 
-	// 磁盘索引文件
-	this.diskName[0] = "var.disk0"
-	this.diskName[1] = "var.disk1"
+	// 旧版本的两个磁盘索引,当前使用的作为第一个段
+	if this.varIndexStatus.CurrDisk >= 0 {
+		name := fmt.Sprintf("var.disk%d", this.varIndexStatus.CurrDisk)
+		this.varIndexStatus.Segments = append([]VarSegmentStatus{
+			VarSegmentStatus{Name: name, Size: diskIndexSize(this.filePath, name)}},
+			this.varIndexStatus.Segments...)
+		this.varIndexStatus.CurrDisk = -1
+	}
 
-	// ----------------------------------------------------
+	isFolded := make(map[string]bool)
+	for _, name := range folded {
+		isFolded[name] = true
+	}
 
-	if this.varIndexStatus.CurrDisk >= 0 {
-		// 已有磁盘索引
-		// 打开当前磁盘库
-		i := this.varIndexStatus.CurrDisk
-		this.disk[i] = NewDiskIndex()
-		err := this.disk[i].Open(this.filePath, this.diskName[i])
+	this.segments = make([]*varSegment, 0, len(this.varIndexStatus.Segments))
+	inUse := make(map[string]bool)
+	for _, st := range this.varIndexStatus.Segments {
+		if isFolded[st.Name] {
+			log.Warn("drop var index segment [%s] already folded", st.Name)
+			removeDiskIndex(this.filePath, st.Name)
+			continue
+		}
+		seg := varSegment{VarSegmentStatus: st}
+		seg.disk = NewDiskIndex()
+		err := seg.disk.Open(this.filePath, st.Name)
 		if err != nil {
 			return log.Error(err)
 		}
-		// 另外一个磁盘库暂时不需要
-		j := (i + 1) % 2
-		this.disk[j] = nil
-	} else {
-		// 完全没有磁盘索引存在
-		// 都标志为不可用,有需要再说
-		this.varIndexStatus.CurrDisk = -1
-		this.disk[0] = nil
-		this.disk[1] = nil
+		this.segments = append(this.segments, &seg)
+		inUse[st.Name] = true
 	}
 
-	return this.SaveJsonFile()
+	// 清理Sync或者合并过程中崩溃残留的段
+	files, _ := filepath.Glob(filepath.Join(this.filePath, varSegmentPrefix+"*"))
+	for _, f := range files {
+		// 段名是前缀加序号,后面是DiskIndex的文件后缀
+		name := strings.TrimPrefix(filepath.Base(f), varSegmentPrefix)
+		if i := strings.Index(name, "."); i >= 0 {
+			name = name[:i]
+		}
+		if !inUse[varSegmentPrefix+name] {
+			log.Warn("remove unused var index file [%s]", f)
+			os.Remove(f)
+		}
+	}
+
+	// 重放预写日志,恢复上次Sync之后写入的索引
+	this.wal, err = openVarWal(this.filePath, "var.wal", this.varIndexStatus.WalGen,
+		this.mem.WriteIndex)
+	if err != nil {
+		return err
+	}
+
+	err = this.saveStatus()
+	if err != nil {
+		return err
+	}
+
+	this.quit = make(chan bool)
+	this.background.Add(1)
+	go this.compactLoop()
+	// 上次退出前可能还有没合并的段
+	this.notifyCompact()
+	return nil
+}
+
+// 停止后台合并,关闭磁盘索引和预写日志.内存索引中没有同步的数据在下次Open时从日志恢复
+func (this *VarIndex) Close() {
+	if this.quit != nil {
+		close(this.quit)
+		this.background.Wait()
+		this.quit = nil
+	}
+
+	this.writelock.Lock()
+	defer this.writelock.Unlock()
+	this.readLock.Lock()
+	defer this.readLock.Unlock()
+
+	for _, seg := range this.segments {
+		seg.disk.Close()
+	}
+	this.segments = nil
+
+	if this.wal != nil {
+		err := this.wal.Close()
+		if err != nil {
+			log.Warn("close wal fail : %s", err)
+		}
+		this.wal = nil
+	}
+}
+
+// 磁盘索引全部文件的总大小
+func diskIndexSize(path string, name string) int64 {
+	files, _ := filepath.Glob(filepath.Join(path, name+".index*"))
+	size := int64(0)
+	for _, f := range files {
+		if info, err := os.Stat(f); err == nil {
+			size += info.Size()
+		}
+	}
+	return size
+}
+
+// 删除磁盘索引的全部文件
+func removeDiskIndex(path string, name string) {
+	files, _ := filepath.Glob(filepath.Join(path, name+".index*"))
+	for _, f := range files {
+		os.Remove(f)
+	}
 }
 
 // VarIndex构造函数
@@ -214,12 +569,8 @@ func NewVarIndex() *VarIndex {
 	s := VarIndex{}
 
 	s.mem = NewMemoryIndex()
-
-	s.disk = make([](*DiskIndex), 2)
-	s.disk[0] = nil
-	s.disk[1] = nil
-
-	s.diskName = make([]string, 2)
+	s.segments = make([]*varSegment, 0)
+	s.compactSignal = make(chan bool, 1)
 
 	s.varIndexStatus.CurrDisk = -1
 	s.lastSyncTime = time.Now().Unix()
@@ -0,0 +1,148 @@
+package database
+
+import (
+	. "github.com/getwe/goose/utils"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestVarIndexWal(t *testing.T) {
+	path := filepath.Join(os.Getenv("HOME"), "tmp", "goosedb", "test_varindex_wal")
+	os.RemoveAll(path)
+	os.MkdirAll(path, 0755)
+
+	checkLen := func(vi *VarIndex, sign TermSign, expect int) {
+		l, err := vi.ReadIndex(sign)
+		if err != nil {
+			t.Fatalf("ReadIndex --- %s", err)
+		}
+		if l.Len() != expect {
+			t.Errorf("term[%d] len[%d] expect[%d]", sign, l.Len(), expect)
+		}
+	}
+
+	vi := NewVarIndex()
+	if err := vi.Open(path); err != nil {
+		t.Fatalf("Open --- %s", err)
+	}
+	for i := 1; i <= 3; i++ {
+		l := NewInvList(1)
+		l.Append(Index{InID: InIdType(i), Weight: TermWeight(i)})
+		if err := vi.WriteIndex(100, &l); err != nil {
+			t.Fatalf("WriteIndex --- %s", err)
+		}
+	}
+	if err := vi.Flush(); err != nil {
+		t.Fatalf("Flush --- %s", err)
+	}
+
+	// 不调用Sync和Close,模拟崩溃,并且日志末尾有写了一半的记录
+	walFile := filepath.Join(path, "var.wal")
+	f, _ := os.OpenFile(walFile, os.O_WRONLY|os.O_APPEND, 0644)
+	f.Write([]byte{0, 0, 0, 16, 1, 2})
+	f.Close()
+
+	vi = NewVarIndex()
+	if err := vi.Open(path); err != nil {
+		t.Fatalf("Open --- %s", err)
+	}
+	checkLen(vi, 100, 3)
+	l, _ := vi.ReadIndex(100)
+	if (*l)[2].InID != 3 || (*l)[2].Weight != 3 {
+		t.Errorf("replay index %v", *l)
+	}
+	oldWal, _ := ioutil.ReadFile(walFile)
+
+	// 合并到磁盘索引之后日志作废
+	if err := vi.ForceSync(); err != nil {
+		t.Fatalf("ForceSync --- %s", err)
+	}
+	vi.Close()
+
+	// 合并后来不及清空的旧日志不会被重放
+	ioutil.WriteFile(walFile, oldWal, 0644)
+	vi = NewVarIndex()
+	if err := vi.Open(path); err != nil {
+		t.Fatalf("Open --- %s", err)
+	}
+	checkLen(vi, 100, 3)
+	vi.Close()
+}
+
+func TestVarIndexSegment(t *testing.T) {
+	path := filepath.Join(os.Getenv("HOME"), "tmp", "goosedb", "test_varindex_segment")
+	os.RemoveAll(path)
+	os.MkdirAll(path, 0755)
+
+	check := func(vi *VarIndex, expect int) {
+		l, err := vi.ReadIndex(100)
+		if err != nil {
+			t.Fatalf("ReadIndex --- %s", err)
+		}
+		if l.Len() != expect {
+			t.Fatalf("len[%d] expect[%d]", l.Len(), expect)
+		}
+		for i, index := range *l {
+			if index.InID != InIdType(i+1) {
+				t.Errorf("index %v not sorted", *l)
+				break
+			}
+		}
+	}
+	segCount := func(vi *VarIndex) int {
+		vi.readLock.RLock()
+		defer vi.readLock.RUnlock()
+		return len(vi.segments)
+	}
+
+	vi := NewVarIndex()
+	if err := vi.Open(path); err != nil {
+		t.Fatalf("Open --- %s", err)
+	}
+	// 每次Sync生成一个段,倒序写入检查归并结果有序
+	for i := varSegmentMergeFactor; i >= 1; i-- {
+		l := NewInvList(1)
+		l.Append(Index{InID: InIdType(i), Weight: 1})
+		vi.WriteIndex(100, &l)
+		l = NewInvList(1)
+		l.Append(Index{InID: InIdType(i), Weight: 1})
+		vi.WriteIndex(TermSign(200+i), &l)
+		if err := vi.ForceSync(); err != nil {
+			t.Fatalf("ForceSync --- %s", err)
+		}
+	}
+	check(vi, varSegmentMergeFactor)
+
+	// 同一层的段合并成一个,后台合并可能已经完成
+	vi.compact()
+	if segCount(vi) != 1 {
+		t.Errorf("segment count [%d] after compact", segCount(vi))
+	}
+	check(vi, varSegmentMergeFactor)
+	l, _ := vi.ReadIndex(200 + varSegmentMergeFactor)
+	if l.Len() != 1 {
+		t.Errorf("term[%d] len[%d]", 200+varSegmentMergeFactor, l.Len())
+	}
+	vi.Close()
+
+	// 被合并的段文件已经删除,崩溃残留的段文件Open时清理
+	files, _ := filepath.Glob(filepath.Join(path, varSegmentPrefix+"*.index.stat"))
+	if len(files) != 1 {
+		t.Errorf("segment files %v", files)
+	}
+	ioutil.WriteFile(filepath.Join(path, varSegmentPrefix+"999.index2"), []byte("x"), 0644)
+
+	vi = NewVarIndex()
+	if err := vi.Open(path); err != nil {
+		t.Fatalf("Open --- %s", err)
+	}
+	check(vi, varSegmentMergeFactor)
+	vi.Close()
+	if _, err := os.Stat(filepath.Join(path, varSegmentPrefix+"999.index2")); err == nil {
+		t.Errorf("unused segment file not removed")
+	}
+}
+
+/* vim: set expandtab ts=4 sw=4 sts=4 tw=100: */
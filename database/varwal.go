@@ -0,0 +1,261 @@
+package database
+
+import (
+	"bufio"
+	"encoding/binary"
+	log "github.com/getwe/goose/log"
+	. "github.com/getwe/goose/utils"
+	"hash/crc32"
+	"io"
+	"os"
+	"path/filepath"
+)
+
+const (
+	// 日志文件头长度
+	varWalHeaderSize = 8
+	// 记录头长度
+	varWalRecordHeaderSize = 8
+	// 一条记录最大长度,超过认为日志已经损坏
+	varWalMaxRecordSize = 64 * 1024 * 1024
+	// 记录长度的最高位,表示记录中带有位置信息.没有这一位的是不带位置的旧记录
+	varWalRecordPosFlag = 1 << 31
+)
+
+// 动态索引的预写日志(write-ahead log).
+// 写入内存索引之前先追加到日志文件,Flush的时候fsync,VarIndex.Open时重放日志重建内存索引,
+// 进程或者机器崩溃不会丢失还没有Sync到磁盘索引的数据.
+//
+// 文件格式(大端序):
+//
+//	[8字节:日志代数]{[4字节:记录长度][4字节:crc32][8字节:TermSign][拉链]}...
+//
+// 记录长度最高位是varWalRecordPosFlag时拉链带有位置信息:
+//
+//	{[4字节:InID][4字节:Weight][4字节:位置个数][4字节:位置]...}...
+//
+// 否则是不带位置的旧格式{[4字节:InID][4字节:Weight]}....
+//
+// 日志代数跟VarIndexStatus.WalGen一致才有效.VarIndex.Sync把内存索引合并到磁盘索引后代数加1,
+// 旧的日志即使没来得及清空也不会再被重放,避免重复写入索引.
+// 并发安全性问题:不可并发,由VarIndex的写锁保护.
+type varWal struct {
+	file   *os.File
+	writer *bufio.Writer
+
+	// 日志代数
+	gen uint64
+
+	fullpath string
+}
+
+// 打开日志文件,代数跟gen一致的时候调用replay逐条重放记录.
+// 文件末尾不完整或者校验失败的记录被截断,一般是写入过程中崩溃导致的.
+func openVarWal(path string, name string, gen uint64,
+	replay func(t TermSign, l *InvList) error) (*varWal, error) {
+
+	w := varWal{}
+	w.fullpath = filepath.Join(path, name)
+
+	var err error
+	w.file, err = os.OpenFile(w.fullpath, os.O_RDWR|os.O_CREATE, 0644)
+	if err != nil {
+		return nil, log.Error("open wal [%s] fail : %s", w.fullpath, err)
+	}
+
+	header := make([]byte, varWalHeaderSize)
+	_, err = io.ReadFull(w.file, header)
+	if err != nil || binary.BigEndian.Uint64(header) != gen {
+		if err == nil {
+			log.Warn("wal [%s] gen [%d] expired, current gen [%d]", w.fullpath,
+				binary.BigEndian.Uint64(header), gen)
+		}
+		// 新建的日志或者已经合并到磁盘索引的旧日志
+		err = w.Reset(gen)
+		if err != nil {
+			w.file.Close()
+			return nil, err
+		}
+		return &w, nil
+	}
+	w.gen = gen
+
+	offset, cnt, err := w.replay(replay)
+	if err != nil {
+		w.file.Close()
+		return nil, err
+	}
+	log.Info("wal [%s] gen [%d] replay [%d] records", w.fullpath, gen, cnt)
+
+	// 截断末尾损坏的记录,之后从这里继续追加
+	err = w.file.Truncate(offset)
+	if err != nil {
+		w.file.Close()
+		return nil, log.Error("truncate wal [%s] fail : %s", w.fullpath, err)
+	}
+	_, err = w.file.Seek(offset, os.SEEK_SET)
+	if err != nil {
+		w.file.Close()
+		return nil, log.Error("seek wal [%s] fail : %s", w.fullpath, err)
+	}
+	w.writer = bufio.NewWriter(w.file)
+	return &w, nil
+}
+
+// 逐条读取记录,返回最后一条完整记录的结束位置以及记录数量
+func (this *varWal) replay(replay func(t TermSign, l *InvList) error) (int64, int, error) {
+	reader := bufio.NewReader(this.file)
+	offset := int64(varWalHeaderSize)
+	cnt := 0
+
+	head := make([]byte, varWalRecordHeaderSize)
+	for {
+		_, err := io.ReadFull(reader, head)
+		if err != nil {
+			if err != io.EOF {
+				log.Warn("wal [%s] broken record head at [%d]", this.fullpath, offset)
+			}
+			return offset, cnt, nil
+		}
+		length := binary.BigEndian.Uint32(head[0:4])
+		sum := binary.BigEndian.Uint32(head[4:8])
+		withPos := length&varWalRecordPosFlag != 0
+		length &^= varWalRecordPosFlag
+		if length < 8 || (!withPos && (length-8)%8 != 0) || length > varWalMaxRecordSize {
+			log.Warn("wal [%s] illegal record length [%d] at [%d]", this.fullpath, length, offset)
+			return offset, cnt, nil
+		}
+
+		body := make([]byte, length)
+		_, err = io.ReadFull(reader, body)
+		if err != nil || crc32.ChecksumIEEE(body) != sum {
+			log.Warn("wal [%s] broken record at [%d]", this.fullpath, offset)
+			return offset, cnt, nil
+		}
+
+		t, l, err := decodeVarWalRecord(body, withPos)
+		if err != nil {
+			log.Warn("wal [%s] broken record at [%d] : %s", this.fullpath, offset, err)
+			return offset, cnt, nil
+		}
+		err = replay(t, l)
+		if err != nil {
+			return offset, cnt, err
+		}
+		offset += int64(varWalRecordHeaderSize + length)
+		cnt++
+	}
+}
+
+// 追加一条记录,Flush之后才保证写入磁盘
+func (this *varWal) Append(t TermSign, l *InvList) error {
+	body := encodeVarWalRecord(t, l)
+	head := make([]byte, varWalRecordHeaderSize)
+	binary.BigEndian.PutUint32(head[0:4], uint32(len(body))|varWalRecordPosFlag)
+	binary.BigEndian.PutUint32(head[4:8], crc32.ChecksumIEEE(body))
+
+	_, err := this.writer.Write(head)
+	if err != nil {
+		return err
+	}
+	_, err = this.writer.Write(body)
+	return err
+}
+
+// 缓存写入文件并fsync
+func (this *varWal) Flush() error {
+	err := this.writer.Flush()
+	if err != nil {
+		return err
+	}
+	return this.file.Sync()
+}
+
+// 清空日志,设置新的代数
+func (this *varWal) Reset(gen uint64) error {
+	err := this.file.Truncate(0)
+	if err != nil {
+		return log.Error("truncate wal [%s] fail : %s", this.fullpath, err)
+	}
+	_, err = this.file.Seek(0, os.SEEK_SET)
+	if err != nil {
+		return log.Error("seek wal [%s] fail : %s", this.fullpath, err)
+	}
+
+	header := make([]byte, varWalHeaderSize)
+	binary.BigEndian.PutUint64(header, gen)
+	this.writer = bufio.NewWriter(this.file)
+	_, err = this.writer.Write(header)
+	if err != nil {
+		return err
+	}
+	this.gen = gen
+	return this.Flush()
+}
+
+func (this *varWal) Close() error {
+	err := this.Flush()
+	this.file.Close()
+	return err
+}
+
+func encodeVarWalRecord(t TermSign, l *InvList) []byte {
+	size := 8
+	for _, index := range *l {
+		size += 12 + 4*len(index.Pos)
+	}
+	buf := make([]byte, size)
+	binary.BigEndian.PutUint64(buf[0:8], uint64(t))
+	p := buf[8:]
+	for _, index := range *l {
+		binary.BigEndian.PutUint32(p[0:4], uint32(index.InID))
+		binary.BigEndian.PutUint32(p[4:8], uint32(index.Weight))
+		binary.BigEndian.PutUint32(p[8:12], uint32(len(index.Pos)))
+		p = p[12:]
+		for _, pos := range index.Pos {
+			binary.BigEndian.PutUint32(p[0:4], pos)
+			p = p[4:]
+		}
+	}
+	return buf
+}
+
+func decodeVarWalRecord(buf []byte, withPos bool) (TermSign, *InvList, error) {
+	t := TermSign(binary.BigEndian.Uint64(buf[0:8]))
+	p := buf[8:]
+	if !withPos {
+		l := NewInvList(len(p) / 8)
+		for ; len(p) >= 8; p = p[8:] {
+			l.Append(Index{
+				InID:   InIdType(binary.BigEndian.Uint32(p[0:4])),
+				Weight: TermWeight(binary.BigEndian.Uint32(p[4:8]))})
+		}
+		return t, &l, nil
+	}
+
+	l := NewInvList()
+	for len(p) > 0 {
+		if len(p) < 12 {
+			return 0, nil, log.Error("record truncated")
+		}
+		index := Index{
+			InID:   InIdType(binary.BigEndian.Uint32(p[0:4])),
+			Weight: TermWeight(binary.BigEndian.Uint32(p[4:8]))}
+		n := int(binary.BigEndian.Uint32(p[8:12]))
+		p = p[12:]
+		if n > len(p)/4 {
+			return 0, nil, log.Error("pos count [%d] error", n)
+		}
+		if n > 0 {
+			index.Pos = make([]uint32, n)
+			for i := range index.Pos {
+				index.Pos[i] = binary.BigEndian.Uint32(p[4*i:])
+			}
+			p = p[4*n:]
+		}
+		l.Append(index)
+	}
+	return t, &l, nil
+}
+
+/* vim: set expandtab ts=4 sw=4 sts=4 tw=100: */
@@ -72,3 +72,21 @@ func LoadConfiguration(confPath string) error {
 
 	return nil
 }
+
+// 关闭全部日志,等待缓存的日志写入文件.程序退出前调用,之后不能再打日志
+func Close() {
+	closeLogger(debugLogger)
+	closeLogger(infoLogger)
+	closeLogger(errorLogger)
+}
+
+// 没有开启的日志Filter的LogWriter是nil的*FileLogWriter,不能直接调用log4go.Logger.Close
+func closeLogger(l log4go.Logger) {
+	for name, filt := range l {
+		flw, ok := filt.LogWriter.(*log4go.FileLogWriter)
+		if filt.LogWriter != nil && (!ok || flw != nil) {
+			filt.Close()
+		}
+		delete(l, name)
+	}
+}
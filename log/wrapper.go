@@ -82,6 +82,16 @@ func (this *GooseLogger) Info(arg ...interface{}) error {
 	return nil
 }
 
+// 还没输出的Info日志
+func (this *GooseLogger) Infos() []string {
+	return this.logstr
+}
+
+// 追加另一个logger中还没输出的Info日志
+func (this *GooseLogger) Merge(other *GooseLogger) {
+	this.logstr = append(this.logstr, other.logstr...)
+}
+
 // 输出全部Info日志
 func (this *GooseLogger) PrintAllInfo() error {
 	infoLogger.Info(strings.Join(this.logstr, " "))
@@ -0,0 +1,160 @@
+// goose检索服务和索引服务的TCP通信协议.
+//
+// 每个请求和响应都是一个帧:
+//
+//	[2字节:Magic][1字节:Version][1字节:Type][4字节:Length][Length字节:Payload]
+//
+// 整数都是大端序.一个连接上可以连续发送多个请求,不需要等待响应,
+// 服务端按请求的顺序逐个返回响应.
+//
+// 响应帧Type为TypeOK时Payload是结果;为TypeError时Payload是
+//
+//	[2字节:状态码][错误信息]
+//
+// 状态码跟HTTP服务一致,比如策略返回的StyError的状态码,其它错误是500.
+//
+// 为了兼容旧的客户端,服务端发现连接的第一个字节不是Magic的第一个字节时,
+// 按旧协议处理:一次读取作为请求,返回结果后关闭连接.
+package protocol
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+)
+
+const (
+	// 帧头标记.旧协议的请求一般是文本,不会以0x00开头
+	Magic0 = 0x00
+	Magic1 = 0x47 // 'G'
+
+	// 当前协议版本
+	Version = 1
+
+	// 帧头长度
+	HeaderSize = 8
+)
+
+// 帧类型
+const (
+	// 请求
+	TypeSearch = 1 // 检索
+	TypeIndex  = 2 // 动态插入索引,Payload是一个doc
+	TypeDelete = 3 // 删除doc,Payload是空白分隔的十进制外部id
+
+	// 响应
+	TypeOK    = 0x80
+	TypeError = 0x81
+)
+
+var (
+	ErrMagic   = errors.New("frame magic error")
+	ErrVersion = errors.New("frame version not support")
+)
+
+// 帧长度超过接收缓冲区,Payload已经被丢弃,连接可以继续使用
+type ErrFrameTooLarge struct {
+	Length uint32
+	Limit  int
+}
+
+func (this *ErrFrameTooLarge) Error() string {
+	return fmt.Sprintf("frame length [%d] larger than [%d]", this.Length, this.Limit)
+}
+
+// 帧头
+type Header struct {
+	Version uint8
+	Type    uint8
+	Length  uint32
+}
+
+// 写入一个帧
+func WriteFrame(w io.Writer, typ uint8, payload []byte) error {
+	buf := make([]byte, HeaderSize+len(payload))
+	buf[0] = Magic0
+	buf[1] = Magic1
+	buf[2] = Version
+	buf[3] = typ
+	binary.BigEndian.PutUint32(buf[4:HeaderSize], uint32(len(payload)))
+	copy(buf[HeaderSize:], payload)
+	_, err := w.Write(buf)
+	return err
+}
+
+// 写入一个错误响应帧
+func WriteError(w io.Writer, status int, msg string) error {
+	payload := make([]byte, 2+len(msg))
+	binary.BigEndian.PutUint16(payload, uint16(status))
+	copy(payload[2:], msg)
+	return WriteFrame(w, TypeError, payload)
+}
+
+// 解析错误响应帧的Payload
+func ParseError(payload []byte) (status int, msg string) {
+	if len(payload) < 2 {
+		return 0, string(payload)
+	}
+	return int(binary.BigEndian.Uint16(payload)), string(payload[2:])
+}
+
+// 读取帧头
+func ReadHeader(r io.Reader) (Header, error) {
+	var h Header
+	buf := make([]byte, HeaderSize)
+	_, err := io.ReadFull(r, buf)
+	if err != nil {
+		return h, err
+	}
+	if buf[0] != Magic0 || buf[1] != Magic1 {
+		return h, ErrMagic
+	}
+	h.Version = buf[2]
+	h.Type = buf[3]
+	h.Length = binary.BigEndian.Uint32(buf[4:HeaderSize])
+	if h.Version != Version {
+		return h, ErrVersion
+	}
+	return h, nil
+}
+
+// 读取一个帧,Payload读入buf并返回buf的切片.
+// Payload超过buf长度的时候丢弃Payload,返回*ErrFrameTooLarge.
+func ReadFrame(r io.Reader, buf []byte) (Header, []byte, error) {
+	h, err := ReadHeader(r)
+	if err != nil {
+		return h, nil, err
+	}
+	if int64(h.Length) > int64(len(buf)) {
+		_, err = io.CopyN(ioutil.Discard, r, int64(h.Length))
+		if err != nil {
+			return h, nil, err
+		}
+		return h, nil, &ErrFrameTooLarge{Length: h.Length, Limit: len(buf)}
+	}
+	_, err = io.ReadFull(r, buf[:h.Length])
+	if err != nil {
+		return h, nil, err
+	}
+	return h, buf[:h.Length], nil
+}
+
+// 生成连接的读缓冲.缓冲区不小于旧协议的请求缓冲区,
+// 旧协议判断之后从缓冲读取一次,跟直接读取连接得到的请求一样长.
+func NewConnReader(conn io.Reader, legacyBufSize int) *bufio.Reader {
+	return bufio.NewReaderSize(conn, legacyBufSize)
+}
+
+// 根据连接的第一个字节判断是否是帧协议,不消耗数据
+func IsFramed(r *bufio.Reader) (bool, error) {
+	b, err := r.Peek(1)
+	if err != nil {
+		return false, err
+	}
+	return b[0] == Magic0, nil
+}
+
+/* vim: set expandtab ts=4 sw=4 sts=4 tw=100: */
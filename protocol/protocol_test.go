@@ -0,0 +1,87 @@
+package protocol
+
+import (
+	"bufio"
+	"bytes"
+	"net"
+	"testing"
+)
+
+func TestFrame(t *testing.T) {
+	var stream bytes.Buffer
+	WriteFrame(&stream, TypeSearch, []byte("hello"))
+	WriteFrame(&stream, TypeIndex, nil)
+	WriteFrame(&stream, TypeSearch, bytes.Repeat([]byte("x"), 100))
+	WriteError(&stream, 400, "bad request")
+
+	r := bufio.NewReader(&stream)
+	framed, err := IsFramed(r)
+	if err != nil || !framed {
+		t.Fatalf("IsFramed framed[%v] err[%v]", framed, err)
+	}
+
+	buf := make([]byte, 16)
+	h, payload, err := ReadFrame(r, buf)
+	if err != nil || h.Type != TypeSearch || string(payload) != "hello" {
+		t.Fatalf("frame 1 type[%d] payload[%s] err[%v]", h.Type, payload, err)
+	}
+	h, payload, err = ReadFrame(r, buf)
+	if err != nil || h.Type != TypeIndex || len(payload) != 0 {
+		t.Fatalf("frame 2 type[%d] payload[%s] err[%v]", h.Type, payload, err)
+	}
+	// 超长的帧被丢弃,后面的帧还能正常读取
+	_, _, err = ReadFrame(r, buf)
+	if _, ok := err.(*ErrFrameTooLarge); !ok {
+		t.Fatalf("frame 3 err[%v]", err)
+	}
+	h, payload, err = ReadFrame(r, buf)
+	if err != nil || h.Type != TypeError {
+		t.Fatalf("frame 4 type[%d] err[%v]", h.Type, err)
+	}
+	status, msg := ParseError(payload)
+	if status != 400 || msg != "bad request" {
+		t.Errorf("error frame status[%d] msg[%s]", status, msg)
+	}
+
+	// 旧协议的请求
+	r = bufio.NewReader(bytes.NewBufferString("query"))
+	framed, err = IsFramed(r)
+	if err != nil || framed {
+		t.Errorf("legacy request framed[%v] err[%v]", framed, err)
+	}
+}
+
+func TestLegacyLargeRequest(t *testing.T) {
+	client, server := net.Pipe()
+	defer server.Close()
+	req := bytes.Repeat([]byte("q"), 20000)
+	go func() {
+		client.Write(req)
+		client.Close()
+	}()
+
+	// 超过默认缓冲4096的旧协议请求一次读取完整
+	reqbuf := make([]byte, 32*1024)
+	r := NewConnReader(server, len(reqbuf))
+	framed, err := IsFramed(r)
+	if err != nil || framed {
+		t.Fatalf("legacy request framed[%v] err[%v]", framed, err)
+	}
+	n, err := r.Read(reqbuf)
+	if err != nil || n != len(req) {
+		t.Errorf("legacy request read len[%d] err[%v]", n, err)
+	}
+}
+
+func TestFrameVersion(t *testing.T) {
+	var stream bytes.Buffer
+	WriteFrame(&stream, TypeSearch, []byte("hello"))
+	b := stream.Bytes()
+	b[2] = Version + 1
+	_, _, err := ReadFrame(&stream, make([]byte, 16))
+	if err != ErrVersion {
+		t.Errorf("read unknown version err[%v]", err)
+	}
+}
+
+/* vim: set expandtab ts=4 sw=4 sts=4 tw=100: */
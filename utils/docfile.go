@@ -0,0 +1,137 @@
+package utils
+
+import (
+	"compress/gzip"
+	log "github.com/getwe/goose/log"
+	"github.com/klauspost/compress/zstd"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync/atomic"
+)
+
+// 展开建库数据文件列表.多个文件用逗号分隔,每一项可以是文件,目录(目录下的全部文件)
+// 或者glob模式.同一项展开的多个文件按文件名排序,重复出现的文件只保留第一次.
+func ExpandDocFiles(spec string) ([]string, error) {
+	files := make([]string, 0)
+	seen := make(map[string]bool)
+	add := func(f string) {
+		if !seen[f] {
+			seen[f] = true
+			files = append(files, f)
+		}
+	}
+
+	for _, item := range strings.Split(spec, ",") {
+		item = strings.TrimSpace(item)
+		if len(item) == 0 {
+			continue
+		}
+
+		matches, err := filepath.Glob(item)
+		if err != nil {
+			return nil, log.Error("bad data file pattern [%s] : %s", item, err)
+		}
+		if len(matches) == 0 {
+			return nil, log.Error("data file [%s] not found", item)
+		}
+
+		for _, m := range matches {
+			info, err := os.Stat(m)
+			if err != nil {
+				return nil, err
+			}
+			if !info.IsDir() {
+				add(m)
+				continue
+			}
+			infos, err := ioutil.ReadDir(m)
+			if err != nil {
+				return nil, err
+			}
+			for _, fi := range infos {
+				if fi.Mode().IsRegular() {
+					add(filepath.Join(m, fi.Name()))
+				}
+			}
+		}
+	}
+
+	if len(files) == 0 {
+		return nil, log.Error("no data file in [%s]", spec)
+	}
+	return files, nil
+}
+
+// 打开的数据文件
+type DocFile struct {
+	io.Reader
+
+	file    *os.File
+	closers []io.Closer
+
+	// 已经从磁盘读取的字节数,压缩文件是压缩后的字节数.原子操作
+	offset int64
+}
+
+// 已经从磁盘读取的字节数,可以在读取的同时调用,用于估计读取进度
+func (this *DocFile) Offset() int64 {
+	return atomic.LoadInt64(&this.offset)
+}
+
+func (this *DocFile) Close() error {
+	var err error
+	for _, c := range this.closers {
+		if e := c.Close(); e != nil && err == nil {
+			err = e
+		}
+	}
+	return err
+}
+
+// 统计读取字节数
+type docFileCounter struct {
+	f *DocFile
+}
+
+func (this docFileCounter) Read(p []byte) (int, error) {
+	n, err := this.f.file.Read(p)
+	atomic.AddInt64(&this.f.offset, int64(n))
+	return n, err
+}
+
+// 打开数据文件,按扩展名透明解压.gz和.zst文件
+func OpenDocFile(path string) (*DocFile, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	df := &DocFile{file: f}
+	counter := docFileCounter{f: df}
+
+	switch {
+	case strings.HasSuffix(path, ".gz"):
+		gz, err := gzip.NewReader(counter)
+		if err != nil {
+			f.Close()
+			return nil, log.Error("open gzip [%s] fail : %s", path, err)
+		}
+		df.Reader = gz
+		df.closers = []io.Closer{gz, f}
+	case strings.HasSuffix(path, ".zst"):
+		zr, err := zstd.NewReader(counter)
+		if err != nil {
+			f.Close()
+			return nil, log.Error("open zstd [%s] fail : %s", path, err)
+		}
+		zrc := zr.IOReadCloser()
+		df.Reader = zrc
+		df.closers = []io.Closer{zrc, f}
+	default:
+		df.Reader = counter
+		df.closers = []io.Closer{f}
+	}
+	return df, nil
+}
@@ -2,27 +2,53 @@ package utils
 
 import (
 	"bufio"
-	"os"
+	"io"
 )
 
+// 按行读取doc,行的长度没有限制.返回的doc不包含行尾的\n或者\r\n
 type FileIter struct {
-	s *bufio.Scanner
+	r *bufio.Reader
+
+	// 读取结束或者出错
+	done bool
+	err  error
 }
 
-// 内部进行了一次拷贝返回[]buf
+// 每次返回新分配的[]byte
 func (this *FileIter) NextDoc() interface{} {
-	if this.s.Scan() {
-		ref := this.s.Bytes()
-		buf := make([]byte, len(ref))
-		copy(buf, ref)
-		return buf
+	if this.done {
+		return nil
 	}
-	return nil
+	line, err := this.r.ReadBytes('\n')
+	if err != nil {
+		this.done = true
+		if err != io.EOF {
+			this.err = err
+			return nil
+		}
+		// 最后一行没有换行符
+		if len(line) == 0 {
+			return nil
+		}
+	}
+	n := len(line)
+	if n > 0 && line[n-1] == '\n' {
+		n--
+		if n > 0 && line[n-1] == '\r' {
+			n--
+		}
+	}
+	return line[:n]
+}
+
+// 读取过程中遇到的错误,正常读到文件结束返回nil
+func (this *FileIter) Err() error {
+	return this.err
 }
 
-func NewFileIter(fh *os.File) *FileIter {
+func NewFileIter(r io.Reader) *FileIter {
 	fi := FileIter{}
-	fi.s = bufio.NewScanner(fh)
+	fi.r = bufio.NewReader(r)
 	return &fi
 }
 
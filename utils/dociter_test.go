@@ -0,0 +1,103 @@
+package utils
+
+import (
+	"bytes"
+	"compress/gzip"
+	"github.com/klauspost/compress/zstd"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func readAllDoc(t *testing.T, path string) []string {
+	r, err := OpenDocFile(path)
+	if err != nil {
+		t.Fatalf("OpenDocFile [%s] --- %s", path, err)
+	}
+	defer r.Close()
+
+	iter := NewFileIter(r)
+	docs := make([]string, 0)
+	for doc := iter.NextDoc(); doc != nil; doc = iter.NextDoc() {
+		docs = append(docs, string(doc.([]byte)))
+	}
+	if iter.Err() != nil {
+		t.Fatalf("read [%s] --- %s", path, iter.Err())
+	}
+	// 压缩文件统计的是压缩后的大小
+	if info, _ := os.Stat(path); r.Offset() != info.Size() {
+		t.Errorf("[%s] offset [%d] size [%d]", path, r.Offset(), info.Size())
+	}
+	return docs
+}
+
+func TestDocFile(t *testing.T) {
+	dir := filepath.Join(os.Getenv("HOME"), "tmp", "goosedb", "test_docfile")
+	os.RemoveAll(dir)
+	os.MkdirAll(filepath.Join(dir, "shard"), 0755)
+
+	// 超过bufio.Scanner默认上限的长行,\r\n结尾,最后一行没有换行
+	long := strings.Repeat("x", 1024*1024)
+	content := "a\n" + long + "\r\n\nb"
+	expect := []string{"a", long, "", "b"}
+
+	var gzBuf bytes.Buffer
+	gz := gzip.NewWriter(&gzBuf)
+	gz.Write([]byte(content))
+	gz.Close()
+
+	var zstBuf bytes.Buffer
+	zw, _ := zstd.NewWriter(&zstBuf)
+	zw.Write([]byte(content))
+	zw.Close()
+
+	files := map[string][]byte{
+		"plain":             []byte(content),
+		"shard/part-1.gz":   gzBuf.Bytes(),
+		"shard/part-2.zst":  zstBuf.Bytes(),
+		"shard/part-0.data": []byte(content),
+	}
+	for name, buf := range files {
+		err := ioutil.WriteFile(filepath.Join(dir, name), buf, 0644)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	for name, _ := range files {
+		docs := readAllDoc(t, filepath.Join(dir, name))
+		if len(docs) != len(expect) {
+			t.Fatalf("[%s] doc count [%d]", name, len(docs))
+		}
+		for i := range docs {
+			if docs[i] != expect[i] {
+				t.Errorf("[%s] doc[%d] len [%d] expect len [%d]", name, i,
+					len(docs[i]), len(expect[i]))
+			}
+		}
+	}
+
+	// 目录按文件名排序,重复的只保留第一次
+	spec := filepath.Join(dir, "plain") + "," + filepath.Join(dir, "shard") + "," +
+		filepath.Join(dir, "shard", "*.gz")
+	list, err := ExpandDocFiles(spec)
+	if err != nil {
+		t.Fatalf("ExpandDocFiles --- %s", err)
+	}
+	expectList := []string{"plain", "shard/part-0.data", "shard/part-1.gz", "shard/part-2.zst"}
+	if len(list) != len(expectList) {
+		t.Fatalf("ExpandDocFiles %v", list)
+	}
+	for i, f := range list {
+		if f != filepath.Join(dir, expectList[i]) {
+			t.Errorf("file[%d] [%s]", i, f)
+		}
+	}
+
+	_, err = ExpandDocFiles(filepath.Join(dir, "nothing*"))
+	if err == nil {
+		t.Errorf("expand missing file succ")
+	}
+}
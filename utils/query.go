@@ -0,0 +1,131 @@
+package utils
+
+// 查询树节点类型
+type QueryOp int
+
+const (
+	// 叶子节点,一个term
+	QueryOpTerm QueryOp = iota
+	// 全部子节点都命中,其中的NOT子节点都不命中
+	QueryOpAnd
+	// 至少一个子节点命中
+	QueryOpOr
+	// 子节点不命中,只能作为AND节点的子节点
+	QueryOpNot
+	// 至少MinMatch个子节点命中.MinMatch为0表示子节点都是可省的,只用于打分
+	QueryOpAtLeast
+)
+
+// 查询树节点.
+// 叶子节点是term,中间节点是布尔运算.
+// 检索时按先序遍历给叶子节点编号,编号就是TermList返回的列表下标,
+// 也就是CalWeight中termInQuery,termInDoc的下标.
+type QueryNode struct {
+	Op QueryOp
+
+	// 叶子节点的term,只有Op==QueryOpTerm有效.
+	// CanOmit字段在查询树中不起作用,是否可省由查询树的结构决定.
+	Term TermInQuery
+
+	// 子节点
+	Children []*QueryNode
+
+	// 至少命中的子节点数量,只有Op==QueryOpAtLeast有效
+	MinMatch int
+}
+
+func NewTermQuery(t TermInQuery) *QueryNode {
+	return &QueryNode{Op: QueryOpTerm, Term: t}
+}
+
+func NewAndQuery(children ...*QueryNode) *QueryNode {
+	return &QueryNode{Op: QueryOpAnd, Children: children}
+}
+
+func NewOrQuery(children ...*QueryNode) *QueryNode {
+	return &QueryNode{Op: QueryOpOr, Children: children}
+}
+
+func NewNotQuery(child *QueryNode) *QueryNode {
+	return &QueryNode{Op: QueryOpNot, Children: []*QueryNode{child}}
+}
+
+func NewAtLeastQuery(minMatch int, children ...*QueryNode) *QueryNode {
+	return &QueryNode{Op: QueryOpAtLeast, Children: children, MinMatch: minMatch}
+}
+
+// 把扁平的term列表转换为查询树,语义跟扁平列表一致:
+// 有不可省term的时候,全部不可省term都要命中,可省term只参与打分;
+// 全部都是可省term的时候,至少命中一个.
+// 转换后TermList的顺序跟termList一致.
+func NewTermListQuery(termList []TermInQuery) *QueryNode {
+	hasMust := false
+	for _, t := range termList {
+		if t.CanOmit == false {
+			hasMust = true
+			break
+		}
+	}
+
+	if !hasMust {
+		root := NewOrQuery()
+		for _, t := range termList {
+			root.Children = append(root.Children, NewTermQuery(t))
+		}
+		return root
+	}
+
+	// 可省term各自包在一个MinMatch为0的节点中,保持term的顺序
+	root := NewAndQuery()
+	for _, t := range termList {
+		if t.CanOmit {
+			root.Children = append(root.Children, NewAtLeastQuery(0, NewTermQuery(t)))
+		} else {
+			root.Children = append(root.Children, NewTermQuery(t))
+		}
+	}
+	return root
+}
+
+// 按先序遍历收集全部叶子节点的term
+func (this *QueryNode) TermList() []TermInQuery {
+	list := make([]TermInQuery, 0)
+	this.walkTerm(func(n *QueryNode) {
+		list = append(list, n.Term)
+	})
+	return list
+}
+
+// 先序遍历全部叶子节点
+func (this *QueryNode) walkTerm(f func(n *QueryNode)) {
+	if this.Op == QueryOpTerm {
+		f(this)
+		return
+	}
+	for _, c := range this.Children {
+		c.walkTerm(f)
+	}
+}
+
+// 位置约束类型
+type ProximityType int
+
+const (
+	// 短语,term按顺序连续出现
+	ProximityPhrase ProximityType = iota
+	// 邻近,term以任意顺序出现在Distance个词的窗口内
+	ProximityNear
+)
+
+// 位置约束,doc中的term位置不满足约束的不作为检索结果
+type ProximityInQuery struct {
+	Type ProximityType
+
+	// 参与约束的term编号,也就是termInQuery的下标.短语按这里的顺序匹配
+	Terms []int
+
+	// 邻近约束中,全部term出现位置的最大值和最小值之差不超过Distance
+	Distance uint32
+}
+
+/* vim: set expandtab ts=4 sw=4 sts=4 tw=100: */
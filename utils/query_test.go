@@ -0,0 +1,55 @@
+package utils
+
+import (
+	"testing"
+)
+
+func TestQueryTermList(t *testing.T) {
+	q := NewAndQuery(
+		NewTermQuery(TermInQuery{Sign: 1}),
+		NewOrQuery(NewTermQuery(TermInQuery{Sign: 2}), NewTermQuery(TermInQuery{Sign: 3})),
+		NewNotQuery(NewTermQuery(TermInQuery{Sign: 4})))
+
+	list := q.TermList()
+	if len(list) != 4 {
+		t.Fatalf("term count [%d]", len(list))
+	}
+	for i, term := range list {
+		if term.Sign != TermSign(i+1) {
+			t.Errorf("term[%d] sign[%d]", i, term.Sign)
+		}
+	}
+}
+
+func TestTermListQuery(t *testing.T) {
+	termList := []TermInQuery{
+		TermInQuery{Sign: 1, CanOmit: true},
+		TermInQuery{Sign: 2, CanOmit: false},
+		TermInQuery{Sign: 3, CanOmit: true},
+	}
+
+	q := NewTermListQuery(termList)
+	if q.Op != QueryOpAnd || len(q.Children) != 3 {
+		t.Fatalf("op[%d] children[%d]", q.Op, len(q.Children))
+	}
+	if q.Children[0].Op != QueryOpAtLeast || q.Children[0].MinMatch != 0 {
+		t.Errorf("omit term not wrapped")
+	}
+	if q.Children[1].Op != QueryOpTerm {
+		t.Errorf("must term wrapped")
+	}
+	for i, term := range q.TermList() {
+		if term.Sign != termList[i].Sign {
+			t.Errorf("term[%d] sign[%d]", i, term.Sign)
+		}
+	}
+
+	// 全部可省
+	termList[1].CanOmit = true
+	q = NewTermListQuery(termList)
+	if q.Op != QueryOpOr || len(q.Children) != 3 {
+		t.Errorf("op[%d] children[%d]", q.Op, len(q.Children))
+	}
+}
+
+/* vim: set expandtab ts=4 sw=4 sts=4 tw=100: */
@@ -6,7 +6,7 @@ import (
 
 const (
 	GOOSE_MAX_INVLIST_SIZE = 10 * 10000
-	GOOSE_MAX_QUERY_TERM   = 32
+	GOOSE_MAX_QUERY_TERM   = 1024 // query最多的term数量,防止异常请求占用过多资源
 
 	GOOSE_DEFAULT_SEARCH_RESULT_CAPACITY = 10000
 )
@@ -33,9 +33,11 @@ type OutIdType uint32
 // 索引结构
 // InID : 在索引库里面的内部ID,每个外部doc分配一个唯一的InID
 // Weight : term在doc中的打分情况
+// Pos : term在doc中出现的位置,升序.建库时没有填写位置的doc为nil
 type Index struct {
 	InID   InIdType
 	Weight TermWeight
+	Pos    []uint32
 }
 
 // 全文数据
@@ -80,6 +82,9 @@ type TermInDoc struct {
 	Sign TermSign
 	// term在doc中的打分,TermWeight在策略中可以自由定制
 	Weight TermWeight
+	// term在doc中出现的位置(第几个词),升序.
+	// 建库时策略可选填写;检索时只有策略需要位置信息才会读取,否则为nil
+	Pos []uint32
 }
 
 type TermInQuery struct {